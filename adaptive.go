@@ -0,0 +1,173 @@
+// Adaptive quality: shedding decoding load by renegotiating encodings.
+//
+// When ClientConfig.AdaptiveQuality is set, the time taken to read and decode
+// each FramebufferUpdate, as reported by the "decode-duration" metric, is
+// compared with ClientConfig.AdaptiveQualityThreshold:
+//
+//   - After adaptiveSlowUpdates consecutive updates slower than the
+//     threshold, the client steps down one level of qualityLevels.
+//   - After adaptiveFastUpdates consecutive updates faster than half the
+//     threshold, it steps back up one level.
+//   - Updates in between reset both counts.
+//
+// Stepping down is quick and stepping up slow, and the band between half the
+// threshold and the threshold gives hysteresis, so that the client doesn't
+// flap between levels when decoding hovers around the threshold. Each step
+// sends a single SetEncodings. Since the decode time includes waiting for the
+// data of the update, a slow link can also trigger a step down.
+
+package vnc
+
+import (
+	"time"
+
+	"github.com/bigangryrobot/go-vnc/encodings"
+)
+
+// DefaultAdaptiveQualityThreshold is the default
+// ClientConfig.AdaptiveQualityThreshold.
+const DefaultAdaptiveQualityThreshold = 50 * time.Millisecond
+
+// Numbers of consecutive updates after which adaptive quality steps down or
+// up a level.
+const (
+	adaptiveSlowUpdates = 3
+	adaptiveFastUpdates = 30
+)
+
+// qualityLevel describes the encodings advertised at a level of adaptive
+// quality, relative to those in use when adaptive quality first stepped down.
+type qualityLevel struct {
+	compressionLevel int  // Compression level, or -1 to leave it unchanged.
+	dropCompressed   bool // Drop zlib-based encodings, leaving e.g. Hextile.
+}
+
+// qualityLevels are the levels of adaptive quality, from the encodings as
+// configured down to the cheapest to decode. The compression level is
+// lowered first, and then the zlib-based encodings are dropped altogether.
+// JPEG quality levels are not advertised: they let the server send Tight
+// rectangles compressed with JPEG, which TightEncoding can't decode.
+var qualityLevels = []qualityLevel{
+	{compressionLevel: -1},
+	{compressionLevel: 5},
+	{compressionLevel: 1},
+	{compressionLevel: 1, dropCompressed: true},
+}
+
+// compressedEncodings are dropped at the lowest level of adaptive quality.
+var compressedEncodings = []encodings.EncodingType{
+	encodings.EncTight,
+	encodings.EncZRLE,
+	encodings.EncZlib,
+	encodings.EncZlibHex,
+	encodings.EncTRLE,
+}
+
+// adaptiveQuality holds the state of adaptive quality of a connection.
+type adaptiveQuality struct {
+	level      int       // Index into qualityLevels.
+	slow, fast int       // Consecutive slow and fast updates.
+	base       Encodings // Encodings in use at level 0.
+	applied    Encodings // Encodings set for level, if above 0.
+}
+
+// QualityLevel returns the current level of adaptive quality, from 0, the
+// encodings as configured, up to the number of levels by which the client
+// has stepped down.
+func (c *ClientConn) QualityLevel() int { return c.adaptive.level }
+
+// adaptQuality records that an update took d to read and decode, stepping
+// the adaptive quality level down or up as needed.
+func (c *ClientConn) adaptQuality(d time.Duration) error {
+	if !c.config.AdaptiveQuality {
+		return nil
+	}
+	threshold := c.config.AdaptiveQualityThreshold
+	if threshold == 0 {
+		threshold = DefaultAdaptiveQualityThreshold
+	}
+
+	// Encodings set since stepping down, e.g. by SetEncodings, replace the
+	// encodings as configured, from which the client steps down again.
+	a := &c.adaptive
+	if a.level > 0 && !sameEncodings(c.GetEncodings(), a.applied) {
+		c.log.Printf("encodings changed at quality level %d; returning to level 0", a.level)
+		a.level, a.applied = 0, nil
+	}
+	switch {
+	case d > threshold:
+		a.slow, a.fast = a.slow+1, 0
+	case d < threshold/2:
+		a.slow, a.fast = 0, a.fast+1
+	default:
+		a.slow, a.fast = 0, 0
+	}
+
+	switch {
+	case a.slow >= adaptiveSlowUpdates && a.level < len(qualityLevels)-1:
+		if a.level == 0 {
+			a.base = c.GetEncodings()
+		}
+		c.log.Printf("decode took %v, over %v; stepping down to quality level %d", d, threshold, a.level+1)
+		return c.setQualityLevel(a.level + 1)
+	case a.fast >= adaptiveFastUpdates && a.level > 0:
+		c.log.Printf("decode took %v, under %v; stepping up to quality level %d", d, threshold/2, a.level-1)
+		return c.setQualityLevel(a.level - 1)
+	}
+	return nil
+}
+
+// setQualityLevel advertises the encodings of adaptive quality level.
+func (c *ClientConn) setQualityLevel(level int) error {
+	a := &c.adaptive
+	a.slow, a.fast = 0, 0
+
+	ql := qualityLevels[level]
+	encs := a.base
+	if ql.compressionLevel >= 0 {
+		encs = withLevel(encs, &CompressionLevelPseudoEncoding{ql.compressionLevel}, isCompressionLevel)
+	}
+	if ql.dropCompressed {
+		var kept Encodings
+		for _, e := range encs {
+			if !encodingTypesInclude(compressedEncodings, e.Type()) {
+				kept = append(kept, e)
+			}
+		}
+		encs = kept
+	}
+
+	if err := c.SetEncodings(encs); err != nil {
+		return err
+	}
+	a.level = level
+	a.applied = nil
+	if level > 0 {
+		a.applied = c.GetEncodings()
+	}
+	return nil
+}
+
+// sameEncodings returns true if a and b hold the same Encoding values, in
+// the same order.
+func sameEncodings(a, b Encodings) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// encodingTypesInclude returns true if types includes t.
+func encodingTypesInclude(types []encodings.EncodingType, t encodings.EncodingType) bool {
+	for _, typ := range types {
+		if typ == t {
+			return true
+		}
+	}
+	return false
+}
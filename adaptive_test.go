@@ -0,0 +1,164 @@
+package vnc
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bigangryrobot/go-vnc/encodings"
+)
+
+// encodingTypes returns the types of encs.
+func encodingTypes(encs Encodings) []encodings.EncodingType {
+	var types []encodings.EncodingType
+	for _, e := range encs {
+		types = append(types, e.Type())
+	}
+	return types
+}
+
+func TestSetCompressionLevel(t *testing.T) {
+	conn := NewClientConn(&MockConn{}, &ClientConfig{})
+	conn.encodings = Encodings{&TightEncoding{}, &JPEGQualityPseudoEncoding{8}, &RawEncoding{}}
+
+	if err := conn.SetCompressionLevel(10); err == nil {
+		t.Error("expected an error for compression level 10")
+	}
+	if err := conn.SetCompressionLevel(6); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := conn.SetCompressionLevel(2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := conn.SetJPEGQuality(-1); err == nil {
+		t.Error("expected an error for JPEG quality -1")
+	}
+	if err := conn.SetJPEGQuality(3); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := encodingTypes(conn.GetEncodings())
+	want := []encodings.EncodingType{
+		encodings.EncTight,
+		encodings.EncRaw,
+		encodings.EncCompressionLevel3,
+		encodings.EncJPEGQualityLevelPseudo4,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect encodings; got = %v, want = %v", got, want)
+	}
+}
+
+func TestClientConn_AdaptQuality(t *testing.T) {
+	const threshold = 10 * time.Millisecond
+	const (
+		slow = 2 * threshold
+		mid  = threshold * 3 / 4
+		fast = threshold / 4
+	)
+	conn := NewClientConn(&MockConn{}, &ClientConfig{
+		AdaptiveQuality:          true,
+		AdaptiveQualityThreshold: threshold,
+	})
+	base := Encodings{&TightEncoding{}, &ZRLEEncoding{}, &HextileEncoding{}, &RawEncoding{}}
+	conn.encodings = base
+
+	update := func(d time.Duration, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if err := conn.adaptQuality(d); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+
+	for _, tt := range []struct {
+		desc  string
+		d     time.Duration
+		n     int
+		level int
+		encs  []encodings.EncodingType
+	}{
+		{"too few slow updates", slow, adaptiveSlowUpdates - 1, 0, encodingTypes(base)},
+		{"update within the band", mid, 1, 0, encodingTypes(base)},
+		{"slow updates", slow, adaptiveSlowUpdates, 1, []encodings.EncodingType{
+			encodings.EncTight, encodings.EncZRLE, encodings.EncHextile, encodings.EncRaw,
+			encodings.EncCompressionLevel6}},
+		{"more slow updates", slow, adaptiveSlowUpdates, 2, []encodings.EncodingType{
+			encodings.EncTight, encodings.EncZRLE, encodings.EncHextile, encodings.EncRaw,
+			encodings.EncCompressionLevel2}},
+		{"even more slow updates", slow, adaptiveSlowUpdates, 3, []encodings.EncodingType{
+			encodings.EncHextile, encodings.EncRaw, encodings.EncCompressionLevel2}},
+		{"slow updates at the lowest level", slow, adaptiveSlowUpdates, 3, nil},
+		{"fast updates", fast, adaptiveFastUpdates, 2, []encodings.EncodingType{
+			encodings.EncTight, encodings.EncZRLE, encodings.EncHextile, encodings.EncRaw,
+			encodings.EncCompressionLevel2}},
+		{"fast updates interrupted", fast, adaptiveFastUpdates - 1, 2, nil},
+		{"update within the band", mid, 1, 2, nil},
+		{"fast updates after the band", fast, adaptiveFastUpdates - 1, 2, nil},
+		{"all fast updates", fast, 2 * adaptiveFastUpdates, 0, encodingTypes(base)},
+	} {
+		update(tt.d, tt.n)
+		if got, want := conn.QualityLevel(), tt.level; got != want {
+			t.Errorf("%s: incorrect quality level; got = %v, want = %v", tt.desc, got, want)
+		}
+		if tt.encs == nil {
+			continue
+		}
+		if got, want := encodingTypes(conn.GetEncodings()), tt.encs; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: incorrect encodings; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
+func TestClientConn_AdaptQuality_SetEncodings(t *testing.T) {
+	const threshold = 10 * time.Millisecond
+	conn := NewClientConn(&MockConn{}, &ClientConfig{
+		AdaptiveQuality:          true,
+		AdaptiveQualityThreshold: threshold,
+	})
+	conn.encodings = Encodings{&TightEncoding{}, &RawEncoding{}}
+	update := func(d time.Duration, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if err := conn.adaptQuality(d); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+
+	// Encodings set while stepped down are those the client steps down from
+	// next, and back up to.
+	update(2*threshold, adaptiveSlowUpdates)
+	if got, want := conn.QualityLevel(), 1; got != want {
+		t.Fatalf("incorrect quality level; got = %v, want = %v", got, want)
+	}
+	base := Encodings{&ZRLEEncoding{}, &HextileEncoding{}, &RawEncoding{}}
+	if err := conn.SetEncodings(base); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	update(2*threshold, adaptiveSlowUpdates)
+	if got, want := conn.QualityLevel(), 1; got != want {
+		t.Errorf("incorrect quality level; got = %v, want = %v", got, want)
+	}
+	want := []encodings.EncodingType{encodings.EncZRLE, encodings.EncHextile, encodings.EncRaw, encodings.EncCompressionLevel6}
+	if got := encodingTypes(conn.GetEncodings()); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect encodings; got = %v, want = %v", got, want)
+	}
+	update(threshold/4, adaptiveFastUpdates)
+	if got, want := encodingTypes(conn.GetEncodings()), encodingTypes(base); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect encodings back at level 0; got = %v, want = %v", got, want)
+	}
+}
+
+func TestClientConn_AdaptQuality_Disabled(t *testing.T) {
+	conn := NewClientConn(&MockConn{}, &ClientConfig{})
+	for i := 0; i < 2*adaptiveSlowUpdates; i++ {
+		if err := conn.adaptQuality(time.Second); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if got, want := conn.QualityLevel(), 0; got != want {
+		t.Errorf("incorrect quality level; got = %v, want = %v", got, want)
+	}
+}
@@ -0,0 +1,129 @@
+// Interoperability with macOS Screen Sharing, see ClientConfig.AppleCompat.
+
+package vnc
+
+import (
+	"crypto/aes"
+	"crypto/md5"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+
+	"github.com/bigangryrobot/go-vnc/rfbflags"
+)
+
+// ApplePixelFormat is the pixel format of macOS Screen Sharing: 32 bits per
+// pixel, depth 24, little-endian true-color with the red channel in the third
+// byte.
+var ApplePixelFormat = PixelFormat{BPP: 32, Depth: 24, BigEndian: rfbflags.RFBFalse, TrueColor: rfbflags.RFBTrue,
+	RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 16, GreenShift: 8, BlueShift: 0}
+
+// appleEncodings returns the encodings advertised under
+// ClientConfig.AppleCompat, most preferred first.
+func appleEncodings() Encodings {
+	return Encodings{
+		&ZRLEEncoding{},
+		&HextileEncoding{},
+		&CopyRectEncoding{},
+		&RawEncoding{},
+		&CursorPseudoEncoding{},
+		&DesktopSizePseudoEncoding{},
+	}
+}
+
+// clientAuths returns the ClientAuth methods offered to the server: those of
+// ClientConfig.Auth, followed under ClientConfig.AppleCompat by Apple Remote
+// Desktop authentication, if not among them.
+func (c *ClientConn) clientAuths() []ClientAuth {
+	auths := c.config.Auth
+	if !c.config.AppleCompat {
+		return auths
+	}
+	for _, a := range auths {
+		if a.SecurityType() == SecTypeARD {
+			return auths
+		}
+	}
+	ard := &ClientAuthARD{Username: c.config.Username, Password: c.config.Password}
+	return append(auths[:len(auths):len(auths)], ard)
+}
+
+// ClientAuthARD is the Diffie-Hellman authentication of Apple Remote
+// Desktop, which macOS Screen Sharing requires for user accounts. The
+// username and password are each limited to 63 bytes.
+type ClientAuthARD struct {
+	Username, Password string
+}
+
+// Bounds on the credentials and keys of ClientAuthARD.
+const (
+	ardCredentialSize = 64 // Bytes for each of the username and password.
+	maxARDKeyLength   = 512
+)
+
+func (*ClientAuthARD) SecurityType() uint8 {
+	return SecTypeARD
+}
+
+// Handshake reads the Diffie-Hellman parameters and public key of the server,
+// and sends the credentials, encrypted with AES-128 in ECB mode under the MD5
+// of the shared secret, followed by the public key of the client.
+func (auth *ClientAuthARD) Handshake(c *ClientConn) error {
+	if len(auth.Username) >= ardCredentialSize || len(auth.Password) >= ardCredentialSize {
+		return NewVNCError(fmt.Sprintf("ARD authentication failed; username and password are limited to %d bytes", ardCredentialSize-1))
+	}
+
+	var params struct {
+		Generator, KeyLength uint16
+	}
+	if err := c.receive(&params); err != nil {
+		return err
+	}
+	if params.KeyLength == 0 || params.KeyLength > maxARDKeyLength {
+		return NewVNCError(fmt.Sprintf("ARD authentication failed; invalid key length %d", params.KeyLength))
+	}
+	var prime, serverKey []byte
+	if err := c.receiveN(&prime, int(params.KeyLength)); err != nil {
+		return err
+	}
+	if err := c.receiveN(&serverKey, int(params.KeyLength)); err != nil {
+		return err
+	}
+
+	p := new(big.Int).SetBytes(prime)
+	if p.Cmp(big.NewInt(3)) <= 0 {
+		return NewVNCError("ARD authentication failed; invalid prime modulus")
+	}
+	// The private key lies in [2, p-2].
+	private, err := rand.Int(rand.Reader, new(big.Int).Sub(p, big.NewInt(3)))
+	if err != nil {
+		return err
+	}
+	private.Add(private, big.NewInt(2))
+	g := big.NewInt(int64(params.Generator))
+	public := new(big.Int).Exp(g, private, p).FillBytes(make([]byte, params.KeyLength))
+	shared := new(big.Int).Exp(new(big.Int).SetBytes(serverKey), private, p).FillBytes(make([]byte, params.KeyLength))
+
+	// Each credential is NUL-terminated, in a field padded with random
+	// bytes.
+	credentials := make([]byte, 2*ardCredentialSize)
+	if _, err := rand.Read(credentials); err != nil {
+		return err
+	}
+	copy(credentials, auth.Username+"\x00")
+	copy(credentials[ardCredentialSize:], auth.Password+"\x00")
+
+	key := md5.Sum(shared)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(credentials); i += block.BlockSize() {
+		block.Encrypt(credentials[i:i+block.BlockSize()], credentials[i:i+block.BlockSize()])
+	}
+
+	if err := c.send(credentials); err != nil {
+		return err
+	}
+	return c.send(public)
+}
@@ -0,0 +1,155 @@
+package vnc
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/md5"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bigangryrobot/go-vnc/encodings"
+)
+
+func TestClientConfig_AppleCompat(t *testing.T) {
+	cfg := NewClientConfig("s3cret")
+	cfg.Username = "alice"
+	cfg.AppleCompat = true
+	conn := NewClientConn(&MockConn{}, cfg)
+
+	want := []string{"ZRLE", "Hextile", "CopyRect", "Raw", "CursorPseudo", "DesktopSizePseudo"}
+	var got []string
+	for _, e := range conn.GetEncodings() {
+		got = append(got, e.Type().String())
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("incorrect encodings; got = %v, want = %v", got, want)
+	}
+
+	auths := conn.clientAuths()
+	if got, want := len(auths), len(cfg.Auth)+1; got != want {
+		t.Fatalf("incorrect number of auths; got = %d, want = %d", got, want)
+	}
+	ard, ok := auths[len(auths)-1].(*ClientAuthARD)
+	if !ok || *ard != (ClientAuthARD{"alice", "s3cret"}) {
+		t.Errorf("expected ARD auth with the credentials; got = %#v", auths[len(auths)-1])
+	}
+	if len(cfg.Auth) != 3 {
+		t.Errorf("expected ClientConfig.Auth to be left as is; got = %v", cfg.Auth)
+	}
+
+	// Without AppleCompat, the defaults are unchanged.
+	plain := NewClientConn(&MockConn{}, NewClientConfig(""))
+	if got := len(plain.clientAuths()); got != 3 {
+		t.Errorf("incorrect number of auths without AppleCompat; got = %d", got)
+	}
+	if got := plain.GetEncodings(); len(got) != 1 || got[0].Type() != (&RawEncoding{}).Type() {
+		t.Errorf("incorrect encodings without AppleCompat; got = %v", got)
+	}
+
+	// The pixel format of macOS is requested.
+	h := newRecordingHandler()
+	addr := newTestServer(t, NewServerConfig(""), h)
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("error connecting to server: %s", err)
+	}
+	cfg = NewClientConfig("")
+	cfg.AppleCompat = true
+	vc, err := Connect(context.Background(), nc, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error connecting: %s", err)
+	}
+	defer vc.Close()
+	if got := vc.pixelFormat; got != ApplePixelFormat {
+		t.Errorf("incorrect pixel format; got = %v, want = %v", got, ApplePixelFormat)
+	}
+}
+
+func TestClientConfig_AppleCompat_NoTight(t *testing.T) {
+	h := newRecordingHandler()
+	addr := newTestServer(t, NewServerConfig(""), h)
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("error connecting to server: %s", err)
+	}
+	cfg := NewClientConfig("")
+	cfg.AppleCompat = true
+	vc, err := Connect(context.Background(), nc, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error connecting: %s", err)
+	}
+	defer vc.Close()
+	if _, ok := vc.Encodable(encodings.EncTight); ok {
+		t.Error("expected Tight not to be decodable")
+	}
+
+	// Nor is it advertised to the server.
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-h.events:
+			if !strings.HasPrefix(event, "SetEncodings") {
+				continue
+			}
+			if strings.Contains(event, encodings.EncTight.String()) {
+				t.Errorf("expected Tight not to be advertised; got %q", event)
+			}
+			return
+		case <-timeout:
+			t.Fatal("timed out waiting for SetEncodings")
+		}
+	}
+}
+
+func TestClientAuthARD_Handshake(t *testing.T) {
+	const keyLength = 16
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 127), big.NewInt(1)) // 2^127-1, prime
+	g := big.NewInt(2)
+	serverPrivate := big.NewInt(0x1234567)
+	serverPublic := new(big.Int).Exp(g, serverPrivate, p)
+
+	mockConn := &MockConn{}
+	binary.Write(mockConn, binary.BigEndian, [2]uint16{uint16(g.Int64()), keyLength})
+	mockConn.Write(p.FillBytes(make([]byte, keyLength)))
+	mockConn.Write(serverPublic.FillBytes(make([]byte, keyLength)))
+
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	auth := &ClientAuthARD{Username: "alice", Password: "s3cret"}
+	if err := auth.Handshake(conn); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The server decrypts the credentials with the shared secret.
+	sent := mockConn.b.Bytes()
+	if got, want := len(sent), 2*ardCredentialSize+keyLength; got != want {
+		t.Fatalf("incorrect number of bytes sent; got = %d, want = %d", got, want)
+	}
+	clientPublic := new(big.Int).SetBytes(sent[2*ardCredentialSize:])
+	shared := new(big.Int).Exp(clientPublic, serverPrivate, p).FillBytes(make([]byte, keyLength))
+	key := md5.Sum(shared)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := sent[:2*ardCredentialSize]
+	for i := 0; i < len(credentials); i += block.BlockSize() {
+		block.Decrypt(credentials[i:i+block.BlockSize()], credentials[i:i+block.BlockSize()])
+	}
+	username, _, _ := bytes.Cut(credentials[:ardCredentialSize], []byte{0})
+	password, _, _ := bytes.Cut(credentials[ardCredentialSize:], []byte{0})
+	if string(username) != "alice" || string(password) != "s3cret" {
+		t.Errorf("incorrect credentials; got = %q, %q", username, password)
+	}
+
+	// Credentials too long to be NUL-terminated are rejected.
+	long := &ClientAuthARD{Username: string(make([]byte, ardCredentialSize))}
+	if err := long.Handshake(NewClientConn(&MockConn{}, &ClientConfig{})); err == nil {
+		t.Error("expected an error for a long username")
+	}
+}
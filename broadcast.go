@@ -0,0 +1,178 @@
+// Fan-out of the frames of one connection to many subscribers.
+
+package vnc
+
+import (
+	"image"
+	"image/draw"
+	"sync"
+)
+
+// broadcastBufferSize is the capacity of the channels returned by
+// Broadcaster.Subscribe.
+const broadcastBufferSize = 16
+
+// FrameEvent is delivered by a Broadcaster to its subscribers for each frame
+// changing the framebuffer.
+type FrameEvent struct {
+	// Image holds the pixels of the framebuffer within its bounds, which are
+	// in framebuffer coordinates: the bounding box of the pixel data of an
+	// update, or the whole framebuffer for a snapshot. It is shared by all
+	// subscribers, and must not be modified.
+	Image *image.RGBA
+
+	// Snapshot is true if Image holds the whole framebuffer, replacing that
+	// of the subscriber, whatever its size. Snapshots are sent on
+	// subscribing, after the framebuffer is resized, and after events were
+	// dropped for a slow subscriber.
+	Snapshot bool
+}
+
+// A Broadcaster shares the frames of a single ClientConn, e.g. to a VNC
+// backend, among any number of subscribers, e.g. the web viewers of a
+// gateway. The framebuffer model of the ClientConn is the authoritative
+// copy, from which each subscriber receives the pixels of each frame.
+//
+// Subscribers are sent frames without blocking the reading of the
+// connection: while the channel of a subscriber is full, its frames are
+// dropped, and once it has room again, it is sent a snapshot in their place.
+type Broadcaster struct {
+	c *ClientConn
+
+	mu     sync.Mutex
+	subs   map[<-chan FrameEvent]*subscriber
+	bounds image.Rectangle // Of the last frame sent.
+	closed bool
+}
+
+// subscriber is a channel of a Broadcaster, guarded by its mutex.
+type subscriber struct {
+	ch    chan FrameEvent
+	stale bool // Whether a snapshot is to be sent in place of the next frame.
+}
+
+// NewBroadcaster returns a Broadcaster of the frames of c, which must not be
+// reading from the server yet; see ListenAndHandle. The configuration of c is
+// replaced by a copy maintaining the framebuffer, with an OnFrameComplete
+// callback that calls that of the original, if any, before broadcasting the
+// frame.
+func NewBroadcaster(c *ClientConn) *Broadcaster {
+	b := &Broadcaster{c: c, subs: make(map[<-chan FrameEvent]*subscriber)}
+	cfg := *c.config
+	cfg.MaintainFramebuffer = true
+	onFrameComplete := cfg.OnFrameComplete
+	cfg.OnFrameComplete = func(updatedRegions []Rectangle) {
+		if onFrameComplete != nil {
+			onFrameComplete(updatedRegions)
+		}
+		b.broadcast(updatedRegions)
+	}
+	c.config = &cfg
+	return b
+}
+
+// ListenAndHandle calls ListenAndHandle on the ClientConn of b, and closes the
+// channels of all subscribers once it returns, returning its error.
+func (b *Broadcaster) ListenAndHandle() error {
+	err := b.c.ListenAndHandle()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch, s := range b.subs {
+		close(s.ch)
+		delete(b.subs, ch)
+	}
+	return err
+}
+
+// Subscribe returns a channel on which FrameEvents are delivered, starting
+// with a snapshot of the framebuffer, if any frame has been read yet. The
+// channel is closed by Unsubscribe, or once ListenAndHandle returns; after
+// then, Subscribe returns a closed channel.
+func (b *Broadcaster) Subscribe() <-chan FrameEvent {
+	s := &subscriber{ch: make(chan FrameEvent, broadcastBufferSize), stale: true}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(s.ch)
+		return s.ch
+	}
+	b.subs[s.ch] = s
+	if fb := b.c.Framebuffer(); fb != nil && !fb.Bounds().Empty() {
+		s.send(&FrameEvent{fb, true}, nil)
+	}
+	return s.ch
+}
+
+// Unsubscribe stops the delivery of FrameEvents on ch, a channel returned by
+// Subscribe, and closes it. Unknown channels are ignored.
+func (b *Broadcaster) Unsubscribe(ch <-chan FrameEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s, ok := b.subs[ch]; ok {
+		close(s.ch)
+		delete(b.subs, ch)
+	}
+}
+
+// broadcast sends the frame made of the rectangles of pixel data
+// updatedRegions to all subscribers, as a snapshot if the framebuffer was
+// resized since the last frame. The whole framebuffer is only copied if a
+// snapshot is to be sent.
+func (b *Broadcaster) broadcast(updatedRegions []Rectangle) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.subs) == 0 {
+		return
+	}
+
+	var changed image.Rectangle
+	for _, r := range updatedRegions {
+		changed = changed.Union(r.Bounds())
+	}
+	b.c.fbMu.Lock()
+	if b.c.fb == nil {
+		b.c.fbMu.Unlock()
+		return
+	}
+	bounds := b.c.fb.Bounds()
+	resized := bounds != b.bounds
+	b.bounds = bounds
+	var frame *FrameEvent
+	if changed = changed.Intersect(bounds); !resized && !changed.Empty() {
+		img := image.NewRGBA(changed)
+		draw.Draw(img, changed, b.c.fb, changed.Min, draw.Src)
+		frame = &FrameEvent{Image: img}
+	}
+	b.c.fbMu.Unlock()
+
+	var snapshot *FrameEvent
+	for _, s := range b.subs {
+		if resized {
+			s.stale = true
+		}
+		if s.stale && snapshot == nil {
+			snapshot = &FrameEvent{b.c.Framebuffer(), true}
+		}
+		s.send(snapshot, frame)
+	}
+}
+
+// send sends frame to s, or snapshot in its place if s is stale, marking s
+// stale if its channel is full. Nothing is sent for a nil frame unless s is
+// stale.
+func (s *subscriber) send(snapshot, frame *FrameEvent) {
+	ev := frame
+	if s.stale {
+		ev = snapshot
+	}
+	if ev == nil {
+		return
+	}
+	select {
+	case s.ch <- *ev:
+		s.stale = false
+	default:
+		s.stale = true
+	}
+}
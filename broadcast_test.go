@@ -0,0 +1,127 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/bigangryrobot/go-vnc/encodings"
+)
+
+// pixelUpdate returns a FramebufferUpdate, after its message-type, of a Raw
+// encoded pixel of red value i at (i%8, i/8).
+func pixelUpdate(i int) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 1}) // padding, number-of-rectangles
+	binary.Write(&buf, binary.BigEndian, rectangleMessage{uint16(i % 8), uint16(i / 8), 1, 1, encodings.EncRaw})
+	buf.Write([]byte{0, byte(i), 0, 0})
+	return buf.Bytes()
+}
+
+func TestBroadcaster(t *testing.T) {
+	const frames = 20
+	var chunks [][]byte
+	for i := 0; i < frames; i++ {
+		chunks = append(chunks, []byte{0}, pixelUpdate(i))
+	}
+	conn := NewClientConn(&chunkConn{chunks: chunks}, NewClientConfig(""))
+	conn.pixelFormat = roundTripFormat
+	conn.fbWidth, conn.fbHeight = 8, 8
+	var (
+		b          *Broadcaster
+		slow, late <-chan FrameEvent
+		slowEvents []FrameEvent
+		frame      int
+	)
+	conn.config.OnFrameComplete = func([]Rectangle) {
+		switch frame++; frame {
+		case frames - 4:
+			late = b.Subscribe()
+		case frames - 2:
+			// The slow subscriber catches up.
+			for len(slowEvents) < broadcastBufferSize {
+				slowEvents = append(slowEvents, <-slow)
+			}
+		}
+	}
+	b = NewBroadcaster(conn)
+	slow = b.Subscribe()
+	if err := b.ListenAndHandle(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// check checks that ev holds the pixel drawn by the given frame, or, for
+	// a snapshot, all pixels drawn up to it.
+	check := func(desc string, ev FrameEvent, snapshot bool, frame int) {
+		t.Helper()
+		if ev.Image == nil {
+			t.Fatalf("%s: missing event", desc)
+		}
+		if ev.Snapshot != snapshot {
+			t.Errorf("%s: incorrect snapshot; got = %v, want = %v", desc, ev.Snapshot, snapshot)
+		}
+		i := frame - 1
+		want := image.Rect(i%8, i/8, i%8+1, i/8+1)
+		if snapshot {
+			want = image.Rect(0, 0, 8, 8)
+		}
+		if got := ev.Image.Bounds(); got != want {
+			t.Errorf("%s: incorrect bounds; got = %v, want = %v", desc, got, want)
+			return
+		}
+		for ; i >= 0; i-- {
+			p := image.Pt(i%8, i/8)
+			if !p.In(want) {
+				continue
+			}
+			if got, want := ev.Image.RGBAAt(p.X, p.Y), (color.RGBA{uint8(i), 0, 0, 0xff}); got != want {
+				t.Errorf("%s: incorrect pixel %v; got = %v, want = %v", desc, p, got, want)
+			}
+		}
+	}
+
+	// The slow subscriber gets a snapshot of the first frame, then the
+	// following updates until its channel is full, then, once it has room, a
+	// snapshot in place of those dropped, then the following updates.
+	check("slow first", slowEvents[0], true, 1)
+	for i := 1; i < len(slowEvents); i++ {
+		check("slow buffered", slowEvents[i], false, i+1)
+	}
+	check("slow resync", <-slow, true, frames-2)
+	check("slow next", <-slow, false, frames-1)
+	check("slow last", <-slow, false, frames)
+	if _, ok := <-slow; ok {
+		t.Error("slow: expected channel to be closed")
+	}
+
+	// The late subscriber gets a snapshot on subscribing, then each update,
+	// starting with that of the frame it subscribed in.
+	check("late snapshot", <-late, true, frames-4)
+	for i := frames - 4; i <= frames; i++ {
+		check("late update", <-late, false, i)
+	}
+	if _, ok := <-late; ok {
+		t.Error("late: expected channel to be closed")
+	}
+
+	if _, ok := <-b.Subscribe(); ok {
+		t.Error("expected subscribing once closed to return a closed channel")
+	}
+}
+
+func TestBroadcaster_Unsubscribe(t *testing.T) {
+	conn := NewClientConn(&chunkConn{chunks: [][]byte{{0}, pixelUpdate(0)}}, NewClientConfig(""))
+	conn.pixelFormat = roundTripFormat
+	conn.fbWidth, conn.fbHeight = 8, 8
+	b := NewBroadcaster(conn)
+	ch := b.Subscribe()
+	b.Unsubscribe(ch)
+	if _, ok := <-ch; ok {
+		t.Error("expected channel to be closed")
+	}
+	if err := b.ListenAndHandle(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
@@ -19,6 +19,15 @@ const (
 	None Button = 0
 )
 
+// Scroll wheel buttons. Each step of a scroll wheel is conventionally sent as
+// a press and release of one of these buttons.
+const (
+	ScrollUp    = Four
+	ScrollDown  = Five
+	ScrollLeft  = Six
+	ScrollRight = Seven
+)
+
 func Mask(button Button) uint8 {
 	return uint8(button)
 }
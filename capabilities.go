@@ -0,0 +1,95 @@
+// Prerequisites of the pseudo-encodings advertised by SetEncodings.
+
+package vnc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bigangryrobot/go-vnc/encodings"
+	"github.com/bigangryrobot/go-vnc/messages"
+)
+
+// encodingCapability describes what a pseudo-encoding needs to take effect.
+type encodingCapability struct {
+	// Lowest protocol version negotiated on which servers honor it.
+	protocolVersion string
+	// Encodings that must be advertised with it.
+	requires []encodings.EncodingType
+	// Server messages sent in response to it, which must be in
+	// ClientConfig.ServerMessages to be read.
+	messages []messages.ServerMessage
+}
+
+// encodingCapabilities holds the prerequisites of the pseudo-encodings
+// defined by the rfbproto extensions, which servers only implement on top of
+// protocol version 3.8. Encodings not listed have none.
+var encodingCapabilities = map[encodings.EncodingType]encodingCapability{
+	encodings.EncContinuousUpdatesPseudo: {
+		protocolVersion: PROTO_VERS_3_8,
+		requires:        []encodings.EncodingType{encodings.EncFencePseudo},
+		messages:        []messages.ServerMessage{messages.EndOfContinuousUpdates},
+	},
+	encodings.EncFencePseudo: {
+		protocolVersion: PROTO_VERS_3_8,
+		messages:        []messages.ServerMessage{messages.ServerFence},
+	},
+	encodings.EncExtendedDesktopSizePseudo: {protocolVersion: PROTO_VERS_3_8},
+	encodings.EncDesktopNamePseudo:         {protocolVersion: PROTO_VERS_3_8},
+	encodings.EncExtendedClipboardPseudo:   {protocolVersion: PROTO_VERS_3_8},
+}
+
+// checkEncodings returns the reasons why encodings of encs won't take effect
+// on c, as their prerequisites in encodingCapabilities aren't met. The
+// protocol version is only checked once negotiated.
+func (c *ClientConn) checkEncodings(encs Encodings) []string {
+	var problems []string
+	for _, e := range encs {
+		capability, ok := encodingCapabilities[e.Type()]
+		if !ok {
+			continue
+		}
+		// The PROTO_VERS_ strings order as the versions do.
+		if pv := capability.protocolVersion; c.protocolVersion != "" && c.protocolVersion < pv {
+			problems = append(problems, fmt.Sprintf("%v needs %s, not %s", e.Type(), strings.TrimSpace(pv), strings.TrimSpace(c.protocolVersion)))
+		}
+		for _, t := range capability.requires {
+			if !encs.Contains(t) {
+				problems = append(problems, fmt.Sprintf("%v needs %v to be advertised too", e.Type(), t))
+			}
+		}
+		for _, m := range capability.messages {
+			if !c.handlesServerMessage(m) {
+				problems = append(problems, fmt.Sprintf("%v needs the %v server message in ClientConfig.ServerMessages", e.Type(), m))
+			}
+		}
+	}
+	return problems
+}
+
+// validateEncodings logs the problems found by checkEncodings with encs, or,
+// if ClientConfig.StrictEncodings is set, returns them as an error.
+func (c *ClientConn) validateEncodings(encs Encodings) error {
+	problems := c.checkEncodings(encs)
+	if len(problems) == 0 {
+		return nil
+	}
+	if c.config.StrictEncodings {
+		return NewVNCError(fmt.Sprintf("SetEncodings: %s", strings.Join(problems, "; ")))
+	}
+	for _, p := range problems {
+		c.log.Printf("SetEncodings: %s", p)
+	}
+	return nil
+}
+
+// handlesServerMessage returns true if a ServerMessage of type t is in
+// ClientConfig.ServerMessages.
+func (c *ClientConn) handlesServerMessage(t messages.ServerMessage) bool {
+	for _, m := range c.config.ServerMessages {
+		if m.Type() == t {
+			return true
+		}
+	}
+	return false
+}
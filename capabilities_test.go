@@ -0,0 +1,76 @@
+package vnc
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestSetEncodings_Capabilities(t *testing.T) {
+	fence := &FencePseudoEncoding{}
+	continuous := &ContinuousUpdatesPseudoEncoding{}
+	messages := []ServerMessage{&FramebufferUpdate{}, &ServerFence{}, &EndOfContinuousUpdates{}}
+
+	for _, tt := range []struct {
+		desc     string
+		version  string
+		messages []ServerMessage
+		encs     Encodings
+		problems []string // Substrings of the problems, in order.
+	}{
+		{"compatible", PROTO_VERS_3_8, messages, Encodings{continuous, fence}, nil},
+		{"before negotiation", "", messages, Encodings{continuous, fence}, nil},
+		{"no prerequisites", PROTO_VERS_3_3, nil, Encodings{&CursorPseudoEncoding{}}, nil},
+		{"protocol version 3.3", PROTO_VERS_3_3, messages, Encodings{continuous, fence}, []string{
+			"ContinuousUpdatesPseudo needs RFB 003.008, not RFB 003.003",
+			"FencePseudo needs RFB 003.008",
+		}},
+		{"without fence", PROTO_VERS_3_8, messages, Encodings{continuous}, []string{
+			"ContinuousUpdatesPseudo needs FencePseudo",
+		}},
+		{"without server message", PROTO_VERS_3_8, []ServerMessage{&FramebufferUpdate{}}, Encodings{continuous, fence}, []string{
+			"EndOfContinuousUpdates server message",
+			"ServerFence server message",
+		}},
+	} {
+		for _, strict := range []bool{false, true} {
+			var logged bytes.Buffer
+			mockConn := &MockConn{}
+			conn := NewClientConn(mockConn, &ClientConfig{
+				Logger:          log.New(&logged, "", 0),
+				ServerMessages:  tt.messages,
+				StrictEncodings: strict,
+			})
+			conn.protocolVersion = tt.version
+
+			err := conn.SetEncodings(tt.encs)
+			var report string
+			if strict {
+				if err != nil {
+					report = err.Error()
+				}
+				if sent := mockConn.b.Len() > 0; sent != (tt.problems == nil) {
+					t.Errorf("%s: strict: incorrect sending; got = %v, want = %v", tt.desc, sent, tt.problems == nil)
+				}
+			} else {
+				if err != nil {
+					t.Errorf("%s: unexpected error: %s", tt.desc, err)
+				}
+				report = logged.String()
+			}
+			if tt.problems == nil && strings.Contains(report, "needs") {
+				t.Errorf("%s: strict %v: unexpected problems: %s", tt.desc, strict, report)
+			}
+			rest := report
+			for _, p := range tt.problems {
+				i := strings.Index(rest, p)
+				if i < 0 {
+					t.Errorf("%s: strict %v: expected %q in %q", tt.desc, strict, p, report)
+					break
+				}
+				rest = rest[i+len(p):]
+			}
+		}
+	}
+}
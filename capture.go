@@ -0,0 +1,60 @@
+// Capture of the bytes of rectangles as sent by the server.
+
+package vnc
+
+import (
+	"bufio"
+	"io"
+	"slices"
+)
+
+// captureReader records the bytes read through it while on.
+type captureReader struct {
+	r   io.Reader
+	on  bool
+	buf []byte
+}
+
+func (r *captureReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.on {
+		r.buf = append(r.buf, p[:n]...)
+	}
+	return n, err
+}
+
+// newReader returns the buffered reader of c reading from r, through a
+// captureReader if ClientConfig.CaptureRawRectangles is set. Data held back by
+// coalesceWrites is flushed before reading from r.
+func (c *ClientConn) newReader(r io.Reader) *bufio.Reader {
+	r = flushingReader{r, c}
+	if c.config.CaptureRawRectangles {
+		c.capture = &captureReader{r: r}
+		r = c.capture
+	}
+	return bufio.NewReaderSize(r, 1024)
+}
+
+// startCapture starts recording the bytes read from c.bufr, if
+// ClientConfig.CaptureRawRectangles is set, including those it has already
+// buffered.
+func (c *ClientConn) startCapture() {
+	if c.capture == nil {
+		return
+	}
+	buffered, _ := c.bufr.Peek(c.bufr.Buffered())
+	c.capture.buf = append(c.capture.buf[:0], buffered...)
+	c.capture.on = true
+}
+
+// endCapture stops recording, returning the bytes read from c.bufr since
+// startCapture, or nil if ClientConfig.CaptureRawRectangles is not set. The
+// bytes read ahead by c.bufr are left out.
+func (c *ClientConn) endCapture() []byte {
+	if c.capture == nil || !c.capture.on {
+		return nil
+	}
+	c.capture.on = false
+	read := len(c.capture.buf) - c.bufr.Buffered()
+	return slices.Clone(c.capture.buf[:read])
+}
@@ -0,0 +1,76 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/bigangryrobot/go-vnc/encodings"
+)
+
+func TestClientConfig_CaptureRawRectangles(t *testing.T) {
+	pixel := []byte{0, 0xff, 0, 0} // in roundTripFormat
+	rect := func(x uint16, enc encodings.EncodingType, body ...[]byte) []byte {
+		b := new(bytes.Buffer)
+		binary.Write(b, binary.BigEndian, rectangleMessage{x, 0, 1, 1, enc})
+		for _, p := range body {
+			b.Write(p)
+		}
+		return b.Bytes()
+	}
+	rects := [][]byte{
+		rect(0, encodings.EncRaw, pixel),
+		rect(1, encodings.EncRRE, []byte{0, 0, 0, 0}, pixel),
+		rect(2, encodings.EncHextile, []byte{1}, pixel),
+	}
+	var update bytes.Buffer
+	update.Write([]byte{0, 0xff, 0xff}) // padding, number-of-rectangles
+	for _, r := range rects {
+		update.Write(r)
+	}
+	update.Write(rect(0, encodings.EncLastRectPseudo))
+	update.Write([]byte{2}) // Bell, read ahead but not captured.
+
+	for _, concurrency := range []int{0, 2} {
+		conn := roundTripConn(update.Bytes())
+		conn.config.CaptureRawRectangles = true
+		conn.config.DecodeConcurrency = concurrency
+		conn.bufr = conn.newReader(conn.Conn)
+
+		msg, err := (&FramebufferUpdate{}).Read(conn)
+		if err != nil {
+			t.Fatalf("concurrency %d: unexpected error: %s", concurrency, err)
+		}
+		fu := msg.(*FramebufferUpdate)
+		if !reflect.DeepEqual(fu.Wire, rects) {
+			t.Errorf("concurrency %d: incorrect captured bytes; got = %v, want = %v", concurrency, fu.Wire, rects)
+			continue
+		}
+
+		// The captured bytes decode to the same rectangles.
+		for i, wire := range fu.Wire {
+			want := fu.Rects[i].Enc
+			got, err := DecodeEncoding(want.Type(), wire, conn.pixelFormat, conn.colorMap)
+			if err != nil {
+				t.Errorf("concurrency %d: rectangle %d: unexpected error: %s", concurrency, i, err)
+				continue
+			}
+			gotBytes, _ := got.Marshal()
+			wantBytes, _ := want.Marshal()
+			if !bytes.Equal(gotBytes, wantBytes) {
+				t.Errorf("concurrency %d: rectangle %d: incorrect decoding; got = %v, want = %v", concurrency, i, gotBytes, wantBytes)
+			}
+		}
+	}
+
+	// Nothing is captured by default.
+	conn := roundTripConn(update.Bytes())
+	msg, err := (&FramebufferUpdate{}).Read(conn)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if wire := msg.(*FramebufferUpdate).Wire; wire != nil {
+		t.Errorf("expected no captured bytes; got = %v", wire)
+	}
+}
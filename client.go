@@ -4,6 +4,7 @@ package vnc
 
 import (
 	"fmt"
+	"image"
 	"strings"
 	"unicode"
 
@@ -22,27 +23,51 @@ type SetPixelFormatMessage struct {
 }
 
 // SetPixelFormat sets the format in which pixel values should be sent
-// in FramebufferUpdate messages from the server.
+// in FramebufferUpdate messages from the server. A warning is logged if it
+// differs substantially from the server's native format; see
+// ServerPixelFormat.
+//
+// Changing the pixel format changes the size of the pixels in compressed
+// data, so the Tight zlib streams are reset before the next Tight rectangle
+// is decoded. ZRLE rectangles are decompressed independently of each other,
+// and need no reset.
 //
 // See RFC 6143 Section 7.5.1
 func (c *ClientConn) SetPixelFormat(pf PixelFormat) error {
-	msg := SetPixelFormatMessage{
-		Msg: messages.SetPixelFormat,
-		PF:  pf,
+	b, err := pf.MarshalBinary()
+	if err != nil {
+		return err
 	}
+	// message-type, padding, pixel-format, as in SetPixelFormatMessage.
+	msg := append([]byte{byte(messages.SetPixelFormat), 0, 0, 0}, b...)
 	if err := c.send(msg); err != nil {
 		return err
 	}
 
 	// Invalidate the color map.
 	if !rfbflags.IsTrueColor(pf.TrueColor) {
-		c.colorMap = [256]Color{}
+		c.colorMap = nil
 	}
 
+	if pf != c.pixelFormat {
+		c.zlibsStale.Store(true)
+	}
 	c.pixelFormat = pf
+	c.requestedPixelFormat = &pf
+
+	if server := c.serverPixelFormat; server.BPP != 0 && pixelFormatsDiffer(server, pf) {
+		c.log.Printf("warning: requested pixel format %v differs from the server's native format %v, forcing the server to convert pixel data", pf, server)
+	}
 	return nil
 }
 
+// pixelFormatsDiffer returns true if converting pixel data between the
+// formats a and b takes more than reordering bytes or bits: their bits per
+// pixel, depth, or use of a color map differ.
+func pixelFormatsDiffer(a, b PixelFormat) bool {
+	return a.BPP != b.BPP || a.Depth != b.Depth || rfbflags.IsTrueColor(a.TrueColor) != rfbflags.IsTrueColor(b.TrueColor)
+}
+
 // SetEncodingsMessage holds the wire format message, sans encoding-type field.
 type SetEncodingsMessage struct {
 	Msg     messages.ClientMessage // message-type
@@ -54,21 +79,33 @@ type SetEncodingsMessage struct {
 // from the server. After calling this method, the encs slice given should not
 // be modified.
 //
+// Encodings of a type already listed are dropped, and RawEncoding, which
+// every client must support, is advertised last if encs doesn't include it.
+//
+// SetEncodings may be called on a live connection while ListenAndHandle is
+// running. Encodings dropped by the change remain decodable until the server
+// sends an update that no longer uses them, since updates already in flight
+// were encoded under the old list; their zlib streams are then reset.
+//
+// Servers should only use the encodings advertised, but some send others
+// regardless. Rectangles of any encoding that DecodeEncoding can decode are
+// decoded whether advertised or not; only those of other encodings end the
+// session, or, for pseudo-encodings, are skipped under
+// ClientConfig.SkipUnknownPseudoEncodings.
+//
+// Pseudo-encodings whose prerequisites aren't met, such as ContinuousUpdates
+// on a protocol version 3.3 connection or without Fence, are reported in the
+// log, or, if ClientConfig.StrictEncodings is set, as an error, in which case
+// nothing is sent; see capabilities.go.
+//
 // TODO(kward:20170306) Fix bad practice of mixing of protocol and internal
 // state here.
 //
 // See RFC 6143 Section 7.5.2
 func (c *ClientConn) SetEncodings(encs Encodings) error {
-	// Make sure RawEncoding is supported.
-	haveRaw := false
-	for _, v := range encs {
-		if v.Type() == encodings.EncRaw {
-			haveRaw = true
-			break
-		}
-	}
-	if !haveRaw {
-		encs = append(encs, &RawEncoding{})
+	encs = c.normalizeEncodings(encs)
+	if err := c.validateEncodings(encs); err != nil {
+		return err
 	}
 
 	buf := NewBuffer(nil)
@@ -94,10 +131,88 @@ func (c *ClientConn) SetEncodings(encs Encodings) error {
 		return err
 	}
 
-	c.encodings = encs
+	c.replaceEncodings(encs)
 	return nil
 }
 
+// Bounds of the levels of CompressionLevelPseudoEncoding and
+// JPEGQualityPseudoEncoding.
+const (
+	MinLevel = 0
+	MaxLevel = 9
+)
+
+// SetCompressionLevel asks the server to compress pixel data at level, from
+// 0, the fastest, to 9, the best compression, by advertising the encodings
+// in use with a CompressionLevelPseudoEncoding in place of any previous one.
+// Servers may keep the level of zlib streams already started; set
+// ClientConfig.CompressionLevel to have it apply from the first update.
+func (c *ClientConn) SetCompressionLevel(level int) error {
+	if level < MinLevel || level > MaxLevel {
+		return NewVNCError(fmt.Sprintf("invalid compression level %d", level))
+	}
+	return c.SetEncodings(withLevel(c.GetEncodings(), &CompressionLevelPseudoEncoding{level}, isCompressionLevel))
+}
+
+// SetJPEGQuality asks the server to send JPEG images of quality level, from
+// 0, the lowest, to 9, the highest, by advertising the encodings in use with
+// a JPEGQualityPseudoEncoding in place of any previous one.
+func (c *ClientConn) SetJPEGQuality(level int) error {
+	if level < MinLevel || level > MaxLevel {
+		return NewVNCError(fmt.Sprintf("invalid JPEG quality %d", level))
+	}
+	return c.SetEncodings(withLevel(c.GetEncodings(), &JPEGQualityPseudoEncoding{level}, isJPEGQuality))
+}
+
+func isCompressionLevel(t encodings.EncodingType) bool {
+	return t >= encodings.EncCompressionLevel1 && t <= encodings.EncCompressionLevel10
+}
+
+func isJPEGQuality(t encodings.EncodingType) bool {
+	return t >= encodings.EncJPEGQualityLevelPseudo1 && t <= encodings.EncJPEGQualityLevelPseudo10
+}
+
+// withLevel returns a copy of encs with the encodings matched by isLevel
+// replaced by level.
+func withLevel(encs Encodings, level Encoding, isLevel func(encodings.EncodingType) bool) Encodings {
+	var out Encodings
+	for _, e := range encs {
+		if !isLevel(e.Type()) {
+			out = append(out, e)
+		}
+	}
+	return append(out, level)
+}
+
+// withLevelFirst returns a copy of encs with the encodings matched by isLevel
+// replaced by level, placed ahead of the others.
+func withLevelFirst(encs Encodings, level Encoding, isLevel func(encodings.EncodingType) bool) Encodings {
+	out := Encodings{level}
+	for _, e := range encs {
+		if !isLevel(e.Type()) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// normalizeEncodings returns encs without repeated encoding types, keeping
+// the first of each, and with RawEncoding appended if absent, since every
+// client must be able to decode Raw. encs itself is left unchanged.
+func (c *ClientConn) normalizeEncodings(encs Encodings) Encodings {
+	out := make(Encodings, 0, len(encs)+1)
+	for _, e := range encs {
+		if !out.Contains(e.Type()) {
+			out = append(out, e)
+		}
+	}
+	if !out.Contains(encodings.EncRaw) {
+		c.log.Print("SetEncodings: appending the mandatory Raw encoding")
+		out = append(out, &RawEncoding{})
+	}
+	return out
+}
+
 // FramebufferUpdateRequestMessage holds the wire format message.
 type FramebufferUpdateRequestMessage struct {
 	Msg           messages.ClientMessage // message-type
@@ -112,7 +227,27 @@ type FramebufferUpdateRequestMessage struct {
 // See RFC 6143 Section 7.5.3
 func (c *ClientConn) FramebufferUpdateRequest(inc rfbflags.RFBFlag, x, y, w, h uint16) error {
 	msg := FramebufferUpdateRequestMessage{messages.FramebufferUpdateRequest, inc, x, y, w, h}
-	return c.send(&msg)
+	if err := c.send(&msg); err != nil {
+		return err
+	}
+	c.updateRequests.Add(1)
+	return nil
+}
+
+// requestNextUpdate sends the incremental FramebufferUpdateRequest for the
+// whole framebuffer that keeps a request outstanding after each update, if
+// ClientConfig.AutoRequestUpdates is set, continuous updates are not enabled
+// and the connection isn't paused, waiting out MinUpdateInterval first.
+func (c *ClientConn) requestNextUpdate() error {
+	if !c.config.AutoRequestUpdates || c.continuousUpdates.Load() || c.Paused() {
+		return nil
+	}
+	if wait := c.config.MinUpdateInterval - c.clock.Now().Sub(c.lastAutoRequest); wait > 0 {
+		<-c.clock.After(wait)
+	}
+	c.lastAutoRequest = c.clock.Now()
+	w, h := c.framebufferSize()
+	return c.FramebufferUpdateRequest(rfbflags.RFBTrue, 0, 0, w, h)
 }
 
 // KeyEventMessage holds the wire format message.
@@ -151,23 +286,177 @@ type PointerEventMessage struct {
 	X, Y uint16                 // x-, y-position
 }
 
+// PointerMode describes how pointer events convey the pointer position.
+type PointerMode int
+
+const (
+	// PointerAbsolute sends the position of the pointer.
+	PointerAbsolute PointerMode = iota
+	// PointerRelative sends the motion of the pointer since the last event.
+	PointerRelative
+)
+
+// String implements the fmt.Stringer interface.
+func (m PointerMode) String() string {
+	switch m {
+	case PointerAbsolute:
+		return "absolute"
+	case PointerRelative:
+		return "relative"
+	}
+	return fmt.Sprintf("PointerMode(%d)", int(m))
+}
+
+// PointerClamp describes how PointerEvent treats positions outside the
+// framebuffer.
+type PointerClamp int
+
+const (
+	// PointerClampNone sends positions as given.
+	PointerClampNone PointerClamp = iota
+	// PointerClampToFramebuffer moves positions to the nearest pixel of the
+	// framebuffer.
+	PointerClampToFramebuffer
+	// PointerClampError rejects positions outside the framebuffer with an
+	// error, without sending the event.
+	PointerClampError
+)
+
+// String implements the fmt.Stringer interface.
+func (p PointerClamp) String() string {
+	switch p {
+	case PointerClampNone:
+		return "none"
+	case PointerClampToFramebuffer:
+		return "clamp"
+	case PointerClampError:
+		return "error"
+	}
+	return fmt.Sprintf("PointerClamp(%d)", int(p))
+}
+
+// clampPointer applies the ClampPointer configuration to the position x, y.
+// Positions are left alone while the framebuffer size is unknown.
+func (c *ClientConn) clampPointer(x, y uint16) (uint16, uint16, error) {
+	mode := c.config.ClampPointer
+	w, h := c.framebufferSize()
+	if mode == PointerClampNone || w == 0 || h == 0 || (x < w && y < h) {
+		return x, y, nil
+	}
+	if mode == PointerClampError {
+		return 0, 0, NewVNCError(fmt.Sprintf("pointer position (%d, %d) lies outside the %dx%d framebuffer", x, y, w, h))
+	}
+	return min(x, w-1), min(y, h-1), nil
+}
+
+// pointerRelativeOrigin is added to relative motion so that negative deltas
+// can be sent in the unsigned x- and y-position fields, as QEMU expects.
+const pointerRelativeOrigin = 0x7fff
+
 // PointerEvent indicates that pointer movement or a pointer button
 // press or release.
 //
 // The `button` is a bitwise mask of various Button values. When a button
 // is set, it is pressed, when it is unset, it is released.
 //
+// The x and y positions are always absolute. If the server requested relative
+// pointer events with the QEMU Pointer Motion Change pseudo-encoding, the
+// motion since the previous event is sent instead; see PointerMode.
+//
+// Positions outside the framebuffer are handled as configured by
+// ClientConfig.ClampPointer.
+//
 // See RFC 6143 Section 7.5.5
 func (c *ClientConn) PointerEvent(button buttons.Button, x, y uint16) error {
-	msg := PointerEventMessage{messages.PointerEvent, uint8(button), x, y}
+	x, y, err := c.clampPointer(x, y)
+	if err != nil {
+		return err
+	}
+	msgX, msgY := x, y
+	if c.PointerMode() == PointerRelative {
+		msgX = uint16(int(x) - int(c.pointerX) + pointerRelativeOrigin)
+		msgY = uint16(int(y) - int(c.pointerY) + pointerRelativeOrigin)
+	}
+	msg := PointerEventMessage{messages.PointerEvent, uint8(button), msgX, msgY}
 	if err := c.send(msg); err != nil {
 		return err
 	}
+	c.pointerX, c.pointerY = x, y
+	c.pointerButtons = button
 
 	settleUI()
 	return nil
 }
 
+// PointerButtons describes the state of the standard pointer buttons, as an
+// alternative to building a buttons.Button mask by hand.
+type PointerButtons struct {
+	Left, Middle, Right bool
+
+	// Scroll wheel buttons; see Scroll for sending scroll steps.
+	ScrollUp, ScrollDown, ScrollLeft, ScrollRight bool
+}
+
+// Button returns the button mask of b.
+func (b PointerButtons) Button() buttons.Button {
+	var mask buttons.Button
+	for _, bb := range []struct {
+		pressed bool
+		button  buttons.Button
+	}{
+		{b.Left, buttons.Left},
+		{b.Middle, buttons.Middle},
+		{b.Right, buttons.Right},
+		{b.ScrollUp, buttons.ScrollUp},
+		{b.ScrollDown, buttons.ScrollDown},
+		{b.ScrollLeft, buttons.ScrollLeft},
+		{b.ScrollRight, buttons.ScrollRight},
+	} {
+		if bb.pressed {
+			mask |= bb.button
+		}
+	}
+	return mask
+}
+
+// Mask returns the button-mask of b, as sent in a PointerEvent message.
+func (b PointerButtons) Mask() uint8 { return buttons.Mask(b.Button()) }
+
+// SendPointer sends a PointerEvent with the pointer at x, y and the buttons
+// of b pressed.
+func (c *ClientConn) SendPointer(x, y uint16, b PointerButtons) error {
+	return c.PointerEvent(b.Button(), x, y)
+}
+
+// Scroll scrolls by dx steps right and dy steps down, with the pointer at
+// x, y. Negative values scroll left and up. Each step is sent as a press and
+// release of the scroll button, with the buttons held by the last
+// PointerEvent still pressed; vertical steps are sent first.
+func (c *ClientConn) Scroll(x, y uint16, dx, dy int) error {
+	held := c.pointerButtons &^ (buttons.ScrollUp | buttons.ScrollDown | buttons.ScrollLeft | buttons.ScrollRight)
+	for _, axis := range []struct {
+		steps              int
+		negative, positive buttons.Button
+	}{
+		{dy, buttons.ScrollUp, buttons.ScrollDown},
+		{dx, buttons.ScrollLeft, buttons.ScrollRight},
+	} {
+		button, steps := axis.positive, axis.steps
+		if steps < 0 {
+			button, steps = axis.negative, -steps
+		}
+		for i := 0; i < steps; i++ {
+			if err := c.PointerEvent(held|button, x, y); err != nil {
+				return err
+			}
+			if err := c.PointerEvent(held, x, y); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // ClientCutTextMessage holds the wire format message, sans the text field.
 type ClientCutTextMessage struct {
 	Msg    messages.ClientMessage // message-type
@@ -197,13 +486,146 @@ func (c *ClientConn) ClientCutText(text string) error {
 		Msg:    messages.ClientCutText,
 		Length: uint32(len(text)),
 	}
-	if err := c.send(msg); err != nil {
-		return err
-	}
-	if err := c.send([]byte(text)); err != nil {
+	if err := c.send(msg, []byte(text)); err != nil {
 		return err
 	}
 
 	settleUI()
 	return nil
 }
+
+// FenceFlags holds the flags of a Fence message.
+type FenceFlags uint32
+
+// Flags of a Fence message.
+const (
+	FenceBlockBefore FenceFlags = 1 << 0
+	FenceBlockAfter  FenceFlags = 1 << 1
+	FenceSyncNext    FenceFlags = 1 << 2
+	FenceRequest     FenceFlags = 1 << 31
+)
+
+// maxFencePayload is the largest payload of a Fence message.
+const maxFencePayload = 64
+
+// SendRaw sends b to the server as is, for client messages this package does
+// not implement, such as vendor extensions. The bytes are counted by the
+// "bytes-sent" metric like those of any other message. Receiving the
+// server's side of such an extension is done by adding a ServerMessage to
+// ClientConfig.ServerMessages.
+//
+// Framing is the caller's responsibility: b must hold whole messages,
+// starting with the message-type, and only of types the server has agreed to
+// receive. Anything else desynchronizes the connection, which the server will
+// likely close. b is written under the same lock as the messages sent by the
+// other methods, so it may be sent from any goroutine without being
+// interleaved with them.
+func (c *ClientConn) SendRaw(b []byte) error {
+	return c.send(b)
+}
+
+// EnableContinuousUpdatesMessage holds the wire format message.
+type EnableContinuousUpdatesMessage struct {
+	Msg           messages.ClientMessage // message-type
+	Enable        rfbflags.RFBFlag       // enable-flag
+	X, Y          uint16                 // x-position, y-position
+	Width, Height uint16                 // width, height
+}
+
+// EnableContinuousUpdates asks the server to send FramebufferUpdates for the
+// given region whenever it changes, without waiting for requests, or, if
+// enable is false, to stop doing so. The server must have advertised support
+// for it with an EndOfContinuousUpdates message; see ServerSupports. While
+// continuous updates are enabled, AutoRequestUpdates sends no requests. The
+// server acknowledges disabling them, or ends them itself, with an
+// EndOfContinuousUpdates message.
+//
+// Servers without support ignore the message, which would leave the client
+// waiting for updates that never come. Unless the server has advertised
+// support, continuous updates are therefore disabled again if it hasn't done
+// so within ClientConfig.ContinuousUpdatesTimeout, logging the downgrade, and
+// AutoRequestUpdates, if set, resumes requesting updates. FramebufferUpdates
+// are no evidence of support, since they may answer requests sent before.
+//
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#enablecontinuousupdates
+func (c *ClientConn) EnableContinuousUpdates(enable bool, x, y, w, h uint16) error {
+	msg := EnableContinuousUpdatesMessage{messages.EnableContinuousUpdates, rfbflags.BoolToRFBFlag(enable), x, y, w, h}
+	// Only servers that advertised support acknowledge a disabling.
+	acked := !enable && c.continuousUpdates.Load() && c.ServerSupports(encodings.EncContinuousUpdatesPseudo)
+	if acked {
+		c.continuousDisables.Add(1)
+	}
+	if err := c.send(&msg); err != nil {
+		if acked {
+			c.continuousDisables.Add(-1)
+		}
+		return err
+	}
+	c.continuousEnabled.Store(enable)
+	gen := c.continuousGen.Add(1)
+	if enable {
+		c.continuousRegion = image.Rect(int(x), int(y), int(x)+int(w), int(y)+int(h))
+		c.continuousUpdates.Store(true)
+		if !c.ServerSupports(encodings.EncContinuousUpdatesPseudo) {
+			c.watchContinuousUpdates(gen)
+		}
+	}
+	return nil
+}
+
+// supersededContinuousDisable consumes the acknowledgment of a disabling of
+// continuous updates, if one is outstanding, and returns true if the
+// disabling was superseded by a later one or by an enabling, in which case
+// the EndOfContinuousUpdates message doesn't end the continuous updates.
+func (c *ClientConn) supersededContinuousDisable() bool {
+	for {
+		n := c.continuousDisables.Load()
+		if n == 0 {
+			return false
+		}
+		if c.continuousDisables.CompareAndSwap(n, n-1) {
+			return n > 1 || c.continuousEnabled.Load()
+		}
+	}
+}
+
+// watchContinuousUpdates falls back to requesting updates once the
+// ContinuousUpdatesTimeout has passed, unless the server has since advertised
+// support for continuous updates, or they were enabled or disabled again
+// since the enabling with the generation gen.
+func (c *ClientConn) watchContinuousUpdates(gen uint64) {
+	timeout := c.config.continuousUpdatesTimeout()
+	if timeout < 0 {
+		return
+	}
+	after := c.clock.After(timeout)
+	go func() {
+		<-after
+		if c.continuousGen.Load() != gen || c.ServerSupports(encodings.EncContinuousUpdatesPseudo) {
+			return
+		}
+		if !c.continuousUpdates.CompareAndSwap(true, false) {
+			return
+		}
+		c.log.Printf("continuous updates not honored by the server within %v; falling back to requesting updates", timeout)
+		if c.config.AutoRequestUpdates && !c.Paused() {
+			w, h := c.framebufferSize()
+			if err := c.FramebufferUpdateRequest(rfbflags.RFBTrue, 0, 0, w, h); err != nil {
+				c.log.Printf("error requesting update; %s", err)
+			}
+		}
+	}()
+}
+
+// ContinuousUpdates returns true while continuous updates are enabled: from
+// a call to EnableContinuousUpdates until the server sends an
+// EndOfContinuousUpdates message, or the client falls back to requesting
+// updates. See ContinuousUpdatesActive.
+func (c *ClientConn) ContinuousUpdates() bool { return c.continuousUpdates.Load() }
+
+// ContinuousUpdatesActive returns true while continuous updates are enabled
+// and the server has advertised support for them, with an
+// EndOfContinuousUpdates message, so that they are known to be honored.
+func (c *ClientConn) ContinuousUpdatesActive() bool {
+	return c.continuousUpdates.Load() && c.ServerSupports(encodings.EncContinuousUpdatesPseudo)
+}
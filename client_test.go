@@ -1,10 +1,16 @@
 package vnc
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"log"
 	"math"
 	"net"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -85,6 +91,10 @@ func TestSetEncodings(t *testing.T) {
 		encTypes []encodings.EncodingType
 	}{
 		{Encodings{&RawEncoding{}}, []encodings.EncodingType{0}},
+		{Encodings{&TightEncoding{}}, []encodings.EncodingType{encodings.EncTight, encodings.EncRaw}},
+		{Encodings{&RawEncoding{}, &TightEncoding{}}, []encodings.EncodingType{encodings.EncRaw, encodings.EncTight}},
+		{Encodings{&TightEncoding{}, &HextileEncoding{}, &TightEncoding{}},
+			[]encodings.EncodingType{encodings.EncTight, encodings.EncHextile, encodings.EncRaw}},
 	}
 
 	mockConn := &MockConn{}
@@ -116,19 +126,160 @@ func TestSetEncodings(t *testing.T) {
 			t.Errorf("incorrect message-type; got = %v, want = %v", got, want)
 			continue
 		}
-		if got, want := req.NumEncs, uint16(len(tt.encs)); got != want {
+		if got, want := req.NumEncs, uint16(len(tt.encTypes)); got != want {
 			t.Errorf("incorrect number-of-encodings; got = %v, want = %v", got, want)
 			continue
 		}
-		if got, want := len(encs), len(tt.encs); got != want {
+		if got, want := len(encs), len(tt.encTypes); got != want {
 			t.Errorf("lengths of encodings don't match; got = %v, want = %v", got, want)
 			continue
 		}
-		for i := 0; i < len(tt.encs); i++ {
-			if got, want := encodings.EncodingType(encs[i]), tt.encs[i].Type(); got != want {
+		for i := 0; i < len(tt.encTypes); i++ {
+			if got, want := encodings.EncodingType(encs[i]), tt.encTypes[i]; got != want {
 				t.Errorf("incorrect encoding-type [%v]; got = %v, want = %v", i, got, want)
 			}
 		}
+		if got, want := encodingTypes(conn.GetEncodings()), tt.encTypes; !reflect.DeepEqual(got, want) {
+			t.Errorf("incorrect encodings in use; got = %v, want = %v", got, want)
+		}
+	}
+}
+
+func TestSetPixelFormat_ResetsTightStreams(t *testing.T) {
+	rect := &Rectangle{Width: 2, Height: 2}
+	mockConn := &splitConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.pixelFormat = PixelFormat32bit
+
+	pixels32 := bytes.Repeat([]byte{1}, 2*2*4)
+	writeTightCopyRect(&mockConn.r, pixels32)
+	if _, err := (&TightEncoding{}).Read(conn, rect); err != nil {
+		t.Fatalf("32bpp: unexpected error: %s", err)
+	}
+	stream := conn.zlibs[0]
+
+	if err := conn.SetPixelFormat(PixelFormat16bit); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	pixels16 := bytes.Repeat([]byte{2}, 2*2*2)
+	writeTightCopyRect(&mockConn.r, pixels16)
+	enc, err := (&TightEncoding{}).Read(conn, rect)
+	if err != nil {
+		t.Fatalf("16bpp: unexpected error: %s", err)
+	}
+	if got, want := enc.(*TightEncoding).Data, pixels16; !bytes.Equal(got, want) {
+		t.Errorf("16bpp: incorrect pixels; got = %v, want = %v", got, want)
+	}
+	if conn.zlibs[0] == stream {
+		t.Error("expected zlib stream 0 to be reset")
+	}
+}
+
+// chunkConn is a MockConn that reads from chunks, rather than the data
+// written to it, returning at most one chunk per Read.
+type chunkConn struct {
+	MockConn
+	chunks [][]byte
+}
+
+func (c *chunkConn) Read(b []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, c.chunks[0])
+	if c.chunks[0] = c.chunks[0][n:]; len(c.chunks[0]) == 0 {
+		c.chunks = c.chunks[1:]
+	}
+	return n, nil
+}
+
+func TestSetEncodings_MidSession(t *testing.T) {
+	update := func(enc encodings.EncodingType) *bytes.Buffer {
+		var buf bytes.Buffer
+		buf.Write([]byte{0, 0, 1}) // padding, number-of-rectangles
+		binary.Write(&buf, binary.BigEndian, rectangleMessage{0, 0, 2, 2, enc})
+		return &buf
+	}
+	pixels := bytes.Repeat([]byte{1}, 2*2*4)
+
+	// An update encoded with Tight before the server saw the change,
+	// followed by one encoded with Hextile.
+	var tight bytes.Buffer
+	writeTightCopyRect(&tight, pixels)
+	hextile := update(encodings.EncHextile)
+	hextile.Write([]byte{0x01}) // Raw tile
+	hextile.Write(pixels)
+
+	mockConn := &chunkConn{chunks: [][]byte{update(encodings.EncTight).Bytes(), tight.Bytes(), hextile.Bytes()}}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.pixelFormat = PixelFormat32bit
+	if err := conn.SetEncodings(Encodings{&TightEncoding{}, &RawEncoding{}}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := conn.SetEncodings(Encodings{&HextileEncoding{}, &RawEncoding{}}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	msg, err := (&FramebufferUpdate{}).Read(conn)
+	if err != nil {
+		t.Fatalf("in-flight update: unexpected error: %s", err)
+	}
+	if got, want := msg.(*FramebufferUpdate).Rects[0].Enc.(*TightEncoding).Data, pixels; !bytes.Equal(got, want) {
+		t.Errorf("in-flight update: incorrect pixels; got = %v, want = %v", got, want)
+	}
+	if conn.zlibs[0] == nil {
+		t.Error("in-flight update: expected zlib stream 0 to be kept")
+	}
+
+	msg, err = (&FramebufferUpdate{}).Read(conn)
+	if err != nil {
+		t.Fatalf("subsequent update: unexpected error: %s", err)
+	}
+	if got, want := len(msg.(*FramebufferUpdate).Rects[0].Enc.(*HextileEncoding).Colors), 2*2; got != want {
+		t.Errorf("subsequent update: incorrect number of colors; got = %v, want = %v", got, want)
+	}
+	if conn.zlibs[0] != nil {
+		t.Error("subsequent update: expected zlib stream 0 to be reset")
+	}
+	if _, ok := conn.Encodable(encodings.EncTight); ok {
+		t.Error("subsequent update: expected Tight to no longer be decodable")
+	}
+}
+
+func TestSetEncodings_MidSession_PendingRequest(t *testing.T) {
+	// An update answering the request outstanding at the change, which
+	// happens not to use Tight, followed by one answering a later request.
+	var update bytes.Buffer
+	update.Write([]byte{0, 0, 1}) // padding, number-of-rectangles
+	binary.Write(&update, binary.BigEndian, rectangleMessage{0, 0, 1, 1, encodings.EncRaw})
+	update.Write([]byte{1, 2, 3, 4})
+
+	mockConn := &chunkConn{chunks: [][]byte{update.Bytes(), update.Bytes()}}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.pixelFormat = PixelFormat32bit
+	conn.fbWidth, conn.fbHeight = 1, 1
+	if err := conn.SetEncodings(Encodings{&TightEncoding{}, &RawEncoding{}}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := conn.FramebufferUpdateRequest(rfbflags.RFBTrue, 0, 0, 1, 1); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.zlibs[0] = io.NopCloser(&bytes.Buffer{})
+	if err := conn.SetEncodings(Encodings{&HextileEncoding{}, &RawEncoding{}}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if _, err := (&FramebufferUpdate{}).Read(conn); err != nil {
+		t.Fatalf("answering update: unexpected error: %s", err)
+	}
+	if conn.zlibs[0] == nil {
+		t.Error("answering update: expected zlib stream 0 to be kept")
+	}
+	if _, err := (&FramebufferUpdate{}).Read(conn); err != nil {
+		t.Fatalf("subsequent update: unexpected error: %s", err)
+	}
+	if conn.zlibs[0] != nil {
+		t.Error("subsequent update: expected zlib stream 0 to be reset")
 	}
 }
 
@@ -183,6 +334,67 @@ func TestFramebufferUpdateRequest(t *testing.T) {
 	}
 }
 
+func TestClientConfig_AutoRequestUpdates(t *testing.T) {
+	update := []byte{0, 0, 0, 0} // message-type, padding, number-of-rectangles
+	want := FramebufferUpdateRequestMessage{messages.FramebufferUpdateRequest, rfbflags.RFBTrue, 0, 0, 640, 480}
+
+	for _, tt := range []struct {
+		auto bool
+		want int
+	}{
+		{false, 0},
+		{true, 2},
+	} {
+		conn := NewClientConn(&chunkConn{chunks: [][]byte{update, update}}, NewClientConfig(""))
+		conn.config.AutoRequestUpdates = tt.auto
+		conn.fbWidth, conn.fbHeight = 640, 480
+		if err := conn.ListenAndHandle(); err != nil {
+			t.Fatalf("auto %v: unexpected error: %s", tt.auto, err)
+		}
+
+		written := &conn.Conn.(*chunkConn).MockConn
+		for i := 0; i < tt.want; i++ {
+			var req FramebufferUpdateRequestMessage
+			if err := binary.Read(written, binary.BigEndian, &req); err != nil {
+				t.Fatalf("auto %v: expected request %d: %s", tt.auto, i, err)
+			}
+			if req != want {
+				t.Errorf("auto %v: incorrect request %d; got = %v, want = %v", tt.auto, i, req, want)
+			}
+		}
+		if n := written.b.Len(); n != 0 {
+			t.Errorf("auto %v: unexpected %d bytes sent", tt.auto, n)
+		}
+	}
+}
+
+func TestClientConfig_MinUpdateInterval(t *testing.T) {
+	update := []byte{0, 0, 0, 0} // message-type, padding, number-of-rectangles
+	cfg := NewClientConfig("")
+	cfg.MinUpdateInterval = time.Second
+	conn := NewClientConn(&chunkConn{chunks: [][]byte{update, update}}, cfg)
+	clk := newFakeClock()
+	conn.setClock(clk)
+	written := &conn.Conn.(*chunkConn).MockConn
+
+	done := make(chan error)
+	go func() { done <- conn.ListenAndHandle() }()
+
+	// The first request is sent at once, and the second once the interval
+	// has passed.
+	clk.BlockUntil(t, 1)
+	if got, want := written.b.Len(), binary.Size(FramebufferUpdateRequestMessage{}); got != want {
+		t.Errorf("incorrect bytes sent before the interval; got = %d, want = %d", got, want)
+	}
+	clk.Advance(time.Second)
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := written.b.Len(), 2*binary.Size(FramebufferUpdateRequestMessage{}); got != want {
+		t.Errorf("incorrect bytes sent after the interval; got = %d, want = %d", got, want)
+	}
+}
+
 func ExampleClientConn_KeyEvent() {
 	// Establish TCP connection.
 	nc, err := net.DialTimeout("tcp", "127.0.0.1:5900", 10*time.Second)
@@ -319,6 +531,92 @@ func TestPointerEvent(t *testing.T) {
 	}
 }
 
+func TestPointerEvent_PointerMode(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.encodings = Encodings{&RawEncoding{}, &QEMUPointerMotionChangePseudoEncoding{}}
+
+	// setMode reads a FramebufferUpdate holding a pointer motion change.
+	setMode := func(x uint16) {
+		mockConn.Reset()
+		conn.bufr.Reset(mockConn)
+		conn.send([]byte{0, 0, 1}) // padding, number-of-rectangles
+		conn.send(rectangleMessage{x, 0, 0, 0, encodings.EncQEMUPointerMotionChangePseudo})
+		if _, err := (&FramebufferUpdate{}).Read(conn); err != nil {
+			t.Fatalf("unexpected error reading update: %s", err)
+		}
+	}
+
+	SetSettle(0) // Disable UI settling for tests.
+	for _, tt := range []struct {
+		mode         uint16 // x-position of the pointer motion change, or none
+		x, y         uint16
+		wantMode     PointerMode
+		wantX, wantY uint16
+	}{
+		{mode: 0xffff, x: 100, y: 200, wantMode: PointerAbsolute, wantX: 100, wantY: 200},
+		{mode: 0, x: 110, y: 190, wantMode: PointerRelative, wantX: 0x7fff + 10, wantY: 0x7fff - 10},
+		{mode: 0xffff, x: 110, y: 190, wantMode: PointerRelative, wantX: 0x7fff, wantY: 0x7fff},
+		{mode: 1, x: 5, y: 6, wantMode: PointerAbsolute, wantX: 5, wantY: 6},
+	} {
+		if tt.mode != 0xffff {
+			setMode(tt.mode)
+		}
+		if got, want := conn.PointerMode(), tt.wantMode; got != want {
+			t.Errorf("incorrect pointer mode; got = %v, want = %v", got, want)
+		}
+
+		mockConn.Reset()
+		conn.bufr.Reset(mockConn)
+		if err := conn.PointerEvent(buttons.None, tt.x, tt.y); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var req PointerEventMessage
+		if err := conn.receive(&req); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := req.X, tt.wantX; got != want {
+			t.Errorf("%v: incorrect x-position; got = %#x, want = %#x", tt.wantMode, got, want)
+		}
+		if got, want := req.Y, tt.wantY; got != want {
+			t.Errorf("%v: incorrect y-position; got = %#x, want = %#x", tt.wantMode, got, want)
+		}
+	}
+}
+
+func TestPointerEvent_PointerMode_Concurrent(t *testing.T) {
+	SetSettle(0) // Disable UI settling for tests.
+	const n = 1000
+
+	// The server switches the pointer mode back and forth, while the client
+	// sends pointer events. chunkConn doesn't synchronize its reads and
+	// writes, nor do metrics and update requests once disabled.
+	var chunks [][]byte
+	for i := 0; i < n; i++ {
+		var update bytes.Buffer
+		update.Write([]byte{0, 0, 0, 1}) // message-type, padding, number-of-rectangles
+		binary.Write(&update, binary.BigEndian, rectangleMessage{uint16(i % 2), 0, 0, 0, encodings.EncQEMUPointerMotionChangePseudo})
+		chunks = append(chunks, update.Bytes())
+	}
+	cfg := NewClientConfig("")
+	cfg.DisableMetrics = true
+	cfg.AutoRequestUpdates = false
+	conn := NewClientConn(&chunkConn{chunks: chunks}, cfg)
+	conn.encodings = Encodings{&RawEncoding{}, &QEMUPointerMotionChangePseudoEncoding{}}
+	done := make(chan error, 1)
+	go func() { done <- conn.ListenAndHandle() }()
+
+	for i := 0; i < n; i++ {
+		if err := conn.PointerEvent(buttons.None, uint16(i), uint16(i)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		conn.PointerMode()
+	}
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
 func TestClientCutText(t *testing.T) {
 	tests := []struct {
 		text string
@@ -376,3 +674,299 @@ func TestClientCutText(t *testing.T) {
 		}
 	}
 }
+
+func TestPointerEvent_ClampPointer(t *testing.T) {
+	SetSettle(0) // Disable UI settling for tests.
+	for _, tt := range []struct {
+		clamp        PointerClamp
+		x, y         uint16
+		wantX, wantY uint16
+		wantErr      bool
+	}{
+		{PointerClampNone, 800, 700, 800, 700, false},
+		{PointerClampToFramebuffer, 10, 20, 10, 20, false},
+		{PointerClampToFramebuffer, 640, 20, 639, 20, false},
+		{PointerClampToFramebuffer, 10, 480, 10, 479, false},
+		{PointerClampToFramebuffer, 0xffff, 0xffff, 639, 479, false},
+		{PointerClampError, 639, 479, 639, 479, false},
+		{PointerClampError, 640, 0, 0, 0, true},
+		{PointerClampError, 0, 480, 0, 0, true},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{ClampPointer: tt.clamp})
+		conn.fbWidth, conn.fbHeight = 640, 480
+
+		err := conn.PointerEvent(buttons.None, tt.x, tt.y)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%v (%d, %d): expected an error", tt.clamp, tt.x, tt.y)
+			}
+			if mockConn.b.Len() != 0 {
+				t.Errorf("%v (%d, %d): expected nothing sent", tt.clamp, tt.x, tt.y)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v (%d, %d): unexpected error: %v", tt.clamp, tt.x, tt.y, err)
+			continue
+		}
+		var req PointerEventMessage
+		if err := conn.receive(&req); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := req.X, tt.wantX; got != want {
+			t.Errorf("%v (%d, %d): incorrect x-position; got = %v, want = %v", tt.clamp, tt.x, tt.y, got, want)
+		}
+		if got, want := req.Y, tt.wantY; got != want {
+			t.Errorf("%v (%d, %d): incorrect y-position; got = %v, want = %v", tt.clamp, tt.x, tt.y, got, want)
+		}
+	}
+}
+
+func TestPointerEvent_ClampPointer_Resize(t *testing.T) {
+	SetSettle(0) // Disable UI settling for tests.
+	const n = 1000
+
+	// The server resizes the desktop back and forth, while the client sends
+	// pointer events clamped to it. chunkConn doesn't synchronize its reads
+	// and writes, nor do metrics and update requests once disabled. Reading
+	// the updates at once also keeps the read goroutine from flushing sends.
+	var updates bytes.Buffer
+	for i := 0; i < n; i++ {
+		updates.Write([]byte{0, 0, 0, 1}) // message-type, padding, number-of-rectangles
+		binary.Write(&updates, binary.BigEndian, rectangleMessage{0, 0, uint16(100 + i%2), 100, encodings.EncDesktopSizePseudo})
+	}
+	chunks := [][]byte{updates.Bytes()}
+	cfg := NewClientConfig("")
+	cfg.DisableMetrics = true
+	cfg.AutoRequestUpdates = false
+	cfg.ClampPointer = PointerClampToFramebuffer
+	conn := NewClientConn(&chunkConn{chunks: chunks}, cfg)
+	conn.encodings = Encodings{&RawEncoding{}, &DesktopSizePseudoEncoding{}}
+	conn.fbWidth, conn.fbHeight = 100, 100
+	done := make(chan error, 1)
+	go func() { done <- conn.ListenAndHandle() }()
+
+	for i := 0; i < n; i++ {
+		if err := conn.PointerEvent(buttons.None, 0xffff, 0xffff); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if w, h := conn.GetFramebufferWidth(), conn.GetFramebufferHeight(); w != 101 || h != 100 {
+		t.Errorf("incorrect framebuffer size; got = %dx%d, want = 101x100", w, h)
+	}
+}
+
+func TestPointerButtons_Mask(t *testing.T) {
+	for _, tt := range []struct {
+		b    PointerButtons
+		want uint8
+	}{
+		{PointerButtons{}, 0},
+		{PointerButtons{Left: true}, 0x01},
+		{PointerButtons{Middle: true}, 0x02},
+		{PointerButtons{Right: true}, 0x04},
+		{PointerButtons{ScrollUp: true}, 0x08},
+		{PointerButtons{ScrollDown: true}, 0x10},
+		{PointerButtons{ScrollLeft: true}, 0x20},
+		{PointerButtons{ScrollRight: true}, 0x40},
+		{PointerButtons{Left: true, Right: true, ScrollDown: true}, 0x15},
+	} {
+		if got := tt.b.Mask(); got != tt.want {
+			t.Errorf("%+v: incorrect mask; got = %#x, want = %#x", tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestScroll(t *testing.T) {
+	SetSettle(0) // Disable UI settling for tests.
+	for _, tt := range []struct {
+		desc   string
+		held   PointerButtons
+		dx, dy int
+		want   []uint8 // button-masks sent
+	}{
+		{"none", PointerButtons{}, 0, 0, nil},
+		{"down", PointerButtons{}, 0, 2, []uint8{0x10, 0, 0x10, 0}},
+		{"up", PointerButtons{}, 0, -1, []uint8{0x08, 0}},
+		{"right", PointerButtons{}, 1, 0, []uint8{0x40, 0}},
+		{"left and down", PointerButtons{}, -1, 1, []uint8{0x10, 0, 0x20, 0}},
+		{"while dragging", PointerButtons{Left: true}, 0, -1, []uint8{0x09, 0x01}},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{})
+		if err := conn.SendPointer(10, 20, tt.held); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.desc, err)
+		}
+		mockConn.Reset()
+
+		if err := conn.Scroll(10, 20, tt.dx, tt.dy); err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.desc, err)
+			continue
+		}
+		var got []uint8
+		for mockConn.b.Len() > 0 || conn.bufr.Buffered() > 0 {
+			var req PointerEventMessage
+			if err := conn.receive(&req); err != nil {
+				t.Fatal(err)
+			}
+			if req.X != 10 || req.Y != 20 {
+				t.Errorf("%s: incorrect position; got = (%d, %d), want = (10, 20)", tt.desc, req.X, req.Y)
+			}
+			got = append(got, req.Mask)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: incorrect button-masks; got = %#x, want = %#x", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestSetPixelFormat_Requested(t *testing.T) {
+	var logs bytes.Buffer
+	conn := NewClientConn(&MockConn{}, &ClientConfig{Logger: log.New(&logs, "", 0)})
+	conn.serverPixelFormat = PixelFormat32bit
+	if _, ok := conn.RequestedPixelFormat(); ok {
+		t.Error("expected no requested pixel format")
+	}
+
+	for _, tt := range []struct {
+		pf   PixelFormat
+		warn bool
+	}{
+		{PixelFormat32bit, false},
+		{PixelFormat32bitBGR, false},
+		{PixelFormat16bit, true},
+		{PixelFormat8bit, true},
+	} {
+		logs.Reset()
+		if err := conn.SetPixelFormat(tt.pf); err != nil {
+			t.Fatalf("%v: unexpected error: %s", tt.pf, err)
+		}
+		if got, ok := conn.RequestedPixelFormat(); !ok || got != tt.pf {
+			t.Errorf("incorrect requested pixel format; got = %v, want = %v", got, tt.pf)
+		}
+		if got, want := conn.ServerPixelFormat(), PixelFormat32bit; got != want {
+			t.Errorf("incorrect server pixel format; got = %v, want = %v", got, want)
+		}
+		if got := strings.Contains(logs.String(), "warning"); got != tt.warn {
+			t.Errorf("%v: incorrect warning; got = %q, want warning = %v", tt.pf, logs.String(), tt.warn)
+		}
+	}
+}
+
+func TestClientConn_SendRaw(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+
+	// A vendor message-type followed by its payload.
+	msg := []byte{0xfc, 0, 0, 3, 'a', 'b', 'c'}
+	if err := conn.SendRaw(msg); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := conn.SendRaw(nil); err != nil {
+		t.Fatalf("unexpected error sending nothing: %s", err)
+	}
+
+	if got, want := mockConn.b.Bytes(), msg; !bytes.Equal(got, want) {
+		t.Errorf("incorrect bytes sent; got = %v, want = %v", got, want)
+	}
+	if got, want := conn.metricValue("bytes-sent"), uint64(len(msg)); got != want {
+		t.Errorf("incorrect bytes-sent; got = %v, want = %v", got, want)
+	}
+}
+
+func TestClientConn_SendRaw_Concurrent(t *testing.T) {
+	SetSettle(0) // Disable UI settling for tests.
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	const n = 100
+
+	// A vendor message-type followed by its payload.
+	raw := []byte{0xfc, 0, 0, 3, 'a', 'b', 'c'}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			if err := conn.SendRaw(raw); err != nil {
+				t.Errorf("unexpected SendRaw error: %s", err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			if err := conn.KeyEvent(keys.Key(i), true); err != nil {
+				t.Errorf("unexpected KeyEvent error: %s", err)
+			}
+		}
+	}()
+	wg.Wait()
+
+	// Each message is whole, and those of each goroutine are in order.
+	var raws, keyEvents int
+	for mockConn.b.Len() > 0 {
+		switch messages.ClientMessage(mockConn.b.Bytes()[0]) {
+		case messages.KeyEvent:
+			var msg KeyEventMessage
+			if err := binary.Read(mockConn, binary.BigEndian, &msg); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if want := (KeyEventMessage{messages.KeyEvent, rfbflags.RFBTrue, [2]byte{}, keys.Key(keyEvents)}); msg != want {
+				t.Fatalf("incorrect KeyEvent %d; got = %v, want = %v", keyEvents, msg, want)
+			}
+			keyEvents++
+		default:
+			got := make([]byte, len(raw))
+			if _, err := io.ReadFull(mockConn, got); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !bytes.Equal(got, raw) {
+				t.Fatalf("incorrect raw message %d; got = %v, want = %v", raws, got, raw)
+			}
+			raws++
+		}
+	}
+	if raws != n || keyEvents != n {
+		t.Errorf("incorrect messages; got %d raw and %d KeyEvent, want %d of each", raws, keyEvents, n)
+	}
+}
+
+func TestClientConfig_IdleTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	cfg := NewClientConfig("")
+	cfg.IdleTimeout = 10 * time.Second
+	cfg.ServerMessageCh = make(chan ServerMessage, 1)
+	conn := NewClientConn(client, cfg)
+	clk := newFakeClock()
+	conn.setClock(clk)
+
+	done := make(chan error)
+	go func() { done <- conn.ListenAndHandle() }()
+
+	// A message received before the timeout restarts it.
+	clk.BlockUntil(t, 1)
+	clk.Advance(6 * time.Second)
+	if _, err := server.Write([]byte{byte(messages.Bell)}); err != nil {
+		t.Fatalf("unexpected error sending Bell: %s", err)
+	}
+	<-cfg.ServerMessageCh
+	clk.BlockUntil(t, 1)
+	clk.Advance(4 * time.Second)
+	clk.BlockUntil(t, 1)
+	select {
+	case err := <-done:
+		t.Fatalf("connection closed after a message; err = %v", err)
+	default:
+	}
+
+	// The server going silent for the timeout closes the connection.
+	clk.Advance(6 * time.Second)
+	if err := <-done; err != ErrIdleTimeout {
+		t.Errorf("incorrect error; got = %v, want = %v", err, ErrIdleTimeout)
+	}
+}
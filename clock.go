@@ -0,0 +1,57 @@
+// Time sources for time-dependent features.
+
+package vnc
+
+import "time"
+
+// clock tells the time and waits for durations to pass. Time-dependent
+// features of a connection use its clock rather than the time package, so
+// that tests can control the passage of time.
+type clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After returns a channel receiving the current time once d has passed.
+	After(d time.Duration) <-chan time.Time
+	// NewTicker returns a ticker delivering the time every d.
+	NewTicker(d time.Duration) ticker
+}
+
+// ticker is the interface of a time.Ticker.
+type ticker interface {
+	// C returns the channel on which ticks are delivered.
+	C() <-chan time.Time
+	// Stop turns off the ticker.
+	Stop()
+}
+
+// realClock is the clock of the time package.
+type realClock struct{}
+
+// Verify that interfaces are honored.
+var _ clock = realClock{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTicker(d time.Duration) ticker       { return realTicker{time.NewTicker(d)} }
+
+// realTicker adapts a time.Ticker to the ticker interface.
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// setClock makes c use clk for all its time-dependent features, including
+// throttling of its connection and its rate metrics.
+func (c *ClientConn) setClock(clk clock) {
+	c.clock = clk
+	for _, m := range c.metrics {
+		if g, ok := m.(*rateGauge); ok {
+			g.setClock(clk)
+		}
+	}
+	if tc, ok := c.Conn.(*throttledConn); ok {
+		tc.r.setClock(clk)
+		tc.w.setClock(clk)
+	}
+}
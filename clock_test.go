@@ -0,0 +1,182 @@
+package vnc
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock whose time only passes when advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// fakeWaiter is a pending After channel or ticker of a fakeClock.
+type fakeWaiter struct {
+	at     time.Time
+	period time.Duration // Zero for After channels.
+	ch     chan time.Time
+}
+
+// Verify that interfaces are honored.
+var _ clock = (*fakeClock)(nil)
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &fakeWaiter{at: c.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.ch <- c.now
+		return w.ch
+	}
+	c.waiters = append(c.waiters, w)
+	return w.ch
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &fakeWaiter{at: c.now.Add(d), period: d, ch: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, w)
+	return &fakeTicker{c, w}
+}
+
+// Advance moves the time forward by d, firing the channels and tickers that
+// fall due. Like a time.Ticker, a ticker drops ticks its reader isn't ready
+// for.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		for !w.at.After(c.now) {
+			select {
+			case w.ch <- w.at:
+			default:
+			}
+			if w.period == 0 {
+				break
+			}
+			w.at = w.at.Add(w.period)
+		}
+		if w.period != 0 || w.at.After(c.now) {
+			pending = append(pending, w)
+		}
+	}
+	c.waiters = pending
+}
+
+// Pending returns the number of channels and tickers pending.
+func (c *fakeClock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// BlockUntil waits until n channels or tickers are pending.
+func (c *fakeClock) BlockUntil(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pending := c.Pending()
+		if pending >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d waiters; got %d", n, pending)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// fakeTicker is a ticker of a fakeClock.
+type fakeTicker struct {
+	c *fakeClock
+	w *fakeWaiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.w.ch }
+
+func (t *fakeTicker) Stop() {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	for i, w := range t.c.waiters {
+		if w == t.w {
+			t.c.waiters = append(t.c.waiters[:i], t.c.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	clk := newFakeClock()
+	start := clk.Now()
+	after := clk.After(time.Second)
+	tick := clk.NewTicker(300 * time.Millisecond)
+
+	clk.Advance(500 * time.Millisecond)
+	select {
+	case <-after:
+		t.Error("After fired early")
+	default:
+	}
+	if got, want := <-tick.C(), start.Add(300*time.Millisecond); !got.Equal(want) {
+		t.Errorf("incorrect tick; got = %v, want = %v", got, want)
+	}
+
+	clk.Advance(500 * time.Millisecond)
+	if got, want := <-after, start.Add(time.Second); !got.Equal(want) {
+		t.Errorf("incorrect After time; got = %v, want = %v", got, want)
+	}
+	if got, want := <-tick.C(), start.Add(600*time.Millisecond); !got.Equal(want) {
+		t.Errorf("incorrect tick; got = %v, want = %v", got, want)
+	}
+
+	tick.Stop()
+	clk.Advance(time.Second)
+	select {
+	case <-tick.C():
+		t.Error("stopped ticker fired")
+	default:
+	}
+}
+
+func TestThrottle_Clock(t *testing.T) {
+	const rate = 1000 // bytes per second, with a burst of 100 bytes
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{MaxBytesPerSecond: rate})
+	clk := newFakeClock()
+	conn.setClock(clk)
+
+	done := make(chan error)
+	go func() { done <- conn.send(make([]byte, 100)) }()
+
+	// The bucket starts empty, so the write waits for 100 bytes worth of time.
+	clk.BlockUntil(t, 1)
+	select {
+	case <-done:
+		t.Fatal("write completed before the clock advanced")
+	default:
+	}
+	clk.Advance(100 * time.Millisecond)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for write")
+	}
+}
@@ -0,0 +1,101 @@
+// Command vncshot connects to a VNC server and saves a screenshot of its
+// framebuffer as a PNG image.
+//
+// Usage:
+//
+//	vncshot [flags] address
+//
+// The address is that accepted by vnc.Dial, e.g. "localhost:5901" or
+// "unix:///run/vnc.sock". With -tls, the connection to a TCP address is made
+// over TLS, e.g. to a server behind a TLS tunnel.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"image/png"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	vnc "github.com/bigangryrobot/go-vnc"
+)
+
+var (
+	output   = flag.String("o", "screenshot.png", "file to write the PNG image to")
+	password = flag.String("password", "", "password for servers requiring VNC authentication")
+	timeout  = flag.Duration("timeout", 30*time.Second, "time allowed to connect and take the screenshot")
+	useTLS   = flag.Bool("tls", false, "connect to a TCP address over TLS")
+	insecure = flag.Bool("insecure", false, "with -tls, skip verification of the server's certificate")
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("vncshot: ")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: vncshot [flags] address\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if err := run(ctx, flag.Arg(0)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run takes a screenshot of the server at address, and writes it to output.
+func run(ctx context.Context, address string) error {
+	cfg := vnc.NewClientConfig(*password)
+	cfg.RequestInitialUpdate = false // Screenshot requests its own update.
+
+	conn, err := dial(ctx, address, cfg)
+	if err != nil {
+		return fmt.Errorf("connecting to %s: %w", address, err)
+	}
+	defer conn.Close()
+
+	img, _, err := conn.Screenshot(ctx)
+	if err != nil {
+		return fmt.Errorf("taking screenshot: %w", err)
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return fmt.Errorf("writing %s: %w", *output, err)
+	}
+	return f.Close()
+}
+
+// dial connects to the server at address, over TLS if requested.
+func dial(ctx context.Context, address string, cfg *vnc.ClientConfig) (*vnc.ClientConn, error) {
+	if !*useTLS {
+		return vnc.Dial(ctx, address, cfg)
+	}
+	if strings.HasPrefix(address, "unix://") {
+		return nil, fmt.Errorf("-tls is only supported for TCP addresses")
+	}
+	addr := strings.TrimPrefix(address, "tcp://")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), vnc.DefaultPort)
+	}
+	d := tls.Dialer{Config: &tls.Config{InsecureSkipVerify: *insecure}}
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return vnc.Connect(ctx, nc, cfg)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	vnc "github.com/bigangryrobot/go-vnc"
+	"github.com/bigangryrobot/go-vnc/buttons"
+	"github.com/bigangryrobot/go-vnc/encodings"
+	"github.com/bigangryrobot/go-vnc/keys"
+	"github.com/bigangryrobot/go-vnc/rfbflags"
+)
+
+// stripesHandler serves a 2x2 desktop of a red and a blue column, responding
+// to each FramebufferUpdateRequest with a single Raw rectangle.
+type stripesHandler struct{}
+
+func (stripesHandler) SetPixelFormat(*vnc.ServerConn, vnc.PixelFormat) error              { return nil }
+func (stripesHandler) SetEncodings(*vnc.ServerConn, []encodings.EncodingType) error       { return nil }
+func (stripesHandler) KeyEvent(*vnc.ServerConn, keys.Key, bool) error                     { return nil }
+func (stripesHandler) PointerEvent(*vnc.ServerConn, buttons.Button, uint16, uint16) error { return nil }
+func (stripesHandler) ClientCutText(*vnc.ServerConn, string) error                        { return nil }
+
+func (stripesHandler) FramebufferUpdateRequest(c *vnc.ServerConn, inc rfbflags.RFBFlag, x, y, w, h uint16) error {
+	pf := c.GetPixelFormat()
+	red, blue := vnc.NewColor(&pf, nil), vnc.NewColor(&pf, nil)
+	red.R, blue.B = pf.RedMax, pf.BlueMax
+	return c.FramebufferUpdate([]vnc.Rectangle{{
+		X: 0, Y: 0, Width: 2, Height: 2,
+		Enc: &vnc.RawEncoding{Colors: []vnc.Color{*red, *blue, *red, *blue}},
+	}})
+}
+
+func TestRun(t *testing.T) {
+	vnc.SetSettle(0) // Disable UI settling for tests.
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	defer ln.Close()
+	cfg := vnc.NewServerConfig("")
+	cfg.FBWidth, cfg.FBHeight = 2, 2
+	go cfg.Serve(ln, stripesHandler{})
+
+	*output = filepath.Join(t.TempDir(), "screenshot.png")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := run(ctx, ln.Addr().String()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f, err := os.Open(*output)
+	if err != nil {
+		t.Fatalf("error opening screenshot: %s", err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("error decoding screenshot: %s", err)
+	}
+	if got, want := img.Bounds(), image.Rect(0, 0, 2, 2); got != want {
+		t.Fatalf("incorrect screenshot bounds; got = %v, want = %v", got, want)
+	}
+	for _, tt := range []struct {
+		x, y int
+		want color.RGBA
+	}{
+		{0, 0, color.RGBA{0xff, 0, 0, 0xff}},
+		{1, 0, color.RGBA{0, 0, 0xff, 0xff}},
+		{0, 1, color.RGBA{0xff, 0, 0, 0xff}},
+		{1, 1, color.RGBA{0, 0, 0xff, 0xff}},
+	} {
+		if got := color.RGBAModel.Convert(img.At(tt.x, tt.y)); got != tt.want {
+			t.Errorf("incorrect pixel at (%d, %d); got = %v, want = %v", tt.x, tt.y, got, tt.want)
+		}
+	}
+}
@@ -6,17 +6,19 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"time"
 )
 
 // VNCError implements error interface.
 type VNCError struct {
 	desc string
+	err  error // Underlying typed error, if any.
 }
 
 // NewVNCError returns a custom VNCError error.
 func NewVNCError(desc string) error {
-	return &VNCError{desc}
+	return &VNCError{desc: desc}
 }
 
 // Error returns an VNCError as a string.
@@ -24,6 +26,58 @@ func (e VNCError) Error() string {
 	return e.desc
 }
 
+// Unwrap returns the typed error underlying a VNCError, if any, so that it
+// can be inspected with errors.As.
+func (e VNCError) Unwrap() error {
+	return e.err
+}
+
+// ProtocolError wraps an error reading a message from the peer, other than
+// the connection closing (io.EOF or io.ErrUnexpectedEOF).
+type ProtocolError struct {
+	Err error
+}
+
+// Error implements the error interface.
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("protocol error: %v", e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// PartialReadError is returned when fewer bytes than expected could be read
+// from the peer, e.g. because the connection closed or a read timed out.
+type PartialReadError struct {
+	Want, Got int   // Numbers of bytes expected and read.
+	Err       error // Error ending the read.
+}
+
+// Error implements the error interface.
+func (e *PartialReadError) Error() string {
+	return fmt.Sprintf("read %d of %d bytes: %v", e.Got, e.Want, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *PartialReadError) Unwrap() error {
+	return e.Err
+}
+
+// ErrIdleTimeout is returned by ListenAndHandle when it closed the connection
+// because no server message was received within ClientConfig.IdleTimeout.
+var ErrIdleTimeout = NewVNCError("no server message received within idle timeout")
+
+// readError returns err, as returned by a read from the peer, wrapped in a
+// ProtocolError unless it indicates the connection closed.
+func readError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return err
+	}
+	return &ProtocolError{err}
+}
+
 func Errorf(format string, a ...interface{}) error {
 	return &VNCError{
 		desc: fmt.Sprintf(format, a...),
@@ -77,7 +131,9 @@ type Marshaler interface {
 	Marshal() ([]byte, error)
 }
 
-// Unarshaler is the interface satisfied for unmarshaling messages.
+// Unmarshaler is the interface satisfied for unmarshaling messages. Types
+// satisfying both Marshaler and Unmarshaler must round-trip: unmarshaling
+// the output of Marshal yields an equal value.
 type Unmarshaler interface {
 	// Unmarshal parses a wire format message into a message.
 	Unmarshal(data []byte) error
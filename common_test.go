@@ -2,7 +2,9 @@ package vnc
 
 import (
 	"bytes"
+	"image"
 	"net"
+	"reflect"
 	"testing"
 	"time"
 
@@ -80,3 +82,115 @@ func (m *MockConn) SetWriteDeadline(t time.Time) error { return nil }
 func (m *MockConn) Reset() {
 	m.b.Reset()
 }
+
+// roundTripFormat is a 32 bits-per-pixel format whose components don't
+// overlap, so that colors survive a round-trip.
+var roundTripFormat = PixelFormat{BPP: 32, Depth: 24, BigEndian: RFBTrue, TrueColor: RFBTrue,
+	RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 16, GreenShift: 8, BlueShift: 0}
+
+// roundTripConn returns a ClientConn with a 640x480 framebuffer reading data,
+// using roundTripFormat and supporting every encoding that can be marshaled.
+func roundTripConn(data []byte) *ClientConn {
+	mockConn := &MockConn{}
+	mockConn.Write(data)
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.pixelFormat = roundTripFormat
+	conn.fbWidth, conn.fbHeight = 640, 480
+	conn.encodings = Encodings{&RawEncoding{}, &CopyRectEncoding{}, &RREEncoding{},
+		&ZRLEEncoding{}, &CursorPseudoEncoding{}, &DesktopSizePseudoEncoding{}}
+	return conn
+}
+
+// readEncoding returns a function reading an Encoding of a 2x2 rectangle.
+func readEncoding(e Encoding) func(data []byte) (Marshaler, error) {
+	return func(data []byte) (Marshaler, error) {
+		conn := roundTripConn(data)
+		return e.Read(conn, &Rectangle{Width: 2, Height: 2})
+	}
+}
+
+// testRoundTrip marshals m, reads the result back with read, and checks that
+// the value read equals m.
+func testRoundTrip(t *testing.T, desc string, m Marshaler, read func(data []byte) (Marshaler, error)) {
+	t.Helper()
+	data, err := m.Marshal()
+	if err != nil {
+		t.Errorf("%s: unexpected error marshaling: %s", desc, err)
+		return
+	}
+	got, err := read(data)
+	if err != nil {
+		t.Errorf("%s: unexpected error reading: %s", desc, err)
+		return
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("%s: round-trip mismatch; got = %v, want = %v", desc, got, m)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	pf := roundTripFormat
+	var cm ColorMap
+	color := func(r, g, b uint16) Color { return Color{pf: &pf, cm: &cm, R: r, G: g, B: b} }
+	unmarshal := func(u Unmarshaler) func(data []byte) (Marshaler, error) {
+		return func(data []byte) (Marshaler, error) {
+			return u.(Marshaler), u.Unmarshal(data)
+		}
+	}
+
+	for _, tt := range []struct {
+		desc string
+		m    Marshaler
+		read func(data []byte) (Marshaler, error)
+	}{
+		{"PixelFormat", &PixelFormat16bit, unmarshal(&PixelFormat{})},
+		{"ServerInit", &ServerInit{FBWidth: 640, FBHeight: 480, PixelFormat: PixelFormat32bit, NameLength: 4},
+			unmarshal(&ServerInit{})},
+		{"Color", &Color{pf: &pf, cm: &cm, R: 1, G: 2, B: 3}, unmarshal(NewColor(&pf, &cm))},
+		{"RawEncoding",
+			&RawEncoding{[]Color{color(1, 2, 3), color(4, 5, 6), color(7, 8, 9), color(255, 255, 255)}},
+			readEncoding(&RawEncoding{})},
+		{"CopyRectEncoding", &CopyRectEncoding{SrcX: 10, SrcY: 20}, readEncoding(&CopyRectEncoding{})},
+		{"RREEncoding",
+			&RREEncoding{color(1, 2, 3), []RRESubRect{{color(4, 5, 6), Rectangle{X: 1, Y: 0, Width: 1, Height: 2}}}},
+			readEncoding(&RREEncoding{})},
+		{"CoRREEncoding",
+			&CoRREEncoding{color(1, 2, 3), []RRESubRect{{color(4, 5, 6), Rectangle{X: 1, Y: 0, Width: 1, Height: 2}}}},
+			readEncoding(&CoRREEncoding{})},
+		{"ZRLEEncoding", &ZRLEEncoding{[]byte{1, 2, 3, 4}}, readEncoding(&ZRLEEncoding{})},
+		{"CursorPseudoEncoding",
+			&CursorPseudoEncoding{Pixels: make([]byte, 2*2*4), Bitmask: []byte{0x80, 0x40}},
+			readEncoding(&CursorPseudoEncoding{})},
+		{"XCursorPseudoEncoding",
+			&XCursorPseudoEncoding{[3]uint8{1, 2, 3}, [3]uint8{4, 5, 6}, []byte{0x40, 0x80}, []byte{0xc0, 0xc0}},
+			readEncoding(&XCursorPseudoEncoding{})},
+		{"DesktopSizePseudoEncoding", &DesktopSizePseudoEncoding{}, readEncoding(&DesktopSizePseudoEncoding{})},
+		{"FramebufferUpdate",
+			newFramebufferUpdate([]Rectangle{
+				{X: 1, Y: 2, Width: 1, Height: 1, Enc: &RawEncoding{[]Color{color(1, 2, 3)}}},
+				{X: 0, Y: 0, Width: 5, Height: 6, Enc: &DesktopSizePseudoEncoding{}},
+			}),
+			func(data []byte) (Marshaler, error) {
+				conn := roundTripConn(data[1:]) // Read follows the message-type.
+				msg, err := (&FramebufferUpdate{}).Read(conn)
+				if err != nil {
+					return nil, err
+				}
+				fu := msg.(*FramebufferUpdate)
+				for i := range fu.Rects {
+					fu.Rects[i].encFn = nil
+				}
+				fu.Changed = image.Rectangle{} // Not part of the wire format.
+				return fu, nil
+			}},
+	} {
+		testRoundTrip(t, tt.desc, tt.m, tt.read)
+	}
+
+	// Encodings that are decoded lossily can't round-trip.
+	for _, e := range []Encoding{&HextileEncoding{}, &TightEncoding{}, &JRLEEncoding{}} {
+		if _, err := e.Marshal(); err == nil {
+			t.Errorf("%v: expected Marshal error", e.Type())
+		}
+	}
+}
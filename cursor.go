@@ -0,0 +1,100 @@
+// Rendering of the cursor shapes sent by the server.
+
+package vnc
+
+import (
+	"image"
+	"image/color"
+)
+
+// cursorChanged calls the OnCursorChange callback, if any, for each Cursor or
+// XCursor pseudo-rectangle among rects, in order.
+func (c *ClientConn) cursorChanged(rects []Rectangle) {
+	if c.config.OnCursorChange == nil {
+		return
+	}
+	for i := range rects {
+		rect := &rects[i]
+		img, ok := c.CursorImage(rect)
+		if !ok {
+			continue
+		}
+		c.config.OnCursorChange(img, image.Pt(int(rect.X), int(rect.Y)))
+	}
+}
+
+// CursorImage returns the cursor shape of rect, a Cursor or XCursor
+// pseudo-rectangle read by c, as passed to OnCursorChange, and true, or false
+// for other rectangles. The image is nil for a hidden cursor.
+//
+// The alpha of each pixel comes from the cursor's bitmask: pixels whose bit
+// is clear have alpha 0, and the others alpha 0xff, with the color of the
+// pixel data. As *image.RGBA holds alpha-premultiplied colors, transparent
+// pixels are all zero; since alpha is either none or full, the colors are the
+// same straight, and the image composites correctly with draw.Over over any
+// background.
+func (c *ClientConn) CursorImage(rect *Rectangle) (*image.RGBA, bool) {
+	switch enc := rect.Enc.(type) {
+	case *CursorPseudoEncoding:
+		return c.cursorImage(rect, enc), true
+	case *XCursorPseudoEncoding:
+		return xCursorImage(rect, enc), true
+	}
+	return nil, false
+}
+
+// bitSet returns true if the bit of pixel (x, y) is set in bits, a bitmap of
+// rows of width pixels padded to whole bytes, most significant bit first.
+func bitSet(bits []byte, width, x, y int) bool {
+	i := y*((width+7)/8) + x/8
+	return i < len(bits) && bits[i]&(0x80>>(x%8)) != 0
+}
+
+// cursorImage returns the cursor shape of a Cursor pseudo-rectangle, with
+// the pixels outside its bitmask transparent, or nil for a hidden cursor.
+func (c *ClientConn) cursorImage(rect *Rectangle, enc *CursorPseudoEncoding) *image.RGBA {
+	if rect.Area() == 0 {
+		return nil
+	}
+	w, h := int(rect.Width), int(rect.Height)
+	bytesPerPixel := c.pixelFormat.BytesPerPixel()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := (y*w + x) * bytesPerPixel
+			if !bitSet(enc.Bitmask, w, x, y) || i+bytesPerPixel > len(enc.Pixels) {
+				continue
+			}
+			col := NewColor(&c.pixelFormat, &c.colorMap)
+			if err := col.Unmarshal(enc.Pixels[i : i+bytesPerPixel]); err != nil {
+				continue
+			}
+			r, g, b := c.ResolveColor(*col)
+			img.SetRGBA(x, y, color.RGBA{r, g, b, 0xff})
+		}
+	}
+	return img
+}
+
+// xCursorImage returns the cursor shape of an XCursor pseudo-rectangle, with
+// the pixels outside its bitmask transparent, or nil for a hidden cursor.
+func xCursorImage(rect *Rectangle, enc *XCursorPseudoEncoding) *image.RGBA {
+	if rect.Area() == 0 {
+		return nil
+	}
+	w, h := int(rect.Width), int(rect.Height)
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if !bitSet(enc.Bitmask, w, x, y) {
+				continue
+			}
+			rgb := enc.Secondary
+			if bitSet(enc.Bitmap, w, x, y) {
+				rgb = enc.Primary
+			}
+			img.SetRGBA(x, y, color.RGBA{rgb[0], rgb[1], rgb[2], 0xff})
+		}
+	}
+	return img
+}
@@ -0,0 +1,119 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/bigangryrobot/go-vnc/encodings"
+)
+
+func TestClientConfig_OnCursorChange(t *testing.T) {
+	header := func(x, y, w, h uint16, enc encodings.EncodingType) []byte {
+		b := new(bytes.Buffer)
+		binary.Write(b, binary.BigEndian, rectangleMessage{x, y, w, h, enc})
+		return b.Bytes()
+	}
+
+	var update bytes.Buffer
+	update.Write([]byte{0, 0, 3}) // padding, number-of-rectangles
+	update.Write(header(1, 0, 2, 1, encodings.EncCursorPseudo))
+	update.Write([]byte{0, 0xff, 0, 0, 0, 0, 0xff, 0, 0x80}) // red, green, first pixel visible
+	update.Write(header(0, 1, 2, 1, encodings.EncXCursorPseudo))
+	update.Write([]byte{0, 0, 0xff, 0xff, 0xff, 0xff}) // primary blue, secondary white
+	update.Write([]byte{0x80, 0xc0})                   // bitmap, bitmask
+	update.Write(header(0, 0, 0, 0, encodings.EncXCursorPseudo))
+
+	type change struct {
+		cursor  *image.RGBA
+		hotspot image.Point
+	}
+	var changes []change
+	mockConn := &MockConn{}
+	mockConn.Write(update.Bytes())
+	conn := NewClientConn(mockConn, &ClientConfig{
+		OnCursorChange: func(cursor *image.RGBA, hotspot image.Point) {
+			changes = append(changes, change{cursor, hotspot})
+		},
+	})
+	conn.pixelFormat = roundTripFormat
+	conn.encodings = Encodings{&RawEncoding{}, &CursorPseudoEncoding{}, &XCursorPseudoEncoding{}}
+
+	if _, err := (&FramebufferUpdate{}).Read(conn); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := len(changes), 3; got != want {
+		t.Fatalf("incorrect number of changes; got = %v, want = %v", got, want)
+	}
+
+	for i, tt := range []struct {
+		hotspot image.Point
+		pixels  []color.RGBA
+	}{
+		{image.Pt(1, 0), []color.RGBA{{0xff, 0, 0, 0xff}, {}}},
+		{image.Pt(0, 1), []color.RGBA{{0, 0, 0xff, 0xff}, {0xff, 0xff, 0xff, 0xff}}},
+	} {
+		got := changes[i]
+		if got.hotspot != tt.hotspot {
+			t.Errorf("change %d: incorrect hotspot; got = %v, want = %v", i, got.hotspot, tt.hotspot)
+		}
+		if got.cursor == nil {
+			t.Errorf("change %d: expected a cursor", i)
+			continue
+		}
+		if got, want := got.cursor.Bounds(), image.Rect(0, 0, 2, 1); got != want {
+			t.Errorf("change %d: incorrect bounds; got = %v, want = %v", i, got, want)
+		}
+		for x, want := range tt.pixels {
+			if got := got.cursor.RGBAAt(x, 0); got != want {
+				t.Errorf("change %d: incorrect pixel %d; got = %v, want = %v", i, x, got, want)
+			}
+		}
+	}
+	if changes[2].cursor != nil {
+		t.Errorf("expected a nil cursor for a hidden cursor; got = %v", changes[2].cursor)
+	}
+}
+
+func TestClientConn_CursorImage(t *testing.T) {
+	// A 3x3 white cursor whose corners are outside the bitmask.
+	conn := NewClientConn(&MockConn{}, &ClientConfig{})
+	conn.pixelFormat = roundTripFormat
+	rect := &Rectangle{Width: 3, Height: 3, Enc: &CursorPseudoEncoding{
+		Pixels:  bytes.Repeat([]byte{0xff, 0xff, 0xff, 0xff}, 9),
+		Bitmask: []byte{0x40, 0xe0, 0x40},
+	}}
+	img, ok := conn.CursorImage(rect)
+	if !ok || img == nil {
+		t.Fatalf("expected a cursor image; got = %v, %v", img, ok)
+	}
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 3; x++ {
+			want := color.RGBA{0xff, 0xff, 0xff, 0xff}
+			if x != 1 && y != 1 { // Corner.
+				want = color.RGBA{}
+			}
+			if got := img.RGBAAt(x, y); got != want {
+				t.Errorf("incorrect pixel (%d, %d); got = %v, want = %v", x, y, got, want)
+			}
+		}
+	}
+
+	// Compositing shows the background through the corners.
+	bg := image.NewRGBA(img.Bounds())
+	draw.Draw(bg, bg.Bounds(), image.NewUniform(color.RGBA{0, 0, 0xff, 0xff}), image.Point{}, draw.Src)
+	draw.Draw(bg, bg.Bounds(), img, image.Point{}, draw.Over)
+	if got, want := bg.RGBAAt(0, 0), (color.RGBA{0, 0, 0xff, 0xff}); got != want {
+		t.Errorf("incorrect composited corner; got = %v, want = %v", got, want)
+	}
+	if got, want := bg.RGBAAt(1, 1), (color.RGBA{0xff, 0xff, 0xff, 0xff}); got != want {
+		t.Errorf("incorrect composited center; got = %v, want = %v", got, want)
+	}
+
+	if _, ok := conn.CursorImage(&Rectangle{Enc: &RawEncoding{}}); ok {
+		t.Error("expected no cursor image for a Raw rectangle")
+	}
+}
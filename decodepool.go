@@ -0,0 +1,176 @@
+// Concurrent decoding of FramebufferUpdate rectangles.
+
+package vnc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/bigangryrobot/go-vnc/encodings"
+)
+
+// decodePool decodes the rectangles of a FramebufferUpdate on a bounded
+// number of goroutines.
+type decodePool struct {
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	mu       sync.Mutex
+	err      error // First decoding error.
+	buffered int   // Bytes of the payloads not yet decoded.
+	peak     int   // The most bytes buffered at once; only set by read.
+}
+
+func newDecodePool(concurrency int) *decodePool {
+	return &decodePool{sem: make(chan struct{}, concurrency)}
+}
+
+// read reads the pixel data of rect, the index-th rectangle of its update,
+// encoded with encImpl. Stateless encodings are read in full and decoded
+// asynchronously; all others are decoded before read returns.
+func (p *decodePool) read(c *ClientConn, index int, rect *Rectangle, encImpl Encoding) error {
+	payload, ok, err := readStatelessPayload(c, rect, encImpl.Type())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return rect.readEncoding(c, encImpl)
+	}
+
+	p.mu.Lock()
+	p.buffered += len(payload)
+	p.peak = max(p.peak, p.buffered)
+	p.mu.Unlock()
+
+	dc := c.decodeConn(payload)
+	p.sem <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			p.mu.Lock()
+			p.buffered -= len(payload)
+			p.mu.Unlock()
+			<-p.sem
+			p.wg.Done()
+		}()
+		if err := rect.readEncoding(dc, encImpl); err != nil {
+			err = truncatedRectangle(index, rect, encImpl.Type(), err)
+			p.mu.Lock()
+			if p.err == nil {
+				p.err = err
+			}
+			p.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// wait blocks until all rectangles have been decoded, returning the first
+// decoding error.
+func (p *decodePool) wait() error {
+	p.wg.Wait()
+	return p.err
+}
+
+// decodeConn returns a ClientConn that reads payload, holding a snapshot of
+// the pixel format and color map of c, for use by Encoding.Read. It has no
+// metrics, since the bytes of payload were counted when read from c.
+func (c *ClientConn) decodeConn(payload []byte) *ClientConn {
+	return &ClientConn{
+		bufr:        bufio.NewReader(bytes.NewReader(payload)),
+		config:      c.config,
+		log:         c.log,
+		colorMap:    slices.Clone(c.colorMap),
+		pixelFormat: c.pixelFormat,
+	}
+}
+
+// readStatelessPayload reads the encoded pixel data of rect without decoding
+// it, for encodings that can be decoded independently of connection state.
+// It returns false if enc is not such an encoding, in which case nothing is
+// read.
+func readStatelessPayload(c *ClientConn, rect *Rectangle, enc encodings.EncodingType) ([]byte, bool, error) {
+	bytesPerPixel := c.pixelFormat.BytesPerPixel()
+	var payload bytes.Buffer
+	read := func(n int) ([]byte, error) {
+		start := payload.Len()
+		if m, err := io.CopyN(&payload, c.bufr, int64(n)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, &PartialReadError{Want: n, Got: int(m), Err: readError(err)}
+		}
+		c.adjustMetric("bytes-received", int64(n))
+		return payload.Bytes()[start:], nil
+	}
+
+	switch enc {
+	case encodings.EncRaw:
+		if _, err := read(rect.Area() * bytesPerPixel); err != nil {
+			return nil, true, err
+		}
+
+	case encodings.EncRRE:
+		header, err := read(4 + bytesPerPixel) // number-of-subrectangles, background
+		if err != nil {
+			return nil, true, err
+		}
+		numSubRects := binary.BigEndian.Uint32(header)
+		if err := checkRRESubRects(numSubRects, rect); err != nil {
+			return nil, true, err
+		}
+		if _, err := read(int(numSubRects) * (bytesPerPixel + 8)); err != nil {
+			return nil, true, err
+		}
+
+	case encodings.EncHextile:
+		for y := 0; y < int(rect.Height); y += 16 {
+			for x := 0; x < int(rect.Width); x += 16 {
+				tileW, tileH := min(16, int(rect.Width)-x), min(16, int(rect.Height)-y)
+				mask, err := read(1)
+				if err != nil {
+					return nil, true, err
+				}
+				if mask[0]&0x01 != 0 { // Raw
+					if _, err := read(tileW * tileH * bytesPerPixel); err != nil {
+						return nil, true, err
+					}
+					continue
+				}
+				n := 0
+				if mask[0]&0x02 != 0 { // BackgroundSpecified
+					n += bytesPerPixel
+				}
+				if mask[0]&0x04 != 0 { // ForegroundSpecified
+					n += bytesPerPixel
+				}
+				if _, err := read(n); err != nil {
+					return nil, true, err
+				}
+				if mask[0]&0x08 == 0 { // AnySubrects
+					continue
+				}
+				count, err := read(1)
+				if err != nil {
+					return nil, true, err
+				}
+				subRectLen := 2
+				if mask[0]&0x10 != 0 { // SubrectsColoured
+					subRectLen += bytesPerPixel
+				}
+				if _, err := read(int(count[0]) * subRectLen); err != nil {
+					return nil, true, err
+				}
+			}
+		}
+
+	default:
+		return nil, false, nil
+	}
+
+	return payload.Bytes(), true, nil
+}
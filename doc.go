@@ -17,7 +17,6 @@ with something more appropriate for your setup.
 
 	  "github.com/bigangryrobot/go-vnc"
 	  "github.com/bigangryrobot/go-vnc/messages"
-	  "github.com/bigangryrobot/go-vnc/rfbflags"
 	)
 
 	func main() {
@@ -27,24 +26,16 @@ with something more appropriate for your setup.
 	    log.Fatalf("Error connecting to VNC host. %v", err)
 	  }
 
-	  // Negotiate connection with the server.
+	  // Negotiate connection with the server. Once connected, the client
+	  // requests a framebuffer update after each one it receives, at most
+	  // once a second.
 	  vcc := vnc.NewClientConfig("some_password")
+	  vcc.MinUpdateInterval = time.Second
 	  vc, err := vnc.Connect(context.Background(), nc, vcc)
 	  if err != nil {
 	    log.Fatalf("Error negotiating connection to VNC host. %v", err)
 	  }
 
-	  // Periodically request framebuffer updates.
-	  go func() {
-	    w, h := vc.FramebufferWidth(), vc.FramebufferHeight()
-	    for {
-	      if err := vc.FramebufferUpdateRequest(rfbflags.RFBTrue, 0, 0, w, h); err != nil {
-	        log.Printf("error requesting framebuffer update: %v", err)
-	      }
-	      time.Sleep(1 * time.Second)
-	    }
-	  }()
-
 	  // Listen and handle server messages.
 	  go vc.ListenAndHandle()
 
@@ -61,7 +52,7 @@ with something more appropriate for your setup.
 	}
 
 This example will connect to a VNC server running on the localhost. It will
-periodically request updates from the server, and listen for and handle
-incoming FramebufferUpdate messages coming from the server.
+request updates from the server, at most once a second, and listen for and
+handle incoming FramebufferUpdate messages coming from the server.
 */
 package vnc
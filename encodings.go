@@ -10,9 +10,16 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"image"
+	"image/jpeg"
 	"io"
+	"math"
+	"slices"
+	"strings"
 
 	"github.com/bigangryrobot/go-vnc/encodings"
+	"github.com/bigangryrobot/go-vnc/go/lzo"
+	"github.com/bigangryrobot/go-vnc/rfbflags"
 )
 
 //=============================================================================
@@ -50,6 +57,64 @@ func (e Encodings) Marshal() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// Contains returns true if e includes an encoding of type t.
+func (e Encodings) Contains(t encodings.EncodingType) bool {
+	return e.index(t) >= 0
+}
+
+// Add appends enc to e, or replaces the encoding of the same type in place,
+// keeping its priority, if e already includes one.
+func (e *Encodings) Add(enc Encoding) {
+	if i := e.index(enc.Type()); i >= 0 {
+		(*e)[i] = enc
+		return
+	}
+	*e = append(*e, enc)
+}
+
+// Remove removes the encoding of type t from e, if any.
+func (e *Encodings) Remove(t encodings.EncodingType) {
+	if i := e.index(t); i >= 0 {
+		*e = slices.Delete(*e, i, i+1)
+	}
+}
+
+// Prioritize moves the encoding of type t, if any, to the front of e, so that
+// the server prefers it, keeping the order of the others.
+func (e *Encodings) Prioritize(t encodings.EncodingType) {
+	if i := e.index(t); i > 0 {
+		enc := (*e)[i]
+		copy((*e)[1:i+1], (*e)[:i])
+		(*e)[0] = enc
+	}
+}
+
+// index returns the index of the encoding of type t in e, or -1.
+func (e Encodings) index(t encodings.EncodingType) int {
+	return slices.IndexFunc(e, func(enc Encoding) bool { return enc.Type() == t })
+}
+
+// decodableEncodings are the encodings sent by servers as rectangles that
+// DecodeEncoding can decode, by type.
+var decodableEncodings = map[encodings.EncodingType]Encoding{
+	encodings.EncRaw:                           &RawEncoding{},
+	encodings.EncCopyRect:                      &CopyRectEncoding{},
+	encodings.EncRRE:                           &RREEncoding{},
+	encodings.EncCoRRE:                         &CoRREEncoding{},
+	encodings.EncHextile:                       &HextileEncoding{},
+	encodings.EncZRLE:                          &ZRLEEncoding{},
+	encodings.EncTight:                         &TightEncoding{},
+	encodings.EncUltra1:                        &UltraEncoding{},
+	encodings.EncUltra2:                        &Ultra2Encoding{},
+	encodings.EncJRLE:                          &JRLEEncoding{},
+	encodings.EncCursorPseudo:                  &CursorPseudoEncoding{},
+	encodings.EncXCursorPseudo:                 &XCursorPseudoEncoding{},
+	encodings.EncDesktopSizePseudo:             &DesktopSizePseudoEncoding{},
+	encodings.EncDesktopNamePseudo:             &DesktopNamePseudoEncoding{},
+	encodings.EncQEMUPointerMotionChangePseudo: &QEMUPointerMotionChangePseudoEncoding{},
+	encodings.EncQEMULEDStatePseudo:            &QEMULEDStatePseudoEncoding{},
+}
+
 //-----------------------------------------------------------------------------
 // Raw Encoding
 //
@@ -68,39 +133,25 @@ var _ Encoding = (*RawEncoding)(nil)
 
 // Marshal implements the Encoding interface.
 func (e *RawEncoding) Marshal() ([]byte, error) {
-	buf := NewBuffer(nil)
-
-	for _, c := range e.Colors {
-		bytes, err := c.Marshal()
-		if err != nil {
-			return nil, err
-		}
-		if err := buf.Write(bytes); err != nil {
-			return nil, err
-		}
-	}
-
-	return buf.Bytes(), nil
+	return marshalColors(e.Colors)
 }
 
 // Read implements the Encoding interface.
 func (*RawEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
-	var buf bytes.Buffer
-	bytesPerPixel := int(c.pixelFormat.BPP / 8)
+	var buf []byte
+	bytesPerPixel := c.pixelFormat.BytesPerPixel()
 	n := rect.Area() * bytesPerPixel
 	if err := c.receiveN(&buf, n); err != nil {
 		return nil, fmt.Errorf("unable to read rectangle with raw encoding: %w", err)
 	}
 
 	colors := make([]Color, rect.Area())
-	for y := uint16(0); y < rect.Height; y++ {
-		for x := uint16(0); x < rect.Width; x++ {
-			color := NewColor(&c.pixelFormat, &c.colorMap)
-			if err := color.Unmarshal(buf.Next(bytesPerPixel)); err != nil {
-				return nil, err
-			}
-			colors[int(y)*int(rect.Width)+int(x)] = *color
+	for i := range colors {
+		color := NewColor(&c.pixelFormat, &c.colorMap)
+		if err := color.Unmarshal(buf[i*bytesPerPixel:]); err != nil {
+			return nil, err
 		}
+		colors[i] = *color
 	}
 
 	return &RawEncoding{colors}, nil
@@ -133,9 +184,15 @@ func (*CopyRectEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error)
 		SrcX uint16
 		SrcY uint16
 	}
-	if err := binary.Read(c.Conn, binary.BigEndian, &msg); err != nil {
+	if err := binary.Read(c.bufr, binary.BigEndian, &msg); err != nil {
 		return nil, fmt.Errorf("failed to read copyrect encoding: %w", err)
 	}
+
+	// The source is copied from the framebuffer, so must lie within it.
+	if int(msg.SrcX)+int(rect.Width) > int(c.fbWidth) || int(msg.SrcY)+int(rect.Height) > int(c.fbHeight) {
+		return nil, fmt.Errorf("copyrect source %dx%d+%d+%d lies outside the %dx%d framebuffer",
+			rect.Width, rect.Height, msg.SrcX, msg.SrcY, c.fbWidth, c.fbHeight)
+	}
 	return &CopyRectEncoding{SrcX: msg.SrcX, SrcY: msg.SrcY}, nil
 }
 
@@ -184,15 +241,19 @@ var _ Encoding = (*RREEncoding)(nil)
 // Read implements the Encoding interface.
 func (*RREEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
 	var numberOfSubRects uint32
-	if err := binary.Read(c.Conn, binary.BigEndian, &numberOfSubRects); err != nil {
+	if err := binary.Read(c.bufr, binary.BigEndian, &numberOfSubRects); err != nil {
 		return nil, fmt.Errorf("RRE: failed to read sub-rectangle count: %w", err)
 	}
 
-	bytesPerPixel := int(c.pixelFormat.BPP / 8)
+	if err := checkRRESubRects(numberOfSubRects, rect); err != nil {
+		return nil, err
+	}
+
+	bytesPerPixel := c.pixelFormat.BytesPerPixel()
 
 	// Read background color
 	bgPixelBytes := make([]byte, bytesPerPixel)
-	if _, err := io.ReadFull(c.Conn, bgPixelBytes); err != nil {
+	if err := c.readFull(bgPixelBytes); err != nil {
 		return nil, fmt.Errorf("RRE: failed to read background color: %w", err)
 	}
 	bgColor := NewColor(&c.pixelFormat, &c.colorMap)
@@ -204,7 +265,7 @@ func (*RREEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
 	subRects := make([]RRESubRect, numberOfSubRects)
 	for i := uint32(0); i < numberOfSubRects; i++ {
 		subRectPixelBytes := make([]byte, bytesPerPixel)
-		if _, err := io.ReadFull(c.Conn, subRectPixelBytes); err != nil {
+		if err := c.readFull(subRectPixelBytes); err != nil {
 			return nil, fmt.Errorf("RRE: failed to read sub-rect color %d: %w", i, err)
 		}
 		subRectColor := NewColor(&c.pixelFormat, &c.colorMap)
@@ -215,7 +276,7 @@ func (*RREEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
 		var subRectGeom struct {
 			X, Y, W, H uint16
 		}
-		if err := binary.Read(c.Conn, binary.BigEndian, &subRectGeom); err != nil {
+		if err := binary.Read(c.bufr, binary.BigEndian, &subRectGeom); err != nil {
 			return nil, fmt.Errorf("RRE: failed to read sub-rect geometry %d: %w", i, err)
 		}
 
@@ -233,6 +294,16 @@ func (*RREEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
 	return &RREEncoding{BackgroundColor: *bgColor, SubRects: subRects}, nil
 }
 
+// checkRRESubRects returns an error if n sub-rectangles exceed the pixels of
+// rect. More can't be told apart, and a large count from the server would
+// cause a large allocation.
+func checkRRESubRects(n uint32, rect *Rectangle) error {
+	if uint64(n) > uint64(rect.Area()) {
+		return fmt.Errorf("RRE: %d sub-rectangles exceed the %d pixels of the rectangle", n, rect.Area())
+	}
+	return nil
+}
+
 // String implements the fmt.Stringer interface.
 func (e *RREEncoding) String() string {
 	return fmt.Sprintf("RREEncoding(%d sub-rects)", len(e.SubRects))
@@ -265,13 +336,128 @@ func (e *RREEncoding) Marshal() ([]byte, error) {
 		if _, err := buf.Write(srColorBytes); err != nil {
 			return nil, err
 		}
-		if err := binary.Write(buf, binary.BigEndian, &sr.Rect); err != nil {
+		geom := [4]uint16{sr.Rect.X, sr.Rect.Y, sr.Rect.Width, sr.Rect.Height}
+		if err := binary.Write(buf, binary.BigEndian, geom); err != nil {
 			return nil, err
 		}
 	}
 	return buf.Bytes(), nil
 }
 
+// -----------------------------------------------------------------------------
+// CoRRE Encoding
+//
+// Compact RRE is RRE with sub-rectangle geometry in single bytes, limiting
+// rectangles to 255x255 pixels.
+//
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#corre-encoding
+type CoRREEncoding struct {
+	BackgroundColor Color
+	SubRects        []RRESubRect
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*CoRREEncoding)(nil)
+
+// Read implements the Encoding interface.
+func (*CoRREEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	var numberOfSubRects uint32
+	if err := binary.Read(c.bufr, binary.BigEndian, &numberOfSubRects); err != nil {
+		return nil, fmt.Errorf("CoRRE: failed to read sub-rectangle count: %w", err)
+	}
+
+	bytesPerPixel := c.pixelFormat.BytesPerPixel()
+	readColor := func() (Color, error) {
+		pixel := make([]byte, bytesPerPixel)
+		if err := c.readFull(pixel); err != nil {
+			return Color{}, err
+		}
+		color := NewColor(&c.pixelFormat, &c.colorMap)
+		if err := color.Unmarshal(pixel); err != nil {
+			return Color{}, err
+		}
+		return *color, nil
+	}
+
+	bgColor, err := readColor()
+	if err != nil {
+		return nil, fmt.Errorf("CoRRE: failed to read background color: %w", err)
+	}
+
+	// Sub-rectangles are appended as they are read, so that a large count
+	// from the server doesn't cause a large allocation.
+	var subRects []RRESubRect
+	for i := uint32(0); i < numberOfSubRects; i++ {
+		color, err := readColor()
+		if err != nil {
+			return nil, fmt.Errorf("CoRRE: failed to read sub-rect color %d: %w", i, err)
+		}
+		var geom [4]uint8
+		if err := c.readFull(geom[:]); err != nil {
+			return nil, fmt.Errorf("CoRRE: failed to read sub-rect geometry %d: %w", i, err)
+		}
+		subRects = append(subRects, RRESubRect{
+			Color: color,
+			Rect: Rectangle{
+				X:      uint16(geom[0]),
+				Y:      uint16(geom[1]),
+				Width:  uint16(geom[2]),
+				Height: uint16(geom[3]),
+			},
+		})
+	}
+
+	return &CoRREEncoding{BackgroundColor: bgColor, SubRects: subRects}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (e *CoRREEncoding) String() string {
+	return fmt.Sprintf("CoRREEncoding(%d sub-rects)", len(e.SubRects))
+}
+
+// Type implements the Encoding interface.
+func (*CoRREEncoding) Type() encodings.EncodingType {
+	return encodings.EncCoRRE
+}
+
+// Marshal implements the Marshaler interface.
+func (e *CoRREEncoding) Marshal() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, uint32(len(e.SubRects))); err != nil {
+		return nil, err
+	}
+	bgBytes, err := e.BackgroundColor.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(bgBytes)
+
+	for _, sr := range e.SubRects {
+		if sr.Rect.X > math.MaxUint8 || sr.Rect.Y > math.MaxUint8 || sr.Rect.Width > math.MaxUint8 || sr.Rect.Height > math.MaxUint8 {
+			return nil, fmt.Errorf("CoRRE: sub-rect %v exceeds 255 pixels", &sr.Rect)
+		}
+		srColorBytes, err := sr.Color.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(srColorBytes)
+		buf.Write([]byte{uint8(sr.Rect.X), uint8(sr.Rect.Y), uint8(sr.Rect.Width), uint8(sr.Rect.Height)})
+	}
+	return buf.Bytes(), nil
+}
+
+// checkSubRects returns an error if any of subRects, whose positions are
+// relative to rect, extends beyond rect.
+func checkSubRects(rect *Rectangle, subRects []RRESubRect) error {
+	for i, sr := range subRects {
+		if int(sr.Rect.X)+int(sr.Rect.Width) > int(rect.Width) || int(sr.Rect.Y)+int(sr.Rect.Height) > int(rect.Height) {
+			return fmt.Errorf("sub-rect %d (%dx%d+%d+%d) extends beyond its %dx%d rectangle",
+				i, sr.Rect.Width, sr.Rect.Height, sr.Rect.X, sr.Rect.Y, rect.Width, rect.Height)
+		}
+	}
+	return nil
+}
+
 // -----------------------------------------------------------------------------
 // Hextile Encoding
 //
@@ -287,6 +473,10 @@ func (*HextileEncoding) Type() encodings.EncodingType { return encodings.EncHext
 func (e *HextileEncoding) String() string {
 	return fmt.Sprintf("HextileEncoding(%d colors)", len(e.Colors))
 }
+
+// Marshal implements the Marshaler interface. It is unsupported: the decoded
+// Colors don't record the tiling and subencodings the server chose, so the
+// encoding can't round-trip.
 func (*HextileEncoding) Marshal() ([]byte, error) {
 	return nil, errors.New("client-side marshalling of HextileEncoding not supported: this is a server-to-client encoding")
 }
@@ -294,7 +484,7 @@ func (*HextileEncoding) Marshal() ([]byte, error) {
 // Read implements the Encoding interface for Hextile.
 func (*HextileEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
 	colors := make([]Color, rect.Area())
-	bytesPerPixel := int(c.pixelFormat.BPP / 8)
+	bytesPerPixel := c.pixelFormat.BytesPerPixel()
 	var backgroundColor, foregroundColor Color
 
 	for y := rect.Y; y < rect.Y+rect.Height; y += 16 {
@@ -310,14 +500,14 @@ func (*HextileEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
 			}
 
 			var subencodingMask byte
-			if err := binary.Read(c.Conn, binary.BigEndian, &subencodingMask); err != nil {
+			if err := binary.Read(c.bufr, binary.BigEndian, &subencodingMask); err != nil {
 				return nil, fmt.Errorf("hextile: error reading subencoding mask: %w", err)
 			}
 
 			isRaw := (subencodingMask & 0x01) != 0
 			if isRaw {
 				rawTileData := make([]byte, int(tileW)*int(tileH)*bytesPerPixel)
-				if _, err := io.ReadFull(c.Conn, rawTileData); err != nil {
+				if err := c.readFull(rawTileData); err != nil {
 					return nil, fmt.Errorf("hextile: failed to read raw tile: %w", err)
 				}
 				buf := bytes.NewBuffer(rawTileData)
@@ -341,7 +531,7 @@ func (*HextileEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
 			backgroundSpecified := (subencodingMask & 0x02) != 0
 			if backgroundSpecified {
 				bgBytes := make([]byte, bytesPerPixel)
-				if _, err := io.ReadFull(c.Conn, bgBytes); err != nil {
+				if err := c.readFull(bgBytes); err != nil {
 					return nil, fmt.Errorf("hextile: failed to read background color: %w", err)
 				}
 				bgColor := NewColor(&c.pixelFormat, &c.colorMap)
@@ -354,7 +544,7 @@ func (*HextileEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
 			foregroundSpecified := (subencodingMask & 0x04) != 0
 			if foregroundSpecified {
 				fgBytes := make([]byte, bytesPerPixel)
-				if _, err := io.ReadFull(c.Conn, fgBytes); err != nil {
+				if err := c.readFull(fgBytes); err != nil {
 					return nil, fmt.Errorf("hextile: failed to read foreground color: %w", err)
 				}
 				fgColor := NewColor(&c.pixelFormat, &c.colorMap)
@@ -379,7 +569,7 @@ func (*HextileEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
 			anySubrects := (subencodingMask & 0x08) != 0
 			if anySubrects {
 				var numberOfSubRects byte
-				if err := binary.Read(c.Conn, binary.BigEndian, &numberOfSubRects); err != nil {
+				if err := binary.Read(c.bufr, binary.BigEndian, &numberOfSubRects); err != nil {
 					return nil, fmt.Errorf("hextile: failed to read sub-rectangle count: %w", err)
 				}
 				subrectsColoured := (subencodingMask & 0x10) != 0
@@ -388,7 +578,7 @@ func (*HextileEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
 					var subRectColor Color
 					if subrectsColoured {
 						srColorBytes := make([]byte, bytesPerPixel)
-						if _, err := io.ReadFull(c.Conn, srColorBytes); err != nil {
+						if err := c.readFull(srColorBytes); err != nil {
 							return nil, fmt.Errorf("hextile: failed to read subrect color: %w", err)
 						}
 						srColor := NewColor(&c.pixelFormat, &c.colorMap)
@@ -401,10 +591,10 @@ func (*HextileEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
 					}
 
 					var xy, wh byte
-					if err := binary.Read(c.Conn, binary.BigEndian, &xy); err != nil {
+					if err := binary.Read(c.bufr, binary.BigEndian, &xy); err != nil {
 						return nil, fmt.Errorf("hextile: failed to read subrect geometry xy: %w", err)
 					}
-					if err := binary.Read(c.Conn, binary.BigEndian, &wh); err != nil {
+					if err := binary.Read(c.bufr, binary.BigEndian, &wh); err != nil {
 						return nil, fmt.Errorf("hextile: failed to read subrect geometry wh: %w", err)
 					}
 
@@ -430,6 +620,55 @@ func (*HextileEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
 	return &HextileEncoding{Colors: colors}, nil
 }
 
+// -----------------------------------------------------------------------------
+// Zlib Errors
+//
+// Tight and ZRLE rectangles carry zlib data preceded by its length. Corrupt
+// data fails the session unless ClientConfig.ZlibErrorPolicy says otherwise.
+
+// ZlibErrorPolicy describes how corrupt zlib data in Tight and ZRLE
+// rectangles is handled.
+type ZlibErrorPolicy int
+
+const (
+	// ZlibErrorFail returns an error, ending the session.
+	ZlibErrorFail ZlibErrorPolicy = iota
+	// ZlibSkipRectangle resets the affected zlib stream, skips the rest of
+	// the rectangle's compressed data, as given by its declared length, and
+	// carries on. The rectangle is delivered without pixel data.
+	ZlibSkipRectangle
+)
+
+// String implements the fmt.Stringer interface.
+func (p ZlibErrorPolicy) String() string {
+	switch p {
+	case ZlibErrorFail:
+		return "fail"
+	case ZlibSkipRectangle:
+		return "skip-rectangle"
+	}
+	return fmt.Sprintf("ZlibErrorPolicy(%d)", int(p))
+}
+
+// zlibError wraps an error decompressing the zlib data of a rectangle.
+type zlibError struct {
+	err error
+}
+
+func (e *zlibError) Error() string { return e.err.Error() }
+func (e *zlibError) Unwrap() error { return e.err }
+
+// skipZlibError returns true if err is a zlibError that the ZlibErrorPolicy
+// of c skips, logging the rectangle skipped.
+func (c *ClientConn) skipZlibError(rect *Rectangle, err error) bool {
+	var zerr *zlibError
+	if c.config.ZlibErrorPolicy != ZlibSkipRectangle || !errors.As(err, &zerr) {
+		return false
+	}
+	c.log.Printf("skipping rectangle %dx%d+%d+%d with corrupt zlib data: %s", rect.Width, rect.Height, rect.X, rect.Y, err)
+	return true
+}
+
 // -----------------------------------------------------------------------------
 // ZRLE Encoding
 //
@@ -438,7 +677,8 @@ func (*HextileEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
 // See RFC 6143 §7.7.6.
 // https://tools.ietf.org/html/rfc6143#section-7.7.6
 type ZRLEEncoding struct {
-	// Data holds the decompressed ZRLE data.
+	// Data holds the decompressed ZRLE data. It is nil for a rectangle
+	// skipped under ZlibSkipRectangle.
 	Data []byte
 }
 
@@ -448,7 +688,7 @@ var _ Encoding = (*ZRLEEncoding)(nil)
 // Read implements the Encoding interface.
 func (*ZRLEEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
 	var dataLen uint32
-	if err := binary.Read(c.Conn, binary.BigEndian, &dataLen); err != nil {
+	if err := binary.Read(c.bufr, binary.BigEndian, &dataLen); err != nil {
 		return nil, fmt.Errorf("ZRLE: failed to read data length: %w", err)
 	}
 
@@ -456,19 +696,39 @@ func (*ZRLEEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
 		return &ZRLEEncoding{Data: []byte{}}, nil
 	}
 
-	compressedDataReader := io.LimitReader(c.Conn, int64(dataLen))
-	zlibReader, err := zlib.NewReader(compressedDataReader)
+	compressedDataReader := io.LimitReader(c.bufr, int64(dataLen))
+	decompressedData, zerr := decompressZRLE(compressedDataReader)
+
+	// Skip any compressed data left after the end of the zlib stream, or
+	// after corrupt data, so that the next message is read from the right
+	// place.
+	if _, err := io.Copy(io.Discard, compressedDataReader); err != nil {
+		return nil, fmt.Errorf("ZRLE: failed to read data: %w", err)
+	}
+	if zerr != nil {
+		if c.skipZlibError(rect, zerr) {
+			return &ZRLEEncoding{}, nil
+		}
+		return nil, fmt.Errorf("ZRLE: %w", zerr)
+	}
+
+	return &ZRLEEncoding{Data: decompressedData}, nil
+}
+
+// decompressZRLE decompresses the zlib data of a ZRLE rectangle from r.
+// Errors are returned as a zlibError.
+func decompressZRLE(r io.Reader) ([]byte, error) {
+	zlibReader, err := zlib.NewReader(r)
 	if err != nil {
-		return nil, fmt.Errorf("ZRLE: failed to create zlib reader: %w", err)
+		return nil, &zlibError{fmt.Errorf("failed to create zlib reader: %w", err)}
 	}
 	defer zlibReader.Close()
 
-	decompressedData, err := io.ReadAll(zlibReader)
+	data, err := io.ReadAll(zlibReader)
 	if err != nil {
-		return nil, fmt.Errorf("ZRLE: failed to decompress data: %w", err)
+		return nil, &zlibError{fmt.Errorf("failed to decompress data: %w", err)}
 	}
-
-	return &ZRLEEncoding{Data: decompressedData}, nil
+	return data, nil
 }
 
 // String implements the fmt.Stringer interface.
@@ -508,6 +768,8 @@ func (e *ZRLEEncoding) Marshal() ([]byte, error) {
 //
 // See RFC 6143 §7.7.7
 type TightEncoding struct {
+	// Data holds the decoded pixel data. It is nil for a rectangle skipped
+	// under ZlibSkipRectangle.
 	Data []byte
 }
 
@@ -516,24 +778,28 @@ var _ Encoding = (*TightEncoding)(nil)
 
 func (*TightEncoding) Type() encodings.EncodingType { return encodings.EncTight }
 func (*TightEncoding) String() string               { return "TightEncoding" }
+
+// Marshal implements the Marshaler interface. It is unsupported: the decoded
+// Data doesn't record the compression control and filters the server chose,
+// and its zlib streams persist across rectangles, so the encoding can't
+// round-trip.
 func (*TightEncoding) Marshal() ([]byte, error) {
 	return nil, errors.New("client-side marshalling of TightEncoding not supported: this is a server-to-client encoding")
 }
 
 // Read implements the Encoding interface for Tight encoding.
 func (e *TightEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	c.resetStaleZlibs()
+
 	var subencoding byte
-	if err := binary.Read(c.Conn, binary.BigEndian, &subencoding); err != nil {
+	if err := binary.Read(c.bufr, binary.BigEndian, &subencoding); err != nil {
 		return nil, fmt.Errorf("tight: failed to read subencoding: %w", err)
 	}
 
 	// Reset zlib streams if necessary
 	for i := 0; i < 4; i++ {
 		if (subencoding>>uint(i))&1 != 0 {
-			if c.zlibs[i] != nil {
-				c.zlibs[i].Close()
-				c.zlibs[i] = nil
-			}
+			c.closeZlib(i)
 		}
 	}
 
@@ -547,7 +813,11 @@ func (e *TightEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
 		return nil, fmt.Errorf("tight: unsupported filter ID: %d", filterID)
 	}
 
-	return e.readTightFilter(c, rect, filterID)
+	enc, err := e.readTightFilter(c, rect, filterID)
+	if err != nil && c.skipZlibError(rect, err) {
+		return &TightEncoding{}, nil
+	}
+	return enc, err
 }
 
 func (e *TightEncoding) readTightFilter(c *ClientConn, rect *Rectangle, filterID byte) (Encoding, error) {
@@ -563,10 +833,9 @@ func (e *TightEncoding) readTightFilter(c *ClientConn, rect *Rectangle, filterID
 }
 
 func (e *TightEncoding) readTightCopy(c *ClientConn, rect *Rectangle) (Encoding, error) {
-	bytesPerPixel := (c.pixelFormat.BPP + 7) / 8
-	uncompressedSize := int(rect.Width) * int(rect.Height) * int(bytesPerPixel)
+	uncompressedSize := rect.Area() * c.pixelFormat.BytesPerPixel()
 
-	data, err := e.readCompressedData(c, 0)
+	data, err := e.readCompressedData(c, 0, uncompressedSize)
 	if err != nil {
 		return nil, fmt.Errorf("tight (copy): %w", err)
 	}
@@ -575,21 +844,21 @@ func (e *TightEncoding) readTightCopy(c *ClientConn, rect *Rectangle) (Encoding,
 		return nil, fmt.Errorf("tight (copy): decompressed data size mismatch (got %d, want %d)", len(data), uncompressedSize)
 	}
 
-	return &TightEncoding{Data: data}, nil
+	return &TightEncoding{Data: bytes.Clone(data)}, nil
 }
 
 func (e *TightEncoding) readTightPalette(c *ClientConn, rect *Rectangle) (Encoding, error) {
 	var paletteSizeMinus1 byte
-	if err := binary.Read(c.Conn, binary.BigEndian, &paletteSizeMinus1); err != nil {
+	if err := binary.Read(c.bufr, binary.BigEndian, &paletteSizeMinus1); err != nil {
 		return nil, fmt.Errorf("tight (palette): failed to read palette size: %w", err)
 	}
 	paletteSize := int(paletteSizeMinus1) + 1
-	bytesPerPixel := int(c.pixelFormat.BPP / 8)
+	bytesPerPixel := c.pixelFormat.BytesPerPixel()
 
 	palette := make([]Color, paletteSize)
 	for i := 0; i < paletteSize; i++ {
 		colorBytes := make([]byte, bytesPerPixel)
-		if _, err := io.ReadFull(c.Conn, colorBytes); err != nil {
+		if err := c.readFull(colorBytes); err != nil {
 			return nil, fmt.Errorf("tight (palette): failed to read color %d: %w", i, err)
 		}
 		color := NewColor(&c.pixelFormat, &c.colorMap)
@@ -599,11 +868,29 @@ func (e *TightEncoding) readTightPalette(c *ClientConn, rect *Rectangle) (Encodi
 		palette[i] = *color
 	}
 
-	data, err := e.readCompressedData(c, 1)
+	// Indices take one bit per pixel, in rows padded to whole bytes, for
+	// palettes of two colors, and a byte per pixel otherwise.
+	maxLen := int(rect.Width) * int(rect.Height)
+	if paletteSize <= 2 {
+		maxLen = (int(rect.Width) + 7) / 8 * int(rect.Height)
+	}
+	data, err := e.readCompressedData(c, 1, maxLen)
 	if err != nil {
 		return nil, fmt.Errorf("tight (palette): %w", err)
 	}
 
+	// Marshal each color once, rather than for every pixel, into a single
+	// buffer.
+	paletteBytes := make([][]byte, paletteSize)
+	paletteBuf := make([]byte, paletteSize*4)
+	for i, color := range palette {
+		n, err := color.MarshalTo(paletteBuf[i*4:])
+		if err != nil {
+			return nil, fmt.Errorf("tight (palette): failed to marshal color from palette: %w", err)
+		}
+		paletteBytes[i] = paletteBuf[i*4 : i*4+n]
+	}
+
 	pixelData := new(bytes.Buffer)
 	expectedSize := int(rect.Width) * int(rect.Height) * bytesPerPixel
 	pixelData.Grow(expectedSize)
@@ -618,11 +905,7 @@ func (e *TightEncoding) readTightPalette(c *ClientConn, rect *Rectangle) (Encodi
 					break
 				}
 				index := (byteVal >> uint(i)) & 1
-				colorBytes, err := palette[index].Marshal()
-				if err != nil {
-					return nil, fmt.Errorf("tight (palette): failed to marshal color from palette: %w", err)
-				}
-				pixelData.Write(colorBytes)
+				pixelData.Write(paletteBytes[index])
 				pixelsWritten++
 			}
 			if pixelsWritten >= totalPixels {
@@ -635,11 +918,7 @@ func (e *TightEncoding) readTightPalette(c *ClientConn, rect *Rectangle) (Encodi
 			if int(index) >= len(palette) {
 				return nil, fmt.Errorf("tight (palette): invalid palette index %d for palette of size %d", index, len(palette))
 			}
-			colorBytes, err := palette[index].Marshal()
-			if err != nil {
-				return nil, fmt.Errorf("tight (palette): failed to marshal color from palette: %w", err)
-			}
-			pixelData.Write(colorBytes)
+			pixelData.Write(paletteBytes[index])
 		}
 	}
 
@@ -650,89 +929,121 @@ func (e *TightEncoding) readTightPalette(c *ClientConn, rect *Rectangle) (Encodi
 	return &TightEncoding{Data: pixelData.Bytes()}, nil
 }
 
+// readTightGradient decodes gradient-filtered data. Each pixel is predicted
+// component-wise from its left, upper and upper-left neighbours, and the
+// correction for each component is carried in a pixel of the connection's
+// pixel format.
 func (e *TightEncoding) readTightGradient(c *ClientConn, rect *Rectangle) (Encoding, error) {
-	bytesPerPixel := int(c.pixelFormat.BPP / 8)
-	if bytesPerPixel != 3 && bytesPerPixel != 4 {
+	pf := c.pixelFormat
+	bytesPerPixel := pf.BytesPerPixel()
+	switch bytesPerPixel {
+	case 1, 2, 4:
+	default:
 		return nil, fmt.Errorf("tight (gradient): unsupported bytesPerPixel: %d", bytesPerPixel)
 	}
 
-	correctionData, err := e.readCompressedData(c, 2)
+	correctionData, err := e.readCompressedData(c, 2, int(rect.Width)*int(rect.Height)*bytesPerPixel)
 	if err != nil {
 		return nil, fmt.Errorf("tight (gradient): %w", err)
 	}
-	correctionReader := bytes.NewReader(correctionData)
-
-	pixelData := make([]byte, int(rect.Width)*int(rect.Height)*bytesPerPixel)
-
-	for y := uint16(0); y < rect.Height; y++ {
-		for x := uint16(0); x < rect.Width; x++ {
-			var p1, p2, p3 [4]byte // R, G, B, (A)
+	width, height := int(rect.Width), int(rect.Height)
+	if got, want := len(correctionData), width*height*bytesPerPixel; got != want {
+		return nil, fmt.Errorf("tight (gradient): decompressed data size mismatch (got %d, want %d)", got, want)
+	}
 
-			// Get pixel to the left (P1)
-			if x > 0 {
-				offset := ((y * rect.Width) + (x - 1)) * uint16(bytesPerPixel)
-				copy(p1[:], pixelData[offset:offset+uint16(bytesPerPixel)])
-			}
-			// Get pixel above (P2)
-			if y > 0 {
-				offset := (((y - 1) * rect.Width) + x) * uint16(bytesPerPixel)
-				copy(p2[:], pixelData[offset:offset+uint16(bytesPerPixel)])
-			}
-			// Get pixel top-left (P3)
-			if x > 0 && y > 0 {
-				offset := (((y - 1) * rect.Width) + (x - 1)) * uint16(bytesPerPixel)
-				copy(p3[:], pixelData[offset:offset+uint16(bytesPerPixel)])
-			}
+	max := [3]int{int(pf.RedMax), int(pf.GreenMax), int(pf.BlueMax)}
+	shift := [3]uint8{pf.RedShift, pf.GreenShift, pf.BlueShift}
 
-			currentPixelOffset := ((y * rect.Width) + x) * uint16(bytesPerPixel)
+	pixelData := make([]byte, len(correctionData))
+	prevRow := make([][3]int, width) // Components of the row above.
+	thisRow := make([][3]int, width)
 
-			for b := 0; b < bytesPerPixel; b++ {
-				pred := int(p1[b]) + int(p2[b]) - int(p3[b])
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			offset := (y*width + x) * bytesPerPixel
+			correction := pf.readPixel(correctionData[offset:])
 
-				// Clamp predictor
+			var pixel uint32
+			for i := range max {
+				// Predict the component from its neighbours, clamped to its range.
+				pred := prevRow[x][i]
+				if x > 0 {
+					pred += thisRow[x-1][i] - prevRow[x-1][i]
+				}
 				if pred < 0 {
 					pred = 0
 				}
-				if pred > 255 {
-					pred = 255
+				if pred > max[i] {
+					pred = max[i]
 				}
 
-				correction, err := correctionReader.ReadByte()
-				if err != nil {
-					return nil, fmt.Errorf("tight (gradient): failed to read correction byte: %w", err)
-				}
-
-				pixelData[currentPixelOffset+uint16(b)] = byte(pred) + correction
+				v := (pred + int(correction>>shift[i])&max[i]) & max[i]
+				thisRow[x][i] = v
+				pixel |= uint32(v) << shift[i]
 			}
+			pf.writePixel(pixelData[offset:], pixel)
 		}
+		prevRow, thisRow = thisRow, prevRow
 	}
 
 	return &TightEncoding{Data: pixelData}, nil
 }
 
-// readCompressedData reads a compact length, then that many bytes of zlib data.
-func (e *TightEncoding) readCompressedData(c *ClientConn, zlibStream int) ([]byte, error) {
-	// Read compact length
+// readCompressedData reads a compact length, then that many bytes of zlib
+// data, and decompresses them with the given stream. At most maxLen bytes of
+// decompressed data are accepted. The returned slice is a buffer of the
+// connection that is reused by the next rectangle using the same stream.
+//
+// Errors decompressing the data, which has then been read in full, are
+// returned as a zlibError, and reset the stream, whose state is unusable.
+func (e *TightEncoding) readCompressedData(c *ClientConn, zlibStream int, maxLen int) ([]byte, error) {
+	length, err := readCompactLength(c.bufr)
+	if err != nil {
+		return nil, err
+	}
+
+	if length == 0 {
+		return []byte{}, nil
+	}
+
+	if cap(c.tightCompressed) < length {
+		c.tightCompressed = make([]byte, length)
+	}
+	compressedData := c.tightCompressed[:length]
+	if err := c.readFull(compressedData); err != nil {
+		return nil, fmt.Errorf("failed to read compressed data: %w", err)
+	}
+
+	buf, err := c.decompressTight(zlibStream, compressedData, maxLen)
+	if err != nil {
+		c.closeZlib(zlibStream)
+		return nil, &zlibError{err}
+	}
+	return buf, nil
+}
+
+// readCompactLength reads a length in the compact representation of Tight,
+// of one to three bytes holding seven bits each, least significant first.
+func readCompactLength(r io.Reader) (int, error) {
 	var length int
 	for i := 0; i < 3; i++ {
 		var part byte
-		if err := binary.Read(c.Conn, binary.BigEndian, &part); err != nil {
-			return nil, fmt.Errorf("failed to read compact length part %d: %w", i, err)
+		if err := binary.Read(r, binary.BigEndian, &part); err != nil {
+			return 0, fmt.Errorf("failed to read compact length part %d: %w", i, err)
 		}
 		length |= int(part&0x7F) << (i * 7)
 		if (part & 0x80) == 0 {
 			break
 		}
 	}
+	return length, nil
+}
 
-	if length == 0 {
-		return []byte{}, nil
-	}
-
-	compressedData := make([]byte, length)
-	if _, err := io.ReadFull(c.Conn, compressedData); err != nil {
-		return nil, fmt.Errorf("failed to read compressed data: %w", err)
-	}
+// decompressTight decompresses compressedData with the given Tight zlib
+// stream, into the buffer of the stream.
+func (c *ClientConn) decompressTight(zlibStream int, compressedData []byte, maxLen int) ([]byte, error) {
+	c.zlibsMu.Lock()
+	defer c.zlibsMu.Unlock()
 
 	// Initialize zlib reader if it's the first time
 	if c.zlibs[zlibStream] == nil {
@@ -749,12 +1060,293 @@ func (e *TightEncoding) readCompressedData(c *ClientConn, zlibStream int) ([]byt
 		}
 	}
 
-	decompressed, err := io.ReadAll(c.zlibs[zlibStream])
-	if err != nil && err != io.EOF {
-		return nil, fmt.Errorf("failed to decompress data: %w", err)
+	// Decompress into the buffer of the stream, growing it as needed, and
+	// reading one byte beyond maxLen to detect oversized data.
+	buf := c.zlibBufs[zlibStream][:0]
+	for {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+		end := cap(buf)
+		if end > maxLen+1 {
+			end = maxLen + 1
+		}
+		n, err := c.zlibs[zlibStream].Read(buf[len(buf):end])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress data: %w", err)
+		}
+		if len(buf) > maxLen {
+			return nil, fmt.Errorf("decompressed data exceeds %d bytes", maxLen)
+		}
+	}
+	c.zlibBufs[zlibStream] = buf
+
+	return buf, nil
+}
+
+// -----------------------------------------------------------------------------
+// Ultra Encodings
+//
+// UltraVNC's Ultra encoding sends the raw pixel data of a rectangle
+// compressed with LZO1X, preceded by the length of the compressed data. The
+// Ultra2 encoding is framed the same way, but its compressed data isn't
+// decoded; it is kept as-is so that sessions survive servers that use it.
+//
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#ultra-encoding
+
+// UltraEncoding holds the pixel data of an Ultra encoded rectangle.
+type UltraEncoding struct {
+	Colors []Color
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*UltraEncoding)(nil)
+
+// readUltraData reads the length-prefixed compressed data of an Ultra or
+// Ultra2 encoded rectangle, rejecting lengths beyond the worst-case LZO
+// expansion of the rectangle's raw pixel data.
+func readUltraData(c *ClientConn, rect *Rectangle) ([]byte, error) {
+	var length uint32
+	if err := c.receive(&length); err != nil {
+		return nil, fmt.Errorf("ultra: failed to read data length: %w", err)
+	}
+	rawLen := rect.Area() * c.pixelFormat.BytesPerPixel()
+	if max := rawLen + rawLen/16 + 64 + 3; int64(length) > int64(max) {
+		return nil, fmt.Errorf("ultra: data length %d exceeds %d for a %dx%d rectangle", length, max, rect.Width, rect.Height)
+	}
+	data := make([]byte, length)
+	if err := c.readFull(data); err != nil {
+		return nil, fmt.Errorf("ultra: failed to read data: %w", err)
+	}
+	c.adjustMetric("bytes-received", int64(length))
+	return data, nil
+}
+
+// Read implements the Encoding interface.
+func (*UltraEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	data, err := readUltraData(c, rect)
+	if err != nil {
+		return nil, err
+	}
+	bytesPerPixel := c.pixelFormat.BytesPerPixel()
+	pixels, err := lzo.Decompress1X(data, rect.Area()*bytesPerPixel)
+	if err != nil {
+		return nil, fmt.Errorf("ultra: failed to decompress data: %w", err)
+	}
+
+	colors := make([]Color, rect.Area())
+	for i := range colors {
+		color := NewColor(&c.pixelFormat, &c.colorMap)
+		if err := color.Unmarshal(pixels[i*bytesPerPixel : (i+1)*bytesPerPixel]); err != nil {
+			return nil, err
+		}
+		colors[i] = *color
+	}
+	return &UltraEncoding{colors}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (e *UltraEncoding) String() string {
+	return fmt.Sprintf("UltraEncoding(%d colors)", len(e.Colors))
+}
+
+// Type implements the Encoding interface.
+func (*UltraEncoding) Type() encodings.EncodingType { return encodings.EncUltra1 }
+
+// Marshal implements the Marshaler interface. It is unsupported, as no LZO
+// compressor is available.
+func (*UltraEncoding) Marshal() ([]byte, error) {
+	return nil, errors.New("marshalling of UltraEncoding not supported: LZO compression is unavailable")
+}
+
+// Ultra2Encoding holds the undecoded data of an Ultra2 encoded rectangle.
+type Ultra2Encoding struct {
+	// Data holds the compressed data, sans length.
+	Data []byte
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*Ultra2Encoding)(nil)
+
+// Read implements the Encoding interface.
+func (*Ultra2Encoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	data, err := readUltraData(c, rect)
+	if err != nil {
+		return nil, err
 	}
+	return &Ultra2Encoding{data}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (e *Ultra2Encoding) String() string {
+	return fmt.Sprintf("Ultra2Encoding(%d bytes compressed)", len(e.Data))
+}
 
-	return decompressed, nil
+// Type implements the Encoding interface.
+func (*Ultra2Encoding) Type() encodings.EncodingType { return encodings.EncUltra2 }
+
+// Marshal implements the Marshaler interface.
+func (e *Ultra2Encoding) Marshal() ([]byte, error) {
+	buf := NewBuffer(nil)
+	if err := buf.Write(uint32(len(e.Data))); err != nil {
+		return nil, err
+	}
+	if err := buf.Write(e.Data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//-----------------------------------------------------------------------------
+// JRLE Encoding
+//
+// TurboVNC's JPEG Run-Length Encoding divides a rectangle into tiles of
+// 64x64 pixels, left to right and top to bottom, the last of each row and
+// column being smaller if need be. Each tile starts with a subencoding byte:
+//
+//	0: RLE. Runs of a pixel value, in the pixel format, followed by its
+//	   run length less one, as a sum of bytes ending with the first that
+//	   is not 255, as in ZRLE, until the tile is filled.
+//	1: JPEG. A compact length, as in Tight, followed by that many bytes of
+//	   a JPEG image of the tile. It requires a true-color pixel format.
+
+// jrleTileSize is the width and height of JRLE tiles.
+const jrleTileSize = 64
+
+// Subencodings of JRLE tiles.
+const (
+	jrleRLE  = 0
+	jrleJPEG = 1
+)
+
+// JRLEEncoding holds the pixel data of a JRLE encoded rectangle.
+type JRLEEncoding struct {
+	Colors []Color
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*JRLEEncoding)(nil)
+
+// Read implements the Encoding interface.
+func (*JRLEEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	colors := make([]Color, rect.Area())
+	for ty := 0; ty < int(rect.Height); ty += jrleTileSize {
+		for tx := 0; tx < int(rect.Width); tx += jrleTileSize {
+			tile := image.Rect(tx, ty, min(tx+jrleTileSize, int(rect.Width)), min(ty+jrleTileSize, int(rect.Height)))
+			var subencoding byte
+			if err := c.receive(&subencoding); err != nil {
+				return nil, fmt.Errorf("jrle: failed to read subencoding: %w", err)
+			}
+			var err error
+			switch subencoding {
+			case jrleRLE:
+				err = readJRLERuns(c, tile, int(rect.Width), colors)
+			case jrleJPEG:
+				err = readJRLEJPEG(c, tile, int(rect.Width), colors)
+			default:
+				err = fmt.Errorf("unsupported subencoding %d", subencoding)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("jrle: tile at (%d, %d): %w", tx, ty, err)
+			}
+		}
+	}
+	return &JRLEEncoding{colors}, nil
+}
+
+// readJRLERuns reads the runs of an RLE tile into the pixels of tile within
+// colors, a rectangle of the given width.
+func readJRLERuns(c *ClientConn, tile image.Rectangle, width int, colors []Color) error {
+	bytesPerPixel := c.pixelFormat.BytesPerPixel()
+	pixel := make([]byte, bytesPerPixel)
+	tileW := tile.Dx()
+	received := 0
+	defer func() { c.adjustMetric("bytes-received", int64(received)) }()
+	for i, n := 0, tile.Dx()*tile.Dy(); i < n; {
+		received += bytesPerPixel
+		if err := c.readFull(pixel); err != nil {
+			return fmt.Errorf("failed to read run pixel: %w", err)
+		}
+		color := NewColor(&c.pixelFormat, &c.colorMap)
+		if err := color.Unmarshal(pixel); err != nil {
+			return err
+		}
+		run := 1
+		for {
+			var b byte
+			if err := binary.Read(c.bufr, binary.BigEndian, &b); err != nil {
+				return fmt.Errorf("failed to read run length: %w", err)
+			}
+			received++
+			run += int(b)
+			if b != 255 {
+				break
+			}
+		}
+		if run > n-i {
+			return fmt.Errorf("run of %d pixels exceeds the %d left in the tile", run, n-i)
+		}
+		for ; run > 0; run, i = run-1, i+1 {
+			colors[(tile.Min.Y+i/tileW)*width+tile.Min.X+i%tileW] = *color
+		}
+	}
+	return nil
+}
+
+// readJRLEJPEG reads the JPEG image of a tile into the pixels of tile within
+// colors, a rectangle of the given width.
+func readJRLEJPEG(c *ClientConn, tile image.Rectangle, width int, colors []Color) error {
+	pf := c.pixelFormat
+	if !rfbflags.IsTrueColor(pf.TrueColor) {
+		return errors.New("JPEG tile requires a true-color pixel format")
+	}
+	length, err := readCompactLength(c.bufr)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, length)
+	if err := c.readFull(data); err != nil {
+		return fmt.Errorf("failed to read JPEG data: %w", err)
+	}
+	c.adjustMetric("bytes-received", int64(length))
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to decode JPEG data: %w", err)
+	}
+	b := img.Bounds()
+	if b.Dx() != tile.Dx() || b.Dy() != tile.Dy() {
+		return fmt.Errorf("JPEG image of %dx%d doesn't match the %dx%d tile", b.Dx(), b.Dy(), tile.Dx(), tile.Dy())
+	}
+	scale := func(v uint32, max uint16) uint16 { return uint16(v * uint32(max) / 0xffff) }
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			color := NewColor(&c.pixelFormat, &c.colorMap)
+			color.R, color.G, color.B = scale(r, pf.RedMax), scale(g, pf.GreenMax), scale(bl, pf.BlueMax)
+			colors[(tile.Min.Y+y)*width+tile.Min.X+x] = *color
+		}
+	}
+	return nil
+}
+
+// String implements the fmt.Stringer interface.
+func (e *JRLEEncoding) String() string {
+	return fmt.Sprintf("JRLEEncoding(%d colors)", len(e.Colors))
+}
+
+// Type implements the Encoding interface.
+func (*JRLEEncoding) Type() encodings.EncodingType { return encodings.EncJRLE }
+
+// Marshal implements the Marshaler interface. It is unsupported: the decoded
+// Colors don't record the tiling the server chose, and JPEG tiles are lossy,
+// so the encoding can't round-trip.
+func (*JRLEEncoding) Marshal() ([]byte, error) {
+	return nil, errors.New("client-side marshalling of JRLEEncoding not supported: this is a server-to-client encoding")
 }
 
 //=============================================================================
@@ -784,18 +1376,18 @@ var _ Encoding = (*CursorPseudoEncoding)(nil)
 
 // Read implements the Encoding interface.
 func (*CursorPseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
-	bytesPerPixel := int(c.pixelFormat.BPP / 8)
+	bytesPerPixel := c.pixelFormat.BytesPerPixel()
 	area := int(rect.Width) * int(rect.Height)
 	pixelDataSize := area * bytesPerPixel
 	bitmaskSize := (int(rect.Width) + 7) / 8 * int(rect.Height)
 
 	pixels := make([]byte, pixelDataSize)
-	if _, err := io.ReadFull(c.Conn, pixels); err != nil {
+	if err := c.readFull(pixels); err != nil {
 		return nil, fmt.Errorf("failed to read cursor pixel data: %w", err)
 	}
 
 	bitmask := make([]byte, bitmaskSize)
-	if _, err := io.ReadFull(c.Conn, bitmask); err != nil {
+	if err := c.readFull(bitmask); err != nil {
 		return nil, fmt.Errorf("failed to read cursor bitmask data: %w", err)
 	}
 
@@ -824,6 +1416,75 @@ func (e *CursorPseudoEncoding) Marshal() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+//-----------------------------------------------------------------------------
+// XCursor Pseudo-Encoding
+//
+// Used to transmit the shape of the remote cursor as a two-color bitmap. The
+// rectangle of the update defines the hotspot of the cursor. A cursor of zero
+// size hides the cursor, and carries no data.
+//
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#x-cursor-pseudo-encoding
+
+// XCursorPseudoEncoding represents an X cursor shape sent by the server.
+type XCursorPseudoEncoding struct {
+	Primary, Secondary [3]uint8 // RGB of the pixels set and unset in Bitmap.
+	Bitmap             []byte   // Color of each pixel, one bit per pixel.
+	Bitmask            []byte   // Bitmask of the visible pixels, one bit per pixel.
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*XCursorPseudoEncoding)(nil)
+
+// Read implements the Encoding interface.
+func (*XCursorPseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	if rect.Area() == 0 {
+		return &XCursorPseudoEncoding{}, nil
+	}
+
+	var colors [6]uint8
+	if err := c.readFull(colors[:]); err != nil {
+		return nil, fmt.Errorf("failed to read X cursor colors: %w", err)
+	}
+
+	bitmaskSize := (int(rect.Width) + 7) / 8 * int(rect.Height)
+	bitmap := make([]byte, bitmaskSize)
+	if err := c.readFull(bitmap); err != nil {
+		return nil, fmt.Errorf("failed to read X cursor bitmap: %w", err)
+	}
+	bitmask := make([]byte, bitmaskSize)
+	if err := c.readFull(bitmask); err != nil {
+		return nil, fmt.Errorf("failed to read X cursor bitmask: %w", err)
+	}
+
+	return &XCursorPseudoEncoding{
+		Primary:   [3]uint8{colors[0], colors[1], colors[2]},
+		Secondary: [3]uint8{colors[3], colors[4], colors[5]},
+		Bitmap:    bitmap,
+		Bitmask:   bitmask,
+	}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (*XCursorPseudoEncoding) String() string { return "XCursorPseudoEncoding" }
+
+// Type implements the Encoding interface.
+func (*XCursorPseudoEncoding) Type() encodings.EncodingType {
+	return encodings.EncXCursorPseudo
+}
+
+// Marshal implements the Marshaler interface.
+func (e *XCursorPseudoEncoding) Marshal() ([]byte, error) {
+	if len(e.Bitmap) == 0 && len(e.Bitmask) == 0 {
+		return []byte{}, nil
+	}
+	buf := new(bytes.Buffer)
+	buf.Write(e.Primary[:])
+	buf.Write(e.Secondary[:])
+	buf.Write(e.Bitmap)
+	buf.Write(e.Bitmask)
+	return buf.Bytes(), nil
+}
+
 //-----------------------------------------------------------------------------
 // DesktopSize Pseudo-Encoding
 //
@@ -847,8 +1508,7 @@ func (*DesktopSizePseudoEncoding) Marshal() ([]byte, error) {
 
 // Read implements the Encoding interface.
 func (*DesktopSizePseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
-	c.fbWidth = rect.Width
-	c.fbHeight = rect.Height
+	c.setFramebufferSize(rect.Width, rect.Height)
 
 	return &DesktopSizePseudoEncoding{}, nil
 }
@@ -860,3 +1520,350 @@ func (*DesktopSizePseudoEncoding) String() string { return "DesktopSizePseudoEnc
 func (*DesktopSizePseudoEncoding) Type() encodings.EncodingType {
 	return encodings.EncDesktopSizePseudo
 }
+
+//-----------------------------------------------------------------------------
+// DesktopName Pseudo-Encoding
+//
+// A client advertising this pseudo-encoding can handle changes to the desktop
+// name, which the server sends as a rectangle holding the new name, prefixed
+// by its length. The geometry of the rectangle, often zero, is ignored: no
+// pixel data follows, and the framebuffer is left as is.
+//
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#desktopname-pseudo-encoding
+
+// DesktopNamePseudoEncoding represents a desktop name message from the
+// server.
+type DesktopNamePseudoEncoding struct {
+	Name []byte // The name, as sent; see ClientConfig.NameCharset.
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*DesktopNamePseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (e *DesktopNamePseudoEncoding) Marshal() ([]byte, error) {
+	buf := NewBuffer(nil)
+	if err := buf.Write(uint32(len(e.Name))); err != nil {
+		return nil, err
+	}
+	if err := buf.Write(e.Name); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Read implements the Encoding interface.
+func (*DesktopNamePseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	var length uint32
+	if err := c.receive(&length); err != nil {
+		return nil, err
+	}
+	name, err := c.readDesktopName(length)
+	if err != nil {
+		return nil, err
+	}
+	c.setDesktopNameBytes(name)
+
+	return &DesktopNamePseudoEncoding{name}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (*DesktopNamePseudoEncoding) String() string { return "DesktopNamePseudoEncoding" }
+
+// Type implements the Encoding interface.
+func (*DesktopNamePseudoEncoding) Type() encodings.EncodingType {
+	return encodings.EncDesktopNamePseudo
+}
+
+//-----------------------------------------------------------------------------
+// QEMU Pointer Motion Change Pseudo-Encoding
+//
+// The server sends this pseudo-encoding to tell the client whether pointer
+// events should carry absolute positions or relative motion. An x-position
+// of 0 requests relative motion, and 1 absolute positions.
+//
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#qemu-pointer-motion-change-pseudo-encoding
+
+// QEMUPointerMotionChangePseudoEncoding represents a pointer motion change
+// message from the server.
+type QEMUPointerMotionChangePseudoEncoding struct {
+	Mode PointerMode
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*QEMUPointerMotionChangePseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*QEMUPointerMotionChangePseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (*QEMUPointerMotionChangePseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	mode := PointerAbsolute
+	if rect.X == 0 {
+		mode = PointerRelative
+	}
+	c.pointerMode.Store(int32(mode))
+
+	return &QEMUPointerMotionChangePseudoEncoding{mode}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (e *QEMUPointerMotionChangePseudoEncoding) String() string {
+	return fmt.Sprintf("QEMUPointerMotionChangePseudoEncoding(%v)", e.Mode)
+}
+
+// Type implements the Encoding interface.
+func (*QEMUPointerMotionChangePseudoEncoding) Type() encodings.EncodingType {
+	return encodings.EncQEMUPointerMotionChangePseudo
+}
+
+//-----------------------------------------------------------------------------
+// QEMU LED State Pseudo-Encoding
+//
+// The server sends this pseudo-encoding when the state of the keyboard LEDs
+// changes, as a rectangle holding a single byte of LEDFlags, so that the
+// client can keep its lock keys in sync with the remote ones.
+//
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#qemu-led-state-pseudo-encoding
+
+// LEDFlags is the state of the keyboard LEDs, as sent by the server.
+type LEDFlags uint8
+
+const (
+	LEDScrollLock LEDFlags = 1 << iota
+	LEDNumLock
+	LEDCapsLock
+)
+
+// String implements the fmt.Stringer interface.
+func (f LEDFlags) String() string {
+	var names []string
+	for _, led := range []struct {
+		flag LEDFlags
+		name string
+	}{{LEDScrollLock, "ScrollLock"}, {LEDNumLock, "NumLock"}, {LEDCapsLock, "CapsLock"}} {
+		if f&led.flag != 0 {
+			names = append(names, led.name)
+			f &^= led.flag
+		}
+	}
+	if f != 0 {
+		names = append(names, fmt.Sprintf("LEDFlags(%#x)", uint8(f)))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// QEMULEDStatePseudoEncoding represents a LED state message from the server.
+type QEMULEDStatePseudoEncoding struct {
+	State LEDFlags
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*QEMULEDStatePseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (e *QEMULEDStatePseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{byte(e.State)}, nil
+}
+
+// Read implements the Encoding interface.
+func (*QEMULEDStatePseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	var state LEDFlags
+	if err := c.receive(&state); err != nil {
+		return nil, err
+	}
+	c.ledState.Store(uint32(state))
+
+	return &QEMULEDStatePseudoEncoding{state}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (e *QEMULEDStatePseudoEncoding) String() string {
+	return fmt.Sprintf("QEMULEDStatePseudoEncoding(%v)", e.State)
+}
+
+// Type implements the Encoding interface.
+func (*QEMULEDStatePseudoEncoding) Type() encodings.EncodingType {
+	return encodings.EncQEMULEDStatePseudo
+}
+
+//-----------------------------------------------------------------------------
+// Extended Clipboard Pseudo-Encoding
+//
+// A client advertises this pseudo-encoding to allow the server to send
+// ServerCutText messages in the Extended Clipboard format. The server never
+// sends it as a rectangle.
+//
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#extended-clipboard-pseudo-encoding
+
+// ExtendedClipboardPseudoEncoding represents the Extended Clipboard
+// pseudo-encoding.
+type ExtendedClipboardPseudoEncoding struct{}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*ExtendedClipboardPseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*ExtendedClipboardPseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (*ExtendedClipboardPseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	return &ExtendedClipboardPseudoEncoding{}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (*ExtendedClipboardPseudoEncoding) String() string { return "ExtendedClipboardPseudoEncoding" }
+
+// Type implements the Encoding interface.
+func (*ExtendedClipboardPseudoEncoding) Type() encodings.EncodingType {
+	return encodings.EncExtendedClipboardPseudo
+}
+
+//-----------------------------------------------------------------------------
+// Fence Pseudo-Encoding
+//
+// A client advertises this pseudo-encoding to tell the server that it
+// supports Fence messages. The server never sends it as a rectangle.
+//
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#fence-pseudo-encoding
+
+// FencePseudoEncoding represents the Fence pseudo-encoding.
+type FencePseudoEncoding struct{}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*FencePseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*FencePseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (*FencePseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	return &FencePseudoEncoding{}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (*FencePseudoEncoding) String() string { return "FencePseudoEncoding" }
+
+// Type implements the Encoding interface.
+func (*FencePseudoEncoding) Type() encodings.EncodingType {
+	return encodings.EncFencePseudo
+}
+
+//-----------------------------------------------------------------------------
+// ContinuousUpdates Pseudo-Encoding
+//
+// A client advertises this pseudo-encoding to tell the server that it
+// supports continuous updates. A server supporting them replies with an
+// EndOfContinuousUpdates message. The server never sends it as a rectangle.
+//
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#continuousupdates-pseudo-encoding
+
+// ContinuousUpdatesPseudoEncoding represents the ContinuousUpdates
+// pseudo-encoding.
+type ContinuousUpdatesPseudoEncoding struct{}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*ContinuousUpdatesPseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*ContinuousUpdatesPseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (*ContinuousUpdatesPseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	return &ContinuousUpdatesPseudoEncoding{}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (*ContinuousUpdatesPseudoEncoding) String() string { return "ContinuousUpdatesPseudoEncoding" }
+
+// Type implements the Encoding interface.
+func (*ContinuousUpdatesPseudoEncoding) Type() encodings.EncodingType {
+	return encodings.EncContinuousUpdatesPseudo
+}
+
+//-----------------------------------------------------------------------------
+// Compression Level Pseudo-Encoding
+//
+// A client advertises one of these pseudo-encodings to tell the server how
+// hard to compress the pixel data of compressed encodings, such as Tight and
+// ZRLE. The server never sends it.
+//
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#compression-level-pseudo-encoding
+
+// CompressionLevelPseudoEncoding represents a compression level requested by
+// the client. Level ranges from 0, the fastest, to 9, the best compression.
+type CompressionLevelPseudoEncoding struct {
+	Level int
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*CompressionLevelPseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*CompressionLevelPseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (e *CompressionLevelPseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	return &CompressionLevelPseudoEncoding{e.Level}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (e *CompressionLevelPseudoEncoding) String() string {
+	return fmt.Sprintf("CompressionLevelPseudoEncoding(%d)", e.Level)
+}
+
+// Type implements the Encoding interface.
+func (e *CompressionLevelPseudoEncoding) Type() encodings.EncodingType {
+	return encodings.EncCompressionLevel1 + encodings.EncodingType(e.Level)
+}
+
+//-----------------------------------------------------------------------------
+// JPEG Quality Level Pseudo-Encoding
+//
+// A client advertises one of these pseudo-encodings to tell the server the
+// quality of the JPEG images it may send, e.g. within Tight rectangles. The
+// server never sends it.
+//
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#jpeg-quality-level-pseudo-encoding
+
+// JPEGQualityPseudoEncoding represents a JPEG quality level requested by the
+// client. Level ranges from 0, the lowest quality, to 9, the highest.
+type JPEGQualityPseudoEncoding struct {
+	Level int
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*JPEGQualityPseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*JPEGQualityPseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (e *JPEGQualityPseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	return &JPEGQualityPseudoEncoding{e.Level}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (e *JPEGQualityPseudoEncoding) String() string {
+	return fmt.Sprintf("JPEGQualityPseudoEncoding(%d)", e.Level)
+}
+
+// Type implements the Encoding interface.
+func (e *JPEGQualityPseudoEncoding) Type() encodings.EncodingType {
+	return encodings.EncJPEGQualityLevelPseudo1 + encodings.EncodingType(e.Level)
+}
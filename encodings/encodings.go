@@ -52,6 +52,7 @@ const (
 	// QEMU specific
 	EncQEMUPointerMotionChangePseudo EncodingType = -257
 	EncQEMUExtendedKeyEventPseudo    EncodingType = -258
+	EncQEMULEDStatePseudo            EncodingType = -261
 
 	// Compression Level Pseudo Encodings
 	EncCompressionLevel1  EncodingType = -256
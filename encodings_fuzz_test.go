@@ -0,0 +1,92 @@
+package vnc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"testing"
+)
+
+// fuzzEncoding feeds arbitrary data to e.Read as the pixel data of a
+// rectangle of arbitrary size, using roundTripFormat. Read may return an
+// error, but must not panic.
+func fuzzEncoding(f *testing.F, e Encoding, seeds ...[]byte) {
+	for _, seed := range seeds {
+		f.Add(uint8(2), uint8(2), seed)
+	}
+	f.Fuzz(func(t *testing.T, width, height uint8, data []byte) {
+		conn := roundTripConn(data)
+		e.Read(conn, &Rectangle{Width: uint16(width), Height: uint16(height)})
+	})
+}
+
+// zlibCompress returns data compressed with zlib.
+func zlibCompress(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func FuzzRawEncoding(f *testing.F) {
+	fuzzEncoding(f, &RawEncoding{},
+		nil,
+		bytes.Repeat([]byte{0, 1, 2, 3}, 2*2),
+	)
+}
+
+func FuzzRREEncoding(f *testing.F) {
+	fuzzEncoding(f, &RREEncoding{},
+		// Background and a subrectangle.
+		[]byte{0, 0, 0, 1, 0, 1, 2, 3, 0, 4, 5, 6, 0, 0, 0, 0, 0, 1, 0, 1},
+		// A count far beyond the pixels of the rectangle.
+		[]byte{0xff, 0xff, 0xff, 0xff, 0, 1, 2, 3},
+	)
+}
+
+func FuzzHextileEncoding(f *testing.F) {
+	fuzzEncoding(f, &HextileEncoding{},
+		// Raw tile.
+		append([]byte{0x01}, bytes.Repeat([]byte{0, 1, 2, 3}, 2*2)...),
+		// Background, foreground and a subrectangle.
+		[]byte{0x02 | 0x04 | 0x08, 0, 1, 2, 3, 0, 4, 5, 6, 1, 0x00, 0x11},
+		// Colored subrectangles.
+		[]byte{0x02 | 0x08 | 0x10, 0, 1, 2, 3, 2, 0, 4, 5, 6, 0x00, 0x00, 0, 7, 8, 9, 0x11, 0x00},
+	)
+}
+
+func FuzzTightEncoding(f *testing.F) {
+	pixels := bytes.Repeat([]byte{0, 1, 2, 3}, 2*2)
+	var copyFilter bytes.Buffer
+	writeTightCopyRect(&copyFilter, pixels)
+
+	// compressed returns a compact length followed by data compressed with zlib.
+	compressed := func(data []byte) []byte {
+		z := zlibCompress(data)
+		return append(tightCompactLength(len(z)), z...)
+	}
+	palette := []byte{0x10, 1, 0, 1, 2, 3, 0, 4, 5, 6} // palette filter, 2 colors
+	palette = append(palette, compressed([]byte{0x40, 0x80})...)
+	gradient := append([]byte{0x20}, compressed(pixels)...)
+
+	fuzzEncoding(f, &TightEncoding{},
+		copyFilter.Bytes(),
+		palette,
+		gradient,
+		[]byte{0x80}, // JPEG
+	)
+}
+
+func FuzzZRLEEncoding(f *testing.F) {
+	tile := append([]byte{0}, bytes.Repeat([]byte{1, 2, 3}, 2*2)...) // raw tile
+	compressed := zlibCompress(tile)
+	var zrle bytes.Buffer
+	binary.Write(&zrle, binary.BigEndian, uint32(len(compressed)))
+	zrle.Write(compressed)
+
+	fuzzEncoding(f, &ZRLEEncoding{},
+		zrle.Bytes(),
+		[]byte{0, 0, 0, 0},
+	)
+}
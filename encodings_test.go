@@ -3,10 +3,22 @@ package vnc
 // TODO(kward): Fully test the encodings.
 
 import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"reflect"
+	"slices"
 	"testing"
 
 	"github.com/bigangryrobot/go-vnc/encodings"
 	"github.com/bigangryrobot/go-vnc/go/operators"
+	"github.com/bigangryrobot/go-vnc/rfbflags"
 )
 
 func TestEncoding_Marshal(t *testing.T) {
@@ -28,6 +40,8 @@ func TestRawEncoding_Type(t *testing.T) {
 }
 
 func TestRawEncoding_Marshal(t *testing.T) {
+	// The formats of NewPixelFormat, exercising the full range of each shift.
+	pf16 := NewPixelFormat(16)
 	for _, tt := range []struct {
 		desc string
 		e    *RawEncoding
@@ -38,12 +52,12 @@ func TestRawEncoding_Marshal(t *testing.T) {
 			[]byte{}},
 		{"single color",
 			&RawEncoding{[]Color{
-				Color{&PixelFormat16bit, &ColorMap{}, 0, 127, 7, 0}}},
+				Color{&pf16, &ColorMap{}, 0, 127, 7, 0}}},
 			[]byte{0, 127}},
 		{"multiple colors",
 			&RawEncoding{[]Color{
-				Color{&PixelFormat16bit, &ColorMap{}, 0, 127, 7, 0},
-				Color{&PixelFormat16bit, &ColorMap{}, 0, 32767, 2047, 127}}},
+				Color{&pf16, &ColorMap{}, 0, 127, 7, 0},
+				Color{&pf16, &ColorMap{}, 0, 32767, 2047, 127}}},
 			[]byte{0, 127, 127, 255}},
 	} {
 		data, err := tt.e.Marshal()
@@ -60,9 +74,656 @@ func TestRawEncoding_Marshal(t *testing.T) {
 
 func TestRawEncoding_Read(t *testing.T) {}
 
+func TestCopyRectEncoding_Read(t *testing.T) {
+	for _, tt := range []struct {
+		desc       string
+		srcX, srcY uint16
+		rect       Rectangle
+		ok         bool
+	}{
+		{"within", 10, 20, Rectangle{Width: 2, Height: 2}, true},
+		{"bottom-right corner", 630, 470, Rectangle{Width: 10, Height: 10}, true},
+		{"beyond right edge", 631, 0, Rectangle{Width: 10, Height: 10}, false},
+		{"beyond bottom edge", 0, 471, Rectangle{Width: 10, Height: 10}, false},
+		{"wider than framebuffer", 0, 0, Rectangle{Width: 641, Height: 1}, false},
+		{"maximum offset", 0xffff, 0xffff, Rectangle{Width: 1, Height: 1}, false},
+	} {
+		conn := roundTripConn([]byte{byte(tt.srcX >> 8), byte(tt.srcX), byte(tt.srcY >> 8), byte(tt.srcY)})
+		enc, err := (&CopyRectEncoding{}).Read(conn, &tt.rect)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: unexpected error: %v", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if got, want := *enc.(*CopyRectEncoding), (CopyRectEncoding{tt.srcX, tt.srcY}); got != want {
+			t.Errorf("%s: incorrect encoding; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
+func TestCopyRectEncoding_ReadBuffered(t *testing.T) {
+	// An update of a Raw rectangle followed by two CopyRect rectangles,
+	// delivered in a single read, so that the CopyRect payloads are already
+	// buffered when they are decoded.
+	var update bytes.Buffer
+	update.Write([]byte{0, 0, 3}) // padding, number-of-rectangles
+	binary.Write(&update, binary.BigEndian, rectangleMessage{0, 0, 1, 1, encodings.EncRaw})
+	update.Write([]byte{1, 2, 3, 4})
+	binary.Write(&update, binary.BigEndian, rectangleMessage{1, 0, 1, 1, encodings.EncCopyRect})
+	binary.Write(&update, binary.BigEndian, [2]uint16{0, 0})
+	binary.Write(&update, binary.BigEndian, rectangleMessage{2, 0, 1, 1, encodings.EncCopyRect})
+	binary.Write(&update, binary.BigEndian, [2]uint16{1, 0})
+
+	conn := roundTripConn(update.Bytes())
+	msg, err := (&FramebufferUpdate{}).Read(conn)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	rects := msg.(*FramebufferUpdate).Rects
+	if got, want := len(rects), 3; got != want {
+		t.Fatalf("incorrect number of rectangles; got = %v, want = %v", got, want)
+	}
+	for i, want := range []CopyRectEncoding{{0, 0}, {1, 0}} {
+		if got := *rects[i+1].Enc.(*CopyRectEncoding); got != want {
+			t.Errorf("incorrect rectangle %d; got = %v, want = %v", i+1, got, want)
+		}
+	}
+}
+
+func TestEncodings_ReadBuffered(t *testing.T) {
+	// An update holding rectangles of each encoding, delivered in a single
+	// read, so that their payloads are already buffered when decoded.
+	pixel := []byte{0, 1, 2, 3}
+	var update bytes.Buffer
+	header := func(enc encodings.EncodingType) {
+		binary.Write(&update, binary.BigEndian, rectangleMessage{0, 0, 1, 1, enc})
+	}
+	update.Write([]byte{0, 0, 6}) // padding, number-of-rectangles
+	header(encodings.EncRaw)
+	update.Write(pixel)
+	header(encodings.EncRRE)
+	binary.Write(&update, binary.BigEndian, uint32(0))
+	update.Write(pixel)
+	header(encodings.EncZRLE)
+	zrle := append(zlibCompress([]byte{0, 1, 2, 3}), 0xff) // trailing byte beyond the zlib stream
+	binary.Write(&update, binary.BigEndian, uint32(len(zrle)))
+	update.Write(zrle)
+	header(encodings.EncTight)
+	writeTightCopyRect(&update, pixel)
+	header(encodings.EncCursorPseudo)
+	update.Write(pixel)
+	update.Write([]byte{0x80})
+	header(encodings.EncRaw)
+	update.Write([]byte{4, 5, 6, 7})
+
+	conn := roundTripConn(update.Bytes())
+	conn.encodings = append(conn.encodings, &TightEncoding{})
+	msg, err := (&FramebufferUpdate{}).Read(conn)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	rects := msg.(*FramebufferUpdate).Rects
+	if got, want := len(rects), 6; got != want {
+		t.Fatalf("incorrect number of rectangles; got = %v, want = %v", got, want)
+	}
+	if got, want := rects[2].Enc.(*ZRLEEncoding).Data, []byte{0, 1, 2, 3}; !bytes.Equal(got, want) {
+		t.Errorf("incorrect ZRLE data; got = %v, want = %v", got, want)
+	}
+	if got, want := rects[3].Enc.(*TightEncoding).Data, pixel; !bytes.Equal(got, want) {
+		t.Errorf("incorrect Tight data; got = %v, want = %v", got, want)
+	}
+	if got, want := rects[4].Enc.(*CursorPseudoEncoding).Bitmask, []byte{0x80}; !bytes.Equal(got, want) {
+		t.Errorf("incorrect cursor bitmask; got = %v, want = %v", got, want)
+	}
+	last := rects[5].Enc.(*RawEncoding).Colors[0]
+	if last.R != 5 || last.G != 6 || last.B != 7 {
+		t.Errorf("incorrect color of the last rectangle; got = %v, want = {5 6 7}", last)
+	}
+}
+
+func TestEncodings_ReadRGB555(t *testing.T) {
+	// Big-endian RGB555 pixels: red, green, blue and a grey of 20/31.
+	pixels := []byte{0x7c, 0x00, 0x03, 0xe0, 0x00, 0x1f, 0x52, 0x94}
+	want := [][3]uint16{{31, 0, 0}, {0, 31, 0}, {0, 0, 31}, {20, 20, 20}}
+
+	var rre bytes.Buffer
+	binary.Write(&rre, binary.BigEndian, uint32(3)) // number-of-subrectangles
+	rre.Write(pixels[0:2])                          // background
+	for i, xy := range [][2]uint16{{1, 0}, {0, 1}, {1, 1}} {
+		rre.Write(pixels[2*i+2 : 2*i+4])
+		binary.Write(&rre, binary.BigEndian, [4]uint16{xy[0], xy[1], 1, 1})
+	}
+
+	for _, tt := range []struct {
+		desc string
+		enc  Encoding
+		data []byte
+	}{
+		{"raw", &RawEncoding{}, pixels},
+		{"hextile", &HextileEncoding{}, append([]byte{0x01}, pixels...)}, // Raw tile
+		{"rre", &RREEncoding{}, rre.Bytes()},
+	} {
+		mockConn := &MockConn{}
+		mockConn.Write(tt.data)
+		conn := NewClientConn(mockConn, &ClientConfig{})
+		conn.pixelFormat = PixelFormat16bit555
+		rect := &Rectangle{Width: 2, Height: 2}
+		if _, err := DecodeRectangle(conn, rect, tt.enc); err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.desc, err)
+			continue
+		}
+
+		img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+		if err := conn.drawRectangle(img, rect); err != nil {
+			t.Errorf("%s: unexpected error drawing: %s", tt.desc, err)
+			continue
+		}
+		for i, w := range want {
+			got := img.RGBAAt(i%2, i/2)
+			r, g, b := uint8(scaleColor(w[0], 31)>>8), uint8(scaleColor(w[1], 31)>>8), uint8(scaleColor(w[2], 31)>>8)
+			if got.R != r || got.G != g || got.B != b {
+				t.Errorf("%s: incorrect pixel %d; got = %v, want = {%d %d %d}", tt.desc, i, got, r, g, b)
+			}
+		}
+	}
+}
+
+func TestClientConfig_ZlibErrorPolicy(t *testing.T) {
+	// A zlib header followed by a deflate block of the reserved type.
+	corrupt := []byte{0x78, 0x9c, 0xff, 0xff, 0xff, 0xff}
+	pixel := []byte{0, 1, 2, 3}
+
+	for _, tt := range []struct {
+		desc   string
+		policy ZlibErrorPolicy
+		ok     bool
+	}{
+		{"fail", ZlibErrorFail, false},
+		{"skip", ZlibSkipRectangle, true},
+	} {
+		// Corrupt Tight and ZRLE rectangles, each followed by a valid one.
+		var update bytes.Buffer
+		header := func(enc encodings.EncodingType) {
+			binary.Write(&update, binary.BigEndian, rectangleMessage{0, 0, 1, 1, enc})
+		}
+		update.Write([]byte{0, 0, 4}) // padding, number-of-rectangles
+		header(encodings.EncTight)
+		update.Write([]byte{0}) // compression-control
+		update.Write(tightCompactLength(len(corrupt)))
+		update.Write(corrupt)
+		header(encodings.EncTight)
+		writeTightCopyRect(&update, pixel)
+		header(encodings.EncZRLE)
+		binary.Write(&update, binary.BigEndian, uint32(len(corrupt)))
+		update.Write(corrupt)
+		header(encodings.EncZRLE)
+		zrle := zlibCompress(pixel)
+		binary.Write(&update, binary.BigEndian, uint32(len(zrle)))
+		update.Write(zrle)
+
+		conn := roundTripConn(update.Bytes())
+		conn.config.ZlibErrorPolicy = tt.policy
+		conn.encodings = append(conn.encodings, &TightEncoding{})
+		msg, err := (&FramebufferUpdate{}).Read(conn)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.desc, err)
+			continue
+		}
+		rects := msg.(*FramebufferUpdate).Rects
+		if got, want := len(rects), 4; got != want {
+			t.Errorf("%s: incorrect number of rectangles; got = %v, want = %v", tt.desc, got, want)
+			continue
+		}
+		if got := rects[0].Enc.(*TightEncoding).Data; got != nil {
+			t.Errorf("%s: expected no Tight data for the corrupt rectangle; got = %v", tt.desc, got)
+		}
+		if got, want := rects[1].Enc.(*TightEncoding).Data, pixel; !bytes.Equal(got, want) {
+			t.Errorf("%s: incorrect Tight data; got = %v, want = %v", tt.desc, got, want)
+		}
+		if got := rects[2].Enc.(*ZRLEEncoding).Data; got != nil {
+			t.Errorf("%s: expected no ZRLE data for the corrupt rectangle; got = %v", tt.desc, got)
+		}
+		if got, want := rects[3].Enc.(*ZRLEEncoding).Data, pixel; !bytes.Equal(got, want) {
+			t.Errorf("%s: incorrect ZRLE data; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
 func TestDesktopSizePseudoEncoding_Type(t *testing.T) {
 	e := &DesktopSizePseudoEncoding{}
 	if got, want := e.Type(), encodings.DesktopSizePseudoEncoding; got != want {
 		t.Errorf("incorrect encoding; got = %s, want = %s", got, want)
 	}
 }
+
+// tightCompactLength returns the Tight compact representation of n.
+func tightCompactLength(n int) []byte {
+	b := []byte{byte(n & 0x7f)}
+	if n > 0x7f {
+		b[0] |= 0x80
+		b = append(b, byte((n>>7)&0x7f))
+		if n > 0x3fff {
+			b[1] |= 0x80
+			b = append(b, byte(n>>14))
+		}
+	}
+	return b
+}
+
+func TestTightEncoding_ReadGradient(t *testing.T) {
+	// Pixel components (r, g, b) of a 3x2 image, within the range of a
+	// 5/6/5 format so that every format below can represent them.
+	const width, height = 3, 2
+	image := [width * height][3]int{
+		{1, 2, 3}, {4, 8, 12}, {31, 63, 0},
+		{10, 20, 30}, {0, 0, 0}, {16, 32, 16},
+	}
+
+	rgb888 := PixelFormat{BPP: 32, Depth: 24, TrueColor: RFBTrue,
+		RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 16, GreenShift: 8, BlueShift: 0}
+	bgr888 := PixelFormat{BPP: 32, Depth: 24, TrueColor: RFBTrue,
+		RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 0, GreenShift: 8, BlueShift: 16}
+	rgb565 := PixelFormat{BPP: 16, Depth: 16, TrueColor: RFBTrue,
+		RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5, BlueShift: 0}
+	bgr565 := PixelFormat{BPP: 16, Depth: 16, TrueColor: RFBTrue,
+		RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 0, GreenShift: 5, BlueShift: 11}
+
+	for _, tt := range []struct {
+		desc string
+		pf   PixelFormat
+	}{
+		{"rgb888", rgb888},
+		{"bgr888", bgr888},
+		{"rgb565", rgb565},
+		{"bgr565", bgr565},
+	} {
+		for _, bigEndian := range []rfbflags.RFBFlag{RFBTrue, RFBFalse} {
+			pf := tt.pf
+			pf.BigEndian = bigEndian
+			desc := fmt.Sprintf("%s big-endian:%v", tt.desc, bigEndian)
+			bpp := pf.BytesPerPixel()
+			max := [3]int{int(pf.RedMax), int(pf.GreenMax), int(pf.BlueMax)}
+			shift := [3]uint8{pf.RedShift, pf.GreenShift, pf.BlueShift}
+			pack := func(comps [3]int) uint32 {
+				var p uint32
+				for i := range comps {
+					p |= uint32(comps[i]&max[i]) << shift[i]
+				}
+				return p
+			}
+			component := func(x, y, i int) int {
+				if x < 0 || y < 0 {
+					return 0
+				}
+				return image[y*width+x][i]
+			}
+
+			// Encode the image the way a server would.
+			corrections := make([]byte, width*height*bpp)
+			want := make([]byte, width*height*bpp)
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					var corr [3]int
+					for i := range corr {
+						pred := component(x-1, y, i) + component(x, y-1, i) - component(x-1, y-1, i)
+						if pred < 0 {
+							pred = 0
+						}
+						if pred > max[i] {
+							pred = max[i]
+						}
+						corr[i] = image[y*width+x][i] - pred
+					}
+					offset := (y*width + x) * bpp
+					pf.writePixel(corrections[offset:], pack(corr))
+					pf.writePixel(want[offset:], pack(image[y*width+x]))
+				}
+			}
+			var compressed bytes.Buffer
+			w := zlib.NewWriter(&compressed)
+			w.Write(corrections)
+			w.Close()
+
+			mockConn := &MockConn{}
+			conn := NewClientConn(mockConn, &ClientConfig{})
+			conn.pixelFormat = pf
+			mockConn.Write(tightCompactLength(compressed.Len()))
+			mockConn.Write(compressed.Bytes())
+
+			e := &TightEncoding{}
+			enc, err := e.readTightGradient(conn, &Rectangle{Width: width, Height: height})
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", desc, err)
+				continue
+			}
+			if got := enc.(*TightEncoding).Data; !operators.EqualSlicesOfByte(got, want) {
+				t.Errorf("%s: incorrect result; got = %v, want = %v", desc, got, want)
+			}
+		}
+	}
+}
+
+func TestUltraEncoding_Read(t *testing.T) {
+	// A 2x2 rectangle of 32 bits-per-pixel data: a literal run of the first
+	// two pixels, and a match repeating them.
+	pixels := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	compressed := append([]byte{17 + 8}, pixels...)
+	compressed = append(compressed, 32|6, 7<<2, 0) // M3 match: length 8, distance 8
+	compressed = append(compressed, 0x11, 0, 0)    // end of stream
+
+	for _, tt := range []struct {
+		desc   string
+		length uint32
+		data   []byte
+		ok     bool
+	}{
+		{"valid", uint32(len(compressed)), compressed, true},
+		{"corrupt", uint32(len(compressed) - 3), compressed[:len(compressed)-3], false},
+		{"length too large", 0xffffffff, compressed, false},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{})
+		conn.pixelFormat = roundTripFormat
+		conn.send(tt.length)
+		conn.send(tt.data)
+
+		enc, err := (&UltraEncoding{}).Read(conn, &Rectangle{Width: 2, Height: 2})
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.desc, err)
+			continue
+		}
+		colors := enc.(*UltraEncoding).Colors
+		want := [][3]uint16{{2, 3, 4}, {6, 7, 8}, {2, 3, 4}, {6, 7, 8}}
+		for i, c := range colors {
+			if got := [3]uint16{c.R, c.G, c.B}; got != want[i] {
+				t.Errorf("%s: incorrect color[%d]; got = %v, want = %v", tt.desc, i, got, want[i])
+			}
+		}
+	}
+}
+
+func TestUltra2Encoding_Read(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.pixelFormat = roundTripFormat
+	want := &Ultra2Encoding{[]byte{9, 8, 7}}
+	data, err := want.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockConn.Write(data)
+	mockConn.Write([]byte{2}) // The next message.
+
+	enc, err := (&Ultra2Encoding{}).Read(conn, &Rectangle{Width: 2, Height: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := enc.(*Ultra2Encoding).Data; !operators.EqualSlicesOfByte(got, want.Data) {
+		t.Errorf("incorrect data; got = %v, want = %v", got, want.Data)
+	}
+	var next uint8
+	if err := conn.receive(&next); err != nil || next != 2 {
+		t.Errorf("expected the next message to follow; got = %v, %v", next, err)
+	}
+}
+
+// BenchmarkTightEncoding_Read decodes a 60-frame sequence of 64x64 Tight
+// rectangles using the copy, palette and gradient filters.
+func BenchmarkTightEncoding_Read(b *testing.B) {
+	const size, frames = 64, 60
+	rect := &Rectangle{Width: size, Height: size}
+	compressed := func(w io.Writer, data []byte) {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write(data)
+		zw.Close()
+		w.Write(tightCompactLength(buf.Len()))
+		w.Write(buf.Bytes())
+	}
+	var sequence bytes.Buffer
+	for i := 0; i < frames; i++ {
+		pixels := make([]byte, size*size*4)
+		for p := range pixels {
+			pixels[p] = byte(p*i + p/7)
+		}
+		switch i % 3 {
+		case 0:
+			sequence.Write([]byte{0x00}) // copy filter
+			compressed(&sequence, pixels)
+		case 1:
+			sequence.Write([]byte{0x10, 3}) // palette filter, 4 colors
+			sequence.Write(pixels[:4*4])
+			indices := make([]byte, size*size)
+			for p := range indices {
+				indices[p] = byte(p+i) % 4
+			}
+			compressed(&sequence, indices)
+		case 2:
+			sequence.Write([]byte{0x20}) // gradient filter
+			compressed(&sequence, pixels)
+		}
+	}
+
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.pixelFormat = PixelFormat32bit
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		mockConn.Write(sequence.Bytes())
+		for i := 0; i < frames; i++ {
+			if _, err := (&TightEncoding{}).Read(conn, rect); err != nil {
+				b.Fatalf("frame %d: unexpected error: %s", i, err)
+			}
+		}
+	}
+}
+
+// BenchmarkTightEncoding_ReadPalette decodes a 512x512 Tight rectangle using
+// the palette filter with 16 colors, expanding each index to its color.
+func BenchmarkTightEncoding_ReadPalette(b *testing.B) {
+	const size, colors = 512, 16
+	rect := &Rectangle{Width: size, Height: size}
+	var data bytes.Buffer
+	data.Write([]byte{0x11, colors - 1}) // palette filter on reset stream 0
+	for i := 0; i < colors; i++ {
+		data.Write([]byte{byte(i), byte(i << 2), byte(i << 4), 0})
+	}
+	indices := make([]byte, size*size)
+	for p := range indices {
+		indices[p] = byte(p/7) % colors
+	}
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(indices)
+	zw.Close()
+	data.Write(tightCompactLength(compressed.Len()))
+	data.Write(compressed.Bytes())
+
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.pixelFormat = PixelFormat32bit
+	b.SetBytes(size * size * 4)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		mockConn.Write(data.Bytes())
+		if _, err := (&TightEncoding{}).Read(conn, rect); err != nil {
+			b.Fatalf("unexpected error: %s", err)
+		}
+	}
+}
+
+// BenchmarkRawEncoding_Read decodes Raw rectangles of 32-bit pixels: many
+// small ones, a single large one, and a mix of both.
+func BenchmarkRawEncoding_Read(b *testing.B) {
+	small := Rectangle{Width: 16, Height: 16}
+	large := Rectangle{Width: 1024, Height: 768}
+	for _, bm := range []struct {
+		name  string
+		rects []Rectangle
+	}{
+		{"small", slices.Repeat([]Rectangle{small}, 64)},
+		{"large", []Rectangle{large}},
+		{"mixed", append(slices.Repeat([]Rectangle{small}, 32), large)},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			var data bytes.Buffer
+			for _, rect := range bm.rects {
+				data.Write(make([]byte, rect.Area()*4))
+			}
+			mockConn := &MockConn{}
+			conn := NewClientConn(mockConn, &ClientConfig{})
+			conn.pixelFormat = PixelFormat32bit
+			b.SetBytes(int64(data.Len()))
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				mockConn.Write(data.Bytes())
+				for i := range bm.rects {
+					if _, err := (&RawEncoding{}).Read(conn, &bm.rects[i]); err != nil {
+						b.Fatalf("rectangle %d: unexpected error: %s", i, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEncodings_Helpers(t *testing.T) {
+	encs := Encodings{&RawEncoding{}, &CopyRectEncoding{}, &ZRLEEncoding{}}
+
+	if !encs.Contains(encodings.EncCopyRect) {
+		t.Error("expected CopyRect to be contained")
+	}
+	if encs.Contains(encodings.EncTight) {
+		t.Error("expected Tight not to be contained")
+	}
+
+	for _, tt := range []struct {
+		desc string
+		op   func(*Encodings)
+		want []encodings.EncodingType
+	}{
+		{"add new", func(e *Encodings) { e.Add(&TightEncoding{}) },
+			[]encodings.EncodingType{encodings.EncRaw, encodings.EncCopyRect, encodings.EncZRLE, encodings.EncTight}},
+		{"add existing", func(e *Encodings) { e.Add(&CopyRectEncoding{}) },
+			[]encodings.EncodingType{encodings.EncRaw, encodings.EncCopyRect, encodings.EncZRLE, encodings.EncTight}},
+		{"prioritize", func(e *Encodings) { e.Prioritize(encodings.EncZRLE) },
+			[]encodings.EncodingType{encodings.EncZRLE, encodings.EncRaw, encodings.EncCopyRect, encodings.EncTight}},
+		{"prioritize first", func(e *Encodings) { e.Prioritize(encodings.EncZRLE) },
+			[]encodings.EncodingType{encodings.EncZRLE, encodings.EncRaw, encodings.EncCopyRect, encodings.EncTight}},
+		{"prioritize absent", func(e *Encodings) { e.Prioritize(encodings.EncRRE) },
+			[]encodings.EncodingType{encodings.EncZRLE, encodings.EncRaw, encodings.EncCopyRect, encodings.EncTight}},
+		{"remove", func(e *Encodings) { e.Remove(encodings.EncRaw) },
+			[]encodings.EncodingType{encodings.EncZRLE, encodings.EncCopyRect, encodings.EncTight}},
+		{"remove absent", func(e *Encodings) { e.Remove(encodings.EncRaw) },
+			[]encodings.EncodingType{encodings.EncZRLE, encodings.EncCopyRect, encodings.EncTight}},
+	} {
+		tt.op(&encs)
+		if got := encodingTypes(encs); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: incorrect encodings; got = %v, want = %v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestJRLEEncoding_Read(t *testing.T) {
+	// A 72x8 rectangle: a 64x8 JPEG tile of orange, and an 8x8 RLE tile with
+	// runs of red, green and blue.
+	orange := image.NewRGBA(image.Rect(0, 0, 64, 8))
+	draw.Draw(orange, orange.Bounds(), &image.Uniform{color.RGBA{0xff, 0x80, 0, 0xff}}, image.Point{}, draw.Src)
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, orange, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if jpg.Len() >= 1<<14 {
+		t.Fatalf("JPEG data of %d bytes needs a longer compact length", jpg.Len())
+	}
+
+	var data bytes.Buffer
+	data.Write([]byte{1, byte(jpg.Len()) | 0x80, byte(jpg.Len() >> 7)}) // JPEG, compact length
+	data.Write(jpg.Bytes())
+	data.Write([]byte{0})                 // RLE
+	data.Write([]byte{0, 0xff, 0, 0, 9})  // red, 10 pixels
+	data.Write([]byte{0, 0, 0xff, 0, 29}) // green, 30 pixels
+	data.Write([]byte{0, 0, 0, 0xff, 23}) // blue, 24 pixels
+
+	conn := roundTripConn(data.Bytes())
+	rect := &Rectangle{Width: 72, Height: 8}
+	enc, err := (&JRLEEncoding{}).Read(conn, rect)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	colors := enc.(*JRLEEncoding).Colors
+	at := func(x, y int) (r, g, b uint8) { return conn.ResolveColor(colors[y*72+x]) }
+
+	near := func(got, want uint8) bool { return max(got, want)-min(got, want) <= 4 }
+	for _, p := range []image.Point{{0, 0}, {63, 7}, {30, 4}} {
+		if r, g, b := at(p.X, p.Y); !near(r, 0xff) || !near(g, 0x80) || !near(b, 0) {
+			t.Errorf("JPEG tile: incorrect color at %v; got = %d, %d, %d", p, r, g, b)
+		}
+	}
+	for _, tt := range []struct {
+		p       image.Point
+		r, g, b uint8
+	}{
+		{image.Point{64, 0}, 0xff, 0, 0},
+		{image.Point{65, 1}, 0xff, 0, 0}, // 10th pixel
+		{image.Point{66, 1}, 0, 0xff, 0},
+		{image.Point{71, 4}, 0, 0xff, 0}, // 40th pixel
+		{image.Point{64, 5}, 0, 0, 0xff},
+		{image.Point{71, 7}, 0, 0, 0xff},
+	} {
+		if r, g, b := at(tt.p.X, tt.p.Y); r != tt.r || g != tt.g || b != tt.b {
+			t.Errorf("RLE tile: incorrect color at %v; got = %d, %d, %d, want = %d, %d, %d", tt.p, r, g, b, tt.r, tt.g, tt.b)
+		}
+	}
+	if conn.bufr.Buffered() != 0 {
+		t.Errorf("%d bytes left unread", conn.bufr.Buffered())
+	}
+}
+
+func TestQEMULEDStatePseudoEncoding_Read(t *testing.T) {
+	var data bytes.Buffer
+	for _, state := range []byte{byte(LEDCapsLock | LEDNumLock), 0} {
+		data.Write([]byte{0, 0, 1}) // padding, number-of-rectangles
+		binary.Write(&data, binary.BigEndian, rectangleMessage{0, 0, 0, 0, encodings.EncQEMULEDStatePseudo})
+		data.WriteByte(state)
+	}
+
+	conn := roundTripConn(data.Bytes())
+	conn.encodings = append(conn.encodings, &QEMULEDStatePseudoEncoding{})
+	var changes []LEDFlags
+	conn.config.OnLEDStateChange = func(state LEDFlags) { changes = append(changes, state) }
+
+	for _, want := range []LEDFlags{LEDCapsLock | LEDNumLock, 0} {
+		msg, err := (&FramebufferUpdate{}).Read(conn)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		enc, ok := msg.(*FramebufferUpdate).Rects[0].Enc.(*QEMULEDStatePseudoEncoding)
+		if !ok || enc.State != want {
+			t.Errorf("incorrect encoding; got = %v, want = %v", msg.(*FramebufferUpdate).Rects[0].Enc, want)
+		}
+		if got := conn.LEDState(); got != want {
+			t.Errorf("incorrect LED state; got = %v, want = %v", got, want)
+		}
+	}
+	if want := []LEDFlags{LEDCapsLock | LEDNumLock, 0}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("incorrect OnLEDStateChange calls; got = %v, want = %v", changes, want)
+	}
+	if got, want := (LEDCapsLock | LEDScrollLock).String(), "ScrollLock|CapsLock"; got != want {
+		t.Errorf("incorrect string; got = %q, want = %q", got, want)
+	}
+}
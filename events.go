@@ -0,0 +1,131 @@
+// Typed events decoded from server messages.
+
+package vnc
+
+// Event is the interface satisfied by the events delivered by Events. It is
+// implemented by FramebufferEvent, ColorMapEvent, BellEvent, ClipboardEvent,
+// ResizeEvent, CursorEvent, PointerModeEvent and EndOfContinuousUpdatesEvent.
+type Event interface {
+	isEvent()
+}
+
+// FramebufferEvent holds the rectangles of pixel data of a FramebufferUpdate.
+// Pseudo-encoded rectangles are delivered as their own events instead.
+type FramebufferEvent struct {
+	Rects []Rectangle
+}
+
+// ColorMapEvent is delivered when the server changes the color map.
+type ColorMapEvent struct {
+	FirstColor uint16
+	Colors     []Color
+}
+
+// BellEvent is delivered when the server rings the bell.
+type BellEvent struct{}
+
+// ClipboardEvent is delivered when the server has new text in its cut buffer.
+type ClipboardEvent struct {
+	Text string
+}
+
+// ResizeEvent is delivered when the server changes the framebuffer size.
+type ResizeEvent struct {
+	Width, Height uint16
+}
+
+// CursorEvent is delivered when the server changes the cursor shape.
+type CursorEvent struct {
+	HotspotX, HotspotY uint16
+	Width, Height      uint16
+	Pixels             []byte // Pixel data, in the connection's pixel format.
+	Bitmask            []byte // Bitmask of the visible pixels, one bit per pixel.
+}
+
+// PointerModeEvent is delivered when the server changes the PointerMode.
+type PointerModeEvent struct {
+	Mode PointerMode
+}
+
+// EndOfContinuousUpdatesEvent is delivered when the server ends continuous
+// updates, or tells the client that it supports them.
+type EndOfContinuousUpdatesEvent struct{}
+
+func (FramebufferEvent) isEvent() {}
+func (ColorMapEvent) isEvent()    {}
+func (BellEvent) isEvent()        {}
+func (ClipboardEvent) isEvent()   {}
+func (ResizeEvent) isEvent()      {}
+func (CursorEvent) isEvent()      {}
+func (PointerModeEvent) isEvent() {}
+
+func (EndOfContinuousUpdatesEvent) isEvent() {}
+
+// eventsBufferSize is the capacity of the channel returned by Events.
+const eventsBufferSize = 16
+
+// Events returns a channel on which the messages received by ListenAndHandle
+// are delivered as typed events. Messages are still sent on the
+// ServerMessageCh of the ClientConfig, if any. Events must be called before
+// each call to ListenAndHandle, which closes the channel when it returns. As
+// with ServerMessageCh, the channel must be read for messages to be handled.
+func (c *ClientConn) Events() <-chan Event {
+	if c.events == nil {
+		c.events = make(chan Event, eventsBufferSize)
+	}
+	return c.events
+}
+
+// messageEvents returns the events conveyed by a server message.
+func messageEvents(msg ServerMessage) []Event {
+	switch msg := msg.(type) {
+	case *FramebufferUpdate:
+		return updateEvents(msg)
+	case *SetColorMapEntries:
+		return []Event{ColorMapEvent{msg.FirstColor, msg.Colors}}
+	case *Bell:
+		return []Event{BellEvent{}}
+	case *ServerCutText:
+		if msg.Extended {
+			return nil
+		}
+		return []Event{ClipboardEvent{msg.Text}}
+	case *EndOfContinuousUpdates:
+		return []Event{EndOfContinuousUpdatesEvent{}}
+	}
+	return nil
+}
+
+// updateEvents returns the events conveyed by the rectangles of a
+// FramebufferUpdate, in order, with consecutive rectangles of pixel data
+// grouped into a single FramebufferEvent.
+func updateEvents(msg *FramebufferUpdate) []Event {
+	var (
+		events []Event
+		rects  []Rectangle
+	)
+	flush := func() {
+		if len(rects) > 0 {
+			events = append(events, FramebufferEvent{rects})
+			rects = nil
+		}
+	}
+	for _, rect := range msg.Rects {
+		var ev Event
+		switch enc := rect.Enc.(type) {
+		case *DesktopSizePseudoEncoding:
+			ev = ResizeEvent{rect.Width, rect.Height}
+		case *CursorPseudoEncoding:
+			ev = CursorEvent{rect.X, rect.Y, rect.Width, rect.Height, enc.Pixels, enc.Bitmask}
+		case *QEMUPointerMotionChangePseudoEncoding:
+			ev = PointerModeEvent{enc.Mode}
+		default:
+			rects = append(rects, rect)
+			continue
+		}
+		flush()
+		events = append(events, ev)
+	}
+	flush()
+	return events
+}
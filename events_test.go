@@ -0,0 +1,102 @@
+package vnc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClientConn_Events(t *testing.T) {
+	mockConn := &MockConn{}
+	cfg := NewClientConfig("")
+	cfg.ServerMessageCh = make(chan ServerMessage, 8)
+	cfg.AutoRequestUpdates = false // MockConn would read the request back.
+	conn := NewClientConn(mockConn, cfg)
+	conn.pixelFormat = roundTripFormat
+	conn.encodings = Encodings{&RawEncoding{}, &DesktopSizePseudoEncoding{}}
+
+	// Write the messages as a server would.
+	server := NewServerConn(mockConn, &ServerConfig{PixelFormat: roundTripFormat})
+	pf := roundTripFormat
+	var cm ColorMap
+	color := Color{pf: &pf, cm: &cm, R: 1, G: 2, B: 3}
+	if err := server.FramebufferUpdate([]Rectangle{
+		{X: 0, Y: 0, Width: 1, Height: 1, Enc: &RawEncoding{[]Color{color}}},
+		{X: 1, Y: 0, Width: 1, Height: 1, Enc: &RawEncoding{[]Color{color}}},
+		{X: 0, Y: 0, Width: 800, Height: 600, Enc: &DesktopSizePseudoEncoding{}},
+		{X: 2, Y: 0, Width: 1, Height: 1, Enc: &RawEncoding{[]Color{color}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Bell(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ServerCutText("hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	events := conn.Events()
+	conn.ListenAndHandle() // Returns at the end of the data.
+
+	var got []Event
+	for ev := range events {
+		if fe, ok := ev.(FramebufferEvent); ok {
+			for i := range fe.Rects {
+				fe.Rects[i].encFn = nil
+			}
+		}
+		got = append(got, ev)
+	}
+	want := []Event{
+		FramebufferEvent{[]Rectangle{
+			{X: 0, Y: 0, Width: 1, Height: 1, Enc: &RawEncoding{[]Color{color}}},
+			{X: 1, Y: 0, Width: 1, Height: 1, Enc: &RawEncoding{[]Color{color}}},
+		}},
+		ResizeEvent{800, 600},
+		FramebufferEvent{[]Rectangle{
+			{X: 2, Y: 0, Width: 1, Height: 1, Enc: &RawEncoding{[]Color{color}}},
+		}},
+		BellEvent{},
+		ClipboardEvent{"hello"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect events;\n got = %v\nwant = %v", got, want)
+	}
+
+	// The raw messages are still delivered.
+	var types []string
+	for len(cfg.ServerMessageCh) > 0 {
+		types = append(types, (<-cfg.ServerMessageCh).Type().String())
+	}
+	if got, want := types, []string{"FramebufferUpdate", "Bell", "ServerCutText"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect server messages; got = %v, want = %v", got, want)
+	}
+	if got, want := conn.GetFramebufferWidth(), uint16(800); got != want {
+		t.Errorf("incorrect framebuffer width; got = %v, want = %v", got, want)
+	}
+}
+
+func TestMessageEvents(t *testing.T) {
+	raw := Rectangle{X: 0, Y: 0, Width: 1, Height: 1, Enc: &RawEncoding{}}
+	cursor := &CursorPseudoEncoding{Pixels: []byte{1, 2, 3, 4}, Bitmask: []byte{0x80}}
+
+	for _, tt := range []struct {
+		desc string
+		msg  ServerMessage
+		want []Event
+	}{
+		{"cursor",
+			newFramebufferUpdate([]Rectangle{{X: 3, Y: 4, Width: 1, Height: 1, Enc: cursor}}),
+			[]Event{CursorEvent{3, 4, 1, 1, cursor.Pixels, cursor.Bitmask}}},
+		{"pointer mode",
+			newFramebufferUpdate([]Rectangle{raw, {Enc: &QEMUPointerMotionChangePseudoEncoding{PointerRelative}}}),
+			[]Event{FramebufferEvent{[]Rectangle{raw}}, PointerModeEvent{PointerRelative}}},
+		{"empty update", newFramebufferUpdate(nil), nil},
+		{"color map",
+			&SetColorMapEntries{FirstColor: 2, Colors: []Color{{R: 1}}},
+			[]Event{ColorMapEvent{2, []Color{{R: 1}}}}},
+	} {
+		if got := messageEvents(tt.msg); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: incorrect events; got = %v, want = %v", tt.desc, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Framebuffer model maintained from the updates sent by the server.
+
+package vnc
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"image"
+	"image/draw"
+)
+
+// Framebuffer returns a copy of the framebuffer model, as of the last
+// FramebufferUpdate read, or nil unless ClientConfig.MaintainFramebuffer is
+// set.
+func (c *ClientConn) Framebuffer() *image.RGBA {
+	c.fbMu.Lock()
+	defer c.fbMu.Unlock()
+	if c.fb == nil {
+		return nil
+	}
+	img := image.NewRGBA(c.fb.Bounds())
+	copy(img.Pix, c.fb.Pix)
+	return img
+}
+
+// FramebufferChecksum returns a 64-bit FNV-1a hash of the size and content of
+// the framebuffer model, as of the last FramebufferUpdate read, or 0 unless
+// ClientConfig.MaintainFramebuffer is set. Polling clients can compare
+// checksums to tell whether the screen changed without comparing pixels;
+// updates that redraw the same content leave the checksum unchanged.
+//
+// The hash is computed on demand, over the whole framebuffer, the first time
+// it is asked for after a change, and kept until the next one.
+func (c *ClientConn) FramebufferChecksum() uint64 {
+	c.fbMu.Lock()
+	defer c.fbMu.Unlock()
+	if c.fb == nil {
+		return 0
+	}
+	if !c.fbSumValid {
+		h := fnv.New64a()
+		var size [8]byte
+		binary.BigEndian.PutUint32(size[:4], uint32(c.fb.Rect.Dx()))
+		binary.BigEndian.PutUint32(size[4:], uint32(c.fb.Rect.Dy()))
+		h.Write(size[:])
+		h.Write(c.fb.Pix)
+		c.fbSum, c.fbSumValid = h.Sum64(), true
+	}
+	return c.fbSum
+}
+
+// SetRenderTarget makes each FramebufferUpdate read from now on draw its
+// pixel data onto img, such as a surface of a GUI toolkit, as it is applied,
+// on the reading goroutine; OnFrameComplete tells when a frame is complete.
+// Pixels outside the bounds of img are dropped, and img is not resized with
+// the framebuffer. If the framebuffer model is maintained, its content is
+// drawn onto img at once, so that CopyRect rectangles find their source. A
+// nil img stops rendering.
+//
+// Pixels are written directly when img is an *image.RGBA. Other images are
+// written through img.Set, which converts every pixel to a color.Color and
+// is several times slower.
+func (c *ClientConn) SetRenderTarget(img draw.Image) {
+	c.fbMu.Lock()
+	defer c.fbMu.Unlock()
+	c.renderTarget = img
+	if img != nil && c.fb != nil {
+		draw.Draw(img, c.fb.Bounds(), c.fb, image.Point{}, draw.Src)
+	}
+}
+
+// WaitForFirstFrame blocks until the first FramebufferUpdate of the session
+// has been read and applied, so that the screen is ready for automation, or
+// until ctx is done, in which case ctx.Err() is returned. The update is only
+// read while ListenAndHandle or Screenshot is reading from the connection.
+func (c *ClientConn) WaitForFirstFrame(ctx context.Context) error {
+	select {
+	case <-c.firstFrame:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// initFramebuffer allocates the framebuffer model, if maintained, at the
+// current framebuffer size.
+func (c *ClientConn) initFramebuffer() {
+	if !c.config.MaintainFramebuffer {
+		return
+	}
+	c.fbMu.Lock()
+	defer c.fbMu.Unlock()
+	c.fb = image.NewRGBA(image.Rect(0, 0, int(c.fbWidth), int(c.fbHeight)))
+	c.fbSumValid = false
+}
+
+// applyUpdate applies the rectangles of a FramebufferUpdate to the
+// framebuffer model, in order, so that rectangles following a DesktopSize
+// pseudo-rectangle are drawn at the new size. The OnResize callback, if any,
+// is called for each resize, whether or not the model is maintained. The
+// first update applied releases WaitForFirstFrame. The bounding box of the
+// rectangles of pixel data is returned. Those rectangles are also drawn onto
+// the render target, if any.
+func (c *ClientConn) applyUpdate(rects []Rectangle) (changed image.Rectangle) {
+	defer c.firstFrameOnce.Do(func() { close(c.firstFrame) })
+
+	if c.config.MaintainFramebuffer && c.fb == nil {
+		c.initFramebuffer()
+	}
+	for i := range rects {
+		rect := &rects[i]
+		if _, ok := rect.Enc.(*DesktopSizePseudoEncoding); ok {
+			c.resizeFramebuffer(rect.Width, rect.Height)
+			if c.config.OnResize != nil {
+				c.config.OnResize(rect.Width, rect.Height)
+			}
+			continue
+		}
+		if rect.Enc == nil || rect.Enc.Type() < 0 {
+			continue
+		}
+		changed = changed.Union(rect.Bounds())
+		c.fbMu.Lock()
+		var err error
+		if c.config.MaintainFramebuffer {
+			err = c.drawRectangle(c.fb, rect)
+			c.fbSumValid = false
+		}
+		if c.renderTarget != nil && err == nil {
+			err = c.drawRectangle(c.renderTarget, rect)
+		}
+		c.fbMu.Unlock()
+		if err != nil {
+			c.log.Printf("error applying rectangle %v; %s", rect, err)
+		}
+	}
+	return changed
+}
+
+// resizeFramebuffer replaces the framebuffer model, if maintained, with one
+// of width by height pixels, holding the content of the overlapping top-left
+// region of the old one.
+func (c *ClientConn) resizeFramebuffer(width, height uint16) {
+	if !c.config.MaintainFramebuffer {
+		return
+	}
+	c.fbMu.Lock()
+	defer c.fbMu.Unlock()
+	fb := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
+	if c.fb != nil {
+		draw.Draw(fb, fb.Bounds().Intersect(c.fb.Bounds()), c.fb, image.Point{}, draw.Src)
+	}
+	c.fb, c.fbSumValid = fb, false
+}
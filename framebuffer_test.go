@@ -0,0 +1,341 @@
+package vnc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bigangryrobot/go-vnc/encodings"
+)
+
+func TestClientConn_Framebuffer_Resize(t *testing.T) {
+	header := func(b *bytes.Buffer, x, y, w, h uint16, enc encodings.EncodingType) {
+		binary.Write(b, binary.BigEndian, rectangleMessage{x, y, w, h, enc})
+	}
+	red := []byte{0, 0xff, 0, 0} // in roundTripFormat
+	blue := []byte{0, 0, 0, 0xff}
+
+	// Fill a 2x2 framebuffer with red, then grow it to 3x3 and draw a blue
+	// pixel in the new region, then shrink it to 1x2.
+	var update bytes.Buffer
+	update.Write([]byte{0, 0, 1}) // padding, number-of-rectangles
+	header(&update, 0, 0, 2, 2, encodings.EncRaw)
+	update.Write(bytes.Repeat(red, 2*2))
+	update.Write([]byte{0, 0, 0, 2})
+	header(&update, 0, 0, 3, 3, encodings.EncDesktopSizePseudo)
+	header(&update, 2, 2, 1, 1, encodings.EncRaw)
+	update.Write(blue)
+	update.Write([]byte{0, 0, 0, 1})
+	header(&update, 0, 0, 1, 2, encodings.EncDesktopSizePseudo)
+
+	var resizes [][2]uint16
+	conn := roundTripConn(update.Bytes())
+	conn.fbWidth, conn.fbHeight = 2, 2
+	conn.config.MaintainFramebuffer = true
+	conn.config.OnResize = func(width, height uint16) {
+		resizes = append(resizes, [2]uint16{width, height})
+	}
+
+	opaque := func(c color.RGBA) color.RGBA { c.A = 0xff; return c }
+	for _, tt := range []struct {
+		desc   string
+		bounds image.Rectangle
+		pixels map[image.Point]color.RGBA
+	}{
+		{"initial", image.Rect(0, 0, 2, 2), map[image.Point]color.RGBA{
+			{0, 0}: opaque(color.RGBA{R: 0xff}),
+			{1, 1}: opaque(color.RGBA{R: 0xff}),
+		}},
+		{"grown", image.Rect(0, 0, 3, 3), map[image.Point]color.RGBA{
+			{0, 0}: opaque(color.RGBA{R: 0xff}),
+			{1, 1}: opaque(color.RGBA{R: 0xff}),
+			{2, 0}: {},
+			{2, 2}: opaque(color.RGBA{B: 0xff}),
+		}},
+		{"shrunk", image.Rect(0, 0, 1, 2), map[image.Point]color.RGBA{
+			{0, 0}: opaque(color.RGBA{R: 0xff}),
+			{0, 1}: opaque(color.RGBA{R: 0xff}),
+		}},
+	} {
+		if tt.desc != "initial" {
+			var messageType uint8
+			if err := conn.receive(&messageType); err != nil {
+				t.Fatalf("%s: unexpected error: %s", tt.desc, err)
+			}
+		}
+		if _, err := (&FramebufferUpdate{}).Read(conn); err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.desc, err)
+		}
+		fb := conn.Framebuffer()
+		if got, want := fb.Bounds(), tt.bounds; got != want {
+			t.Errorf("%s: incorrect bounds; got = %v, want = %v", tt.desc, got, want)
+			continue
+		}
+		for p, want := range tt.pixels {
+			if got := fb.RGBAAt(p.X, p.Y); got != want {
+				t.Errorf("%s: incorrect pixel at %v; got = %v, want = %v", tt.desc, p, got, want)
+			}
+		}
+	}
+	if got, want := resizes, [][2]uint16{{3, 3}, {1, 2}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect resizes; got = %v, want = %v", got, want)
+	}
+}
+
+func TestClientConn_Framebuffer_Disabled(t *testing.T) {
+	conn := roundTripConn(nil)
+	conn.applyUpdate([]Rectangle{{Width: 1, Height: 1, Enc: &DesktopSizePseudoEncoding{}}})
+	if fb := conn.Framebuffer(); fb != nil {
+		t.Errorf("expected no framebuffer; got = %v", fb.Bounds())
+	}
+}
+
+func TestClientConn_WaitForFirstFrame(t *testing.T) {
+	conn := roundTripConn([]byte{0, 0, 0}) // padding, no rectangles
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := conn.WaitForFirstFrame(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded before the first update; got = %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- conn.WaitForFirstFrame(context.Background()) }()
+	if _, err := (&FramebufferUpdate{}).Read(conn); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitForFirstFrame did not return after the first update")
+	}
+}
+
+func TestFramebufferUpdate_Changed(t *testing.T) {
+	header := func(b *bytes.Buffer, x, y, w, h uint16, enc encodings.EncodingType) {
+		binary.Write(b, binary.BigEndian, rectangleMessage{x, y, w, h, enc})
+	}
+	pixel := []byte{0, 1, 2, 3}
+
+	for _, tt := range []struct {
+		desc   string
+		update func(b *bytes.Buffer)
+		want   image.Rectangle
+	}{
+		{"pixel data and copy", func(b *bytes.Buffer) {
+			b.Write([]byte{0, 0, 3})
+			header(b, 10, 20, 1, 1, encodings.EncRaw)
+			b.Write(pixel)
+			header(b, 30, 5, 2, 2, encodings.EncCopyRect)
+			binary.Write(b, binary.BigEndian, [2]uint16{0, 0}) // source
+			header(b, 0, 0, 8, 8, encodings.EncDesktopSizePseudo)
+		}, image.Rect(10, 5, 32, 21)},
+		{"pseudo-encodings only", func(b *bytes.Buffer) {
+			b.Write([]byte{0, 0, 1})
+			header(b, 0, 0, 8, 8, encodings.EncDesktopSizePseudo)
+		}, image.Rectangle{}},
+	} {
+		var update bytes.Buffer
+		tt.update(&update)
+		conn := roundTripConn(update.Bytes())
+		msg, err := (&FramebufferUpdate{}).Read(conn)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.desc, err)
+		}
+		if got := msg.(*FramebufferUpdate).Changed; got != tt.want {
+			t.Errorf("%s: incorrect changed region; got = %v, want = %v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestFramebufferUpdate_DesktopNameOnly(t *testing.T) {
+	// A name change in a zero-size rectangle, alone and after pixel data.
+	var update bytes.Buffer
+	update.Write([]byte{0, 0, 1}) // padding, number-of-rectangles
+	binary.Write(&update, binary.BigEndian, rectangleMessage{0, 0, 0, 0, encodings.EncDesktopNamePseudo})
+	update.Write([]byte{0, 0, 0, 4})
+	update.WriteString("name")
+	update.Write([]byte{0, 0, 0, 2})
+	binary.Write(&update, binary.BigEndian, rectangleMessage{0, 0, 1, 1, encodings.EncRaw})
+	update.Write([]byte{0, 1, 2, 3})
+	binary.Write(&update, binary.BigEndian, rectangleMessage{0, 0, 0, 0, encodings.EncDesktopNamePseudo})
+	update.Write([]byte{0, 0, 0, 7})
+	update.WriteString("renamed")
+
+	for _, concurrency := range []int{0, 2} {
+		conn := roundTripConn(update.Bytes())
+		conn.config.MaintainFramebuffer = true
+		conn.config.DecodeConcurrency = concurrency
+		conn.config.OnResize = func(width, height uint16) {
+			t.Errorf("concurrency %d: unexpected resize to %dx%d", concurrency, width, height)
+		}
+		conn.initFramebuffer()
+		fb := conn.fb
+
+		for i, tt := range []struct {
+			name    string
+			changed image.Rectangle
+		}{
+			{"name", image.Rectangle{}},
+			{"renamed", image.Rect(0, 0, 1, 1)},
+		} {
+			if i > 0 {
+				var messageType uint8
+				if err := conn.receive(&messageType); err != nil {
+					t.Fatalf("concurrency %d: %s: unexpected error: %s", concurrency, tt.name, err)
+				}
+			}
+			msg, err := (&FramebufferUpdate{}).Read(conn)
+			if err != nil {
+				t.Fatalf("concurrency %d: %s: unexpected error: %s", concurrency, tt.name, err)
+			}
+			if got := conn.GetDesktopName(); got != tt.name {
+				t.Errorf("concurrency %d: incorrect desktop name; got = %q, want = %q", concurrency, got, tt.name)
+			}
+			if got := msg.(*FramebufferUpdate).Changed; got != tt.changed {
+				t.Errorf("concurrency %d: %s: incorrect changed region; got = %v, want = %v", concurrency, tt.name, got, tt.changed)
+			}
+			if w, h := conn.GetFramebufferWidth(), conn.GetFramebufferHeight(); w != 640 || h != 480 {
+				t.Errorf("concurrency %d: %s: incorrect framebuffer size; got = %dx%d, want = 640x480", concurrency, tt.name, w, h)
+			}
+			if conn.fb != fb {
+				t.Errorf("concurrency %d: %s: framebuffer reallocated", concurrency, tt.name)
+			}
+		}
+	}
+}
+
+// countingImage is a draw.Image other than *image.RGBA, counting the pixels
+// set through it.
+type countingImage struct {
+	*image.NRGBA
+	sets int
+}
+
+func (m *countingImage) Set(x, y int, c color.Color) {
+	m.sets++
+	m.NRGBA.Set(x, y, c)
+}
+
+func (m *countingImage) SetRGBA64(x, y int, c color.RGBA64) {
+	m.sets++
+	m.NRGBA.SetRGBA64(x, y, c)
+}
+
+func TestClientConn_SetRenderTarget(t *testing.T) {
+	red := []byte{0, 0xff, 0, 0} // in roundTripFormat
+	blue := []byte{0, 0, 0, 0xff}
+
+	// Draw a red and a blue pixel, then copy them down a row.
+	var update bytes.Buffer
+	update.Write([]byte{0, 0, 2}) // padding, number-of-rectangles
+	binary.Write(&update, binary.BigEndian, rectangleMessage{0, 0, 2, 1, encodings.EncRaw})
+	update.Write(red)
+	update.Write(blue)
+	binary.Write(&update, binary.BigEndian, rectangleMessage{0, 1, 2, 1, encodings.EncCopyRect})
+	binary.Write(&update, binary.BigEndian, [2]uint16{0, 0})
+
+	for _, tt := range []struct {
+		desc   string
+		target func() draw.Image
+		sets   int // Pixels expected through Set, or -1 for *image.RGBA.
+	}{
+		{"rgba", func() draw.Image { return image.NewRGBA(image.Rect(0, 0, 2, 2)) }, -1},
+		{"custom", func() draw.Image { return &countingImage{NRGBA: image.NewNRGBA(image.Rect(0, 0, 2, 2))} }, 4},
+	} {
+		conn := roundTripConn(update.Bytes())
+		conn.fbWidth, conn.fbHeight = 2, 2
+		target := tt.target()
+		conn.SetRenderTarget(target)
+		if _, err := (&FramebufferUpdate{}).Read(conn); err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.desc, err)
+		}
+
+		for p, want := range map[image.Point]color.RGBA{
+			{0, 0}: {R: 0xff, A: 0xff},
+			{1, 0}: {B: 0xff, A: 0xff},
+			{0, 1}: {R: 0xff, A: 0xff},
+			{1, 1}: {B: 0xff, A: 0xff},
+		} {
+			if got := color.RGBAModel.Convert(target.At(p.X, p.Y)); got != want {
+				t.Errorf("%s: incorrect pixel at %v; got = %v, want = %v", tt.desc, p, got, want)
+			}
+		}
+		if ci, ok := target.(*countingImage); ok && ci.sets != tt.sets {
+			t.Errorf("%s: incorrect pixels set; got = %d, want = %d", tt.desc, ci.sets, tt.sets)
+		}
+
+		// Once detached, the target is left alone.
+		conn.SetRenderTarget(nil)
+		conn.applyUpdate([]Rectangle{{X: 0, Y: 0, Width: 1, Height: 1, Enc: &RawEncoding{Colors: []Color{{}}}}})
+		if got, want := color.RGBAModel.Convert(target.At(0, 0)), (color.RGBA{R: 0xff, A: 0xff}); got != want {
+			t.Errorf("%s: detached target drawn; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
+func TestClientConn_FramebufferChecksum(t *testing.T) {
+	update := func(b *bytes.Buffer, pixel []byte) {
+		b.Write([]byte{0, 0, 0, 1}) // message-type, padding, number-of-rectangles
+		binary.Write(b, binary.BigEndian, rectangleMessage{1, 1, 1, 1, encodings.EncRaw})
+		b.Write(pixel)
+	}
+	red := []byte{0, 0xff, 0, 0} // in roundTripFormat
+	blue := []byte{0, 0, 0, 0xff}
+
+	// The same pixel drawn twice, then a different one.
+	var updates bytes.Buffer
+	update(&updates, red)
+	update(&updates, red)
+	update(&updates, blue)
+	conn := roundTripConn(updates.Bytes())
+	conn.fbWidth, conn.fbHeight = 2, 2
+	conn.config.MaintainFramebuffer = true
+
+	if got := conn.FramebufferChecksum(); got != 0 {
+		t.Errorf("incorrect checksum before the first update; got = %v, want = 0", got)
+	}
+	var sums []uint64
+	for i := 0; i < 3; i++ {
+		var messageType uint8
+		if err := conn.receive(&messageType); err != nil {
+			t.Fatalf("update %d: unexpected error: %s", i, err)
+		}
+		if _, err := (&FramebufferUpdate{}).Read(conn); err != nil {
+			t.Fatalf("update %d: unexpected error: %s", i, err)
+		}
+		sum := conn.FramebufferChecksum()
+		if again := conn.FramebufferChecksum(); again != sum {
+			t.Errorf("update %d: unstable checksum; got = %v, then %v", i, sum, again)
+		}
+		sums = append(sums, sum)
+	}
+	if sums[0] == 0 {
+		t.Error("expected a nonzero checksum")
+	}
+	if sums[1] != sums[0] {
+		t.Errorf("checksum changed by an update of the same content; got = %v, want = %v", sums[1], sums[0])
+	}
+	if sums[2] == sums[1] {
+		t.Errorf("checksum unchanged by an update of new content; got = %v", sums[2])
+	}
+
+	// Resizing keeps it at the same size and changes it at another.
+	conn.resizeFramebuffer(2, 2)
+	if got := conn.FramebufferChecksum(); got != sums[2] {
+		t.Errorf("checksum changed by a resize to the same size; got = %v, want = %v", got, sums[2])
+	}
+	conn.resizeFramebuffer(2, 3)
+	if got := conn.FramebufferChecksum(); got == sums[2] {
+		t.Errorf("checksum unchanged by a resize; got = %v", got)
+	}
+}
@@ -0,0 +1,219 @@
+/*
+The lzo package implements decompression of the LZO1X compressed data
+format, as used by the UltraVNC Ultra encoding.
+*/
+
+package lzo
+
+import "errors"
+
+var (
+	// ErrInputOverrun is returned when the compressed data ends early.
+	ErrInputOverrun = errors.New("lzo: input overrun")
+	// ErrOutputOverrun is returned when the data decompresses to more than
+	// the expected length.
+	ErrOutputOverrun = errors.New("lzo: output overrun")
+	// ErrLookbehindOverrun is returned when a match refers to data before
+	// the start of the output.
+	ErrLookbehindOverrun = errors.New("lzo: lookbehind overrun")
+	// ErrCorrupt is returned when the compressed data is malformed.
+	ErrCorrupt = errors.New("lzo: corrupt data")
+)
+
+// Offsets of the M2 and M4 match instructions.
+const (
+	m2MaxOffset = 0x0800
+	m4Offset    = 0x4000
+)
+
+// decompressor holds the state of a decompression.
+type decompressor struct {
+	in  []byte
+	ip  int
+	out []byte
+	max int
+}
+
+func (d *decompressor) byte() (int, error) {
+	if d.ip >= len(d.in) {
+		return 0, ErrInputOverrun
+	}
+	b := d.in[d.ip]
+	d.ip++
+	return int(b), nil
+}
+
+func (d *decompressor) le16() (int, error) {
+	if d.ip+2 > len(d.in) {
+		return 0, ErrInputOverrun
+	}
+	v := int(d.in[d.ip]) | int(d.in[d.ip+1])<<8
+	d.ip += 2
+	return v, nil
+}
+
+// length reads the zero-run extension of an instruction length, returning
+// base plus the extension.
+func (d *decompressor) length(base int) (int, error) {
+	n := 0
+	for {
+		b, err := d.byte()
+		if err != nil {
+			return 0, err
+		}
+		if b != 0 {
+			return n + base + b, nil
+		}
+		n += 255
+	}
+}
+
+func (d *decompressor) literal(n int) error {
+	if d.ip+n > len(d.in) {
+		return ErrInputOverrun
+	}
+	if len(d.out)+n > d.max {
+		return ErrOutputOverrun
+	}
+	d.out = append(d.out, d.in[d.ip:d.ip+n]...)
+	d.ip += n
+	return nil
+}
+
+// match copies n bytes starting dist bytes back in the output. The source
+// may overlap the bytes being written.
+func (d *decompressor) match(dist, n int) error {
+	pos := len(d.out) - dist
+	if dist <= 0 || pos < 0 {
+		return ErrLookbehindOverrun
+	}
+	if len(d.out)+n > d.max {
+		return ErrOutputOverrun
+	}
+	for i := 0; i < n; i++ {
+		d.out = append(d.out, d.out[pos+i])
+	}
+	return nil
+}
+
+// Decompress1X decompresses LZO1X data from src, which must decompress to
+// exactly outLen bytes.
+func Decompress1X(src []byte, outLen int) ([]byte, error) {
+	d := &decompressor{in: src, out: make([]byte, 0, outLen), max: outLen}
+	if err := d.run(); err != nil {
+		return nil, err
+	}
+	if len(d.out) != outLen {
+		return nil, ErrInputOverrun
+	}
+	if d.ip != len(d.in) {
+		return nil, ErrCorrupt
+	}
+	return d.out, nil
+}
+
+func (d *decompressor) run() error {
+	// state is the number of literals copied after the previous match, or 4
+	// after a literal run, which determines the meaning of instructions
+	// below 16.
+	state := 0
+
+	if len(d.in) > 0 && d.in[0] > 17 {
+		d.ip++
+		t := int(d.in[0]) - 17
+		if err := d.literal(t); err != nil {
+			return err
+		}
+		state = 4
+		if t < 4 {
+			state = t
+		}
+	}
+
+	for {
+		t, err := d.byte()
+		if err != nil {
+			return err
+		}
+
+		var dist, n, next int
+		switch {
+		case t < 16 && state == 0: // Literal run.
+			if t == 0 {
+				if t, err = d.length(15); err != nil {
+					return err
+				}
+			}
+			if err := d.literal(t + 3); err != nil {
+				return err
+			}
+			state = 4
+			continue
+
+		case t < 16: // M1: short match after literals.
+			b, err := d.byte()
+			if err != nil {
+				return err
+			}
+			next = t & 3
+			dist = 1 + t>>2 + b<<2
+			n = 2
+			if state == 4 {
+				dist += m2MaxOffset
+				n = 3
+			}
+
+		case t >= 64: // M2
+			b, err := d.byte()
+			if err != nil {
+				return err
+			}
+			next = t & 3
+			dist = 1 + (t>>2)&7 + b<<3
+			n = t>>5 + 1
+
+		case t >= 32: // M3
+			n = t&31 + 2
+			if n == 2 {
+				if n, err = d.length(33); err != nil {
+					return err
+				}
+			}
+			v, err := d.le16()
+			if err != nil {
+				return err
+			}
+			dist = 1 + v>>2
+			next = v & 3
+
+		default: // M4, or the end of the stream.
+			n = t&7 + 2
+			if n == 2 {
+				if n, err = d.length(9); err != nil {
+					return err
+				}
+			}
+			v, err := d.le16()
+			if err != nil {
+				return err
+			}
+			dist = (t&8)<<11 + v>>2
+			next = v & 3
+			if dist == 0 {
+				if n != 3 {
+					return ErrCorrupt
+				}
+				return nil
+			}
+			dist += m4Offset
+		}
+
+		if err := d.match(dist, n); err != nil {
+			return err
+		}
+		if err := d.literal(next); err != nil {
+			return err
+		}
+		state = next
+	}
+}
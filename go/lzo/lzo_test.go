@@ -0,0 +1,101 @@
+package lzo
+
+import (
+	"bytes"
+	"testing"
+)
+
+// endOfStream is the LZO1X end-of-stream marker.
+var endOfStream = []byte{0x11, 0x00, 0x00}
+
+// pattern returns n bytes of non-repeating test data.
+func pattern(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// withMatch returns data followed by n bytes copied from dist bytes back.
+func withMatch(data []byte, dist, n int) []byte {
+	out := append([]byte{}, data...)
+	for i := 0; i < n; i++ {
+		out = append(out, out[len(out)-dist])
+	}
+	return out
+}
+
+func TestDecompress1X(t *testing.T) {
+	long := pattern(2100)  // Literal run length 2100 = 3 + 15 + 8*255 + 42.
+	huge := pattern(17000) // Literal run length 17000 = 3 + 15 + 66*255 + 152.
+	huge0 := concat([]byte{0x00}, make([]byte, 66), []byte{152})
+
+	for _, tt := range []struct {
+		desc string
+		src  []byte
+		want []byte
+	}{
+		{"initial literals",
+			concat([]byte{17 + 5}, []byte("hello"), endOfStream),
+			[]byte("hello")},
+		{"M3 overlapping match",
+			concat([]byte{17 + 3}, []byte("abc"), []byte{32 | 7, 2 << 2, 0}, endOfStream),
+			[]byte("abcabcabcabc")},
+		{"M2 match",
+			concat([]byte{17 + 4}, []byte("abcd"), []byte{0x60 | 3<<2, 0}, endOfStream),
+			[]byte("abcdabcd")},
+		{"M1 match after trailing literal",
+			concat([]byte{17 + 3}, []byte("xyz"), []byte{2<<2 | 1, 0, 'q'}, endOfStream),
+			[]byte("xyzxyq")},
+		{"long literal run",
+			concat([]byte{0x00, 0, 0, 0, 0, 0, 0, 0, 0, 42}, long, endOfStream),
+			long},
+		{"M1 match after literal run",
+			concat([]byte{0x00, 0, 0, 0, 0, 0, 0, 0, 0, 42}, long, []byte{1 << 2, 1}, endOfStream),
+			withMatch(long, m2MaxOffset+1+1+1<<2, 3)},
+		{"M3 long match",
+			concat([]byte{17 + 3}, []byte("abc"), []byte{32, 0, 7, 2 << 2, 0}, endOfStream),
+			withMatch([]byte("abc"), 3, 33+255+7)},
+		{"M4 match",
+			concat(huge0, huge, []byte{16 | 2, 10<<2 | 1, 0, 'z'}, endOfStream),
+			append(withMatch(huge, m4Offset+10, 4), 'z')},
+	} {
+		got, err := Decompress1X(tt.src, len(tt.want))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.desc, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: incorrect result; got = %v, want = %v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestDecompress1X_Errors(t *testing.T) {
+	hello := concat([]byte{17 + 5}, []byte("hello"), endOfStream)
+	for _, tt := range []struct {
+		desc   string
+		src    []byte
+		outLen int
+		want   error
+	}{
+		{"empty", nil, 0, ErrInputOverrun},
+		{"truncated literals", hello[:4], 5, ErrInputOverrun},
+		{"missing end of stream", hello[:6], 5, ErrInputOverrun},
+		{"short output", hello, 6, ErrInputOverrun},
+		{"long output", hello, 4, ErrOutputOverrun},
+		{"trailing data", append(hello, 0), 5, ErrCorrupt},
+		{"match before start",
+			concat([]byte{17 + 3}, []byte("abc"), []byte{0x60 | 7<<2, 1}, endOfStream), 7, ErrLookbehindOverrun},
+		{"bad end of stream", []byte{17 + 1, 'a', 0x12, 0, 0}, 1, ErrCorrupt},
+	} {
+		if _, err := Decompress1X(tt.src, tt.outLen); err != tt.want {
+			t.Errorf("%s: incorrect error; got = %v, want = %v", tt.desc, err, tt.want)
+		}
+	}
+}
@@ -3,6 +3,7 @@
 package vnc
 
 import (
+	"encoding/binary"
 	"fmt"
 
 	"context"
@@ -32,9 +33,23 @@ const (
 	// Client ProtocolVersions.
 	PROTO_VERS_UNSUP = "UNSUPPORTED"
 	PROTO_VERS_3_3   = "RFB 003.003\n"
+	PROTO_VERS_3_7   = "RFB 003.007\n"
 	PROTO_VERS_3_8   = "RFB 003.008\n"
 )
 
+// HandshakeTrace holds the messages sent by the server during negotiation,
+// exactly as received, e.g. for fingerprinting servers by their quirks.
+type HandshakeTrace struct {
+	// ProtocolVersion is the 12-byte ProtocolVersion message.
+	ProtocolVersion []byte
+	// SecurityTypes is the security-types message: for protocols 3.7 and
+	// 3.8, the number-of-security-types byte followed by the types; for
+	// 3.3, the 4-byte security-type chosen by the server.
+	SecurityTypes []byte
+	// ServerInit is the ServerInit message, including the name.
+	ServerInit []byte
+}
+
 // protocolVersionHandshake implements §7.1.1 ProtocolVersion Handshake.
 func (c *ClientConn) protocolVersionHandshake(ctx context.Context) error {
 	var protocolVersion [pvLen]byte
@@ -43,6 +58,7 @@ func (c *ClientConn) protocolVersionHandshake(ctx context.Context) error {
 	if err := c.receive(&protocolVersion); err != nil {
 		return err
 	}
+	c.handshakeTrace.ProtocolVersion = protocolVersion[:]
 	if c.log != nil {
 		c.log.Printf("protocolVersion: %s", protocolVersion)
 	}
@@ -51,6 +67,9 @@ func (c *ClientConn) protocolVersionHandshake(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	if forced := c.config.ForceProtocolVersion; forced != "" {
+		return c.forceProtocolVersion(forced)
+	}
 	pv := PROTO_VERS_UNSUP
 	if major == 3 {
 		if minor >= 8 {
@@ -81,18 +100,110 @@ func (c *ClientConn) protocolVersionHandshake(ctx context.Context) error {
 	if err = c.send([]byte(pv)); err != nil {
 		return err
 	}
+	c.rttStart = c.clock.Now()
+
+	return nil
+}
+
+// forceProtocolVersion sends banner, the ClientConfig.ForceProtocolVersion,
+// whatever the version of the server. The rest of the handshake follows
+// version 3.8 for a banner of 3.8 or later, 3.7 for 3.7, and 3.3 for the
+// versions between, which implement neither of the later handshakes.
+// Versions before 3.3 are rejected.
+func (c *ClientConn) forceProtocolVersion(banner string) error {
+	major, minor, err := parseProtocolVersion([]byte(banner))
+	if err != nil || banner != fmt.Sprintf("RFB %03d.%03d\n", major, minor) {
+		return NewVNCError(fmt.Sprintf("ProtocolVersion handshake failed; malformed forced version %q", banner))
+	}
+	switch {
+	case major > 3 || major == 3 && minor >= 8:
+		c.protocolVersion = PROTO_VERS_3_8
+	case major == 3 && minor == 7:
+		c.protocolVersion = PROTO_VERS_3_7
+	case major == 3 && minor >= 3:
+		c.protocolVersion = PROTO_VERS_3_3
+	default:
+		return NewVNCError(fmt.Sprintf("ProtocolVersion handshake failed; unsupported forced version %q", banner))
+	}
+	if c.log != nil {
+		c.log.Printf("forced protocolVersion: %s", banner)
+	}
+
+	if err := c.send([]byte(banner)); err != nil {
+		return err
+	}
+	c.rttStart = c.clock.Now()
 
 	return nil
 }
 
+// ConnectionFailedError is wrapped by the VNCError returned when the server
+// refuses the connection during the security handshake by offering no
+// security types, e.g. because of too many authentication failures.
+type ConnectionFailedError struct {
+	// Reason is the reason-string sent by the server.
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *ConnectionFailedError) Error() string {
+	return fmt.Sprintf("connection failed: %s", e.Reason)
+}
+
+// connectionFailed returns a VNCError wrapping a ConnectionFailedError.
+func connectionFailed(reason string) error {
+	err := &ConnectionFailedError{reason}
+	return &VNCError{desc: fmt.Sprintf("Security handshake failed; %s", err), err: err}
+}
+
+// ErrNoSupportedSecurityType is matched, with errors.Is, by the error
+// returned when none of the security types offered by the server is among
+// those of ClientConfig.Auth. The error wraps a NoSupportedSecurityTypeError
+// listing both.
+var ErrNoSupportedSecurityType = NewVNCError("no supported security type")
+
+// NoSupportedSecurityTypeError is wrapped by the VNCError returned when none
+// of the security types offered by the server is supported by the client.
+type NoSupportedSecurityTypeError struct {
+	Offered   []uint8 // By the server, in its order of preference.
+	Supported []uint8 // By the client, from ClientConfig.Auth.
+}
+
+// Error implements the error interface.
+func (e *NoSupportedSecurityTypeError) Error() string {
+	return fmt.Sprintf("no supported security type; server offers %v, client supports %v", e.Offered, e.Supported)
+}
+
+// Is reports whether target is ErrNoSupportedSecurityType.
+func (e *NoSupportedSecurityTypeError) Is(target error) bool {
+	return target == ErrNoSupportedSecurityType
+}
+
+// noSupportedSecurityType returns a VNCError wrapping a
+// NoSupportedSecurityTypeError for the offered security types and auths.
+func noSupportedSecurityType(offered []uint8, auths []ClientAuth) error {
+	err := &NoSupportedSecurityTypeError{Offered: offered}
+	for _, a := range auths {
+		err.Supported = append(err.Supported, a.SecurityType())
+	}
+	return &VNCError{desc: fmt.Sprintf("Security handshake failed; %s", err), err: err}
+}
+
 // securityHandshake implements §7.1.2 Security Handshake.
 func (c *ClientConn) securityHandshake() error {
+	// The server replies as soon as it has read the client's version, so
+	// waiting for the reply measures the round-trip time. Errors are left to
+	// the reads below.
+	if _, err := c.bufr.Peek(1); err == nil {
+		c.rtt = c.clock.Now().Sub(c.rttStart)
+	}
+
 	switch c.protocolVersion {
 	case PROTO_VERS_3_3:
 		if err := c.securityHandshake33(); err != nil {
 			return err
 		}
-	case PROTO_VERS_3_8:
+	case PROTO_VERS_3_7, PROTO_VERS_3_8:
 		if err := c.securityHandshake38(); err != nil {
 			return err
 		}
@@ -109,6 +220,7 @@ func (c *ClientConn) securityHandshake33() error {
 	if err := c.receive(&secType); err != nil {
 		return err
 	}
+	c.handshakeTrace.SecurityTypes = binary.BigEndian.AppendUint32(nil, secType)
 
 	var auth ClientAuth
 	switch uint8(secType) { // 3.3 uses uint32, but 3.8 uses uint8. Unify on 3.8.
@@ -117,13 +229,15 @@ func (c *ClientConn) securityHandshake33() error {
 		if err != nil {
 			return err
 		}
-		return NewVNCError(fmt.Sprintf("Security handshake failed; connection failed: %s", reason))
+		return connectionFailed(reason)
 	case SecTypeNone:
 		auth = &ClientAuthNone{}
 	case SecTypeVNCAuth:
 		auth = &ClientAuthVNC{c.config.Password}
 	case SecTypeVeNCrypt:
 		auth = &ClientAuthVeNCryptAuth{}
+	case SecTypeARD:
+		auth = &ClientAuthARD{c.config.Username, c.config.Password}
 	default:
 		return NewVNCError(fmt.Sprintf("Security handshake failed; invalid security type: %v", secType))
 	}
@@ -147,20 +261,25 @@ func (c *ClientConn) securityHandshake38() error {
 		if err != nil {
 			return err
 		}
-		return NewVNCError(fmt.Sprintf("Security handshake failed; no security types: %v", reason))
+		return connectionFailed(reason)
 	}
-	securityTypes := make([]uint8, numSecurityTypes)
-	if err := c.receive(&securityTypes); err != nil {
-		return err
+	// A buggy server may send fewer types than it promised; reading them with
+	// receiveN detects the short read rather than proceeding with a partial
+	// list.
+	var securityTypes []uint8
+	if err := c.receiveN(&securityTypes, int(numSecurityTypes)); err != nil {
+		return &ProtocolError{Errorf("security-types list truncated; server promised %d types: %v", numSecurityTypes, err)}
 	}
 	c.securityTypes = securityTypes
+	c.handshakeTrace.SecurityTypes = append([]byte{numSecurityTypes}, securityTypes...)
 
 	// Choose client security type.
 	// TODO(kward): try "better" security types first.
 	var auth ClientAuth
+	auths := c.clientAuths()
 FindAuth:
 	for _, securityType := range securityTypes {
-		for _, a := range c.config.Auth {
+		for _, a := range auths {
 			if a.SecurityType() == securityType {
 				// We use the first matching supported authentication.
 				auth = a
@@ -169,7 +288,7 @@ FindAuth:
 		}
 	}
 	if auth == nil {
-		return NewVNCError(fmt.Sprintf("Security handshake failed; no suitable auth schemes found; server supports: %#v", securityTypes))
+		return noSupportedSecurityType(securityTypes, auths)
 	}
 
 	if err := c.send(auth.SecurityType()); err != nil {
@@ -198,9 +317,16 @@ func (c *ClientConn) securityResultHandshake() error {
 	switch securityResult {
 	case 0:
 	case 1:
-		reason, err := c.readErrorReason()
-		if err != nil {
-			return err
+		// Version 3.7 sends no reason-string.
+		var reason string
+		if c.protocolVersion != PROTO_VERS_3_7 {
+			var err error
+			if reason, err = c.readErrorReason(); err != nil {
+				return err
+			}
+		}
+		if reason == "" {
+			reason = "no reason given"
 		}
 		return NewVNCError(fmt.Sprintf("SecurityResult handshake failed: %s", reason))
 	default:
@@ -210,17 +336,108 @@ func (c *ClientConn) securityResultHandshake() error {
 	return nil
 }
 
+// readErrorReason reads a reason-string, preceded by its length. Some
+// servers send a length of 0, for which an empty reason is returned without
+// reading further. The string is read incrementally, so that a length larger
+// than the string the server actually sends doesn't cause a large
+// allocation.
+//
 // TODO(kward): need a context for timeout
 func (c *ClientConn) readErrorReason() (string, error) {
 	var reasonLen uint32
 	if err := c.receive(&reasonLen); err != nil {
 		return "", err
 	}
+	if reasonLen == 0 {
+		return "", nil
+	}
 
-	reason := make([]uint8, reasonLen)
-	if err := c.receive(&reason); err != nil {
+	var reason []uint8
+	if err := c.receiveN(&reason, int(reasonLen)); err != nil {
 		return "", err
 	}
 
 	return string(reason), nil
 }
+
+// serverProtocolVersionHandshake implements the server side of §7.1.1
+// ProtocolVersion Handshake. Only version 3.8 is supported.
+func (c *ServerConn) serverProtocolVersionHandshake() error {
+	if err := c.send([]byte(PROTO_VERS_3_8)); err != nil {
+		return err
+	}
+
+	// Read the ProtocolVersion message chosen by the client.
+	var protocolVersion [pvLen]byte
+	if err := c.receive(&protocolVersion); err != nil {
+		return err
+	}
+	c.log.Printf("protocolVersion: %s", protocolVersion)
+
+	major, minor, err := parseProtocolVersion(protocolVersion[:])
+	if err != nil {
+		return err
+	}
+	if major != 3 || minor != 8 {
+		return NewVNCError(fmt.Sprintf("ProtocolVersion handshake failed; unsupported version '%v'", string(protocolVersion[:])))
+	}
+	c.protocolVersion = PROTO_VERS_3_8
+
+	return nil
+}
+
+// serverSecurityHandshake implements the server side of §7.1.2 Security
+// Handshake and §7.1.3 SecurityResult Handshake.
+func (c *ServerConn) serverSecurityHandshake() error {
+	if len(c.config.Auth) == 0 {
+		return NewVNCError("Security handshake failed; no security types configured")
+	}
+
+	securityTypes := make([]uint8, len(c.config.Auth))
+	for i, a := range c.config.Auth {
+		securityTypes[i] = a.SecurityType()
+	}
+	if err := c.send(uint8(len(securityTypes))); err != nil {
+		return err
+	}
+	if err := c.send(securityTypes); err != nil {
+		return err
+	}
+
+	var secType uint8
+	if err := c.receive(&secType); err != nil {
+		return err
+	}
+	var auth ServerAuth
+	for _, a := range c.config.Auth {
+		if a.SecurityType() == secType {
+			auth = a
+			break
+		}
+	}
+	if auth == nil {
+		return c.sendSecurityResult(NewVNCError(fmt.Sprintf("Security handshake failed; unsupported security type: %v", secType)))
+	}
+
+	return c.sendSecurityResult(auth.Handshake(c))
+}
+
+// sendSecurityResult sends the SecurityResult message matching the outcome
+// of the authentication, and returns that outcome.
+func (c *ServerConn) sendSecurityResult(authErr error) error {
+	if authErr == nil {
+		return c.send(uint32(0))
+	}
+
+	reason := authErr.Error()
+	if err := c.send(uint32(1)); err != nil {
+		return err
+	}
+	if err := c.send(uint32(len(reason))); err != nil {
+		return err
+	}
+	if err := c.send([]byte(reason)); err != nil {
+		return err
+	}
+	return authErr
+}
@@ -1,9 +1,12 @@
 package vnc
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"reflect"
+	"strings"
 	"testing"
 
 	"context"
@@ -113,6 +116,95 @@ func TestProtocolVersionHandshake(t *testing.T) {
 	}
 }
 
+func TestClientConfig_ForceProtocolVersion(t *testing.T) {
+	for _, tt := range []struct {
+		server, forced string
+		ok             bool
+		pv             string // Version followed by the handshake.
+	}{
+		{"RFB 003.008\n", "RFB 003.003\n", true, PROTO_VERS_3_3},
+		{"RFB 003.008\n", "RFB 003.007\n", true, PROTO_VERS_3_7},
+		{"RFB 003.008\n", "RFB 003.005\n", true, PROTO_VERS_3_3},
+		{"RFB 003.003\n", "RFB 003.008\n", true, PROTO_VERS_3_8},
+		{"RFB 002.009\n", "RFB 003.008\n", true, PROTO_VERS_3_8},
+		{"RFB 003.008\n", "RFB 004.001\n", true, PROTO_VERS_3_8},
+		// Versions before 3.3.
+		{"RFB 003.008\n", "RFB 003.002\n", false, ""},
+		{"RFB 003.008\n", "RFB 002.009\n", false, ""},
+		// Malformed banners.
+		{"RFB 003.008\n", "RFB 3.3\n", false, ""},
+		{"RFB 003.008\n", "RFB 003.003", false, ""},
+		{"RFB 003.008\n", "RFB 003.003\nx", false, ""},
+		{"RFB 003.008\n", "VNC 003.003\n", false, ""},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{ForceProtocolVersion: tt.forced})
+		mockConn.Write([]byte(tt.server))
+
+		err := conn.protocolVersionHandshake(context.Background())
+		if !tt.ok {
+			var verr *VNCError
+			if !errors.As(err, &verr) {
+				t.Errorf("%q: expected VNCError; got = %v", tt.forced, err)
+			}
+			if mockConn.b.Len() != 0 {
+				t.Errorf("%q: unexpected banner sent: %q", tt.forced, mockConn.b.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tt.forced, err)
+			continue
+		}
+		if got := mockConn.b.String(); got != tt.forced {
+			t.Errorf("%q: incorrect banner sent; got = %q, want = %q", tt.forced, got, tt.forced)
+		}
+		if got := conn.protocolVersion; got != tt.pv {
+			t.Errorf("%q: incorrect protocol version; got = %q, want = %q", tt.forced, got, tt.pv)
+		}
+	}
+}
+
+func TestClientConfig_ForceProtocolVersion37(t *testing.T) {
+	for _, tt := range []struct {
+		desc   string
+		server []byte // Following the banner.
+		auth   ClientAuth
+		ok     bool
+	}{
+		// A list of security types as in 3.8, and no SecurityResult for None.
+		{"none", []byte{1, SecTypeNone, 0x42}, &ClientAuthNone{}, true},
+		// A failed SecurityResult without a reason-string.
+		{"vnc auth failed", append(append([]byte{1, SecTypeVNCAuth}, make([]byte, 16)...), 0, 0, 0, 1, 0x42), &ClientAuthVNC{"."}, false},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{ForceProtocolVersion: PROTO_VERS_3_7, Auth: []ClientAuth{tt.auth}})
+		mockConn.Write([]byte(PROTO_VERS_3_8))
+		if err := conn.protocolVersionHandshake(context.Background()); err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.desc, err)
+		}
+		mockConn.Reset()
+		mockConn.Write(tt.server)
+
+		err := conn.securityHandshake()
+		if err == nil {
+			err = conn.securityResultHandshake()
+		}
+		if tt.ok && err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.desc, err)
+		}
+		if !tt.ok {
+			if want := "SecurityResult handshake failed: no reason given"; err == nil || err.Error() != want {
+				t.Errorf("%s: incorrect error; got = %v, want = %q", tt.desc, err, want)
+			}
+		}
+		var next uint8
+		if err := conn.receive(&next); err != nil || next != 0x42 {
+			t.Errorf("%s: expected the data following the handshake to be left; got = %v, %v", tt.desc, next, err)
+		}
+	}
+}
+
 func writeVNCAuthChallenge(w io.Writer) error {
 	var ch vncAuthChallenge = vncAuthChallenge{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
 	return binary.Write(w, binary.BigEndian, ch)
@@ -324,6 +416,43 @@ func TestSecurityHandshake38(t *testing.T) {
 	}
 }
 
+func TestSecurityHandshake_ConnectionFailed(t *testing.T) {
+	const reason = "Too many authentication failures"
+	for _, tt := range []struct {
+		version string
+		secType interface{} // security-type or number-of-security-types
+	}{
+		{PROTO_VERS_3_3, uint32(SecTypeInvalid)},
+		{PROTO_VERS_3_8, uint8(0)},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{Auth: []ClientAuth{&ClientAuthNone{}}})
+		conn.protocolVersion = tt.version
+
+		conn.send(tt.secType)
+		conn.send(uint32(len(reason)))
+		conn.send([]byte(reason))
+		// Trailing data that must not be parsed as security types.
+		conn.send([]byte{SecTypeNone, SecTypeNone})
+
+		err := conn.securityHandshake()
+		if _, ok := err.(*VNCError); !ok {
+			t.Errorf("%s: unexpected %v error: %v", tt.version, reflect.TypeOf(err), err)
+		}
+		var cerr *ConnectionFailedError
+		if !errors.As(err, &cerr) {
+			t.Errorf("%s: expected ConnectionFailedError; got = %v", tt.version, err)
+			continue
+		}
+		if got, want := cerr.Reason, reason; got != want {
+			t.Errorf("%s: incorrect reason; got = %q, want = %q", tt.version, got, want)
+		}
+		if got, want := conn.bufr.Buffered()+mockConn.b.Len(), 2; got != want {
+			t.Errorf("%s: incorrect number of unread bytes; got = %v, want = %v", tt.version, got, want)
+		}
+	}
+}
+
 func TestSecurityResultHandshake(t *testing.T) {
 	tests := []struct {
 		result uint32
@@ -368,3 +497,121 @@ func TestSecurityResultHandshake(t *testing.T) {
 		}
 	}
 }
+
+func TestSecurityResultHandshake_EmptyReason(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.config.secType = SecTypeVNCAuth
+
+	// A failure with a reason-length of 0, followed by unrelated data.
+	binary.Write(mockConn, binary.BigEndian, uint32(1))
+	binary.Write(mockConn, binary.BigEndian, uint32(0))
+	mockConn.Write([]byte{0x42})
+
+	err := conn.securityResultHandshake()
+	if _, ok := err.(*VNCError); !ok {
+		t.Fatalf("expected a VNCError; got = %v", err)
+	}
+	if got, want := err.Error(), "SecurityResult handshake failed: no reason given"; got != want {
+		t.Errorf("incorrect error; got = %q, want = %q", got, want)
+	}
+	var next uint8
+	if err := conn.receive(&next); err != nil || next != 0x42 {
+		t.Errorf("expected the data following the result to be left; got = %v, %v", next, err)
+	}
+}
+
+func TestSecurityHandshake38_NoSupportedSecurityType(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{Auth: []ClientAuth{&ClientAuthNone{}, &ClientAuthVNC{"."}}})
+	conn.protocolVersion = PROTO_VERS_3_8
+
+	// The server offers only VeNCrypt.
+	mockConn.Write([]byte{1, SecTypeVeNCrypt})
+
+	err := conn.securityHandshake()
+	if !errors.Is(err, ErrNoSupportedSecurityType) {
+		t.Fatalf("expected ErrNoSupportedSecurityType; got = %v", err)
+	}
+	var serr *NoSupportedSecurityTypeError
+	if !errors.As(err, &serr) {
+		t.Fatalf("expected a NoSupportedSecurityTypeError; got = %v", err)
+	}
+	if got, want := serr.Offered, []uint8{SecTypeVeNCrypt}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect offered security types; got = %v, want = %v", got, want)
+	}
+	if got, want := serr.Supported, []uint8{SecTypeNone, SecTypeVNCAuth}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect supported security types; got = %v, want = %v", got, want)
+	}
+	if got, want := err.Error(), "server offers [19], client supports [1 2]"; !strings.Contains(got, want) {
+		t.Errorf("incorrect error; got = %q, want it to contain %q", got, want)
+	}
+	if mockConn.b.Len() != 0 {
+		t.Errorf("expected no security type sent; got %v", mockConn.b.Bytes())
+	}
+}
+
+func TestSecurityHandshake38_TruncatedTypes(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{Auth: []ClientAuth{&ClientAuthNone{}}})
+	conn.protocolVersion = PROTO_VERS_3_8
+
+	// The server promises 3 security types, but sends only 1 before EOF.
+	mockConn.Write([]byte{3, SecTypeNone})
+
+	err := conn.securityHandshake()
+	var perr *ProtocolError
+	if !errors.As(err, &perr) {
+		t.Fatalf("expected a ProtocolError; got = %v", err)
+	}
+	if !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("expected a truncated security-types error; got = %v", err)
+	}
+	if got := conn.securityTypes; got != nil {
+		t.Errorf("expected no security types; got = %v", got)
+	}
+
+	// Nothing should have been sent in reply.
+	var buf []byte
+	if err := conn.receiveN(&buf, 1024); err != io.EOF {
+		t.Errorf("expected EOF; got = %v", err)
+	}
+}
+
+func TestClientConfig_OnHandshake(t *testing.T) {
+	var serverInit bytes.Buffer
+	binary.Write(&serverInit, binary.BigEndian, ServerInit{FBWidth: 8, FBHeight: 6, PixelFormat: NewPixelFormat(32), NameLength: 3})
+	serverInit.WriteString("foo")
+
+	for _, tt := range []struct {
+		desc          string
+		version       string
+		securityTypes []byte
+	}{
+		{"3.8", "RFB 003.008\n", []byte{2, SecTypeNone, SecTypeVNCAuth}},
+		{"3.3", "RFB 003.003\n", []byte{0, 0, 0, SecTypeNone}},
+		{"3.7 quirk", "RFB 003.007\n", []byte{0, 0, 0, SecTypeNone}},
+	} {
+		var traces []HandshakeTrace
+		cfg := NewClientConfig("")
+		cfg.OnHandshake = func(trace HandshakeTrace) { traces = append(traces, trace) }
+		nc := &chunkConn{chunks: [][]byte{[]byte(tt.version), tt.securityTypes, serverInit.Bytes()}}
+		conn, err := Connect(context.Background(), nc, cfg)
+		if err != nil {
+			t.Fatalf("%s: unexpected error connecting: %s", tt.desc, err)
+		}
+		conn.Close()
+
+		if len(traces) != 1 {
+			t.Fatalf("%s: expected one trace; got %d", tt.desc, len(traces))
+		}
+		want := HandshakeTrace{
+			ProtocolVersion: []byte(tt.version),
+			SecurityTypes:   tt.securityTypes,
+			ServerInit:      serverInit.Bytes(),
+		}
+		if got := traces[0]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: incorrect trace;\ngot  = %q\nwant = %q", tt.desc, got, want)
+		}
+	}
+}
@@ -3,8 +3,11 @@
 package vnc
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
+	"unicode"
 
 	"github.com/bigangryrobot/go-vnc/rfbflags"
 )
@@ -47,7 +50,7 @@ type ServerInit struct {
 const serverInitLen = 24 // Not including Name.
 
 // Verify that interfaces are honored.
-var _ Unmarshaler = (*ServerInit)(nil)
+var _ MarshalerUnmarshaler = (*ServerInit)(nil)
 
 // Read implements
 func (m *ServerInit) Read(r io.Reader) error {
@@ -59,11 +62,16 @@ func (m *ServerInit) Read(r io.Reader) error {
 }
 
 func (m *ServerInit) Unmarshal(data []byte) error {
-	buf := NewBuffer(data)
+	if len(data) < serverInitLen {
+		return io.ErrUnexpectedEOF
+	}
 	var msg ServerInit
-	if err := buf.Read(&msg); err != nil {
+	msg.FBWidth = binary.BigEndian.Uint16(data[0:])
+	msg.FBHeight = binary.BigEndian.Uint16(data[2:])
+	if err := msg.PixelFormat.UnmarshalBinary(data[4 : 4+pixelFormatLen]); err != nil {
 		return err
 	}
+	msg.NameLength = binary.BigEndian.Uint32(data[4+pixelFormatLen:])
 	*m = msg
 	return nil
 }
@@ -71,19 +79,142 @@ func (m *ServerInit) Unmarshal(data []byte) error {
 // serverInit implements §7.3.2 ServerInit.
 func (c *ClientConn) serverInit() error {
 	var msg ServerInit
-	if err := msg.Read(c.Conn); err != nil {
+	var raw bytes.Buffer
+	if err := msg.Read(io.TeeReader(c.bufr, &raw)); err != nil {
 		return Errorf("failure reading ServerInit message; %v", err)
 	}
 
-	c.SetFramebufferWidth(msg.FBWidth)
-	c.SetFramebufferHeight(msg.FBHeight)
+	c.setFramebufferSize(msg.FBWidth, msg.FBHeight)
 	c.pixelFormat = msg.PixelFormat
+	c.serverPixelFormat = msg.PixelFormat
+	c.initFramebuffer()
 
-	name := make([]uint8, msg.NameLength)
-	if err := c.receive(&name); err != nil {
+	name, err := c.readDesktopName(msg.NameLength)
+	if err != nil {
 		return err
 	}
-	c.SetDesktopName(string(name))
+	c.setDesktopNameBytes(name)
+	c.handshakeTrace.ServerInit = append(raw.Bytes(), name...)
+
+	return nil
+}
+
+// readDesktopName reads a desktop name of length bytes. The name is read
+// incrementally, so that a length larger than the name the server actually
+// sends doesn't cause a large allocation. Lengths beyond the configured
+// MaxDesktopNameBytes are rejected without reading the name.
+func (c *ClientConn) readDesktopName(length uint32) ([]byte, error) {
+	if max := c.config.maxDesktopNameBytes(); length > max {
+		return nil, Errorf("desktop name length %d exceeds limit of %d bytes", length, max)
+	}
+	name, err := io.ReadAll(io.LimitReader(c.bufr, int64(length)))
+	if err != nil {
+		return nil, err
+	}
+	c.adjustMetric("bytes-received", int64(len(name)))
+	if len(name) < int(length) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return name, nil
+}
+
+// NameCharset is the character set in which the server's desktop name is
+// decoded. RFC 6143 leaves it undeclared; most servers send UTF-8, but some
+// send Latin-1.
+type NameCharset int
+
+const (
+	// NameCharsetUTF8 decodes names as UTF-8, replacing each invalid byte
+	// with U+FFFD.
+	NameCharsetUTF8 NameCharset = iota
+	// NameCharsetLatin1 decodes names as ISO 8859-1.
+	NameCharsetLatin1
+)
+
+// String implements the fmt.Stringer interface.
+func (cs NameCharset) String() string {
+	switch cs {
+	case NameCharsetUTF8:
+		return "utf-8"
+	case NameCharsetLatin1:
+		return "latin-1"
+	}
+	return fmt.Sprintf("NameCharset(%d)", int(cs))
+}
+
+// decode returns name decoded from the character set.
+func (cs NameCharset) decode(name []byte) string {
+	if cs == NameCharsetLatin1 {
+		runes := make([]rune, len(name))
+		for i, b := range name {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	return string(bytes.Runes(name))
+}
+
+// encode returns name encoded in the character set. Characters Latin-1
+// can't represent are replaced with '?'.
+func (cs NameCharset) encode(name string) []byte {
+	if cs != NameCharsetLatin1 {
+		return []byte(name)
+	}
+	b := make([]byte, 0, len(name))
+	for _, r := range name {
+		if r > unicode.MaxLatin1 {
+			r = '?'
+		}
+		b = append(b, byte(r))
+	}
+	return b
+}
 
+// setDesktopNameBytes sets the desktop name from name, as sent by the server,
+// decoded according to ClientConfig.NameCharset.
+func (c *ClientConn) setDesktopNameBytes(name []byte) {
+	c.desktopNameBytes = name
+	c.desktopName = c.config.NameCharset.decode(name)
+}
+
+// readClientInit implements the server side of §7.3.1 ClientInit.
+func (c *ServerConn) readClientInit() error {
+	var sharedFlag rfbflags.RFBFlag
+	if err := c.receive(&sharedFlag); err != nil {
+		return err
+	}
+	c.log.Printf("shared-flag: %v", sharedFlag)
 	return nil
 }
+
+// Marshal implements the Marshaler interface. The NameLength field is
+// written as-is; the name itself must be written separately.
+func (m *ServerInit) Marshal() ([]byte, error) {
+	pf, err := m.PixelFormat.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 4, serverInitLen)
+	binary.BigEndian.PutUint16(b[0:], m.FBWidth)
+	binary.BigEndian.PutUint16(b[2:], m.FBHeight)
+	b = append(b, pf...)
+	return binary.BigEndian.AppendUint32(b, m.NameLength), nil
+}
+
+// sendServerInit implements the server side of §7.3.2 ServerInit.
+func (c *ServerConn) sendServerInit() error {
+	msg := ServerInit{
+		FBWidth:     c.config.FBWidth,
+		FBHeight:    c.config.FBHeight,
+		PixelFormat: c.config.PixelFormat,
+		NameLength:  uint32(len(c.config.DesktopName)),
+	}
+	bytes, err := msg.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := c.send(bytes); err != nil {
+		return err
+	}
+	return c.send([]byte(c.config.DesktopName))
+}
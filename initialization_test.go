@@ -1,7 +1,9 @@
 package vnc
 
 import (
+	"bytes"
 	"io"
+	"strings"
 	"testing"
 )
 
@@ -128,3 +130,124 @@ func TestServerInit(t *testing.T) {
 		}
 	}
 }
+
+func TestClientConfig_NameCharset(t *testing.T) {
+	latin1 := []byte("Caf\xe9") // "Café" in Latin-1.
+
+	for _, tt := range []struct {
+		charset NameCharset
+		want    string
+	}{
+		{NameCharsetUTF8, "Caf\ufffd"},
+		{NameCharsetLatin1, "Café"},
+	} {
+		// ServerInit.
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{NameCharset: tt.charset})
+		msg := ServerInit{FBWidth: 1, FBHeight: 1, PixelFormat: NewPixelFormat(16), NameLength: uint32(len(latin1))}
+		if err := conn.send(msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.send(latin1); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.serverInit(); err != nil {
+			t.Fatalf("%v: unexpected error: %s", tt.charset, err)
+		}
+		if got := conn.GetDesktopName(); got != tt.want {
+			t.Errorf("%v: incorrect ServerInit name; got = %q, want = %q", tt.charset, got, tt.want)
+		}
+		if got := conn.DesktopNameBytes(); !bytes.Equal(got, latin1) {
+			t.Errorf("%v: incorrect ServerInit name bytes; got = %q, want = %q", tt.charset, got, latin1)
+		}
+
+		// DesktopName pseudo-encoding.
+		conn.SetDesktopName("")
+		data, err := (&DesktopNamePseudoEncoding{latin1}).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mockConn.Write(data)
+		if _, err := (&DesktopNamePseudoEncoding{}).Read(conn, &Rectangle{}); err != nil {
+			t.Fatalf("%v: unexpected error: %s", tt.charset, err)
+		}
+		if got := conn.GetDesktopName(); got != tt.want {
+			t.Errorf("%v: incorrect DesktopName name; got = %q, want = %q", tt.charset, got, tt.want)
+		}
+		if got := conn.DesktopNameBytes(); !bytes.Equal(got, latin1) {
+			t.Errorf("%v: incorrect DesktopName name bytes; got = %q, want = %q", tt.charset, got, latin1)
+		}
+	}
+}
+
+func TestClientConn_SetDesktopName(t *testing.T) {
+	for _, tt := range []struct {
+		charset NameCharset
+		name    string
+		want    []byte
+	}{
+		{NameCharsetUTF8, "Café", []byte("Caf\xc3\xa9")},
+		{NameCharsetLatin1, "Café", []byte("Caf\xe9")},
+		{NameCharsetLatin1, "Caf\u20ac", []byte("Caf?")},
+	} {
+		conn := NewClientConn(&MockConn{}, &ClientConfig{NameCharset: tt.charset})
+		conn.setDesktopNameBytes([]byte("old"))
+		conn.SetDesktopName(tt.name)
+		if got := conn.GetDesktopName(); got != tt.name {
+			t.Errorf("%v: incorrect name; got = %q, want = %q", tt.charset, got, tt.name)
+		}
+		if got := conn.DesktopNameBytes(); !bytes.Equal(got, tt.want) {
+			t.Errorf("%v: incorrect name bytes of %q; got = %q, want = %q", tt.charset, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClientConfig_MaxDesktopNameBytes(t *testing.T) {
+	for _, tt := range []struct {
+		desc   string
+		max    uint32
+		length uint32
+		name   string
+		ok     bool
+	}{
+		{"within default limit", 0, 3, "foo", true},
+		{"at limit", 4, 4, "abcd", true},
+		{"beyond limit", 4, 5, "abcde", false},
+		{"huge length", 0, 0xffffffff, "foo", false},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{MaxDesktopNameBytes: tt.max})
+		msg := ServerInit{FBWidth: 1, FBHeight: 1, PixelFormat: NewPixelFormat(16), NameLength: tt.length}
+		if err := conn.send(msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.send([]byte(tt.name)); err != nil {
+			t.Fatal(err)
+		}
+
+		err := conn.serverInit()
+		if !tt.ok {
+			// The name is rejected before it is read.
+			if verr, ok := err.(*VNCError); !ok || !strings.Contains(verr.Error(), "exceeds limit") {
+				t.Errorf("%s: expected limit error; got = %v", tt.desc, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.desc, err)
+			continue
+		}
+		if got, want := conn.GetDesktopName(), tt.name; got != want {
+			t.Errorf("%s: incorrect desktop name; got = %q, want = %q", tt.desc, got, want)
+		}
+	}
+
+	// A name shorter than its length is an unexpected EOF.
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.send(ServerInit{FBWidth: 1, FBHeight: 1, PixelFormat: NewPixelFormat(16), NameLength: 10})
+	conn.send([]byte("foo"))
+	if err := conn.serverInit(); err != io.ErrUnexpectedEOF {
+		t.Errorf("incorrect error for truncated name; got = %v, want = %v", err, io.ErrUnexpectedEOF)
+	}
+}
@@ -7,6 +7,8 @@ import "fmt"
 const (
 	_ClientMessage_name_0 = "SetPixelFormat"
 	_ClientMessage_name_1 = "SetEncodingsFramebufferUpdateRequestKeyEventPointerEventClientCutText"
+	_ClientMessage_name_2 = "EnableContinuousUpdates"
+	_ClientMessage_name_3 = "ClientFence"
 )
 
 var (
@@ -21,6 +23,10 @@ func (i ClientMessage) String() string {
 	case 2 <= i && i <= 6:
 		i -= 2
 		return _ClientMessage_name_1[_ClientMessage_index_1[i]:_ClientMessage_index_1[i+1]]
+	case i == 150:
+		return _ClientMessage_name_2
+	case i == 248:
+		return _ClientMessage_name_3
 	default:
 		return fmt.Sprintf("ClientMessage(%d)", i)
 	}
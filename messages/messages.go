@@ -22,6 +22,10 @@ const (
 	KeyEvent
 	PointerEvent
 	ClientCutText
+
+	// Extensions, see https://github.com/rfbproto/rfbproto
+	EnableContinuousUpdates ClientMessage = 150
+	ClientFence             ClientMessage = 248
 )
 
 //-----------------------------------------------------------------------------
@@ -40,4 +44,8 @@ const (
 	SetColorMapEntries
 	Bell
 	ServerCutText
+
+	// Extensions, see https://github.com/rfbproto/rfbproto
+	EndOfContinuousUpdates ServerMessage = 150
+	ServerFence            ServerMessage = 248
 )
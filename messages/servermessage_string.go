@@ -4,13 +4,25 @@ package messages
 
 import "fmt"
 
-const _ServerMessage_name = "FramebufferUpdateSetColorMapEntriesBellServerCutText"
+const (
+	_ServerMessage_name_0 = "FramebufferUpdateSetColorMapEntriesBellServerCutText"
+	_ServerMessage_name_1 = "EndOfContinuousUpdates"
+	_ServerMessage_name_2 = "ServerFence"
+)
 
-var _ServerMessage_index = [...]uint8{0, 17, 35, 39, 52}
+var (
+	_ServerMessage_index_0 = [...]uint8{0, 17, 35, 39, 52}
+)
 
 func (i ServerMessage) String() string {
-	if i >= ServerMessage(len(_ServerMessage_index)-1) {
+	switch {
+	case i <= 3:
+		return _ServerMessage_name_0[_ServerMessage_index_0[i]:_ServerMessage_index_0[i+1]]
+	case i == 150:
+		return _ServerMessage_name_1
+	case i == 248:
+		return _ServerMessage_name_2
+	default:
 		return fmt.Sprintf("ServerMessage(%d)", i)
 	}
-	return _ServerMessage_name[_ServerMessage_index[i]:_ServerMessage_index[i+1]]
 }
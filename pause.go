@@ -0,0 +1,102 @@
+// Pausing of a session, e.g. while a viewer is minimized.
+
+package vnc
+
+import (
+	"image"
+
+	"github.com/bigangryrobot/go-vnc/rfbflags"
+)
+
+// pauseState is the state of a ClientConn kept by Pause and Resume, guarded
+// by pauseMu.
+type pauseState struct {
+	paused  bool
+	resumed chan struct{} // Closed by Resume or Close.
+
+	// The region of the continuous updates disabled by Pause, to enable
+	// again on Resume, if any.
+	continuous *image.Rectangle
+}
+
+// Pause stops requesting updates from the server until Resume:
+// AutoRequestUpdates sends no requests, and continuous updates, if enabled,
+// are disabled. With ClientConfig.ParkReadsWhilePaused, ListenAndHandle also
+// stops reading from the server once the message being read, if any, has
+// been handled, leaving further data unread until Resume; none of it is lost.
+// IdleTimeout doesn't apply while paused. Pausing a paused connection does
+// nothing, and if disabling continuous updates fails, the connection isn't
+// paused.
+func (c *ClientConn) Pause() error {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if c.pause.paused {
+		return nil
+	}
+	c.pause.paused = true
+	c.pause.resumed = make(chan struct{})
+
+	if c.continuousUpdates.Load() {
+		r := c.continuousRegion
+		if err := c.EnableContinuousUpdates(false, uint16(r.Min.X), uint16(r.Min.Y), uint16(r.Dx()), uint16(r.Dy())); err != nil {
+			c.wakeParkedReads()
+			c.pause = pauseState{}
+			return err
+		}
+		c.pause.continuous = &r
+	}
+	return nil
+}
+
+// Resume undoes Pause, enabling again the continuous updates it disabled, if
+// any, and sends a non-incremental FramebufferUpdateRequest for the whole
+// framebuffer, so that the viewer can be repainted. Resuming a connection
+// that isn't paused does nothing.
+func (c *ClientConn) Resume() error {
+	c.pauseMu.Lock()
+	if !c.pause.paused {
+		c.pauseMu.Unlock()
+		return nil
+	}
+	continuous := c.pause.continuous
+	c.wakeParkedReads()
+	c.pause = pauseState{}
+	c.pauseMu.Unlock()
+
+	if r := continuous; r != nil {
+		if err := c.EnableContinuousUpdates(true, uint16(r.Min.X), uint16(r.Min.Y), uint16(r.Dx()), uint16(r.Dy())); err != nil {
+			return err
+		}
+	}
+	w, h := c.framebufferSize()
+	return c.FramebufferUpdateRequest(rfbflags.RFBFalse, 0, 0, w, h)
+}
+
+// Paused returns true between calls to Pause and Resume.
+func (c *ClientConn) Paused() bool {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	return c.pause.paused
+}
+
+// waitResumed blocks ListenAndHandle between messages while paused, if
+// ClientConfig.ParkReadsWhilePaused is set, until Resume or Close.
+func (c *ClientConn) waitResumed() {
+	if !c.config.ParkReadsWhilePaused {
+		return
+	}
+	c.pauseMu.Lock()
+	resumed := c.pause.resumed
+	c.pauseMu.Unlock()
+	if resumed != nil {
+		<-resumed
+	}
+}
+
+// wakeParkedReads releases waitResumed. pauseMu must be held.
+func (c *ClientConn) wakeParkedReads() {
+	if c.pause.resumed != nil {
+		close(c.pause.resumed)
+		c.pause.resumed = nil
+	}
+}
@@ -0,0 +1,213 @@
+package vnc
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bigangryrobot/go-vnc/encodings"
+	"github.com/bigangryrobot/go-vnc/messages"
+	"github.com/bigangryrobot/go-vnc/rfbflags"
+)
+
+func TestClientConn_Pause(t *testing.T) {
+	update := []byte{0, 0, 0, 0} // message-type, padding, number-of-rectangles
+	conn := NewClientConn(&chunkConn{chunks: [][]byte{update, update, update}}, NewClientConfig(""))
+	conn.config.AutoRequestUpdates = true
+	conn.fbWidth, conn.fbHeight = 640, 480
+	frames := 0
+	conn.config.OnFrameComplete = func([]Rectangle) {
+		if frames++; frames == 2 {
+			if err := conn.Pause(); err != nil {
+				t.Errorf("unexpected error pausing: %s", err)
+			}
+		}
+	}
+	if err := conn.ListenAndHandle(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !conn.Paused() {
+		t.Fatal("expected the connection to be paused")
+	}
+
+	// Only the first frame is followed by a request.
+	written := &conn.Conn.(*chunkConn).MockConn
+	var req FramebufferUpdateRequestMessage
+	if err := binary.Read(written, binary.BigEndian, &req); err != nil {
+		t.Fatalf("expected a request before pausing: %s", err)
+	}
+	if n := written.b.Len(); n != 0 {
+		t.Fatalf("unexpected %d bytes sent while paused", n)
+	}
+
+	if err := conn.Resume(); err != nil {
+		t.Fatalf("unexpected error resuming: %s", err)
+	}
+	if conn.Paused() {
+		t.Error("expected the connection to be resumed")
+	}
+	if err := binary.Read(written, binary.BigEndian, &req); err != nil {
+		t.Fatalf("expected a request on resuming: %s", err)
+	}
+	if want := (FramebufferUpdateRequestMessage{messages.FramebufferUpdateRequest, rfbflags.RFBFalse, 0, 0, 640, 480}); req != want {
+		t.Errorf("incorrect request on resuming; got = %v, want = %v", req, want)
+	}
+	if n := written.b.Len(); n != 0 {
+		t.Errorf("unexpected %d bytes sent on resuming", n)
+	}
+}
+
+func TestClientConn_Pause_ContinuousUpdates(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, NewClientConfig(""))
+	conn.fbWidth, conn.fbHeight = 640, 480
+	if err := conn.EnableContinuousUpdates(true, 10, 20, 30, 40); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	mockConn.Reset()
+
+	if err := conn.Pause(); err != nil {
+		t.Fatalf("unexpected error pausing: %s", err)
+	}
+	var msg EnableContinuousUpdatesMessage
+	if err := binary.Read(mockConn, binary.BigEndian, &msg); err != nil {
+		t.Fatalf("expected continuous updates to be disabled: %s", err)
+	}
+	if want := (EnableContinuousUpdatesMessage{messages.EnableContinuousUpdates, rfbflags.RFBFalse, 10, 20, 30, 40}); msg != want {
+		t.Errorf("incorrect message on pausing; got = %v, want = %v", msg, want)
+	}
+	// The server acknowledges with EndOfContinuousUpdates.
+	conn.continuousUpdates.Store(false)
+
+	if err := conn.Resume(); err != nil {
+		t.Fatalf("unexpected error resuming: %s", err)
+	}
+	if err := binary.Read(mockConn, binary.BigEndian, &msg); err != nil {
+		t.Fatalf("expected continuous updates to be enabled: %s", err)
+	}
+	if want := (EnableContinuousUpdatesMessage{messages.EnableContinuousUpdates, rfbflags.RFBTrue, 10, 20, 30, 40}); msg != want {
+		t.Errorf("incorrect message on resuming; got = %v, want = %v", msg, want)
+	}
+	var req FramebufferUpdateRequestMessage
+	if err := binary.Read(mockConn, binary.BigEndian, &req); err != nil {
+		t.Fatalf("expected a request on resuming: %s", err)
+	}
+	if want := (FramebufferUpdateRequestMessage{messages.FramebufferUpdateRequest, rfbflags.RFBFalse, 0, 0, 640, 480}); req != want {
+		t.Errorf("incorrect request on resuming; got = %v, want = %v", req, want)
+	}
+	if !conn.ContinuousUpdates() {
+		t.Error("expected continuous updates to be enabled")
+	}
+}
+
+func TestClientConfig_ParkReadsWhilePaused(t *testing.T) {
+	update := []byte{0, 0, 0, 0} // message-type, padding, number-of-rectangles
+	client, server := net.Pipe()
+	defer server.Close()
+	cfg := NewClientConfig("")
+	cfg.ParkReadsWhilePaused = true
+	conn := NewClientConn(client, cfg)
+	conn.fbWidth, conn.fbHeight = 640, 480
+	paused := make(chan struct{})
+	frames := 0
+	conn.config.OnFrameComplete = func([]Rectangle) {
+		if frames++; frames == 1 {
+			conn.Pause()
+			close(paused)
+		}
+	}
+	done := make(chan error, 1)
+	go func() { done <- conn.ListenAndHandle() }()
+
+	if _, err := server.Write(update); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	<-paused
+
+	// The next update isn't read until the connection is resumed.
+	wrote := make(chan error, 1)
+	go func() {
+		_, err := server.Write(update)
+		wrote <- err
+	}()
+	select {
+	case <-wrote:
+		t.Fatal("expected reads to be parked while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	go conn.Resume()
+	// Drain the request sent on resuming.
+	var req FramebufferUpdateRequestMessage
+	if err := binary.Read(server, binary.BigEndian, &req); err != nil {
+		t.Fatalf("expected a request on resuming: %s", err)
+	}
+	if err := <-wrote; err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.Close()
+	<-done
+}
+
+func TestClientConn_Pause_LateEndOfContinuousUpdates(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, NewClientConfig(""))
+	conn.fbWidth, conn.fbHeight = 640, 480
+	conn.confirmEncoding(encodings.EncContinuousUpdatesPseudo)
+	if err := conn.EnableContinuousUpdates(true, 0, 0, 640, 480); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := conn.Pause(); err != nil {
+		t.Fatalf("unexpected error pausing: %s", err)
+	}
+	// With reads parked, the acknowledgment of the disabling is only read
+	// after Resume has enabled continuous updates again.
+	if err := conn.Resume(); err != nil {
+		t.Fatalf("unexpected error resuming: %s", err)
+	}
+	msg, err := (&EndOfContinuousUpdates{}).Read(conn)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if msg.(*EndOfContinuousUpdates).ended {
+		t.Error("expected the late acknowledgment not to end continuous updates")
+	}
+	if !conn.ContinuousUpdates() {
+		t.Error("expected continuous updates to stay enabled")
+	}
+
+	// The server ending them itself still does.
+	if msg, err = (&EndOfContinuousUpdates{}).Read(conn); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !msg.(*EndOfContinuousUpdates).ended || conn.ContinuousUpdates() {
+		t.Error("expected continuous updates to be ended")
+	}
+}
+
+func TestClientConn_Pause_Error(t *testing.T) {
+	client, server := net.Pipe()
+	server.Close()
+	cfg := NewClientConfig("")
+	cfg.ParkReadsWhilePaused = true
+	conn := NewClientConn(client, cfg)
+	conn.continuousUpdates.Store(true)
+
+	if err := conn.Pause(); err == nil {
+		t.Fatal("expected an error pausing")
+	}
+	if conn.Paused() {
+		t.Error("expected the connection not to be paused")
+	}
+	done := make(chan struct{})
+	go func() {
+		conn.waitResumed()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected reads not to be parked")
+	}
+}
@@ -3,6 +3,7 @@
 package vnc
 
 import (
+	"encoding"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -11,10 +12,31 @@ import (
 	"github.com/bigangryrobot/go-vnc/rfbflags"
 )
 
+// Common pixel formats. The true-color formats are named after the order of
+// their components from most to least significant bits, and are big-endian;
+// copy and modify one to change its byte order.
 var (
-	PixelFormat8bit  PixelFormat = NewPixelFormat(8)
-	PixelFormat16bit PixelFormat = NewPixelFormat(16)
-	PixelFormat32bit PixelFormat = NewPixelFormat(32)
+	// PixelFormat8bit is 8 bits-per-pixel with a color map.
+	PixelFormat8bit = PixelFormat{BPP: 8, Depth: 8, BigEndian: rfbflags.RFBTrue, TrueColor: rfbflags.RFBFalse}
+	// PixelFormat8bitBGR is 8 bits-per-pixel BGR233 true-color.
+	PixelFormat8bitBGR = PixelFormat{BPP: 8, Depth: 8, BigEndian: rfbflags.RFBTrue, TrueColor: rfbflags.RFBTrue,
+		RedMax: 7, GreenMax: 7, BlueMax: 3, RedShift: 0, GreenShift: 3, BlueShift: 6}
+	// PixelFormat16bit is 16 bits-per-pixel RGB565 true-color.
+	PixelFormat16bit = PixelFormat{BPP: 16, Depth: 16, BigEndian: rfbflags.RFBTrue, TrueColor: rfbflags.RFBTrue,
+		RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5, BlueShift: 0}
+	// PixelFormat16bit555 is 16 bits-per-pixel RGB555 true-color, of depth 15,
+	// as used by some older servers.
+	PixelFormat16bit555 = PixelFormat{BPP: 16, Depth: 15, BigEndian: rfbflags.RFBTrue, TrueColor: rfbflags.RFBTrue,
+		RedMax: 31, GreenMax: 31, BlueMax: 31, RedShift: 10, GreenShift: 5, BlueShift: 0}
+	// PixelFormat16bitBGR is 16 bits-per-pixel BGR565 true-color.
+	PixelFormat16bitBGR = PixelFormat{BPP: 16, Depth: 16, BigEndian: rfbflags.RFBTrue, TrueColor: rfbflags.RFBTrue,
+		RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 0, GreenShift: 5, BlueShift: 11}
+	// PixelFormat32bit is 32 bits-per-pixel RGB888 true-color.
+	PixelFormat32bit = PixelFormat{BPP: 32, Depth: 32, BigEndian: rfbflags.RFBTrue, TrueColor: rfbflags.RFBTrue,
+		RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 16, GreenShift: 8, BlueShift: 0}
+	// PixelFormat32bitBGR is 32 bits-per-pixel BGR888 true-color.
+	PixelFormat32bitBGR = PixelFormat{BPP: 32, Depth: 32, BigEndian: rfbflags.RFBTrue, TrueColor: rfbflags.RFBTrue,
+		RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 0, GreenShift: 8, BlueShift: 16}
 )
 
 // PixelFormat describes the way a pixel is formatted for a VNC connection.
@@ -33,8 +55,14 @@ const pixelFormatLen = 16
 // Verify that interfaces are honored.
 var _ fmt.Stringer = (*PixelFormat)(nil)
 var _ MarshalerUnmarshaler = (*PixelFormat)(nil)
+var _ encoding.BinaryMarshaler = (*PixelFormat)(nil)
+var _ encoding.BinaryUnmarshaler = (*PixelFormat)(nil)
 
 // NewPixelFormat returns a populated PixelFormat structure.
+//
+// Deprecated: the red-, green- and blue-max values of the returned formats
+// overlap their shifts. Use one of the PixelFormat presets, or build a format
+// with PixelFormatBuilder.
 func NewPixelFormat(bpp uint8) PixelFormat {
 	bigEndian := rfbflags.RFBTrue
 	rgbMax := uint16(math.Exp2(float64(bpp))) - 1
@@ -63,22 +91,32 @@ func (pf PixelFormat) Marshal() ([]byte, error) {
 		return nil, NewVNCError(fmt.Sprintf("Invalid BPP value %v; must be 8, 16, or 32.", pf.BPP))
 	}
 
-	if pf.Depth < pf.BPP {
+	// Depth 15 is the RGB555 layout of 16 bits-per-pixel.
+	rgb555 := pf.BPP == 16 && pf.Depth == 15
+	if pf.Depth < pf.BPP && !rgb555 {
 		return nil, NewVNCError(fmt.Sprintf("Invalid Depth value %v; cannot be < BPP", pf.Depth))
 	}
 	switch pf.Depth {
-	case 8, 16, 32:
+	case 8, 15, 16, 32:
 	default:
-		return nil, NewVNCError(fmt.Sprintf("Invalid Depth value %v; must be 8, 16, or 32.", pf.Depth))
+		return nil, NewVNCError(fmt.Sprintf("Invalid Depth value %v; must be 8, 15, 16, or 32.", pf.Depth))
 	}
 
-	// Create the slice of bytes
-	buf := NewBuffer(nil)
-	if err := buf.Write(&pf); err != nil {
-		return nil, err
-	}
+	return pf.MarshalBinary()
+}
 
-	return buf.Bytes(), nil
+// MarshalBinary implements the encoding.BinaryMarshaler interface, returning
+// the 16-byte pixel-format structure sent in SetPixelFormat and ServerInit.
+// Unlike Marshal, it doesn't validate the format.
+func (pf PixelFormat) MarshalBinary() ([]byte, error) {
+	b := make([]byte, pixelFormatLen)
+	b[0], b[1] = pf.BPP, pf.Depth
+	b[2], b[3] = uint8(pf.BigEndian), uint8(pf.TrueColor)
+	binary.BigEndian.PutUint16(b[4:], pf.RedMax)
+	binary.BigEndian.PutUint16(b[6:], pf.GreenMax)
+	binary.BigEndian.PutUint16(b[8:], pf.BlueMax)
+	b[10], b[11], b[12] = pf.RedShift, pf.GreenShift, pf.BlueShift
+	return b, nil // The padding is zero.
 }
 
 // Read reads from an io.Reader, and populates the PixelFormat.
@@ -90,13 +128,33 @@ func (pf *PixelFormat) Read(r io.Reader) error {
 	return pf.Unmarshal(buf)
 }
 
-// Unmarshal implements the Unmarshaler interface.
+// Unmarshal implements the Unmarshaler interface, reading the pixel-format
+// structure at the start of data.
 func (pf *PixelFormat) Unmarshal(data []byte) error {
-	buf := NewBuffer(data)
+	if len(data) > pixelFormatLen {
+		data = data[:pixelFormatLen]
+	}
+	return pf.UnmarshalBinary(data)
+}
 
-	var msg PixelFormat
-	if err := buf.Read(&msg); err != nil {
-		return err
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface,
+// reading a 16-byte pixel-format structure, as returned by MarshalBinary.
+// Any nonzero true-color-flag is read as RFBTrue.
+func (pf *PixelFormat) UnmarshalBinary(data []byte) error {
+	if len(data) != pixelFormatLen {
+		return NewVNCError(fmt.Sprintf("pixel-format is %d bytes, not %d", len(data), pixelFormatLen))
+	}
+	msg := PixelFormat{
+		BPP:        data[0],
+		Depth:      data[1],
+		BigEndian:  rfbflags.RFBFlag(data[2]),
+		TrueColor:  rfbflags.RFBFlag(data[3]),
+		RedMax:     binary.BigEndian.Uint16(data[4:]),
+		GreenMax:   binary.BigEndian.Uint16(data[6:]),
+		BlueMax:    binary.BigEndian.Uint16(data[8:]),
+		RedShift:   data[10],
+		GreenShift: data[11],
+		BlueShift:  data[12],
 	}
 	if rfbflags.IsTrueColor(msg.TrueColor) {
 		msg.TrueColor = rfbflags.RFBTrue // Use our constant value.
@@ -112,9 +170,150 @@ func (pf PixelFormat) String() string {
 		pf.BPP, pf.Depth, pf.BigEndian, pf.TrueColor, pf.RedMax, pf.GreenMax, pf.BlueMax, pf.RedShift, pf.GreenShift, pf.BlueShift)
 }
 
+// BytesPerPixel returns the number of bytes holding each pixel, BPP rounded
+// up to whole bytes.
+func (pf PixelFormat) BytesPerPixel() int {
+	return (int(pf.BPP) + 7) / 8
+}
+
 func (pf PixelFormat) order() binary.ByteOrder {
 	if rfbflags.IsBigEndian(pf.BigEndian) {
 		return binary.BigEndian
 	}
 	return binary.LittleEndian
 }
+
+// readPixel returns the pixel value held in the first BytesPerPixel bytes of
+// data.
+func (pf PixelFormat) readPixel(data []byte) uint32 {
+	switch pf.BPP {
+	case 8:
+		return uint32(data[0])
+	case 16:
+		return uint32(pf.order().Uint16(data))
+	case 32:
+		return pf.order().Uint32(data)
+	}
+	return 0
+}
+
+// writePixel stores the pixel value in the first BytesPerPixel bytes of data.
+func (pf PixelFormat) writePixel(data []byte, pixel uint32) {
+	switch pf.BPP {
+	case 8:
+		data[0] = byte(pixel)
+	case 16:
+		pf.order().PutUint16(data, uint16(pixel))
+	case 32:
+		pf.order().PutUint32(data, pixel)
+	}
+}
+
+// compactPixelFormat returns a true-color pixel format using half the bits
+// per pixel of pf, or false if there is no smaller format.
+func compactPixelFormat(pf PixelFormat) (PixelFormat, bool) {
+	var compact PixelFormat
+	switch pf.BPP {
+	case 32:
+		compact = PixelFormat16bit
+	case 16:
+		compact = PixelFormat8bitBGR
+	default:
+		return PixelFormat{}, false
+	}
+	compact.BigEndian = pf.BigEndian
+	return compact, true
+}
+
+// PixelFormatBuilder builds a PixelFormat from its fields, validating that
+// they are consistent. A zero PixelFormatBuilder starts from an empty format;
+// use NewPixelFormatBuilder to start from an existing one.
+type PixelFormatBuilder struct {
+	pf PixelFormat
+}
+
+// NewPixelFormatBuilder returns a PixelFormatBuilder starting from pf.
+func NewPixelFormatBuilder(pf PixelFormat) *PixelFormatBuilder {
+	return &PixelFormatBuilder{pf: pf}
+}
+
+// BPP sets the bits-per-pixel.
+func (b *PixelFormatBuilder) BPP(bpp uint8) *PixelFormatBuilder {
+	b.pf.BPP = bpp
+	return b
+}
+
+// Depth sets the depth.
+func (b *PixelFormatBuilder) Depth(depth uint8) *PixelFormatBuilder {
+	b.pf.Depth = depth
+	return b
+}
+
+// BigEndian sets whether multi-byte pixels are big-endian.
+func (b *PixelFormatBuilder) BigEndian(bigEndian bool) *PixelFormatBuilder {
+	b.pf.BigEndian = rfbflags.BoolToRFBFlag(bigEndian)
+	return b
+}
+
+// TrueColor sets whether pixels hold their components, rather than an index
+// into the color map.
+func (b *PixelFormatBuilder) TrueColor(trueColor bool) *PixelFormatBuilder {
+	b.pf.TrueColor = rfbflags.BoolToRFBFlag(trueColor)
+	return b
+}
+
+// Red sets the maximum value of the red component, and its shift.
+func (b *PixelFormatBuilder) Red(max uint16, shift uint8) *PixelFormatBuilder {
+	b.pf.RedMax, b.pf.RedShift = max, shift
+	return b
+}
+
+// Green sets the maximum value of the green component, and its shift.
+func (b *PixelFormatBuilder) Green(max uint16, shift uint8) *PixelFormatBuilder {
+	b.pf.GreenMax, b.pf.GreenShift = max, shift
+	return b
+}
+
+// Blue sets the maximum value of the blue component, and its shift.
+func (b *PixelFormatBuilder) Blue(max uint16, shift uint8) *PixelFormatBuilder {
+	b.pf.BlueMax, b.pf.BlueShift = max, shift
+	return b
+}
+
+// Build returns the PixelFormat, or an error if its fields are inconsistent.
+// In addition to the checks made by Marshal, the components of a true-color
+// format must each have a maximum of one less than a power of two, fit within
+// the bits-per-pixel, and not overlap.
+func (b *PixelFormatBuilder) Build() (PixelFormat, error) {
+	pf := b.pf
+	if _, err := pf.Marshal(); err != nil {
+		return PixelFormat{}, err
+	}
+	if !rfbflags.IsTrueColor(pf.TrueColor) {
+		return pf, nil
+	}
+
+	var used uint32
+	for _, c := range []struct {
+		name  string
+		max   uint16
+		shift uint8
+	}{
+		{"red", pf.RedMax, pf.RedShift},
+		{"green", pf.GreenMax, pf.GreenShift},
+		{"blue", pf.BlueMax, pf.BlueShift},
+	} {
+		if c.max == 0 || c.max&(c.max+1) != 0 {
+			return PixelFormat{}, NewVNCError(fmt.Sprintf("Invalid %s-max value %v; must be one less than a power of two.", c.name, c.max))
+		}
+		bits := uint64(c.max) << c.shift
+		if bits >= 1<<pf.BPP {
+			return PixelFormat{}, NewVNCError(fmt.Sprintf("Invalid %s-shift value %v; %s doesn't fit in %v bits.", c.name, c.shift, c.name, pf.BPP))
+		}
+		if uint32(bits)&used != 0 {
+			return PixelFormat{}, NewVNCError(fmt.Sprintf("Invalid %s-shift value %v; %s overlaps another component.", c.name, c.shift, c.name))
+		}
+		used |= uint32(bits)
+	}
+	return pf, nil
+}
@@ -116,6 +116,48 @@ func TestPixelFormat_Unmarshal(t *testing.T) {
 	}
 }
 
+func TestPixelFormat_MarshalBinary(t *testing.T) {
+	// RGB565, little-endian, as sent by a server.
+	b := []byte{16, 16, 0, 1, 0, 31, 0, 63, 0, 31, 11, 5, 0, 0, 0, 0}
+	want := PixelFormat{BPP: 16, Depth: 16, BigEndian: RFBFalse, TrueColor: RFBTrue,
+		RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5, BlueShift: 0}
+
+	var pf PixelFormat
+	if err := pf.UnmarshalBinary(b); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !equalPixelFormat(pf, want) {
+		t.Errorf("incorrect pixel-format; got = %v, want = %v", pf, want)
+	}
+	got, err := pf.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Equal(got, b) {
+		t.Errorf("incorrect round-trip; got = %v, want = %v", got, b)
+	}
+
+	// The presets round-trip too, and Marshal agrees with MarshalBinary.
+	for _, pf := range []PixelFormat{PixelFormat8bit, PixelFormat16bit, PixelFormat32bitBGR} {
+		b, _ := pf.MarshalBinary()
+		m, err := pf.Marshal()
+		if err != nil || !bytes.Equal(m, b) {
+			t.Errorf("%v: Marshal disagrees with MarshalBinary; got = %v, %v, want = %v", pf, m, err, b)
+		}
+		var got PixelFormat
+		if err := got.UnmarshalBinary(b); err != nil || !equalPixelFormat(got, pf) {
+			t.Errorf("%v: incorrect round-trip; got = %v, %v", pf, got, err)
+		}
+	}
+
+	for _, n := range []int{0, 15, 17} {
+		var pf PixelFormat
+		if err := pf.UnmarshalBinary(make([]byte, n)); err == nil {
+			t.Errorf("expected error for %d bytes", n)
+		}
+	}
+}
+
 func TestPixelFormat_String(t *testing.T) {
 	for _, tt := range []struct {
 		desc string
@@ -143,3 +185,95 @@ func equalPixelFormat(g, w PixelFormat) bool {
 	}
 	return operators.EqualSlicesOfByte(got, want)
 }
+
+func TestPixelFormat_Presets(t *testing.T) {
+	for _, tt := range []struct {
+		desc string
+		pf   PixelFormat
+		b    []byte
+	}{
+		{"8bit", PixelFormat8bit,
+			[]uint8{8, 8, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{"8bit BGR233", PixelFormat8bitBGR,
+			[]uint8{8, 8, 1, 1, 0, 7, 0, 7, 0, 3, 0, 3, 6, 0, 0, 0}},
+		{"16bit RGB565", PixelFormat16bit,
+			[]uint8{16, 16, 1, 1, 0, 31, 0, 63, 0, 31, 11, 5, 0, 0, 0, 0}},
+		{"16bit RGB555", PixelFormat16bit555,
+			[]uint8{16, 15, 1, 1, 0, 31, 0, 31, 0, 31, 10, 5, 0, 0, 0, 0}},
+		{"16bit BGR565", PixelFormat16bitBGR,
+			[]uint8{16, 16, 1, 1, 0, 31, 0, 63, 0, 31, 0, 5, 11, 0, 0, 0}},
+		{"32bit RGB888", PixelFormat32bit,
+			[]uint8{32, 32, 1, 1, 0, 255, 0, 255, 0, 255, 16, 8, 0, 0, 0, 0}},
+		{"32bit BGR888", PixelFormat32bitBGR,
+			[]uint8{32, 32, 1, 1, 0, 255, 0, 255, 0, 255, 0, 8, 16, 0, 0, 0}},
+	} {
+		b, err := tt.pf.Marshal()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.desc, err)
+			continue
+		}
+		if got, want := b, tt.b; !bytes.Equal(got, want) {
+			t.Errorf("%s: incorrect pixel-format; got = %v, want = %v", tt.desc, got, want)
+		}
+		if _, err := NewPixelFormatBuilder(tt.pf).Build(); err != nil {
+			t.Errorf("%s: unexpected error building preset: %s", tt.desc, err)
+		}
+	}
+}
+
+func TestPixelFormat_BytesPerPixel(t *testing.T) {
+	for _, tt := range []struct {
+		bpp  uint8
+		want int
+	}{
+		{8, 1},
+		{15, 2},
+		{16, 2},
+		{24, 3},
+		{32, 4},
+	} {
+		if got := (PixelFormat{BPP: tt.bpp}).BytesPerPixel(); got != tt.want {
+			t.Errorf("bpp %d: incorrect bytes per pixel; got = %v, want = %v", tt.bpp, got, tt.want)
+		}
+	}
+}
+
+func TestPixelFormatBuilder(t *testing.T) {
+	rgb565 := func() *PixelFormatBuilder {
+		return (&PixelFormatBuilder{}).BPP(16).Depth(16).BigEndian(true).TrueColor(true).
+			Red(31, 11).Green(63, 5).Blue(31, 0)
+	}
+	for _, tt := range []struct {
+		desc string
+		b    *PixelFormatBuilder
+		want PixelFormat
+		ok   bool
+	}{
+		{"RGB565", rgb565(), PixelFormat16bit, true},
+		{"little-endian", NewPixelFormatBuilder(PixelFormat32bit).BigEndian(false),
+			PixelFormat{BPP: 32, Depth: 32, BigEndian: RFBFalse, TrueColor: RFBTrue,
+				RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 16, GreenShift: 8, BlueShift: 0}, true},
+		{"color-mapped", (&PixelFormatBuilder{}).BPP(8).Depth(8), PixelFormat{BPP: 8, Depth: 8}, true},
+		{"invalid BPP", rgb565().BPP(24), PixelFormat{}, false},
+		{"depth < BPP", rgb565().Depth(8), PixelFormat{}, false},
+		{"zero max", rgb565().Red(0, 11), PixelFormat{}, false},
+		{"max not a power of two less one", rgb565().Green(62, 5), PixelFormat{}, false},
+		{"component beyond BPP", rgb565().Red(31, 12), PixelFormat{}, false},
+		{"overlapping components", rgb565().Green(63, 6), PixelFormat{}, false},
+	} {
+		pf, err := tt.b.Build()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: unexpected error: %v", tt.desc, err)
+			continue
+		}
+		if err != nil {
+			if _, ok := err.(*VNCError); !ok {
+				t.Errorf("%s: unexpected %v error: %v", tt.desc, reflect.TypeOf(err), err)
+			}
+			continue
+		}
+		if got, want := pf, tt.want; got != want {
+			t.Errorf("%s: incorrect pixel format; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Intercepting VNC proxy implementation.
+
+package vnc
+
+import (
+	"context"
+	"net"
+
+	"github.com/bigangryrobot/go-vnc/buttons"
+	"github.com/bigangryrobot/go-vnc/encodings"
+	"github.com/bigangryrobot/go-vnc/keys"
+	"github.com/bigangryrobot/go-vnc/rfbflags"
+)
+
+// proxyEncodings are the encodings a Proxy can decode from the backend and
+// re-marshal to the client. Encodings requested by the client that are not
+// in this set are not forwarded to the backend.
+var proxyEncodings = map[encodings.EncodingType]Encoding{
+	encodings.EncRaw:               &RawEncoding{},
+	encodings.EncDesktopSizePseudo: &DesktopSizePseudoEncoding{},
+}
+
+// A Proxy sits between a VNC client and a backend VNC server, forwarding
+// messages in both directions. Each leg is authenticated independently: the
+// client authenticates to the proxy using ServerConfig, and the proxy
+// authenticates to the backend using ClientConfig.
+type Proxy struct {
+	// Dial opens a connection to the backend VNC server.
+	Dial func() (net.Conn, error)
+
+	// ClientConfig configures the connection to the backend. It is copied
+	// for each proxied connection.
+	ClientConfig *ClientConfig
+
+	// ServerConfig configures the connection with the client. It is copied
+	// for each proxied connection, and its desktop name, framebuffer size and
+	// pixel format are replaced by those of the backend.
+	ServerConfig *ServerConfig
+
+	// ClientHook, if set, is called with each message received from the
+	// client before it is forwarded to the backend. Returning an error
+	// terminates the proxied connection.
+	ClientHook ServerHandler
+
+	// ServerHook, if set, is called with each message received from the
+	// backend before it is forwarded to the client. Returning an error
+	// terminates the proxied connection.
+	ServerHook func(msg ServerMessage) error
+}
+
+// Serve accepts client connections on the listener l, and proxies each of
+// them on its own goroutine, logging their errors to ServerConfig.Logger.
+// Serve returns when l.Accept fails.
+func (p *Proxy) Serve(l net.Listener) error {
+	logger := p.ServerConfig.logger()
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := p.ServeConn(nc); err != nil {
+				logger.Printf("error proxying connection from %v; %v", nc.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn proxies a single client connection until either side closes.
+func (p *Proxy) ServeConn(nc net.Conn) error {
+	bc, err := p.Dial()
+	if err != nil {
+		nc.Close()
+		return Errorf("failure dialing backend; %v", err)
+	}
+	ccfg := *p.ClientConfig
+	ccfg.ServerMessageCh = make(chan ServerMessage)
+	ccfg.RequestInitialUpdate = false // The client's requests are forwarded instead.
+	ccfg.AutoRequestUpdates = false
+	backend, err := Connect(context.Background(), bc, &ccfg)
+	if err != nil {
+		nc.Close()
+		return Errorf("failure connecting to backend; %v", err)
+	}
+	defer backend.Close()
+
+	scfg := *p.ServerConfig
+	scfg.DesktopName = backend.GetDesktopName()
+	scfg.FBWidth = backend.GetFramebufferWidth()
+	scfg.FBHeight = backend.GetFramebufferHeight()
+	scfg.PixelFormat = backend.GetPixelFormat()
+	client, err := Accept(nc, &scfg)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	go func() {
+		backend.ListenAndHandle()
+		close(ccfg.ServerMessageCh)
+	}()
+	go func() {
+		for msg := range ccfg.ServerMessageCh {
+			if err := p.forwardServerMessage(client, msg); err != nil {
+				client.log.Printf("error forwarding server message; %v", err)
+				break
+			}
+		}
+		client.Close()
+		backend.Close()
+		for range ccfg.ServerMessageCh {
+			// Drain so the backend reader can observe the close.
+		}
+	}()
+
+	return client.ListenAndHandle(&proxyConn{p, backend})
+}
+
+// forwardServerMessage sends a message received from the backend to the client.
+func (p *Proxy) forwardServerMessage(client *ServerConn, msg ServerMessage) error {
+	if p.ServerHook != nil {
+		if err := p.ServerHook(msg); err != nil {
+			return err
+		}
+	}
+
+	switch msg := msg.(type) {
+	case *FramebufferUpdate:
+		return client.FramebufferUpdate(msg.Rects)
+	case *SetColorMapEntries:
+		return client.SetColorMapEntries(msg.FirstColor, msg.Colors)
+	case *Bell:
+		return client.Bell()
+	case *ServerCutText:
+		return client.ServerCutText(msg.Text)
+	}
+	return Errorf("unable to forward server message-type: %v", msg.Type())
+}
+
+// proxyConn implements the ServerHandler interface, forwarding client
+// messages to the backend.
+type proxyConn struct {
+	p       *Proxy
+	backend *ClientConn
+}
+
+// Verify that interfaces are honored.
+var _ ServerHandler = (*proxyConn)(nil)
+
+func (pc *proxyConn) SetPixelFormat(c *ServerConn, pf PixelFormat) error {
+	if h := pc.p.ClientHook; h != nil {
+		if err := h.SetPixelFormat(c, pf); err != nil {
+			return err
+		}
+	}
+	return pc.backend.SetPixelFormat(pf)
+}
+
+func (pc *proxyConn) SetEncodings(c *ServerConn, encs []encodings.EncodingType) error {
+	if h := pc.p.ClientHook; h != nil {
+		if err := h.SetEncodings(c, encs); err != nil {
+			return err
+		}
+	}
+	var supported Encodings
+	for _, e := range encs {
+		if enc, ok := proxyEncodings[e]; ok {
+			supported = append(supported, enc)
+		}
+	}
+	return pc.backend.SetEncodings(supported)
+}
+
+func (pc *proxyConn) FramebufferUpdateRequest(c *ServerConn, inc rfbflags.RFBFlag, x, y, w, h uint16) error {
+	if hook := pc.p.ClientHook; hook != nil {
+		if err := hook.FramebufferUpdateRequest(c, inc, x, y, w, h); err != nil {
+			return err
+		}
+	}
+	return pc.backend.FramebufferUpdateRequest(inc, x, y, w, h)
+}
+
+func (pc *proxyConn) KeyEvent(c *ServerConn, key keys.Key, down bool) error {
+	if h := pc.p.ClientHook; h != nil {
+		if err := h.KeyEvent(c, key, down); err != nil {
+			return err
+		}
+	}
+	return pc.backend.KeyEvent(key, down)
+}
+
+func (pc *proxyConn) PointerEvent(c *ServerConn, button buttons.Button, x, y uint16) error {
+	if h := pc.p.ClientHook; h != nil {
+		if err := h.PointerEvent(c, button, x, y); err != nil {
+			return err
+		}
+	}
+	return pc.backend.PointerEvent(button, x, y)
+}
+
+func (pc *proxyConn) ClientCutText(c *ServerConn, text string) error {
+	if h := pc.p.ClientHook; h != nil {
+		if err := h.ClientCutText(c, text); err != nil {
+			return err
+		}
+	}
+	return pc.backend.ClientCutText(text)
+}
@@ -0,0 +1,149 @@
+package vnc
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bigangryrobot/go-vnc/keys"
+	"github.com/bigangryrobot/go-vnc/messages"
+	"github.com/bigangryrobot/go-vnc/rfbflags"
+)
+
+func TestProxy(t *testing.T) {
+	SetSettle(0) // Disable UI settling for tests.
+
+	// Backend server.
+	bcfg := NewServerConfig("backend")
+	bcfg.DesktopName = "backend desktop"
+	bcfg.FBWidth, bcfg.FBHeight = 320, 240
+	backend := newRecordingHandler()
+	backendAddr := newTestServer(t, bcfg, backend)
+
+	// Proxy.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	defer ln.Close()
+	clientHook := newRecordingHandler()
+	serverMsgs := make(chan messages.ServerMessage, 16)
+	p := &Proxy{
+		Dial:         func() (net.Conn, error) { return net.Dial("tcp", backendAddr) },
+		ClientConfig: NewClientConfig("backend"),
+		ServerConfig: NewServerConfig("front"),
+		ClientHook:   clientHook,
+		ServerHook: func(msg ServerMessage) error {
+			serverMsgs <- msg.Type()
+			return nil
+		},
+	}
+	go p.Serve(ln)
+
+	// Client.
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting to proxy: %s", err)
+	}
+	ccfg := NewClientConfig("front")
+	ccfg.ServerMessageCh = make(chan ServerMessage, 1)
+	ccfg.RequestInitialUpdate = false
+	vc, err := Connect(context.Background(), nc, ccfg)
+	if err != nil {
+		t.Fatalf("unexpected error connecting to proxy: %s", err)
+	}
+	defer vc.Close()
+	go vc.ListenAndHandle()
+
+	if got, want := vc.GetDesktopName(), bcfg.DesktopName; got != want {
+		t.Errorf("incorrect desktop name; got = %q, want = %q", got, want)
+	}
+	if got, want := vc.GetFramebufferWidth(), bcfg.FBWidth; got != want {
+		t.Errorf("incorrect framebuffer width; got = %v, want = %v", got, want)
+	}
+
+	// The backend sees the proxy's own SetEncodings/SetPixelFormat from
+	// Connect, followed by the client's forwarded ones.
+	backend.expect(t, "SetEncodings [Raw]")
+	backend.expect(t, "SetPixelFormat bpp:32")
+	clientHook.expect(t, "SetEncodings [Raw]")
+	backend.expect(t, "SetEncodings [Raw]")
+	clientHook.expect(t, "SetPixelFormat bpp:32")
+	backend.expect(t, "SetPixelFormat bpp:32")
+
+	vc.KeyEvent(keys.Return, PressKey)
+	want := fmt.Sprintf("KeyEvent %v true", keys.Return)
+	clientHook.expect(t, want)
+	backend.expect(t, want)
+
+	vc.FramebufferUpdateRequest(rfbflags.RFBFalse, 0, 0, 10, 10)
+	want = "FramebufferUpdateRequest RFBFalse 0 0 10 10"
+	clientHook.expect(t, want)
+	backend.expect(t, want)
+
+	// The backend responds to the request with a Bell.
+	for _, ch := range []<-chan messages.ServerMessage{serverMsgs, serverMessageTypes(ccfg.ServerMessageCh)} {
+		select {
+		case got := <-ch:
+			if want := messages.Bell; got != want {
+				t.Errorf("incorrect server message; got = %v, want = %v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for Bell")
+		}
+	}
+}
+
+func TestProxy_BadClientPassword(t *testing.T) {
+	backendAddr := newTestServer(t, NewServerConfig(""), newRecordingHandler())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	defer ln.Close()
+	logged := make(chanWriter, 16)
+	scfg := NewServerConfig("front")
+	scfg.Logger = log.New(logged, "", 0)
+	p := &Proxy{
+		Dial:         func() (net.Conn, error) { return net.Dial("tcp", backendAddr) },
+		ClientConfig: NewClientConfig(""),
+		ServerConfig: scfg,
+	}
+	go p.Serve(ln)
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting to proxy: %s", err)
+	}
+	if _, err := Connect(context.Background(), nc, NewClientConfig("wrong")); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// The failed connection is logged to the ServerConfig's Logger.
+	for {
+		select {
+		case line := <-logged:
+			if strings.HasPrefix(line, "error proxying connection") {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the proxying error to be logged")
+		}
+	}
+}
+
+// serverMessageTypes returns a channel of the types of messages received on ch.
+func serverMessageTypes(ch <-chan ServerMessage) <-chan messages.ServerMessage {
+	types := make(chan messages.ServerMessage, 1)
+	go func() {
+		for msg := range ch {
+			types <- msg.Type()
+		}
+	}()
+	return types
+}
@@ -0,0 +1,82 @@
+// Throughput metrics.
+
+package vnc
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/bigangryrobot/go-vnc/go/metrics"
+)
+
+// rateWindow is the time constant of the moving average kept by a
+// rateGauge: bytes counted this long ago weigh 1/e as much as bytes counted
+// now.
+const rateWindow = time.Second
+
+// rateGauge is a metric of the rate, in bytes per second, at which bytes are
+// counted by Adjust, as an exponentially weighted moving average over
+// rateWindow. The rate decays while nothing is counted, so that stalls show.
+type rateGauge struct {
+	mu    sync.Mutex
+	clock clock
+	rate  float64 // As of last.
+	last  time.Time
+}
+
+// Verify that interfaces are honored.
+var _ metrics.Metric = (*rateGauge)(nil)
+
+func newRateGauge(clk clock) *rateGauge {
+	return &rateGauge{clock: clk, last: clk.Now()}
+}
+
+// setClock makes the gauge use clk, restarting it at zero.
+func (g *rateGauge) setClock(clk clock) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.clock, g.rate, g.last = clk, 0, clk.Now()
+}
+
+// decay brings the rate up to now. The caller holds g.mu.
+func (g *rateGauge) decay(now time.Time) {
+	if dt := now.Sub(g.last); dt > 0 {
+		g.rate *= math.Exp(-float64(dt) / float64(rateWindow))
+		g.last = now
+	}
+}
+
+// Adjust implements the metrics.Metric interface, counting n bytes now.
+// Negative counts are ignored.
+func (g *rateGauge) Adjust(n int64) {
+	if n <= 0 {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.decay(g.clock.Now())
+	g.rate += float64(n) / rateWindow.Seconds()
+}
+
+// Increment implements the metrics.Metric interface, counting one byte.
+func (g *rateGauge) Increment() { g.Adjust(1) }
+
+// Name implements the metrics.Metric interface.
+func (g *rateGauge) Name() string { return "" }
+
+// Reset implements the metrics.Metric interface.
+func (g *rateGauge) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.rate, g.last = 0, g.clock.Now()
+}
+
+// Value implements the metrics.Metric interface, returning the current rate
+// in bytes per second.
+func (g *rateGauge) Value() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.decay(g.clock.Now())
+	return uint64(math.Round(g.rate))
+}
@@ -0,0 +1,47 @@
+package vnc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClientConn_RateMetrics(t *testing.T) {
+	conn := NewClientConn(&MockConn{}, &ClientConfig{})
+	clk := newFakeClock()
+	conn.setClock(clk)
+
+	within := func(got, want, tolerance uint64) bool {
+		return got+tolerance >= want && got <= want+tolerance
+	}
+
+	// Receive 1000 bytes every 100ms, i.e. 10000 bytes per second, for long
+	// enough that the average settles; send nothing.
+	for i := 0; i < 100; i++ {
+		clk.Advance(100 * time.Millisecond)
+		conn.adjustMetric("bytes-received", 1000)
+	}
+	if got := conn.metricValue("read-bps"); !within(got, 10000, 600) {
+		t.Errorf("incorrect steady read rate; got = %d, want ~10000", got)
+	}
+	if got := conn.metricValue("write-bps"); got != 0 {
+		t.Errorf("incorrect write rate; got = %d, want = 0", got)
+	}
+	if got, want := conn.metricValue("bytes-received"), uint64(100*1000); got != want {
+		t.Errorf("incorrect bytes-received; got = %d, want = %d", got, want)
+	}
+
+	// Doubling the rate is tracked within a few windows.
+	for i := 0; i < 50; i++ {
+		clk.Advance(100 * time.Millisecond)
+		conn.adjustMetric("bytes-received", 2000)
+	}
+	if got := conn.metricValue("read-bps"); !within(got, 20000, 1200) {
+		t.Errorf("incorrect doubled read rate; got = %d, want ~20000", got)
+	}
+
+	// A stall decays the rate towards zero.
+	clk.Advance(5 * time.Second)
+	if got := conn.metricValue("read-bps"); got > 200 {
+		t.Errorf("incorrect read rate after a stall; got = %d, want ~0", got)
+	}
+}
@@ -0,0 +1,70 @@
+// Structured records of decoded rectangles, for debugging.
+
+package vnc
+
+import (
+	"image"
+	"image/color"
+)
+
+// RectInfo describes a decoded rectangle of pixel data, as passed to
+// ClientConfig.OnDecodedRectangle.
+type RectInfo struct {
+	X, Y, Width, Height uint16
+	Encoding            string // The name of the encoding, such as "Tight".
+	Pixels              int    // The number of pixels, Width * Height.
+
+	// Sample is the color of the rectangle's top-left pixel as drawn onto
+	// the framebuffer, valid if Sampled is set. CopyRect rectangles, which
+	// hold no pixels of their own, and rectangles that fail to draw aren't
+	// sampled.
+	Sample  color.RGBA
+	Sampled bool
+}
+
+// pixelSampler is a draw.Image keeping only the color set at one point.
+type pixelSampler struct {
+	at  image.Point
+	col color.RGBA
+	ok  bool
+}
+
+func (s *pixelSampler) ColorModel() color.Model { return color.RGBAModel }
+func (s *pixelSampler) Bounds() image.Rectangle {
+	return image.Rectangle{s.at, s.at.Add(image.Pt(1, 1))}
+}
+func (s *pixelSampler) At(x, y int) color.Color { return s.col }
+func (s *pixelSampler) Set(x, y int, col color.Color) {
+	if image.Pt(x, y) == s.at {
+		s.col, s.ok = color.RGBAModel.Convert(col).(color.RGBA), true
+	}
+}
+
+// decodedRectangles calls the OnDecodedRectangle callback, if any, for each
+// rectangle of pixel data among rects, in order.
+func (c *ClientConn) decodedRectangles(rects []Rectangle) {
+	if c.config.OnDecodedRectangle == nil {
+		return
+	}
+	for i := range rects {
+		rect := &rects[i]
+		if rect.Enc == nil || rect.Enc.Type() < 0 {
+			continue
+		}
+		info := RectInfo{
+			X:        rect.X,
+			Y:        rect.Y,
+			Width:    rect.Width,
+			Height:   rect.Height,
+			Encoding: rect.Enc.Type().String(),
+			Pixels:   rect.Area(),
+		}
+		if _, ok := rect.Enc.(*CopyRectEncoding); !ok && rect.Area() > 0 {
+			s := &pixelSampler{at: image.Pt(int(rect.X), int(rect.Y))}
+			if err := c.drawRectangle(s, rect); err == nil {
+				info.Sample, info.Sampled = s.col, s.ok
+			}
+		}
+		c.config.OnDecodedRectangle(info)
+	}
+}
@@ -0,0 +1,36 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/color"
+	"reflect"
+	"testing"
+
+	"github.com/bigangryrobot/go-vnc/encodings"
+)
+
+func TestClientConfig_OnDecodedRectangle(t *testing.T) {
+	var update bytes.Buffer
+	update.Write([]byte{0, 0, 2}) // padding, number-of-rectangles
+	binary.Write(&update, binary.BigEndian, rectangleMessage{3, 4, 2, 1, encodings.EncRaw})
+	update.Write([]byte{0, 0x12, 0x34, 0x56, 0, 0xff, 0xff, 0xff}) // in roundTripFormat
+	binary.Write(&update, binary.BigEndian, rectangleMessage{0, 0, 2, 1, encodings.EncCopyRect})
+	binary.Write(&update, binary.BigEndian, [2]uint16{3, 4})
+
+	conn := roundTripConn(update.Bytes())
+	var got []RectInfo
+	conn.config.OnDecodedRectangle = func(info RectInfo) { got = append(got, info) }
+	if _, err := (&FramebufferUpdate{}).Read(conn); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := []RectInfo{
+		{X: 3, Y: 4, Width: 2, Height: 1, Encoding: "Raw", Pixels: 2,
+			Sample: color.RGBA{0x12, 0x34, 0x56, 0xff}, Sampled: true},
+		{X: 0, Y: 0, Width: 2, Height: 1, Encoding: "CopyRect", Pixels: 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect rectangle info; got = %+v, want = %+v", got, want)
+	}
+}
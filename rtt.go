@@ -0,0 +1,68 @@
+// Choosing the initial encoding preference from the round-trip time.
+//
+// The round-trip time of the link is measured during the handshake, from
+// sending the client's ProtocolVersion to receiving the server's security
+// types, which the server only sends once it has read the version. When
+// ClientConfig.AutoEncodingByRTT is set, the encodings of autoEncodings are
+// added to those advertised during negotiation, and all are reordered: on
+// links slower than the threshold, the compressed encodings of
+// compressedEncodings come first, trading decoding time for bandwidth; on
+// faster links, the light encodings of lightEncodings come first, being
+// cheapest to decode. CopyRect, cheap on any link, stays in front of both.
+
+package vnc
+
+import (
+	"slices"
+	"time"
+
+	"github.com/bigangryrobot/go-vnc/encodings"
+)
+
+// DefaultAutoEncodingRTTThreshold is the default
+// ClientConfig.AutoEncodingRTTThreshold.
+const DefaultAutoEncodingRTTThreshold = 20 * time.Millisecond
+
+// autoEncodings returns the encodings advertised with AutoEncodingByRTT, in
+// addition to those set.
+func autoEncodings() Encodings {
+	return Encodings{&CopyRectEncoding{}, &RawEncoding{}, &HextileEncoding{}, &ZRLEEncoding{}, &TightEncoding{}}
+}
+
+// lightEncodings are preferred on links faster than the threshold.
+var lightEncodings = []encodings.EncodingType{
+	encodings.EncRaw,
+	encodings.EncHextile,
+}
+
+// RTT returns the round-trip time to the server as measured during the
+// handshake, or zero if it hasn't been measured.
+func (c *ClientConn) RTT() time.Duration { return c.rtt }
+
+// orderEncodingsByRTT returns a copy of encs, with the encodings of
+// autoEncodings added, ordered for the measured round-trip time.
+func (c *ClientConn) orderEncodingsByRTT(encs Encodings) Encodings {
+	threshold := c.config.AutoEncodingRTTThreshold
+	if threshold == 0 {
+		threshold = DefaultAutoEncodingRTTThreshold
+	}
+	preferred := lightEncodings
+	if c.rtt >= threshold {
+		preferred = compressedEncodings
+	}
+	if c.log != nil {
+		c.log.Printf("round-trip time %v; preferring %v", c.rtt, preferred)
+	}
+
+	encs = slices.Clone(encs)
+	for _, enc := range autoEncodings() {
+		if !encs.Contains(enc.Type()) {
+			encs = append(encs, enc)
+		}
+	}
+	for i := len(preferred) - 1; i >= 0; i-- {
+		encs.Prioritize(preferred[i])
+	}
+	encs.Prioritize(encodings.EncCopyRect)
+	return encs
+}
@@ -0,0 +1,80 @@
+package vnc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bigangryrobot/go-vnc/encodings"
+)
+
+// latencyConn is a chunkConn on a link with a round-trip time of rtt: reading
+// the reply to data written advances clk by rtt.
+type latencyConn struct {
+	chunkConn
+	clk   *fakeClock
+	rtt   time.Duration
+	wrote bool
+}
+
+func (c *latencyConn) Write(b []byte) (int, error) {
+	c.wrote = true
+	return c.chunkConn.Write(b)
+}
+
+func (c *latencyConn) Read(b []byte) (int, error) {
+	if c.wrote {
+		c.clk.Advance(c.rtt)
+		c.wrote = false
+	}
+	return c.chunkConn.Read(b)
+}
+
+func TestClientConfig_AutoEncodingByRTT(t *testing.T) {
+	var serverInit bytes.Buffer
+	binary.Write(&serverInit, binary.BigEndian, ServerInit{FBWidth: 8, FBHeight: 6, PixelFormat: NewPixelFormat(32)})
+	handshake := [][]byte{[]byte(PROTO_VERS_3_8), {1, SecTypeNone}, serverInit.Bytes()}
+
+	for _, tt := range []struct {
+		desc    string
+		rtt     time.Duration
+		auto    bool
+		initial Encodings
+		want    []encodings.EncodingType
+	}{
+		{"lan", time.Millisecond, true, Encodings{&RawEncoding{}}, []encodings.EncodingType{
+			encodings.EncCopyRect, encodings.EncRaw, encodings.EncHextile, encodings.EncZRLE, encodings.EncTight}},
+		{"wan", 80 * time.Millisecond, true, Encodings{&RawEncoding{}}, []encodings.EncodingType{
+			encodings.EncCopyRect, encodings.EncTight, encodings.EncZRLE, encodings.EncRaw, encodings.EncHextile}},
+		{"wan keeping pseudo-encodings", 80 * time.Millisecond, true, Encodings{&CursorPseudoEncoding{}, &HextileEncoding{}}, []encodings.EncodingType{
+			encodings.EncCopyRect, encodings.EncTight, encodings.EncZRLE, encodings.EncCursorPseudo, encodings.EncHextile, encodings.EncRaw}},
+		{"disabled", 80 * time.Millisecond, false, Encodings{&RawEncoding{}}, []encodings.EncodingType{
+			encodings.EncRaw}},
+	} {
+		clk := newFakeClock()
+		nc := &latencyConn{chunkConn: chunkConn{chunks: slices.Clone(handshake)}, clk: clk, rtt: tt.rtt}
+		cfg := NewClientConfig("")
+		cfg.AutoEncodingByRTT = tt.auto
+		conn := NewClientConn(nc, cfg)
+		conn.setClock(clk)
+		conn.encodings = tt.initial
+		initial := append(Encodings(nil), tt.initial...)
+
+		if err := conn.negotiate(context.Background()); err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.desc, err)
+		}
+		if got, want := conn.RTT(), tt.rtt; got != want {
+			t.Errorf("%s: incorrect RTT; got = %v, want = %v", tt.desc, got, want)
+		}
+		if got := encodingTypes(conn.GetEncodings()); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: incorrect encodings; got = %v, want = %v", tt.desc, got, tt.want)
+		}
+		if !reflect.DeepEqual(tt.initial, initial) {
+			t.Errorf("%s: encodings set were modified; got = %v, want = %v", tt.desc, tt.initial, initial)
+		}
+	}
+}
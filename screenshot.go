@@ -0,0 +1,195 @@
+package vnc
+
+import (
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"time"
+
+	"github.com/bigangryrobot/go-vnc/messages"
+	"github.com/bigangryrobot/go-vnc/rfbflags"
+)
+
+// Screenshot requests the whole framebuffer from the server and returns it as
+// an image once the resulting FramebufferUpdate has been read. Other server
+// messages received in the meantime are read and discarded. The update is
+// read as by ListenAndHandle, so that it is applied to the framebuffer model
+// and passed to the callbacks as usual; a DesktopSize pseudo-rectangle
+// resizes the image.
+//
+// Screenshot reads from the connection itself, so it must not be called while
+// ListenAndHandle is running.
+//
+// If ctx is done before the update has been read in full, the image holds the
+// rectangles decoded so far, complete is false, and err is ctx.Err(). With a
+// DecodeConcurrency above 1, rectangles are only drawn once all of them have
+// been decoded. The connection is then part way through a message, and
+// should be closed.
+func (c *ClientConn) Screenshot(ctx context.Context) (img *image.RGBA, complete bool, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	// The image is returned whatever the outcome, holding the rectangles
+	// drawn so far.
+	w, h := c.framebufferSize()
+	c.screenshot = image.NewRGBA(image.Rect(0, 0, int(w), int(h)))
+	defer func() {
+		img, c.screenshot = c.screenshot, nil
+	}()
+
+	// Interrupt blocked reads when ctx is done, restoring the read deadline
+	// afterwards, once the interruption has been made.
+	c.deadlineMu.Lock()
+	deadline := c.readDeadline
+	c.deadlineMu.Unlock()
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		c.SetReadDeadline(time.Unix(1, 0))
+		close(interrupted)
+	})
+	defer func() {
+		if !stop() {
+			<-interrupted
+			c.SetReadDeadline(deadline)
+		}
+		if err != nil && ctx.Err() != nil {
+			complete, err = false, ctx.Err()
+		}
+	}()
+
+	if err := c.FramebufferUpdateRequest(rfbflags.RFBFalse, 0, 0, w, h); err != nil {
+		return nil, false, err
+	}
+
+	serverMessages := make(map[messages.ServerMessage]ServerMessage)
+	for _, m := range c.config.ServerMessages {
+		serverMessages[m.Type()] = m
+	}
+	for {
+		messageType, err := c.receiveMessageType()
+		if err != nil {
+			return nil, false, err
+		}
+		if messageType == messages.FramebufferUpdate {
+			break
+		}
+		msg, ok := serverMessages[messageType]
+		if !ok {
+			return nil, false, &ProtocolError{Errorf("unsupported message-type: %v", messageType)}
+		}
+		if _, err := msg.Read(c); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if _, err := (&FramebufferUpdate{}).Read(c); err != nil {
+		return nil, false, err
+	}
+	return nil, true, nil
+}
+
+// drawScreenshot draws rect onto the image of Screenshot, if one is being
+// taken, replacing the image for a DesktopSize pseudo-rectangle with one of
+// the new size, holding the overlapping top-left region of the old one.
+func (c *ClientConn) drawScreenshot(rect *Rectangle) error {
+	if c.screenshot == nil {
+		return nil
+	}
+	if _, ok := rect.Enc.(*DesktopSizePseudoEncoding); ok {
+		img := image.NewRGBA(image.Rect(0, 0, int(rect.Width), int(rect.Height)))
+		draw.Draw(img, img.Bounds().Intersect(c.screenshot.Bounds()), c.screenshot, image.Point{}, draw.Src)
+		c.screenshot = img
+		return nil
+	}
+	return c.drawRectangle(c.screenshot, rect)
+}
+
+// drawRectangle draws the pixel data of rect onto img. Rectangles without
+// pixel data, such as those of pseudo-encodings, are ignored. An error is
+// returned, and nothing drawn, if an RRE or CoRRE sub-rectangle extends
+// beyond its rectangle. Pixels are packed and stored directly into the Pix
+// of an *image.RGBA, and set through img.Set otherwise.
+func (c *ClientConn) drawRectangle(img draw.Image, rect *Rectangle) error {
+	rgba, _ := img.(*image.RGBA)
+	set := func(x, y int, col Color) {
+		r, g, b := c.ResolveColor(col)
+		if rgba != nil {
+			if !image.Pt(x, y).In(rgba.Rect) {
+				return
+			}
+			pixel := Color{R: uint16(r), G: uint16(g), B: uint16(b)}.Pack(rgbaPixelFormat) | rgbaOpaque
+			binary.LittleEndian.PutUint32(rgba.Pix[rgba.PixOffset(x, y):], pixel)
+			return
+		}
+		img.Set(x, y, color.RGBA{r, g, b, 0xff})
+	}
+	setAll := func(colors []Color) {
+		for i, col := range colors {
+			set(int(rect.X)+i%int(rect.Width), int(rect.Y)+i/int(rect.Width), col)
+		}
+	}
+
+	switch enc := rect.Enc.(type) {
+	case *RawEncoding:
+		setAll(enc.Colors)
+	case *HextileEncoding:
+		setAll(enc.Colors)
+	case *UltraEncoding:
+		setAll(enc.Colors)
+	case *JRLEEncoding:
+		setAll(enc.Colors)
+	case *RREEncoding:
+		return drawSubRects(rect, enc.BackgroundColor, enc.SubRects, set)
+	case *CoRREEncoding:
+		return drawSubRects(rect, enc.BackgroundColor, enc.SubRects, set)
+	case *TightEncoding:
+		bytesPerPixel := c.pixelFormat.BytesPerPixel()
+		if len(enc.Data) != rect.Area()*bytesPerPixel {
+			return nil
+		}
+		for i := 0; i < rect.Area(); i++ {
+			col := NewColor(&c.pixelFormat, &c.colorMap)
+			if err := col.Unmarshal(enc.Data[i*bytesPerPixel:]); err != nil {
+				return nil
+			}
+			set(int(rect.X)+i%int(rect.Width), int(rect.Y)+i/int(rect.Width), *col)
+		}
+	case *CopyRectEncoding:
+		// Draw handles the source overlapping rect in any direction, copying
+		// backwards when the source lies above or to the left of rect.
+		draw.Draw(img, rect.Bounds(), img, image.Pt(int(enc.SrcX), int(enc.SrcY)), draw.Src)
+	}
+	return nil
+}
+
+// rgbaPixelFormat is the layout of the pixels of an *image.RGBA, read as
+// little-endian 32-bit values, leaving out the alpha channel, which
+// rgbaOpaque sets.
+var rgbaPixelFormat = PixelFormat{BPP: 32, Depth: 24, BigEndian: rfbflags.RFBFalse, TrueColor: rfbflags.RFBTrue,
+	RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 0, GreenShift: 8, BlueShift: 16}
+
+const rgbaOpaque = 0xff << 24
+
+// drawSubRects fills rect with bg, then draws each of the RRE or CoRRE
+// subRects over it, after checking that they all lie within rect.
+func drawSubRects(rect *Rectangle, bg Color, subRects []RRESubRect, set func(x, y int, col Color)) error {
+	if err := checkSubRects(rect, subRects); err != nil {
+		return err
+	}
+	for y := 0; y < int(rect.Height); y++ {
+		for x := 0; x < int(rect.Width); x++ {
+			set(int(rect.X)+x, int(rect.Y)+y, bg)
+		}
+	}
+	for _, sr := range subRects {
+		for y := 0; y < int(sr.Rect.Height); y++ {
+			for x := 0; x < int(sr.Rect.Width); x++ {
+				set(int(rect.X)+int(sr.Rect.X)+x, int(rect.Y)+int(sr.Rect.Y)+y, sr.Color)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,355 @@
+package vnc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bigangryrobot/go-vnc/encodings"
+)
+
+// newScreenshotConn returns a 4x2 ClientConn reading from a pipe, and the
+// server end of the pipe after the FramebufferUpdateRequest has been read.
+func newScreenshotConn(t *testing.T) (*ClientConn, <-chan net.Conn) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	conn := NewClientConn(client, NewClientConfig(""))
+	conn.pixelFormat = roundTripFormat
+	conn.fbWidth, conn.fbHeight = 4, 2
+
+	ready := make(chan net.Conn, 1)
+	go func() {
+		req := make([]byte, 10)
+		if _, err := io.ReadFull(server, req); err == nil {
+			ready <- server
+		}
+	}()
+	return conn, ready
+}
+
+// writeRawRect writes the header of a Raw encoded 2x2 rectangle at x, and
+// its pixels if pixel isn't nil.
+func writeRawRect(w io.Writer, x uint16, pixel []byte) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, rectangleMessage{x, 0, 2, 2, encodings.EncRaw})
+	if pixel != nil {
+		buf.Write(bytes.Repeat(pixel, 2*2))
+	}
+	w.Write(buf.Bytes())
+}
+
+func TestClientConn_Screenshot(t *testing.T) {
+	conn, ready := newScreenshotConn(t)
+	go func() {
+		server := <-ready
+		server.Write([]byte{0, 0, 0, 2}) // message-type, padding, number-of-rectangles
+		writeRawRect(server, 0, []byte{0, 0xff, 0, 0})
+		writeRawRect(server, 2, []byte{0, 0, 0, 0xff})
+	}()
+
+	img, complete, err := conn.Screenshot(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !complete {
+		t.Error("expected a complete screenshot")
+	}
+	for _, tt := range []struct {
+		x, y int
+		want color.RGBA
+	}{
+		{0, 0, color.RGBA{0xff, 0, 0, 0xff}},
+		{1, 1, color.RGBA{0xff, 0, 0, 0xff}},
+		{3, 1, color.RGBA{0, 0, 0xff, 0xff}},
+	} {
+		if got := img.RGBAAt(tt.x, tt.y); got != tt.want {
+			t.Errorf("incorrect pixel at (%d, %d); got = %v, want = %v", tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+func TestClientConn_Screenshot_DesktopSize(t *testing.T) {
+	conn, ready := newScreenshotConn(t)
+	conn.encodings = Encodings{&RawEncoding{}, &DesktopSizePseudoEncoding{}}
+	conn.config.MaintainFramebuffer = true
+	go func() {
+		server := <-ready
+		var buf bytes.Buffer
+		buf.Write([]byte{0, 0, 0, 2}) // message-type, padding, number-of-rectangles
+		binary.Write(&buf, binary.BigEndian, rectangleMessage{0, 0, 6, 2, encodings.EncDesktopSizePseudo})
+		server.Write(buf.Bytes())
+		writeRawRect(server, 4, []byte{0, 0xff, 0, 0})
+	}()
+
+	img, complete, err := conn.Screenshot(context.Background())
+	if err != nil || !complete {
+		t.Fatalf("unexpected result; complete = %v, err = %v", complete, err)
+	}
+	if got, want := img.Bounds(), image.Rect(0, 0, 6, 2); got != want {
+		t.Errorf("incorrect screenshot bounds; got = %v, want = %v", got, want)
+	}
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	if got := img.RGBAAt(5, 1); got != red {
+		t.Errorf("incorrect screenshot pixel; got = %v, want = %v", got, red)
+	}
+
+	// The update is applied to the framebuffer model as when listening.
+	if got := conn.Framebuffer().RGBAAt(5, 1); got != red {
+		t.Errorf("incorrect framebuffer pixel; got = %v, want = %v", got, red)
+	}
+}
+
+func TestClientConn_Screenshot_SubRectOutOfBounds(t *testing.T) {
+	conn, ready := newScreenshotConn(t)
+	conn.encodings = Encodings{&RawEncoding{}, &RREEncoding{}}
+	go func() {
+		server := <-ready
+		var buf bytes.Buffer
+		buf.Write([]byte{0, 0, 0, 1}) // message-type, padding, number-of-rectangles
+		binary.Write(&buf, binary.BigEndian, rectangleMessage{0, 0, 2, 2, encodings.EncRRE})
+		binary.Write(&buf, binary.BigEndian, uint32(1)) // number-of-subrectangles
+		buf.Write([]byte{0, 0xff, 0, 0})                // background-pixel-value
+		buf.Write([]byte{0, 0, 0, 0xff})                // subrect-pixel-value
+		binary.Write(&buf, binary.BigEndian, [4]uint16{1, 1, 2, 2})
+		server.Write(buf.Bytes())
+	}()
+
+	_, complete, err := conn.Screenshot(context.Background())
+	if err == nil {
+		t.Fatal("expected an error for a sub-rectangle beyond its rectangle")
+	}
+	if complete {
+		t.Error("expected an incomplete screenshot")
+	}
+}
+
+func TestClientConn_Screenshot_Cancelled(t *testing.T) {
+	conn, ready := newScreenshotConn(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		server := <-ready
+		server.Write([]byte{0, 0, 0, 2}) // message-type, padding, number-of-rectangles
+		writeRawRect(server, 0, []byte{0, 0xff, 0, 0})
+		writeRawRect(server, 2, nil) // The pixels never arrive.
+		cancel()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		img, complete, err := conn.Screenshot(ctx)
+		if got, want := err, context.Canceled; !errors.Is(got, want) {
+			t.Errorf("incorrect error; got = %v, want = %v", got, want)
+		}
+		if complete {
+			t.Error("expected a partial screenshot")
+		}
+		if got, want := img.RGBAAt(1, 1), (color.RGBA{0xff, 0, 0, 0xff}); got != want {
+			t.Errorf("incorrect decoded pixel; got = %v, want = %v", got, want)
+		}
+		if got, want := img.RGBAAt(3, 1), (color.RGBA{}); got != want {
+			t.Errorf("incorrect pending pixel; got = %v, want = %v", got, want)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Screenshot to return")
+	}
+}
+
+func TestClientConn_Screenshot_AlreadyCancelled(t *testing.T) {
+	conn, _ := newScreenshotConn(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	img, complete, err := conn.Screenshot(ctx)
+	if got, want := err, context.Canceled; !errors.Is(got, want) {
+		t.Errorf("incorrect error; got = %v, want = %v", got, want)
+	}
+	if complete {
+		t.Error("expected an incomplete screenshot")
+	}
+	if img != nil {
+		t.Errorf("expected no image; got = %v", img.Bounds())
+	}
+}
+
+func TestClientConn_DrawRectangle_SubRects(t *testing.T) {
+	conn := NewClientConn(&MockConn{}, &ClientConfig{})
+	conn.pixelFormat = roundTripFormat
+	red := Color{pf: &conn.pixelFormat, cm: &conn.colorMap, R: 0xff}
+	blue := Color{pf: &conn.pixelFormat, cm: &conn.colorMap, B: 0xff}
+
+	for _, tt := range []struct {
+		desc    string
+		subRect Rectangle
+		ok      bool
+	}{
+		{"inside", Rectangle{X: 1, Y: 1, Width: 2, Height: 1}, true},
+		{"at the edge", Rectangle{X: 2, Y: 0, Width: 1, Height: 2}, true},
+		{"x+width beyond", Rectangle{X: 2, Y: 0, Width: 2, Height: 1}, false},
+		{"y+height beyond", Rectangle{X: 0, Y: 1, Width: 1, Height: 2}, false},
+	} {
+		subRects := []RRESubRect{{blue, tt.subRect}}
+		for _, enc := range []Encoding{
+			&RREEncoding{BackgroundColor: red, SubRects: subRects},
+			&CoRREEncoding{BackgroundColor: red, SubRects: subRects},
+		} {
+			img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+			rect := &Rectangle{X: 1, Y: 1, Width: 3, Height: 2, Enc: enc}
+			err := conn.drawRectangle(img, rect)
+			if tt.ok {
+				if err != nil {
+					t.Errorf("%s %s: unexpected error: %s", tt.desc, enc, err)
+					continue
+				}
+				x, y := int(rect.X+tt.subRect.X), int(rect.Y+tt.subRect.Y)
+				if got, want := img.RGBAAt(x, y), (color.RGBA{0, 0, 0xff, 0xff}); got != want {
+					t.Errorf("%s %s: incorrect sub-rect pixel; got = %v, want = %v", tt.desc, enc, got, want)
+				}
+				if got, want := img.RGBAAt(1, 1), (color.RGBA{0xff, 0, 0, 0xff}); got != want {
+					t.Errorf("%s %s: incorrect background pixel; got = %v, want = %v", tt.desc, enc, got, want)
+				}
+				continue
+			}
+			if err == nil {
+				t.Errorf("%s %s: expected an error", tt.desc, enc)
+			}
+			if got, want := img.RGBAAt(1, 1), (color.RGBA{}); got != want {
+				t.Errorf("%s %s: expected nothing drawn; got = %v", tt.desc, enc, got)
+			}
+		}
+	}
+}
+
+// plainImage hides the concrete type of its image from draw.Draw, which then
+// takes its generic path.
+type plainImage struct{ draw.Image }
+
+func TestClientConn_DrawRectangle_CopyRectOverlap(t *testing.T) {
+	conn := NewClientConn(&MockConn{}, &ClientConfig{})
+	const size = 8
+	// Each pixel of the gradient is distinct, so any smearing shows.
+	gradient := func(img draw.Image) {
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				img.Set(x, y, color.RGBA{uint8(x * 16), uint8(y * 16), 0x80, 0xff})
+			}
+		}
+	}
+
+	for _, tt := range []struct {
+		desc       string
+		rect       Rectangle
+		srcX, srcY int
+	}{
+		{"scroll up", Rectangle{X: 0, Y: 0, Width: size, Height: size - 2}, 0, 2},
+		{"scroll down", Rectangle{X: 0, Y: 2, Width: size, Height: size - 2}, 0, 0},
+		{"scroll left", Rectangle{X: 0, Y: 0, Width: size - 2, Height: size}, 2, 0},
+		{"scroll right", Rectangle{X: 2, Y: 0, Width: size - 2, Height: size}, 0, 0},
+		{"scroll up and left", Rectangle{X: 0, Y: 0, Width: size - 1, Height: size - 1}, 1, 1},
+		{"scroll down and right", Rectangle{X: 1, Y: 1, Width: size - 1, Height: size - 1}, 0, 0},
+	} {
+		for _, img := range []draw.Image{
+			image.NewRGBA(image.Rect(0, 0, size, size)),
+			image.NewNRGBA(image.Rect(0, 0, size, size)),
+			&plainImage{image.NewRGBA(image.Rect(0, 0, size, size))},
+		} {
+			gradient(img)
+			want := image.NewRGBA(image.Rect(0, 0, size, size))
+			gradient(want)
+			bounds := tt.rect.Bounds()
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					sx, sy := x-bounds.Min.X+tt.srcX, y-bounds.Min.Y+tt.srcY
+					want.Set(x, y, color.RGBA{uint8(sx * 16), uint8(sy * 16), 0x80, 0xff})
+				}
+			}
+
+			rect := tt.rect
+			rect.Enc = &CopyRectEncoding{SrcX: uint16(tt.srcX), SrcY: uint16(tt.srcY)}
+			if err := conn.drawRectangle(img, &rect); err != nil {
+				t.Fatalf("%s %T: unexpected error: %s", tt.desc, img, err)
+			}
+		pixels:
+			for y := 0; y < size; y++ {
+				for x := 0; x < size; x++ {
+					got := color.RGBAModel.Convert(img.At(x, y))
+					if want := want.RGBAAt(x, y); got != want {
+						t.Errorf("%s %T: incorrect pixel (%d, %d); got = %v, want = %v", tt.desc, img, x, y, got, want)
+						break pixels
+					}
+				}
+			}
+		}
+	}
+}
+
+// rawGradient returns a Raw encoded rectangle of width by height distinct
+// colors in roundTripFormat.
+func rawGradient(x, y, width, height uint16) *Rectangle {
+	colors := make([]Color, int(width)*int(height))
+	for i := range colors {
+		colors[i] = Color{pf: &roundTripFormat, R: uint16(i), G: uint16(i >> 8), B: 0x80}
+	}
+	return &Rectangle{X: x, Y: y, Width: width, Height: height, Enc: &RawEncoding{Colors: colors}}
+}
+
+func TestClientConn_DrawRectangle_Packed(t *testing.T) {
+	conn := NewClientConn(&MockConn{}, &ClientConfig{})
+	conn.pixelFormat = roundTripFormat
+	// The rectangle overhangs the images, whose pixels beyond it are left
+	// alone.
+	rect := rawGradient(2, 1, 8, 4)
+	bounds := image.Rect(0, 0, 6, 3)
+
+	packed := image.NewRGBA(bounds)
+	want := &plainImage{image.NewRGBA(bounds)}
+	if err := conn.drawRectangle(packed, rect); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := conn.drawRectangle(want, rect); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := packed.Pix, want.Image.(*image.RGBA).Pix; !bytes.Equal(got, want) {
+		t.Errorf("incorrect pixels; got = %v, want = %v", got, want)
+	}
+	if got, want := packed.RGBAAt(3, 2), (color.RGBA{9, 0, 0x80, 0xff}); got != want {
+		t.Errorf("incorrect pixel (3, 2); got = %v, want = %v", got, want)
+	}
+}
+
+// BenchmarkClientConn_DrawRectangle applies a full-frame Raw update, storing
+// packed pixels into an *image.RGBA, and through the generic img.Set.
+func BenchmarkClientConn_DrawRectangle(b *testing.B) {
+	conn := NewClientConn(&MockConn{}, &ClientConfig{})
+	conn.pixelFormat = roundTripFormat
+	rect := rawGradient(0, 0, 640, 480)
+	bounds := image.Rect(0, 0, 640, 480)
+
+	for _, bm := range []struct {
+		desc string
+		img  draw.Image
+	}{
+		{"packed", image.NewRGBA(bounds)},
+		{"generic", &plainImage{image.NewRGBA(bounds)}},
+	} {
+		b.Run(bm.desc, func(b *testing.B) {
+			b.SetBytes(int64(rect.Area()) * 4)
+			for i := 0; i < b.N; i++ {
+				if err := conn.drawRectangle(bm.img, rect); err != nil {
+					b.Fatalf("unexpected error: %s", err)
+				}
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ package vnc
 
 import (
 	"crypto/des"
+	"crypto/rand"
+	"crypto/subtle"
 )
 
 const (
@@ -11,6 +13,7 @@ const (
 	SecTypeNone     = uint8(1)
 	SecTypeVNCAuth  = uint8(2)
 	SecTypeVeNCrypt = uint8(19)
+	SecTypeARD      = uint8(30) // Apple Remote Desktop.
 )
 
 // ClientAuth implements a method of authenticating with a remote server.
@@ -175,3 +178,59 @@ func (p *ClientAuthVNC) encrypt(key string, bytes []byte) ([]byte, error) {
 
 	return crypted, nil
 }
+
+// ServerAuth implements a method of authenticating a remote client.
+type ServerAuth interface {
+	// SecurityType returns the byte identifier sent to the client to
+	// identify this authentication scheme.
+	SecurityType() uint8
+
+	// Handshake is called when the authentication handshake should be
+	// performed, as part of the general RFB handshake. (see 7.2.1)
+	Handshake(*ServerConn) error
+}
+
+// ServerAuthNone is the "none" authentication. See 7.2.1.
+type ServerAuthNone struct{}
+
+func (*ServerAuthNone) SecurityType() uint8 {
+	return SecTypeNone
+}
+
+func (*ServerAuthNone) Handshake(conn *ServerConn) error {
+	return nil
+}
+
+// ServerAuthVNC is the standard password authentication. See 7.2.2.
+type ServerAuthVNC struct {
+	Password string
+}
+
+func (*ServerAuthVNC) SecurityType() uint8 {
+	return SecTypeVNCAuth
+}
+
+func (auth *ServerAuthVNC) Handshake(conn *ServerConn) error {
+	var challenge vncAuthChallenge
+	if _, err := rand.Read(challenge[:]); err != nil {
+		return err
+	}
+	if err := conn.send(challenge); err != nil {
+		return err
+	}
+
+	var response vncAuthChallenge
+	if err := conn.receive(&response); err != nil {
+		return err
+	}
+
+	expected, err := (&ClientAuthVNC{}).encrypt(auth.Password, challenge[:])
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(expected, response[:]) != 1 {
+		return NewVNCError("Authentication failed")
+	}
+
+	return nil
+}
@@ -5,8 +5,16 @@ https://tools.ietf.org/html/rfc6143#section-7.6
 package vnc
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"image"
+	"io"
+	"log"
+	"math"
+	"unicode"
 
 	"github.com/bigangryrobot/go-vnc/encodings"
 	"github.com/bigangryrobot/go-vnc/messages"
@@ -35,6 +43,17 @@ type ServerMessage interface {
 type FramebufferUpdate struct {
 	NumRect uint16      // number-of-rectangles
 	Rects   []Rectangle // rectangles
+
+	// Changed is the bounding box of the rectangles of pixel data in the
+	// update, including CopyRect destinations, as applied by Read, so that
+	// renderers can redraw only that region. It is not part of the wire
+	// format, and is empty for updates without pixel data.
+	Changed image.Rectangle
+
+	// Wire holds, if ClientConfig.CaptureRawRectangles is set, each of
+	// Rects as sent by the server, its header followed by its encoded data,
+	// so that proxies can forward or cache them without encoding them again.
+	Wire [][]byte
 }
 
 // Verify that interfaces are honored.
@@ -61,27 +80,511 @@ func (m *FramebufferUpdate) Read(c *ClientConn) (ServerMessage, error) {
 	// encs[Raw] = &RawEncoding{} // Raw encoding support required.
 
 	// Read packet.
+	term, err := c.readUpdateHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	// Extract rectangles, accounting for the memory held by their decoded
+	// pixel data until the next update replaces them.
+	c.resetMetric("framebuffer-bytes")
+	start := c.clock.Now()
+	var pool *decodePool
+	if c.config.DecodeConcurrency > 1 {
+		pool = newDecodePool(c.config.DecodeConcurrency)
+	}
+	// The capacity, which allows for a terminator read past the limit, is
+	// never exceeded, so pointers into rects stay valid for the pool.
+	rects := make([]Rectangle, 0, term.limit+1)
+	var wire [][]byte
+	for term.more() {
+		rects = append(rects, *NewRectangle(c.Encodable))
+		rect := &rects[len(rects)-1]
+		c.startCapture()
+		encImpl, err := term.readHeader(c, rect)
+		if err == nil && encImpl == nil { // Terminator or skipped rectangle.
+			c.endCapture()
+			rects = rects[:len(rects)-1]
+			continue
+		}
+		if err == nil {
+			if pool == nil {
+				_, err = DecodeRectangle(c, rect, encImpl)
+			} else {
+				c.recordRectangle(rect, encImpl)
+				err = pool.read(c, term.read-1, rect, encImpl)
+			}
+			err = truncatedRectangle(term.read-1, rect, encImpl.Type(), err)
+		}
+		if err == nil && pool == nil {
+			err = c.drawScreenshot(rect)
+		}
+		if c.capture != nil {
+			wire = append(wire, c.endCapture())
+		}
+		if err != nil {
+			if pool != nil {
+				pool.wait()
+			}
+			return nil, err
+		}
+	}
+	if pool != nil {
+		if err := pool.wait(); err != nil {
+			return nil, err
+		}
+		for i := range rects {
+			if err := c.drawScreenshot(&rects[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := term.finish(c); err != nil {
+		return nil, err
+	}
+
+	// Servers that send more rectangles than announced leave data behind that
+	// would be misparsed as the next message.
+	if err := c.checkNextMessageType(); err != nil {
+		return nil, err
+	}
+
+	decodeDuration := c.clock.Now().Sub(start)
+	c.resetMetric("decode-duration")
+	c.adjustMetric("decode-duration", decodeDuration.Microseconds())
+
+	if err := c.adaptQuality(decodeDuration); err != nil {
+		return nil, err
+	}
+	c.settleEncodings(rects)
+	msg := newFramebufferUpdate(rects)
+	msg.Wire = wire
+	msg.Changed = c.applyUpdate(rects)
+	c.cursorChanged(rects)
+	c.ledStateChanged(rects)
+	c.decodedRectangles(rects)
+	c.frameComplete(rects)
+
+	// The colors of rects refer to the current pixel format, so it is only
+	// switched once they were applied and handed to the callbacks.
+	var buffered uint64
+	if pool != nil {
+		buffered = uint64(pool.peak)
+	}
+	if err := c.checkDecodeMemory(buffered); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// updateEnd is how the rectangles of a FramebufferUpdate ended.
+type updateEnd int
+
+const (
+	updateOpen                   updateEnd = iota // More rectangles are to be read.
+	updateCountRead                               // All announced rectangles were read.
+	updateLastRect                                // A LastRect pseudo-rectangle ended it.
+	updateEndOfContinuousUpdates                  // An EndOfContinuousUpdates message ended it.
+)
+
+// updateTerminator decides where the rectangles of a FramebufferUpdate end,
+// so that every loop reading them agrees: after the announced number, or at
+// a terminator such as LastRect, which ends the update early. An update
+// announcing the count of 65535 used with LastRect is also ended, while
+// continuous updates are enabled, by an EndOfContinuousUpdates message in
+// place of its next rectangle.
+type updateTerminator struct {
+	numRects uint16 // As announced.
+	limit    int    // Most rectangles to read; see rectangleLimit.
+	read     int
+	end      updateEnd
+}
+
+// readUpdateHeader reads the padding and number of rectangles that start the
+// body of a FramebufferUpdate, returning the terminator for its rectangles.
+func (c *ClientConn) readUpdateHeader() (*updateTerminator, error) {
 	var pad [1]byte
 	if err := c.receive(&pad); err != nil {
 		return nil, err
 	}
-
 	var numRects uint16
 	if err := c.receive(&numRects); err != nil {
 		return nil, err
 	}
+	limit, err := c.rectangleLimit(numRects)
+	if err != nil {
+		return nil, err
+	}
+	return &updateTerminator{numRects: numRects, limit: limit}, nil
+}
 
-	// Extract rectangles.
-	rects := make([]Rectangle, numRects)
-	for i := 0; i < int(numRects); i++ {
-		rect := NewRectangle(c.Encodable)
-		if err := rect.Read(c); err != nil {
-			return nil, err
+// more reports whether another rectangle header is to be read. An update
+// announcing no rectangles, as servers send when nothing changed, ends at
+// once, without reading any further. One header past the limit is read of an
+// update announcing the count used with LastRect, which may only be its
+// terminator.
+func (t *updateTerminator) more() bool {
+	if t.end != updateOpen {
+		return false
+	}
+	if t.read == int(t.numRects) {
+		t.end = updateCountRead
+		return false
+	}
+	return t.read < t.limit || t.read == t.limit && t.numRects == math.MaxUint16
+}
+
+// terminate ends the update early for the reason end.
+func (t *updateTerminator) terminate(end updateEnd) {
+	if t.end == updateOpen {
+		t.end = end
+	}
+}
+
+// readHeader reads the header of the next rectangle into rect, returning its
+// encoding. A nil encoding is returned for a terminator, which ends the
+// update, and for a skipped rectangle; neither has a body. An
+// EndOfContinuousUpdates message is left unread, to be read as the message
+// following the update.
+func (t *updateTerminator) readHeader(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	if t.numRects == math.MaxUint16 && c.endOfContinuousUpdatesNext() {
+		t.terminate(updateEndOfContinuousUpdates)
+		return nil, nil
+	}
+	encImpl, err := rect.readHeader(c)
+	if err != nil && err != errSkippedRectangle {
+		return nil, err
+	}
+	if err == nil && encImpl == nil { // LastRect
+		t.terminate(updateLastRect)
+		return nil, nil
+	}
+	if t.read == t.limit {
+		return nil, c.tooManyRectangles(t.numRects)
+	}
+	t.read++
+	if err == errSkippedRectangle {
+		return nil, nil
+	}
+	return encImpl, nil
+}
+
+// endOfContinuousUpdatesNext reports whether continuous updates are enabled
+// and the next byte read is the message-type of EndOfContinuousUpdates, which
+// can't start the header of a rectangle within the framebuffer, as the high
+// byte of its x-position.
+func (c *ClientConn) endOfContinuousUpdatesNext() bool {
+	if !c.continuousUpdates.Load() || int(messages.EndOfContinuousUpdates)<<8 < int(c.fbWidth) {
+		return false
+	}
+	b, err := c.bufr.Peek(1)
+	return err == nil && messages.ServerMessage(b[0]) == messages.EndOfContinuousUpdates
+}
+
+// finish returns an error if the update stopped at the rectangle limit
+// without having ended.
+func (t *updateTerminator) finish(c *ClientConn) error {
+	if t.end == updateOpen {
+		return c.tooManyRectangles(t.numRects)
+	}
+	return nil
+}
+
+// rectangleLimit returns the number of rectangles to read of an update
+// announcing numRects, or a ProtocolError if numRects exceeds the configured
+// MaxRectanglesPerUpdate. The count of 65535 used with LastRect is instead
+// capped at the limit, not counting the LastRect; an update going past it is
+// rejected with tooManyRectangles.
+func (c *ClientConn) rectangleLimit(numRects uint16) (int, error) {
+	max := c.config.maxRectanglesPerUpdate()
+	if numRects <= max {
+		return int(numRects), nil
+	}
+	if numRects == math.MaxUint16 {
+		return int(max), nil
+	}
+	return 0, c.tooManyRectangles(numRects)
+}
+
+// tooManyRectangles returns the error for an update announcing numRects,
+// more than the configured MaxRectanglesPerUpdate.
+func (c *ClientConn) tooManyRectangles(numRects uint16) error {
+	return &ProtocolError{Errorf("FramebufferUpdate of %d rectangles exceeds limit of %d", numRects, c.config.maxRectanglesPerUpdate())}
+}
+
+// ResyncError is returned when a server message is followed by data that
+// does not start with a known server message-type, e.g. because the server
+// sent more rectangles than it announced in a FramebufferUpdate. The stream
+// is out of sync, and further messages can't be parsed reliably.
+type ResyncError struct {
+	// MessageType is the unexpected message-type byte.
+	MessageType messages.ServerMessage
+}
+
+// Error implements the error interface.
+func (e *ResyncError) Error() string {
+	return fmt.Sprintf("lost message synchronization; invalid server message-type %d", uint8(e.MessageType))
+}
+
+// checkNextMessageType returns a ResyncError if data already received from
+// the server does not start with a known server message-type. It does not
+// block waiting for the next message. With ClientConfig.Resync, the data is
+// instead skipped once the next message-type is read.
+func (c *ClientConn) checkNextMessageType() error {
+	if c.config.Resync || c.bufr.Buffered() == 0 {
+		return nil
+	}
+	b, err := c.bufr.Peek(1)
+	if err != nil {
+		return nil
+	}
+	messageType := messages.ServerMessage(b[0])
+	if c.isKnownMessageType(messageType) {
+		return nil
+	}
+	return &ResyncError{messageType}
+}
+
+// receiveMessageType receives the message-type of the next server message,
+// resynchronizing on an unknown one if ClientConfig.Resync is set.
+func (c *ClientConn) receiveMessageType() (messages.ServerMessage, error) {
+	var messageType messages.ServerMessage
+	if err := c.receive(&messageType); err != nil {
+		return 0, err
+	}
+	if !c.config.Resync || c.isKnownMessageType(messageType) {
+		return messageType, nil
+	}
+	return c.resync(messageType)
+}
+
+// resync skips the data following the unknown messageType, up to
+// ClientConfig.MaxResyncBytes, and returns the first known message-type
+// found that starts a plausible message; see plausibleMessage.
+func (c *ClientConn) resync(messageType messages.ServerMessage) (messages.ServerMessage, error) {
+	bad := messageType
+	for skipped := 1; skipped <= c.config.maxResyncBytes(); skipped++ {
+		if err := c.receive(&messageType); err != nil {
+			return 0, err
+		}
+		if c.isKnownMessageType(messageType) && c.plausibleMessage(messageType) {
+			c.log.Printf("warning: resynchronized after skipping %d bytes from invalid server message-type %d", skipped, uint8(bad))
+			c.adjustMetric("resyncs", 1)
+			return messageType, nil
+		}
+	}
+	return 0, &ResyncError{bad}
+}
+
+// plausibleMessage reports whether the data following the message-type t, as
+// far as it can be peeked at without reading it, makes a plausible message,
+// so that resync doesn't stop at every byte of noise that happens to be a
+// message-type. A FramebufferUpdate must announce rectangles within the
+// limit, the first of which has a known encoding and, for pixel data, lies
+// within the framebuffer; the padding of messages must be zero; a Bell must
+// be followed by another message-type. Messages of types configured in
+// ServerMessages are taken as they are.
+func (c *ClientConn) plausibleMessage(t messages.ServerMessage) bool {
+	switch t {
+	case messages.FramebufferUpdate:
+		// padding, number-of-rectangles, first rectangle header
+		b, err := c.bufr.Peek(3 + binary.Size(rectangleMessage{}))
+		if err != nil || b[0] != 0 {
+			return false
+		}
+		numRects := binary.BigEndian.Uint16(b[1:])
+		if _, err := c.rectangleLimit(numRects); err != nil || numRects == 0 {
+			return false
+		}
+		var msg rectangleMessage
+		if err := binary.Read(bytes.NewReader(b[3:]), binary.BigEndian, &msg); err != nil {
+			return false
+		}
+		return c.plausibleRectangle(msg)
+	case messages.SetColorMapEntries:
+		// padding, first-color, number-of-colors
+		b, err := c.bufr.Peek(5)
+		if err != nil || b[0] != 0 || rfbflags.IsTrueColor(c.pixelFormat.TrueColor) {
+			return false
+		}
+		first, n := int(binary.BigEndian.Uint16(b[1:])), int(binary.BigEndian.Uint16(b[3:]))
+		return n > 0 && first+n <= math.MaxUint16+1
+	case messages.Bell:
+		// The end of the data is left to the read of the next message.
+		b, err := c.bufr.Peek(1)
+		return err != nil || c.isKnownMessageType(messages.ServerMessage(b[0]))
+	case messages.ServerCutText:
+		// padding, length
+		b, err := c.bufr.Peek(7)
+		if err != nil || b[0] != 0 || b[1] != 0 || b[2] != 0 {
+			return false
+		}
+		length := binary.BigEndian.Uint32(b[3:])
+		if int32(length) < 0 {
+			return c.GetEncodings().Contains(encodings.EncExtendedClipboardPseudo)
+		}
+		return length <= c.config.maxClipboardBytes()
+	}
+	return true
+}
+
+// plausibleRectangle reports whether msg is the header of a rectangle of an
+// encoding c can read, lying within the framebuffer unless of a
+// pseudo-encoding.
+func (c *ClientConn) plausibleRectangle(msg rectangleMessage) bool {
+	if msg.E == encodings.EncLastRectPseudo {
+		return true
+	}
+	if _, ok := c.Encodable(msg.E); !ok {
+		if _, ok := decodableEncodings[msg.E]; !ok {
+			return false
+		}
+	}
+	if msg.E < 0 || c.fbWidth == 0 {
+		return true
+	}
+	return msg.W > 0 && msg.H > 0 && int(msg.X)+int(msg.W) <= int(c.fbWidth) && int(msg.Y)+int(msg.H) <= int(c.fbHeight)
+}
+
+// isKnownMessageType returns true if t is a server message-type defined by
+// RFC 6143 or configured in ServerMessages.
+func (c *ClientConn) isKnownMessageType(t messages.ServerMessage) bool {
+	known := []messages.ServerMessage{
+		messages.FramebufferUpdate,
+		messages.SetColorMapEntries,
+		messages.Bell,
+		messages.ServerCutText,
+	}
+	for _, m := range c.config.ServerMessages {
+		known = append(known, m.Type())
+	}
+	for _, k := range known {
+		if k == t {
+			return true
+		}
+	}
+	return false
+}
+
+// InterleavedMessageError is returned when a rectangle header of a
+// FramebufferUpdate can't be a rectangle, and starts with a server
+// message-type. RFC 6143 only allows messages to start at message boundaries,
+// but some servers send e.g. a Bell in the middle of an update. The stream is
+// out of sync, and further messages can't be parsed reliably.
+type InterleavedMessageError struct {
+	// MessageType is the message-type byte found in place of the rectangle.
+	MessageType messages.ServerMessage
+}
+
+// Error implements the error interface.
+func (e *InterleavedMessageError) Error() string {
+	return fmt.Sprintf("lost message synchronization; server message-type %v found in place of a FramebufferUpdate rectangle", e.MessageType)
+}
+
+// TruncatedRectangleError is returned when the data of a rectangle of a
+// FramebufferUpdate ends before its encoding is fully read, e.g. because the
+// server or a proxy closed the connection. It matches io.ErrUnexpectedEOF
+// with errors.Is.
+type TruncatedRectangleError struct {
+	Index               int // Of the rectangle among those of the update.
+	X, Y, Width, Height uint16
+	Encoding            encodings.EncodingType
+	Short               int   // Bytes missing from the read that failed, or 0 if unknown.
+	Err                 error // The error ending the read.
+}
+
+// Error implements the error interface.
+func (e *TruncatedRectangleError) Error() string {
+	short := ""
+	if e.Short > 0 {
+		short = fmt.Sprintf(", %d bytes short", e.Short)
+	}
+	return fmt.Sprintf("rectangle %d (%dx%d at %d,%d, encoding %v) truncated%s: %v",
+		e.Index, e.Width, e.Height, e.X, e.Y, e.Encoding, short, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *TruncatedRectangleError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is io.ErrUnexpectedEOF.
+func (e *TruncatedRectangleError) Is(target error) bool {
+	return target == io.ErrUnexpectedEOF
+}
+
+// truncatedRectangle returns err, from reading the data of rectangle r, the
+// index-th of its update, encoded with t, as a TruncatedRectangleError if the
+// data ended early, and as is otherwise.
+func truncatedRectangle(index int, r *Rectangle, t encodings.EncodingType, err error) error {
+	var terr *TruncatedRectangleError
+	if err == nil || errors.As(err, &terr) || !(errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)) {
+		return err
+	}
+	terr = &TruncatedRectangleError{Index: index, X: r.X, Y: r.Y, Width: r.Width, Height: r.Height, Encoding: t, Err: err}
+	var perr *PartialReadError
+	if errors.As(err, &perr) {
+		terr.Short = perr.Want - perr.Got
+	}
+	return terr
+}
+
+// interleavedMessage returns an InterleavedMessageError if the rectangle
+// header msg starts with a known server message-type other than
+// FramebufferUpdate, whose type byte can't be told apart from a small
+// x-position.
+func (c *ClientConn) interleavedMessage(msg rectangleMessage) error {
+	messageType := messages.ServerMessage(msg.X >> 8)
+	if messageType == messages.FramebufferUpdate || !c.isKnownMessageType(messageType) {
+		return nil
+	}
+	return &InterleavedMessageError{messageType}
+}
+
+// ledStateChanged calls the OnLEDStateChange callback, if any, for each QEMU
+// LED State pseudo-rectangle among rects, in order.
+func (c *ClientConn) ledStateChanged(rects []Rectangle) {
+	if c.config.OnLEDStateChange == nil {
+		return
+	}
+	for _, r := range rects {
+		if enc, ok := r.Enc.(*QEMULEDStatePseudoEncoding); ok {
+			c.config.OnLEDStateChange(enc.State)
+		}
+	}
+}
+
+// frameComplete calls the OnFrameComplete callback, if any, with the
+// rectangles of pixel data among rects.
+func (c *ClientConn) frameComplete(rects []Rectangle) {
+	if c.config.OnFrameComplete == nil {
+		return
+	}
+	regions := make([]Rectangle, 0, len(rects))
+	for _, r := range rects {
+		if r.Enc != nil && r.Enc.Type() >= 0 {
+			regions = append(regions, r)
 		}
-		rects[i] = *rect
 	}
+	c.config.OnFrameComplete(regions)
+}
 
-	return newFramebufferUpdate(rects), nil
+// checkDecodeMemory switches to a more compact pixel format when the memory
+// held by decoded pixel data, plus the buffered bytes of encoded pixel data
+// held at once by the decode pool, exceeds the configured MaxDecodeMemory.
+func (c *ClientConn) checkDecodeMemory(buffered uint64) error {
+	max := c.config.MaxDecodeMemory
+	held := c.metricValue("framebuffer-bytes") + buffered
+	if max == 0 || held <= max {
+		return nil
+	}
+	pf, ok := compactPixelFormat(c.pixelFormat)
+	if !ok {
+		return nil
+	}
+	c.log.Printf("decode memory %d exceeds %d; switching to pixel format %v", held, max, pf)
+	return c.SetPixelFormat(pf)
 }
 
 // Marshal implements the Marshaler interface.
@@ -109,20 +612,37 @@ func (m *FramebufferUpdate) Marshal() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// Unmarshal implements the Unmarshaler interface.
+// Unmarshal implements the Unmarshaler interface. It is unsupported, as the
+// pixel data of the rectangles can only be decoded using the pixel format
+// and encodings of a connection; use Read instead.
 func (m *FramebufferUpdate) Unmarshal(_ []byte) error {
 	return fmt.Errorf("Unmarshal() unimplemented")
 }
 
+// FramebufferUpdate sends a FramebufferUpdate message containing rects to the
+// client. Rectangle colors are marshaled using their own pixel format, which
+// should match the format last requested by the client.
+func (c *ServerConn) FramebufferUpdate(rects []Rectangle) error {
+	bytes, err := newFramebufferUpdate(rects).Marshal()
+	if err != nil {
+		return err
+	}
+	return c.send(bytes)
+}
+
 // EncodableFunc describes the function for encoding a Rectangle.
 type EncodableFunc func(enc encodings.EncodingType) (Encoding, bool)
 
 // Encodable returns the Encoding that can be used to encode a Rectangle, or
 // false if the encoding isn't recognized.
 func (c *ClientConn) Encodable(enc encodings.EncodingType) (Encoding, bool) {
-	for _, e := range c.encodings {
-		if e.Type() == enc {
-			return e, true
+	c.encodingsMu.Lock()
+	defer c.encodingsMu.Unlock()
+	for _, encs := range []Encodings{c.encodings, c.retiredEncodings} {
+		for _, e := range encs {
+			if e.Type() == enc {
+				return e, true
+			}
 		}
 	}
 	return nil, false
@@ -154,20 +674,148 @@ func NewRectangle(fn EncodableFunc) *Rectangle {
 
 // Read a rectangle message from ClientConn c.
 func (r *Rectangle) Read(c *ClientConn) error {
+	encImpl, err := r.readHeader(c)
+	if err == errSkippedRectangle {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = DecodeRectangle(c, r, encImpl)
+	return err
+}
+
+// errSkippedRectangle is returned by Rectangle.readHeader for a rectangle of
+// an unknown pseudo-encoding skipped under
+// ClientConfig.SkipUnknownPseudoEncodings. The rectangle is assumed to have
+// no body.
+var errSkippedRectangle = errors.New("skipped rectangle of unknown pseudo-encoding")
+
+// payloadPseudoEncodings are the pseudo-encodings this package can't decode
+// that are known to carry data after their header, and so can't be skipped.
+var payloadPseudoEncodings = map[encodings.EncodingType]bool{
+	encodings.EncExtendedDesktopSizePseudo: true,
+	encodings.EncExtendedClipboardPseudo:   true,
+}
+
+// readHeader reads the rectangle header from ClientConn c, returning the
+// Encoding with which to read the pixel data that follows. A nil Encoding is
+// returned for a LastRect pseudo-rectangle, which ends the update, and
+// errSkippedRectangle for a skipped one.
+func (r *Rectangle) readHeader(c *ClientConn) (Encoding, error) {
 	var msg rectangleMessage
 	if err := c.receive(&msg); err != nil {
-		return err
+		return nil, err
 	}
 	r.X, r.Y, r.Width, r.Height = msg.X, msg.Y, msg.W, msg.H
+	if msg.E == encodings.EncLastRectPseudo {
+		c.confirmEncoding(encodings.EncLastRectPseudo)
+		return nil, nil
+	}
 
 	encImpl, ok := r.encFn(msg.E)
 	if !ok {
-		return fmt.Errorf("unsupported encoding type: %d", msg.E)
+		if err := c.interleavedMessage(msg); err != nil {
+			return nil, err
+		}
+		// Servers may use encodings the client didn't advertise; decode them
+		// anyway if possible.
+		encImpl, ok = decodableEncodings[msg.E]
+	}
+	if !ok {
+		if msg.E < 0 && c.config.SkipUnknownPseudoEncodings && !payloadPseudoEncodings[msg.E] {
+			c.log.Printf("skipping rectangle of unknown pseudo-encoding %d", msg.E)
+			c.adjustMetric("pseudo-encodings-skipped", 1)
+			return nil, errSkippedRectangle
+		}
+		return nil, fmt.Errorf("unsupported encoding type: %d", msg.E)
+	}
+
+	// A message-type byte can also make up a header of a supported encoding,
+	// in which case the rectangle lies beyond the framebuffer. Rectangles of
+	// pseudo-encodings, which have negative types, needn't lie within it.
+	outside := c.fbWidth > 0 && (int(r.X)+int(r.Width) > int(c.fbWidth) || int(r.Y)+int(r.Height) > int(c.fbHeight))
+	if msg.E >= 0 && outside {
+		if err := c.interleavedMessage(msg); err != nil {
+			return nil, err
+		}
+	}
+	return encImpl, nil
+}
+
+// DecodeRectangle reads the pixel data of rectangle r, whose header has
+// already been read, from ClientConn c using encoding enc, and records the
+// rectangle in the state of c: its encoding is counted in ObservedEncodings,
+// and the memory held by its pixel data in the "framebuffer-bytes" metric.
+// The decoded Encoding is stored in r.Enc, and returned.
+//
+// DecodeRectangle is the decoding path used by ListenAndHandle. It reads
+// through c like any other message, so it can equally decode rectangles from
+// recorded sessions or a proxied connection.
+func DecodeRectangle(c *ClientConn, r *Rectangle, enc Encoding) (Encoding, error) {
+	c.recordRectangle(r, enc)
+	if err := r.readEncoding(c, enc); err != nil {
+		return nil, err
+	}
+	return r.Enc, nil
+}
+
+// DecodeEncoding decodes a single rectangle of encoding type t from data,
+// without a connection, e.g. to test decoders or to validate captured
+// sessions offline. data holds the rectangle as sent within a
+// FramebufferUpdate: its header, whose encoding-type must be t, followed by
+// its encoded data, all of which must be consumed. Pixel data is decoded
+// using pixel format pf and color map cm.
+//
+// The rectangle is read by the same code as those of ListenAndHandle, on a
+// connection of default configuration. Encodings relying on state carried
+// between rectangles, such as the zlib streams of Tight and ZRLE, start from
+// their initial state.
+func DecodeEncoding(t encodings.EncodingType, data []byte, pf PixelFormat, cm ColorMap) (Encoding, error) {
+	enc, ok := decodableEncodings[t]
+	if !ok {
+		return nil, NewVNCError(fmt.Sprintf("DecodeEncoding: unsupported encoding type %v", t))
+	}
+	br := bytes.NewReader(data)
+	c := &ClientConn{
+		bufr:        bufio.NewReader(br),
+		config:      &ClientConfig{},
+		log:         log.New(io.Discard, "", 0),
+		colorMap:    cm,
+		pixelFormat: pf,
+		encodings:   Encodings{enc},
+	}
+	r := NewRectangle(c.Encodable)
+	encImpl, err := r.readHeader(c)
+	if err != nil {
+		return nil, err
 	}
+	if encImpl == nil {
+		return nil, NewVNCError(fmt.Sprintf("DecodeEncoding: rectangle of encoding type %v, not %v", encodings.EncLastRectPseudo, t))
+	}
+	if encImpl.Type() != t {
+		return nil, NewVNCError(fmt.Sprintf("DecodeEncoding: rectangle of encoding type %v, not %v", encImpl.Type(), t))
+	}
+	if _, err := DecodeRectangle(c, r, encImpl); err != nil {
+		return nil, err
+	}
+	if n := c.bufr.Buffered() + br.Len(); n > 0 {
+		return nil, NewVNCError(fmt.Sprintf("DecodeEncoding: %d bytes left after the rectangle", n))
+	}
+	return r.Enc, nil
+}
+
+// recordRectangle records a rectangle of encoding enc in the state of c.
+func (c *ClientConn) recordRectangle(r *Rectangle, enc Encoding) {
+	c.observeEncoding(enc.Type())
+	c.adjustMetric("framebuffer-bytes", int64(r.Area())*int64(c.pixelFormat.BytesPerPixel()))
+}
 
+// readEncoding reads the pixel data of the rectangle from ClientConn c.
+func (r *Rectangle) readEncoding(c *ClientConn, encImpl Encoding) error {
 	enc, err := encImpl.Read(c, r)
 	if err != nil {
-		return fmt.Errorf("error reading rectangle encoding: %s", err)
+		return fmt.Errorf("error reading rectangle encoding: %w", err)
 	}
 
 	r.Enc = enc
@@ -223,6 +871,11 @@ func (r *Rectangle) String() string {
 // Area returns the total area in pixels of the Rectangle.
 func (r *Rectangle) Area() int { return int(r.Width) * int(r.Height) }
 
+// Bounds returns the region of the framebuffer covered by r.
+func (r *Rectangle) Bounds() image.Rectangle {
+	return image.Rect(int(r.X), int(r.Y), int(r.X)+int(r.Width), int(r.Y)+int(r.Height))
+}
+
 //-----------------------------------------------------------------------------
 // SetColorMapEntries is sent by the server to set values into
 // the color map. This message will automatically update the color map
@@ -265,18 +918,48 @@ func (*SetColorMapEntries) Read(c *ClientConn) (ServerMessage, error) {
 
 	result.Colors = make([]Color, numColors)
 	for i := uint16(0); i < numColors; i++ {
-		color := &result.Colors[i]
-		if err := c.receive(&color); err != nil {
+		var rgb [3]uint16 // red, green, blue
+		if err := c.receive(&rgb); err != nil {
 			return nil, err
 		}
+		color := &result.Colors[i]
+		color.R, color.G, color.B = rgb[0], rgb[1], rgb[2]
 
-		// Update the connection's color map
-		c.colorMap[result.FirstColor+i] = *color
+		// Update the connection's color map, ignoring entries past the 16-bit
+		// index maximum.
+		if index := int(result.FirstColor) + int(i); index <= math.MaxUint16 {
+			c.colorMap.Set(uint16(index), color.R, color.G, color.B)
+		}
 	}
 
 	return &result, nil
 }
 
+// SetColorMapEntries sends a SetColorMapEntries message to the client,
+// setting len(colors) entries of its color map starting at firstColor.
+func (c *ServerConn) SetColorMapEntries(firstColor uint16, colors []Color) error {
+	buf := NewBuffer(nil)
+	msg := struct {
+		Msg        messages.ServerMessage // message-type
+		_          [1]byte                // padding
+		FirstColor uint16                 // first-color
+		NumColors  uint16                 // number-of-colors
+	}{
+		Msg:        messages.SetColorMapEntries,
+		FirstColor: firstColor,
+		NumColors:  uint16(len(colors)),
+	}
+	if err := buf.Write(msg); err != nil {
+		return err
+	}
+	for _, color := range colors {
+		if err := buf.Write([3]uint16{color.R, color.G, color.B}); err != nil {
+			return err
+		}
+	}
+	return c.send(buf.Bytes())
+}
+
 // Color represents a single color in a color map.
 type Color struct {
 	pf      *PixelFormat
@@ -288,8 +971,30 @@ type Color struct {
 // Verify that interfaces are honored.
 var _ MarshalerUnmarshaler = (*Color)(nil)
 
-// ColorMap represents a translation map of colors.
-type ColorMap [256]Color
+// ColorMap represents a translation map of colors. It grows as entries are
+// set, up to the 65536 entries addressable by 16-bit pixels, unset entries
+// being black, so a server may populate it sparsely, in any order.
+type ColorMap []Color
+
+// Set sets the color at index, growing the map to hold it if needed.
+func (cm *ColorMap) Set(index uint16, r, g, b uint16) {
+	if cm == nil {
+		return
+	}
+	if n := int(index) + 1; n > len(*cm) {
+		*cm = append(*cm, make([]Color, n-len(*cm))...)
+	}
+	(*cm)[index] = Color{R: r, G: g, B: b}
+}
+
+// Get returns the color at index, or false if index is beyond the size of
+// the map.
+func (cm *ColorMap) Get(index uint16) (Color, bool) {
+	if cm == nil || int(index) >= len(*cm) {
+		return Color{}, false
+	}
+	return (*cm)[index], true
+}
 
 // NewColor returns a new Color object.
 func NewColor(pf *PixelFormat, cm *ColorMap) *Color {
@@ -301,28 +1006,73 @@ func NewColor(pf *PixelFormat, cm *ColorMap) *Color {
 
 // Marshal implements the Marshaler interface.
 func (c *Color) Marshal() ([]byte, error) {
-	order := c.pf.order()
-	pixel := c.cmIndex
-	if rfbflags.IsTrueColor(c.pf.TrueColor) {
-		pixel = uint32(c.R) << c.pf.RedShift
-		pixel |= uint32(c.G) << c.pf.GreenShift
-		pixel |= uint32(c.B) << c.pf.BlueShift
+	var bytes []byte
+	switch c.pf.BPP {
+	case 8, 16, 32:
+		bytes = make([]byte, c.pf.BPP/8)
 	}
+	if _, err := c.MarshalTo(bytes); err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
 
-	var bytes []byte
+// MarshalTo writes the color to dst, as Marshal would return it, and returns
+// the number of bytes written, so that the colors of a rectangle can be
+// marshaled without allocating for each. io.ErrShortBuffer is returned if dst
+// is too small. Nothing is written for pixel formats of other than 8, 16 or
+// 32 bits per pixel.
+func (c *Color) MarshalTo(dst []byte) (int, error) {
+	order := c.pf.order()
+	pixel := c.Pack(*c.pf)
+
+	n := 0
 	switch c.pf.BPP {
-	case 8:
-		bytes = make([]byte, 1)
-		bytes[0] = byte(pixel)
-	case 16:
-		bytes = make([]byte, 2)
-		order.PutUint16(bytes, uint16(pixel))
-	case 32:
-		bytes = make([]byte, 4)
-		order.PutUint32(bytes, pixel)
+	case 8, 16, 32:
+		n = int(c.pf.BPP / 8)
 	}
+	if len(dst) < n {
+		return 0, io.ErrShortBuffer
+	}
+	switch n {
+	case 1:
+		dst[0] = byte(pixel)
+	case 2:
+		order.PutUint16(dst, uint16(pixel))
+	case 4:
+		order.PutUint32(dst, pixel)
+	}
+	return n, nil
+}
 
-	return bytes, nil
+// Pack returns the pixel value of c in pf, before byte ordering: the red,
+// green and blue components of c, which must not exceed the maximums of pf,
+// shifted into place, or the color map index of c if pf is color-mapped.
+func (c Color) Pack(pf PixelFormat) uint32 {
+	if !rfbflags.IsTrueColor(pf.TrueColor) {
+		return c.cmIndex
+	}
+	return uint32(c.R)<<pf.RedShift | uint32(c.G)<<pf.GreenShift | uint32(c.B)<<pf.BlueShift
+}
+
+// marshalColors returns colors marshaled one after the other into a single
+// buffer.
+func marshalColors(colors []Color) ([]byte, error) {
+	var (
+		out   []byte
+		pixel [4]byte
+	)
+	for i := range colors {
+		n, err := colors[i].MarshalTo(pixel[:])
+		if err != nil {
+			return nil, err
+		}
+		if out == nil {
+			out = make([]byte, 0, n*len(colors))
+		}
+		out = append(out, pixel[:n]...)
+	}
+	return out, nil
 }
 
 // Unmarshal implements the Unmarshaler interface.
@@ -348,13 +1098,69 @@ func (c *Color) Unmarshal(data []byte) error {
 		c.G = uint16((pixel >> c.pf.GreenShift) & uint32(c.pf.GreenMax))
 		c.B = uint16((pixel >> c.pf.BlueShift) & uint32(c.pf.BlueMax))
 	} else {
-		*c = c.cm[pixel]
+		if pixel <= math.MaxUint16 {
+			if entry, ok := c.cm.Get(uint16(pixel)); ok {
+				c.R, c.G, c.B = entry.R, entry.G, entry.B
+			}
+		}
 		c.cmIndex = pixel
 	}
 
 	return nil
 }
 
+// Equal reports whether c and other represent the same RGB color, as
+// resolved by RGB, regardless of their pixel formats or whether they are
+// color-mapped.
+func (c Color) Equal(other Color) bool {
+	r1, g1, b1 := c.RGB()
+	r2, g2, b2 := other.RGB()
+	return r1 == r2 && g1 == g2 && b1 == b2
+}
+
+// RGB returns the 16-bit RGB components of c. Color-mapped colors are looked
+// up by index in the color map of c, if any; true-color components are scaled
+// from the red-, green- and blue-max values of the pixel format of c. Colors
+// without a pixel format are assumed to hold 16-bit components already.
+func (c Color) RGB() (r, g, b uint16) {
+	switch {
+	case c.pf == nil:
+		return c.R, c.G, c.B
+	case rfbflags.IsTrueColor(c.pf.TrueColor):
+		return scaleColor(c.R, c.pf.RedMax), scaleColor(c.G, c.pf.GreenMax), scaleColor(c.B, c.pf.BlueMax)
+	case c.cmIndex <= math.MaxUint16:
+		if entry, ok := c.cm.Get(uint16(c.cmIndex)); ok {
+			return entry.R, entry.G, entry.B
+		}
+	}
+	return c.R, c.G, c.B
+}
+
+// Hex returns the RGB color of c as a "#rrggbb" string.
+func (c Color) Hex() string {
+	r, g, b := c.RGB()
+	return fmt.Sprintf("#%02x%02x%02x", r>>8, g>>8, b>>8)
+}
+
+// scaleColor scales a color component in the range [0, max] to 16 bits.
+func scaleColor(v, max uint16) uint16 {
+	if max == 0 {
+		return 0
+	}
+	if v > max {
+		v = max
+	}
+	return uint16(uint32(v) * math.MaxUint16 / uint32(max))
+}
+
+// ResolveColor returns the 8-bit RGB components of color, as resolved by
+// Color.RGB in the pixel format and color map of the connection.
+func (c *ClientConn) ResolveColor(color Color) (r, g, b uint8) {
+	color.pf, color.cm = &c.pixelFormat, &c.colorMap
+	r16, g16, b16 := color.RGB()
+	return uint8(r16 >> 8), uint8(g16 >> 8), uint8(b16 >> 8)
+}
+
 func colorsToImage(x, y, width, height uint16, colors []Color) *image.RGBA64 {
 	rect := image.Rect(int(x), int(y), int(x+width), int(y+height))
 	rgba := image.NewRGBA64(rect)
@@ -387,11 +1193,98 @@ var _ ServerMessage = (*Bell)(nil)
 // Type implements the ServerMessage interface.
 func (*Bell) Type() messages.ServerMessage { return messages.Bell }
 
-// Read implements the ServerMessage interface.
+// Read implements the ServerMessage interface. A Bell is its message-type
+// alone, so nothing is read. Servers that follow it with a vendor payload
+// leave data behind that would be misparsed as the next message; a
+// ResyncError is returned if that data is already buffered.
 func (*Bell) Read(c *ClientConn) (ServerMessage, error) {
+	if err := c.checkNextMessageType(); err != nil {
+		return nil, err
+	}
 	return &Bell{}, nil
 }
 
+// Bell sends a Bell message to the client.
+func (c *ServerConn) Bell() error {
+	return c.send(messages.Bell)
+}
+
+//-----------------------------------------------------------------------------
+// ServerFence is sent by servers supporting the Fence pseudo-encoding, to
+// synchronize with the client or to respond to a ClientFence.
+//
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#servertoclientfence
+
+// ServerFence represents the wire format message, sans message-type and
+// padding.
+type ServerFence struct {
+	Flags   FenceFlags
+	Payload []byte
+}
+
+// Verify that interfaces are honored.
+var _ ServerMessage = (*ServerFence)(nil)
+
+// Type implements the ServerMessage interface.
+func (*ServerFence) Type() messages.ServerMessage { return messages.ServerFence }
+
+// Read implements the ServerMessage interface. Fences are only read, and
+// recorded as support for the Fence pseudo-encoding; those with FenceRequest
+// set are left to the caller to answer, e.g. with SendRaw.
+func (*ServerFence) Read(c *ClientConn) (ServerMessage, error) {
+	var msg struct {
+		_      [3]byte    // padding
+		Flags  FenceFlags // flags
+		Length uint8      // length
+	}
+	if err := c.receive(&msg); err != nil {
+		return nil, err
+	}
+	if msg.Length > maxFencePayload {
+		return nil, &ProtocolError{Errorf("ServerFence payload length %d exceeds %d bytes", msg.Length, maxFencePayload)}
+	}
+	payload := make([]byte, msg.Length)
+	if _, err := io.ReadFull(c.bufr, payload); err != nil {
+		return nil, readError(err)
+	}
+	c.adjustMetric("bytes-received", int64(len(payload)))
+	c.confirmEncoding(encodings.EncFencePseudo)
+	return &ServerFence{msg.Flags, payload}, nil
+}
+
+//-----------------------------------------------------------------------------
+// EndOfContinuousUpdates is sent by servers supporting the ContinuousUpdates
+// pseudo-encoding, first to tell the client so, and then whenever continuous
+// updates end, whether asked by the client or not.
+//
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#endofcontinuousupdates
+
+// EndOfContinuousUpdates represents the wire format message, which has
+// nothing beyond its message-type.
+type EndOfContinuousUpdates struct {
+	ended bool // Continuous updates were enabled.
+}
+
+// Verify that interfaces are honored.
+var _ ServerMessage = (*EndOfContinuousUpdates)(nil)
+
+// Type implements the ServerMessage interface.
+func (*EndOfContinuousUpdates) Type() messages.ServerMessage {
+	return messages.EndOfContinuousUpdates
+}
+
+// Read implements the ServerMessage interface. The client returns to
+// requesting updates, and records that the server supports continuous
+// updates. The acknowledgment of a disabling superseded since, e.g. by
+// Resume, is ignored.
+func (*EndOfContinuousUpdates) Read(c *ClientConn) (ServerMessage, error) {
+	c.confirmEncoding(encodings.EncContinuousUpdatesPseudo)
+	if c.supersededContinuousDisable() {
+		return &EndOfContinuousUpdates{}, nil
+	}
+	return &EndOfContinuousUpdates{ended: c.continuousUpdates.Swap(false)}, nil
+}
+
 //-----------------------------------------------------------------------------
 // ServerCutText indicates the server has new text in the cut buffer.
 //
@@ -402,6 +1295,10 @@ func (*Bell) Read(c *ClientConn) (ServerMessage, error) {
 // padding.
 type ServerCutText struct {
 	Text string
+
+	// Extended is set for messages in the Extended Clipboard format, whose
+	// payload is skipped, leaving Text empty.
+	Extended bool
 }
 
 // Verify that interfaces are honored.
@@ -411,9 +1308,12 @@ var _ ServerMessage = (*ServerCutText)(nil)
 func (*ServerCutText) Type() messages.ServerMessage { return messages.ServerCutText }
 
 // Read implements the ServerMessage interface.
+// The text is read incrementally, so that a length larger than the text the
+// server actually sends doesn't cause a large allocation. Lengths beyond the
+// configured MaxClipboardBytes are rejected without reading the text.
 func (*ServerCutText) Read(c *ClientConn) (ServerMessage, error) {
 	// Read off the padding
-	var padding [1]byte
+	var padding [3]byte
 	if err := c.receive(&padding); err != nil {
 		return nil, err
 	}
@@ -422,11 +1322,68 @@ func (*ServerCutText) Read(c *ClientConn) (ServerMessage, error) {
 	if err := c.receive(&textLength); err != nil {
 		return nil, err
 	}
+	// Servers may only use the Extended Clipboard format, denoted by a
+	// negative length, once the client has advertised it.
+	if int32(textLength) < 0 && c.GetEncodings().Contains(encodings.EncExtendedClipboardPseudo) {
+		return c.readExtendedCutText(uint32(-int32(textLength)))
+	}
+	if max := c.config.maxClipboardBytes(); textLength > max {
+		return nil, Errorf("ServerCutText length %d exceeds limit of %d bytes", textLength, max)
+	}
+
+	textBytes, err := io.ReadAll(io.LimitReader(c.bufr, int64(textLength)))
+	if err != nil {
+		return nil, err
+	}
+	c.adjustMetric("bytes-received", int64(len(textBytes)))
+	if len(textBytes) < int(textLength) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return &ServerCutText{Text: string(textBytes)}, nil
+}
 
-	textBytes := make([]uint8, textLength)
-	if err := c.receive(&textBytes); err != nil {
+// readExtendedCutText skips the payload of length bytes of a ServerCutText
+// message in the Extended Clipboard format, which a negative length denotes,
+// and records that the server supports the extension.
+func (c *ClientConn) readExtendedCutText(length uint32) (ServerMessage, error) {
+	if max := c.config.maxClipboardBytes(); length > max {
+		return nil, Errorf("ServerCutText length %d exceeds limit of %d bytes", length, max)
+	}
+	n, err := io.Copy(io.Discard, io.LimitReader(c.bufr, int64(length)))
+	if err != nil {
 		return nil, err
 	}
+	c.adjustMetric("bytes-received", n)
+	if n < int64(length) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	c.confirmEncoding(encodings.EncExtendedClipboardPseudo)
+	return &ServerCutText{Extended: true}, nil
+}
+
+// ServerCutText tells the client that the server has new text in its cut
+// buffer. The text string MUST only contain Latin-1 characters, which are
+// sent encoded as Latin-1.
+func (c *ServerConn) ServerCutText(text string) error {
+	latin1 := make([]byte, 0, len(text))
+	for _, char := range text {
+		if char > unicode.MaxLatin1 {
+			return NewVNCError(fmt.Sprintf("Character %q is not valid Latin-1", char))
+		}
+		latin1 = append(latin1, byte(char))
+	}
 
-	return &ServerCutText{string(textBytes)}, nil
+	msg := struct {
+		Msg    messages.ServerMessage // message-type
+		_      [3]byte                // padding
+		Length uint32                 // length
+	}{
+		Msg:    messages.ServerCutText,
+		Length: uint32(len(latin1)),
+	}
+	if err := c.send(msg); err != nil {
+		return err
+	}
+	return c.send(latin1)
 }
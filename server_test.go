@@ -1,10 +1,23 @@
 package vnc
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+	"net"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/bigangryrobot/go-vnc/encodings"
 	"github.com/bigangryrobot/go-vnc/go/operators"
+	"github.com/bigangryrobot/go-vnc/messages"
+	"github.com/bigangryrobot/go-vnc/rfbflags"
 )
 
 func TestRectangle_Marshal(t *testing.T) {
@@ -125,10 +138,884 @@ func TestFramebufferUpdate(t *testing.T) {
 	}
 }
 
+func TestFramebufferUpdate_MaxDecodeMemory(t *testing.T) {
+	rgb888 := PixelFormat{BPP: 32, Depth: 24, BigEndian: RFBTrue, TrueColor: RFBTrue,
+		RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 16, GreenShift: 8, BlueShift: 0}
+
+	for _, tt := range []struct {
+		max         uint64
+		concurrency int
+		wantBPP     uint8
+	}{
+		{0, 0, 32},  // Disabled.
+		{64, 0, 32}, // At the limit.
+		{32, 0, 16}, // Exceeded; switch to a compact format.
+		{64, 2, 16}, // Exceeded by the payload buffered for the decode pool.
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{MaxDecodeMemory: tt.max, MaintainFramebuffer: true, DecodeConcurrency: tt.concurrency})
+		conn.pixelFormat = rgb888
+		conn.fbWidth, conn.fbHeight = 4, 4
+
+		// A single 4x4 raw rectangle of dark red holds 64 bytes of pixel data.
+		mockConn.Write([]byte{0, 0, 1}) // padding, number-of-rectangles
+		mockConn.Write([]byte{0, 0, 0, 0, 0, 4, 0, 4, 0, 0, 0, 0})
+		mockConn.Write(bytes.Repeat([]byte{0, 0x10, 0, 0}, 4*4))
+
+		if _, err := (&FramebufferUpdate{}).Read(conn); err != nil {
+			t.Fatalf("max %d: unexpected error: %s", tt.max, err)
+		}
+		if got, want := conn.metrics["framebuffer-bytes"].Value(), uint64(64); got != want {
+			t.Errorf("max %d: incorrect framebuffer-bytes; got = %v, want = %v", tt.max, got, want)
+		}
+		if got, want := conn.GetPixelFormat().BPP, tt.wantBPP; got != want {
+			t.Errorf("max %d: incorrect bits-per-pixel; got = %v, want = %v", tt.max, got, want)
+		}
+		// The update is applied in the format it was sent in, before switching.
+		if got, want := conn.Framebuffer().RGBAAt(3, 3), (color.RGBA{R: 0x10, A: 0xff}); got != want {
+			t.Errorf("max %d: incorrect framebuffer pixel; got = %v, want = %v", tt.max, got, want)
+		}
+		if tt.wantBPP == rgb888.BPP {
+			continue
+		}
+		var req SetPixelFormatMessage
+		if err := conn.receive(&req); err != nil {
+			t.Fatalf("max %d: expected SetPixelFormat message: %s", tt.max, err)
+		}
+		if got, want := req.PF.BPP, tt.wantBPP; got != want {
+			t.Errorf("max %d: incorrect requested bits-per-pixel; got = %v, want = %v", tt.max, got, want)
+		}
+	}
+}
+
+func TestFramebufferUpdate_TrailingData(t *testing.T) {
+	raw := func(x uint16) []byte { // 1x1 raw rectangle
+		b := new(bytes.Buffer)
+		binary.Write(b, binary.BigEndian, rectangleMessage{x, 0, 1, 1, encodings.EncRaw})
+		b.Write([]byte{1, 2, 3, 4})
+		return b.Bytes()
+	}
+	lastRect := new(bytes.Buffer)
+	binary.Write(lastRect, binary.BigEndian, rectangleMessage{0, 0, 0, 0, encodings.EncLastRectPseudo})
+	bell := []byte{2}
+
+	for _, tt := range []struct {
+		desc      string
+		numRects  uint16
+		data      [][]byte
+		wantRects int
+		ok        bool
+	}{
+		{"exact count", 1, [][]byte{raw(0), bell}, 1, true},
+		{"stray rectangle", 1, [][]byte{raw(0), raw(0x1000)}, 0, false},
+		{"last rect", 0xffff, [][]byte{raw(0), lastRect.Bytes(), bell}, 1, true},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{})
+		mockConn.Write([]byte{0}) // padding
+		binary.Write(mockConn, binary.BigEndian, tt.numRects)
+		for _, b := range tt.data {
+			mockConn.Write(b)
+		}
+
+		msg, err := (&FramebufferUpdate{}).Read(conn)
+		if !tt.ok {
+			if _, ok := err.(*ResyncError); !ok {
+				t.Errorf("%s: expected ResyncError; got = %v", tt.desc, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.desc, err)
+			continue
+		}
+		if got, want := len(msg.(*FramebufferUpdate).Rects), tt.wantRects; got != want {
+			t.Errorf("%s: incorrect number of rectangles; got = %v, want = %v", tt.desc, got, want)
+		}
+		var messageType uint8
+		if err := conn.receive(&messageType); err != nil || messageType != bell[0] {
+			t.Errorf("%s: expected Bell to follow; got = %v, %v", tt.desc, messageType, err)
+		}
+	}
+}
+
+func TestFramebufferUpdate_MaxRectanglesPerUpdate(t *testing.T) {
+	raw := new(bytes.Buffer) // 1x1 raw rectangle
+	binary.Write(raw, binary.BigEndian, rectangleMessage{0, 0, 1, 1, encodings.EncRaw})
+	raw.Write([]byte{1, 2, 3, 4})
+	lastRect := new(bytes.Buffer)
+	binary.Write(lastRect, binary.BigEndian, rectangleMessage{0, 0, 0, 0, encodings.EncLastRectPseudo})
+
+	for _, tt := range []struct {
+		desc      string
+		max       uint16
+		numRects  uint16
+		data      [][]byte
+		wantRects int
+		ok        bool
+	}{
+		{"within limit", 2, 2, [][]byte{raw.Bytes(), raw.Bytes()}, 2, true},
+		{"oversized count", 2, 3, [][]byte{raw.Bytes(), raw.Bytes(), raw.Bytes()}, 0, false},
+		{"default limit", 0, DefaultMaxRectanglesPerUpdate + 1, nil, 0, false},
+		{"last rect at limit", 2, 0xffff, [][]byte{raw.Bytes(), raw.Bytes(), lastRect.Bytes()}, 2, true},
+		{"last rect beyond limit", 2, 0xffff, [][]byte{raw.Bytes(), raw.Bytes(), raw.Bytes(), lastRect.Bytes()}, 0, false},
+		{"last rect within limit", 2, 0xffff, [][]byte{raw.Bytes(), lastRect.Bytes()}, 1, true},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{MaxRectanglesPerUpdate: tt.max})
+		mockConn.Write([]byte{0}) // padding
+		binary.Write(mockConn, binary.BigEndian, tt.numRects)
+		for _, b := range tt.data {
+			mockConn.Write(b)
+		}
+
+		msg, err := (&FramebufferUpdate{}).Read(conn)
+		if !tt.ok {
+			if _, ok := err.(*ProtocolError); !ok {
+				t.Errorf("%s: expected ProtocolError; got = %v", tt.desc, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.desc, err)
+			continue
+		}
+		if got, want := len(msg.(*FramebufferUpdate).Rects), tt.wantRects; got != want {
+			t.Errorf("%s: incorrect number of rectangles; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
+func TestUpdateTerminator(t *testing.T) {
+	raw := new(bytes.Buffer) // 1x1 raw rectangle
+	binary.Write(raw, binary.BigEndian, rectangleMessage{0, 0, 1, 1, encodings.EncRaw})
+	raw.Write([]byte{1, 2, 3, 4})
+	lastRect := new(bytes.Buffer)
+	binary.Write(lastRect, binary.BigEndian, rectangleMessage{0, 0, 0, 0, encodings.EncLastRectPseudo})
+	bell := []byte{2}
+	endOfContinuousUpdates := []byte{150}
+
+	for _, tt := range []struct {
+		desc       string
+		numRects   uint16
+		continuous bool // Whether continuous updates are enabled.
+		data       [][]byte
+		wantRects  int
+		wantEnd    updateEnd
+	}{
+		{"empty", 0, false, [][]byte{bell}, 0, updateCountRead},
+		{"fixed count", 2, false, [][]byte{raw.Bytes(), raw.Bytes(), bell}, 2, updateCountRead},
+		{"last rect", 0xffff, false, [][]byte{raw.Bytes(), lastRect.Bytes(), bell}, 1, updateLastRect},
+		{"last rect within count", 3, false, [][]byte{raw.Bytes(), lastRect.Bytes(), bell}, 1, updateLastRect},
+		{"end of continuous updates", 0xffff, true, [][]byte{raw.Bytes(), endOfContinuousUpdates}, 1, updateEndOfContinuousUpdates},
+	} {
+		message := func() *MockConn {
+			mockConn := &MockConn{}
+			mockConn.Write([]byte{0}) // padding
+			binary.Write(mockConn, binary.BigEndian, tt.numRects)
+			for _, b := range tt.data {
+				mockConn.Write(b)
+			}
+			return mockConn
+		}
+		newConn := func() *ClientConn {
+			conn := NewClientConn(message(), &ClientConfig{ServerMessages: []ServerMessage{&EndOfContinuousUpdates{}}})
+			conn.fbWidth, conn.fbHeight = 1, 1
+			conn.continuousUpdates.Store(tt.continuous)
+			return conn
+		}
+		next := tt.data[len(tt.data)-1][0] // The message following the update.
+
+		// The terminator itself.
+		conn := newConn()
+		term, err := conn.readUpdateHeader()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.desc, err)
+		}
+		rects := 0
+		for term.more() {
+			rect := NewRectangle(conn.Encodable)
+			encImpl, err := term.readHeader(conn, rect)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", tt.desc, err)
+			}
+			if encImpl == nil {
+				continue
+			}
+			if _, err := DecodeRectangle(conn, rect, encImpl); err != nil {
+				t.Fatalf("%s: unexpected error: %s", tt.desc, err)
+			}
+			rects++
+		}
+		if err := term.finish(conn); err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.desc, err)
+		}
+		if got, want := term.end, tt.wantEnd; got != want {
+			t.Errorf("%s: incorrect end; got = %v, want = %v", tt.desc, got, want)
+		}
+		if got, want := rects, tt.wantRects; got != want {
+			t.Errorf("%s: incorrect number of rectangles; got = %v, want = %v", tt.desc, got, want)
+		}
+
+		// FramebufferUpdate.Read stops at the same place.
+		conn = newConn()
+		msg, err := (&FramebufferUpdate{}).Read(conn)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.desc, err)
+		}
+		if got, want := len(msg.(*FramebufferUpdate).Rects), tt.wantRects; got != want {
+			t.Errorf("%s: incorrect number of rectangles read; got = %v, want = %v", tt.desc, got, want)
+		}
+		var messageType uint8
+		if err := conn.receive(&messageType); err != nil || messageType != next {
+			t.Errorf("%s: expected message-type %d to follow update; got = %v, %v", tt.desc, next, messageType, err)
+		}
+	}
+
+	// A terminator ends the update once, for the first reason given.
+	term := &updateTerminator{numRects: 2, limit: 2}
+	term.terminate(updateLastRect)
+	term.terminate(updateCountRead)
+	if term.more() || term.end != updateLastRect {
+		t.Errorf("incorrect terminated update; more = %v, end = %v", term.more(), term.end)
+	}
+}
+
+func TestClientConfig_SkipUnknownPseudoEncodings(t *testing.T) {
+	raw := new(bytes.Buffer) // 1x1 raw rectangle
+	binary.Write(raw, binary.BigEndian, rectangleMessage{0, 0, 1, 1, encodings.EncRaw})
+	raw.Write([]byte{1, 2, 3, 4})
+	unknown := new(bytes.Buffer)
+	binary.Write(unknown, binary.BigEndian, rectangleMessage{0, 0, 0, 0, encodings.EncodingType(-1000)})
+
+	message := func() *MockConn {
+		mockConn := &MockConn{}
+		mockConn.Write([]byte{0})                           // padding
+		binary.Write(mockConn, binary.BigEndian, uint16(3)) // number-of-rectangles
+		mockConn.Write(raw.Bytes())
+		mockConn.Write(unknown.Bytes())
+		mockConn.Write(raw.Bytes())
+		return mockConn
+	}
+
+	conn := NewClientConn(message(), &ClientConfig{SkipUnknownPseudoEncodings: true})
+	msg, err := (&FramebufferUpdate{}).Read(conn)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := len(msg.(*FramebufferUpdate).Rects), 2; got != want {
+		t.Errorf("incorrect number of rectangles; got = %v, want = %v", got, want)
+	}
+	if got, want := conn.metricValue("pseudo-encodings-skipped"), uint64(1); got != want {
+		t.Errorf("incorrect pseudo-encodings-skipped; got = %v, want = %v", got, want)
+	}
+
+	// It is not set by NewClientConfig, and otherwise the rectangle is an
+	// error.
+	if NewClientConfig("").SkipUnknownPseudoEncodings {
+		t.Error("SkipUnknownPseudoEncodings set by NewClientConfig")
+	}
+	conn = NewClientConn(message(), &ClientConfig{})
+	if _, err := (&FramebufferUpdate{}).Read(conn); err == nil {
+		t.Error("expected error for unknown pseudo-encoding")
+	}
+
+	// Pseudo-encodings known to carry data are never skipped.
+	mockConn := &MockConn{}
+	mockConn.Write([]byte{0, 0, 1}) // padding, number-of-rectangles
+	binary.Write(mockConn, binary.BigEndian, rectangleMessage{0, 0, 8, 8, encodings.EncExtendedDesktopSizePseudo})
+	mockConn.Write([]byte{1, 0, 0, 0}) // number-of-screens, padding
+	conn = NewClientConn(mockConn, &ClientConfig{SkipUnknownPseudoEncodings: true})
+	if _, err := (&FramebufferUpdate{}).Read(conn); err == nil {
+		t.Error("expected error for ExtendedDesktopSize pseudo-encoding")
+	}
+	if got := conn.metricValue("pseudo-encodings-skipped"); got != 0 {
+		t.Errorf("incorrect pseudo-encodings-skipped; got = %v, want = 0", got)
+	}
+}
+
+func TestFramebufferUpdate_UnadvertisedEncoding(t *testing.T) {
+	pixel := []byte{0, 0xff, 0, 0} // in roundTripFormat
+	message := func(enc encodings.EncodingType) []byte {
+		b := new(bytes.Buffer)
+		b.Write([]byte{0, 0, 1}) // padding, number-of-rectangles
+		binary.Write(b, binary.BigEndian, rectangleMessage{0, 0, 1, 1, enc})
+		binary.Write(b, binary.BigEndian, uint32(0)) // RRE number-of-subrectangles
+		b.Write(pixel)
+		return b.Bytes()
+	}
+
+	// RRE is decoded although only Raw was advertised.
+	conn := roundTripConn(message(encodings.EncRRE))
+	conn.encodings = Encodings{&RawEncoding{}}
+	msg, err := (&FramebufferUpdate{}).Read(conn)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	rects := msg.(*FramebufferUpdate).Rects
+	if len(rects) != 1 {
+		t.Fatalf("incorrect number of rectangles; got = %v, want = 1", len(rects))
+	}
+	if _, ok := rects[0].Enc.(*RREEncoding); !ok {
+		t.Errorf("incorrect encoding; got = %v, want RREEncoding", rects[0].Enc)
+	}
+	if got, want := conn.ObservedEncodings()[encodings.EncRRE], 1; got != want {
+		t.Errorf("incorrect observed RRE rectangles; got = %v, want = %v", got, want)
+	}
+
+	// An encoding that can't be decoded still fails.
+	conn = roundTripConn(message(encodings.EncodingType(1000)))
+	if _, err := (&FramebufferUpdate{}).Read(conn); err == nil {
+		t.Error("expected error for an unregistered encoding")
+	}
+}
+
+func TestFramebufferUpdate_InterleavedMessage(t *testing.T) {
+	raw := new(bytes.Buffer) // 1x1 raw rectangle
+	binary.Write(raw, binary.BigEndian, rectangleMessage{0, 0, 1, 1, encodings.EncRaw})
+	raw.Write([]byte{1, 2, 3, 4})
+	bell := []byte{2}
+	cutText := []byte{3, 0, 0, 0, 0, 0, 0, 1, 'x'}
+	// A Bell followed by bytes that make up a Raw rectangle beyond the
+	// framebuffer.
+	rawBell := []byte{2, 0, 0, 0, 0, 4, 0, 4, 0, 0, 0, 0}
+
+	for _, tt := range []struct {
+		desc     string
+		numRects uint16
+		data     [][]byte
+		want     messages.ServerMessage
+	}{
+		{"after header", 1, [][]byte{bell, raw.Bytes()}, messages.Bell},
+		{"between rectangles", 2, [][]byte{raw.Bytes(), bell, raw.Bytes()}, messages.Bell},
+		{"cut text", 2, [][]byte{raw.Bytes(), cutText, raw.Bytes()}, messages.ServerCutText},
+		{"supported encoding", 1, [][]byte{rawBell, bytes.Repeat([]byte{0}, 16*4)}, messages.Bell},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, NewClientConfig(""))
+		conn.fbWidth, conn.fbHeight = 100, 100
+		mockConn.Write([]byte{0}) // padding
+		binary.Write(mockConn, binary.BigEndian, tt.numRects)
+		for _, b := range tt.data {
+			mockConn.Write(b)
+		}
+
+		_, err := (&FramebufferUpdate{}).Read(conn)
+		ierr, ok := err.(*InterleavedMessageError)
+		if !ok {
+			t.Errorf("%s: expected InterleavedMessageError; got = %v", tt.desc, err)
+			continue
+		}
+		if got, want := ierr.MessageType, tt.want; got != want {
+			t.Errorf("%s: incorrect message-type; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
+func TestClientConn_BellAfterUpdate(t *testing.T) {
+	mockConn := &MockConn{}
+	cfg := NewClientConfig("")
+	cfg.ServerMessageCh = make(chan ServerMessage, 2)
+	cfg.AutoRequestUpdates = false // MockConn would read the request back.
+	conn := NewClientConn(mockConn, cfg)
+	conn.encodings = Encodings{&RawEncoding{}}
+	mockConn.Write([]byte{0, 0, 0, 1}) // message-type, padding, number-of-rectangles
+	binary.Write(mockConn, binary.BigEndian, rectangleMessage{0, 0, 1, 1, encodings.EncRaw})
+	mockConn.Write([]byte{1, 2, 3, 4})
+	mockConn.Write([]byte{2}) // Bell
+
+	if err := conn.ListenAndHandle(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, want := range []messages.ServerMessage{messages.FramebufferUpdate, messages.Bell} {
+		if got := (<-cfg.ServerMessageCh).Type(); got != want {
+			t.Errorf("incorrect message; got = %v, want = %v", got, want)
+		}
+	}
+}
+
+func TestClientConn_BellBeforeUpdate(t *testing.T) {
+	mockConn := &MockConn{}
+	cfg := NewClientConfig("")
+	cfg.ServerMessageCh = make(chan ServerMessage, 2)
+	cfg.AutoRequestUpdates = false // MockConn would read the request back.
+	conn := NewClientConn(mockConn, cfg)
+	conn.encodings = Encodings{&RawEncoding{}}
+	mockConn.Write([]byte{2})          // Bell
+	mockConn.Write([]byte{0, 0, 0, 1}) // message-type, padding, number-of-rectangles
+	binary.Write(mockConn, binary.BigEndian, rectangleMessage{0, 0, 1, 1, encodings.EncRaw})
+	mockConn.Write([]byte{1, 2, 3, 4})
+
+	if err := conn.ListenAndHandle(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, want := range []messages.ServerMessage{messages.Bell, messages.FramebufferUpdate} {
+		if got := (<-cfg.ServerMessageCh).Type(); got != want {
+			t.Errorf("incorrect message; got = %v, want = %v", got, want)
+		}
+	}
+}
+
+func TestBell_Payload(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, NewClientConfig(""))
+	mockConn.Write([]byte{0x7f}) // A vendor payload following the Bell.
+	conn.bufr.Peek(1)
+
+	if _, err := (&Bell{}).Read(conn); err == nil {
+		t.Fatal("expected error")
+	} else if _, ok := err.(*ResyncError); !ok {
+		t.Errorf("expected ResyncError; got = %v", err)
+	}
+}
+
+func TestClientConn_Resync(t *testing.T) {
+	// Noise holding message-types, none of which starts a plausible message:
+	// updates of no or too many rectangles, or non-zero padding, color map
+	// entries in a true-color format, a Bell followed by noise, and cut text
+	// with non-zero padding.
+	noise := []byte{0xfe, 0, 0, 0, 0, 0x7f, 1, 1, 2, 0x7f, 3, 0xff, 0x80}
+	messagesWithNoise := func() []byte {
+		var b bytes.Buffer
+		b.Write([]byte{2}) // Bell
+		b.Write(noise)
+		b.Write([]byte{0, 0, 0, 1}) // message-type, padding, number-of-rectangles
+		binary.Write(&b, binary.BigEndian, rectangleMessage{0, 0, 1, 1, encodings.EncRaw})
+		b.Write([]byte{1, 2, 3, 4})
+		b.Write(noise)
+		b.Write([]byte{2}) // Bell
+		return b.Bytes()
+	}
+
+	for _, tt := range []struct {
+		desc    string
+		resync  bool
+		maxScan int
+		ok      bool
+		resyncs uint64
+	}{
+		{"disabled", false, 0, false, 0},
+		{"enabled", true, 0, true, 2},
+		{"scan limit", true, len(noise) - 1, false, 0},
+	} {
+		mockConn := &MockConn{}
+		cfg := NewClientConfig("")
+		cfg.ServerMessageCh = make(chan ServerMessage, 3)
+		cfg.AutoRequestUpdates = false // MockConn would read the request back.
+		cfg.Resync = tt.resync
+		cfg.MaxResyncBytes = tt.maxScan
+		conn := NewClientConn(mockConn, cfg)
+		conn.encodings = Encodings{&RawEncoding{}}
+		mockConn.Write(messagesWithNoise())
+
+		err := conn.ListenAndHandle()
+		if !tt.ok {
+			if _, ok := err.(*ResyncError); !ok {
+				t.Errorf("%s: expected ResyncError; got = %v", tt.desc, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.desc, err)
+		}
+		for _, want := range []messages.ServerMessage{messages.Bell, messages.FramebufferUpdate, messages.Bell} {
+			if got := (<-cfg.ServerMessageCh).Type(); got != want {
+				t.Errorf("%s: incorrect message; got = %v, want = %v", tt.desc, got, want)
+			}
+		}
+		if got, want := conn.metricValue("resyncs"), tt.resyncs; got != want {
+			t.Errorf("%s: incorrect resyncs; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
+func ExampleDecodeEncoding_raw() {
+	data := []byte{
+		0, 0, 0, 0, 0, 2, 0, 1, 0, 0, 0, 0, // x, y, width, height, encoding-type
+		0, 0xff, 0, 0, // red
+		0, 0, 0x80, 0, // green
+	}
+	enc, err := DecodeEncoding(encodings.EncRaw, data, PixelFormat32bit, ColorMap{})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, c := range enc.(*RawEncoding).Colors {
+		fmt.Println(c.Hex())
+	}
+	// Output:
+	// #ff0000
+	// #008000
+}
+
+func ExampleDecodeEncoding_rre() {
+	data := []byte{
+		0, 0, 0, 0, 0, 4, 0, 4, 0, 0, 0, 2, // x, y, width, height, encoding-type
+		0, 0, 0, 1, // number-of-subrectangles
+		0, 0, 0, 0, // background: black
+		0, 0xff, 0xff, 0xff, // white
+		0, 1, 0, 1, 0, 2, 0, 2, // x, y, width, height
+	}
+	enc, err := DecodeEncoding(encodings.EncRRE, data, PixelFormat32bit, ColorMap{})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	rre := enc.(*RREEncoding)
+	fmt.Println("background:", rre.BackgroundColor.Hex())
+	for _, sr := range rre.SubRects {
+		fmt.Printf("%s at (%d, %d), %dx%d\n", sr.Color.Hex(), sr.Rect.X, sr.Rect.Y, sr.Rect.Width, sr.Rect.Height)
+	}
+	// Output:
+	// background: #000000
+	// #ffffff at (1, 1), 2x2
+}
+
+func TestDecodeEncoding(t *testing.T) {
+	raw := []byte{0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0, 1, 2, 3, 4}
+	rreCount := []byte{
+		0, 0, 0, 0, 0, 4, 0, 4, 0, 0, 0, 2, // x, y, width, height, encoding-type
+		0xff, 0xff, 0xff, 0xff, // number-of-subrectangles
+		0, 0, 0, 0, // background
+	}
+	for _, tt := range []struct {
+		desc string
+		enc  encodings.EncodingType
+		data []byte
+		ok   bool
+	}{
+		{"raw", encodings.EncRaw, raw, true},
+		{"mismatched type", encodings.EncRRE, raw, false},
+		{"trailing data", encodings.EncRaw, append(raw[:len(raw):len(raw)], 0), false},
+		{"truncated", encodings.EncRaw, raw[:len(raw)-1], false},
+		{"unsupported type", encodings.EncLastRectPseudo, raw, false},
+		{"RRE sub-rectangles beyond the area", encodings.EncRRE, rreCount, false},
+	} {
+		_, err := DecodeEncoding(tt.enc, tt.data, PixelFormat32bit, ColorMap{})
+		if tt.ok && err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.desc, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: expected error", tt.desc)
+		}
+	}
+}
+
+func TestDecodeRectangle(t *testing.T) {
+	conn := roundTripConn([]byte{0, 1, 2, 3, 0, 4, 5, 6})
+	rect := &Rectangle{X: 1, Y: 2, Width: 2, Height: 1}
+
+	enc, err := DecodeRectangle(conn, rect, &RawEncoding{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := rect.Enc, enc; got != want {
+		t.Errorf("incorrect rectangle encoding; got = %v, want = %v", got, want)
+	}
+	colors := enc.(*RawEncoding).Colors
+	if got, want := len(colors), 2; got != want {
+		t.Fatalf("incorrect number of colors; got = %v, want = %v", got, want)
+	}
+	if got, want := colors[1].Hex(), "#040506"; got != want {
+		t.Errorf("incorrect color; got = %v, want = %v", got, want)
+	}
+	if got, want := conn.ObservedEncodings()[encodings.EncRaw], 1; got != want {
+		t.Errorf("incorrect observed Raw rectangles; got = %v, want = %v", got, want)
+	}
+	if got, want := conn.metrics["framebuffer-bytes"].Value(), uint64(2*4); got != want {
+		t.Errorf("incorrect framebuffer-bytes; got = %v, want = %v", got, want)
+	}
+}
+
+func TestFramebufferUpdate_OnFrameComplete(t *testing.T) {
+	header := func(x uint16, enc encodings.EncodingType) []byte {
+		b := new(bytes.Buffer)
+		binary.Write(b, binary.BigEndian, rectangleMessage{x, 0, 1, 1, enc})
+		return b.Bytes()
+	}
+	raw := func(x uint16) []byte { return append(header(x, encodings.EncRaw), 1, 2, 3, 4) }
+
+	for _, tt := range []struct {
+		desc     string
+		numRects uint16
+		data     [][]byte
+		want     []uint16 // x-positions of the updated regions
+	}{
+		{"rectangles", 2, [][]byte{raw(0), raw(1)}, []uint16{0, 1}},
+		{"last rect", 0xffff, [][]byte{raw(2), header(0, encodings.EncLastRectPseudo)}, []uint16{2}},
+		{"pseudo-encoding", 2, [][]byte{raw(3), header(0, encodings.DesktopSizePseudoEncoding)}, []uint16{3}},
+		{"keepalive", 0, nil, []uint16{}},
+	} {
+		var calls [][]Rectangle
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{
+			OnFrameComplete: func(regions []Rectangle) { calls = append(calls, regions) },
+		})
+		conn.encodings = Encodings{&RawEncoding{}, &DesktopSizePseudoEncoding{}}
+		mockConn.Write([]byte{0}) // padding
+		binary.Write(mockConn, binary.BigEndian, tt.numRects)
+		for _, b := range tt.data {
+			mockConn.Write(b)
+		}
+
+		if _, err := (&FramebufferUpdate{}).Read(conn); err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.desc, err)
+			continue
+		}
+		if got, want := len(calls), 1; got != want {
+			t.Errorf("%s: incorrect number of calls; got = %v, want = %v", tt.desc, got, want)
+			continue
+		}
+		if calls[0] == nil {
+			t.Errorf("%s: expected a non-nil region slice", tt.desc)
+		}
+		got := []uint16{}
+		for _, r := range calls[0] {
+			got = append(got, r.X)
+		}
+		if want := tt.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: incorrect regions; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
+func TestFramebufferUpdate_Empty(t *testing.T) {
+	// The server sends nothing after the update, so any read beyond its
+	// header blocks until the connection is closed.
+	client, server := net.Pipe()
+	defer server.Close()
+	go server.Write([]byte{0, 0, 0}) // padding, number-of-rectangles
+
+	var calls [][]Rectangle
+	conn := NewClientConn(client, &ClientConfig{
+		MaintainFramebuffer: true,
+		OnFrameComplete:     func(regions []Rectangle) { calls = append(calls, regions) },
+	})
+	conn.fbWidth, conn.fbHeight = 4, 4
+
+	type result struct {
+		msg ServerMessage
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		msg, err := (&FramebufferUpdate{}).Read(conn)
+		done <- result{msg, err}
+	}()
+	var r result
+	select {
+	case r = <-done:
+	case <-time.After(5 * time.Second):
+		client.Close()
+		t.Fatal("timed out reading an empty update")
+	}
+	if r.err != nil {
+		t.Fatalf("unexpected error: %s", r.err)
+	}
+	fu := r.msg.(*FramebufferUpdate)
+	if fu.NumRect != 0 || len(fu.Rects) != 0 || !fu.Changed.Empty() {
+		t.Errorf("expected an empty update; got = %+v", fu)
+	}
+	if len(calls) != 1 || calls[0] == nil || len(calls[0]) != 0 {
+		t.Errorf("expected one OnFrameComplete call with no regions; got = %v", calls)
+	}
+	select {
+	case <-conn.firstFrame:
+	default:
+		t.Error("expected the empty update to release WaitForFirstFrame")
+	}
+}
+
+func TestFramebufferUpdate_TruncatedRectangle(t *testing.T) {
+	pixel := []byte{0, 0xff, 0, 0} // in roundTripFormat
+	for _, tt := range []struct {
+		desc  string
+		enc   encodings.EncodingType
+		w, h  uint16
+		body  []byte
+		short int
+	}{
+		{"Raw", encodings.EncRaw, 2, 2, bytes.Repeat(pixel, 3)[:10], 6},
+		{"Hextile", encodings.EncHextile, 2, 2, []byte{1, 0, 0xff, 0, 0, 0}, 11}, // raw tile
+		{"Tight", encodings.EncTight, 2, 2, []byte{0, 10, 1, 2, 3, 4}, 6},        // basic, 10 bytes of zlib data
+		{"Tight at the body", encodings.EncTight, 2, 1, nil, 0},
+	} {
+		for _, concurrency := range []int{0, 2} {
+			var update bytes.Buffer
+			update.Write([]byte{0, 0, 2}) // padding, number-of-rectangles
+			binary.Write(&update, binary.BigEndian, rectangleMessage{0, 0, 1, 1, encodings.EncRaw})
+			update.Write(pixel)
+			binary.Write(&update, binary.BigEndian, rectangleMessage{3, 4, tt.w, tt.h, tt.enc})
+			update.Write(tt.body)
+			conn := roundTripConn(update.Bytes())
+			conn.config.DecodeConcurrency = concurrency
+
+			_, err := (&FramebufferUpdate{}).Read(conn)
+			var terr *TruncatedRectangleError
+			if !errors.As(err, &terr) {
+				t.Errorf("%s, concurrency %d: expected a TruncatedRectangleError; got = %v", tt.desc, concurrency, err)
+				continue
+			}
+			want := TruncatedRectangleError{Index: 1, X: 3, Y: 4, Width: tt.w, Height: tt.h, Encoding: tt.enc, Short: tt.short, Err: terr.Err}
+			if *terr != want {
+				t.Errorf("%s, concurrency %d: incorrect error; got = %+v, want = %+v", tt.desc, concurrency, *terr, want)
+			}
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("%s, concurrency %d: expected io.ErrUnexpectedEOF; got = %v", tt.desc, concurrency, err)
+			}
+		}
+	}
+}
+
+func TestClientConn_ObservedEncodings(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := newMixedUpdateConn(mockConn, 0)
+	for i := 0; i < 2; i++ {
+		writeMixedUpdate(mockConn)
+		if _, err := (&FramebufferUpdate{}).Read(conn); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	want := map[encodings.EncodingType]int{
+		encodings.EncRaw:               4,
+		encodings.EncRRE:               4,
+		encodings.EncHextile:           4,
+		encodings.EncDesktopSizePseudo: 2,
+	}
+	if got := conn.ObservedEncodings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect observed encodings; got = %v, want = %v", got, want)
+	}
+}
+
+// writeMixedUpdate writes a FramebufferUpdate holding Raw, RRE, Hextile and
+// DesktopSize rectangles of 32 bits-per-pixel data to w.
+func writeMixedUpdate(w io.Writer) {
+	const size = 64
+	pixel := func(i int) []byte { return []byte{0, byte(i), byte(i >> 8), byte(i >> 16)} }
+	header := func(x, y, width, height uint16, enc encodings.EncodingType) {
+		binary.Write(w, binary.BigEndian, rectangleMessage{x, y, width, height, enc})
+	}
+
+	w.Write([]byte{0, 0, 7}) // padding, number-of-rectangles
+	for i := 0; i < 2; i++ {
+		// Raw
+		header(0, uint16(i*size), size, size, encodings.EncRaw)
+		for p := 0; p < size*size; p++ {
+			w.Write(pixel(p + i))
+		}
+
+		// RRE
+		header(size, uint16(i*size), size, size, encodings.EncRRE)
+		binary.Write(w, binary.BigEndian, uint32(32))
+		w.Write(pixel(i))
+		for sr := 0; sr < 32; sr++ {
+			w.Write(pixel(sr))
+			binary.Write(w, binary.BigEndian, [4]uint16{uint16(sr), uint16(sr), 2, 2})
+		}
+
+		// Hextile, alternating raw and subrectangle tiles.
+		header(2*size, uint16(i*size), size, size, encodings.EncHextile)
+		for tile := 0; tile < (size/16)*(size/16); tile++ {
+			if tile%2 == 0 {
+				w.Write([]byte{0x01})
+				for p := 0; p < 16*16; p++ {
+					w.Write(pixel(p * tile))
+				}
+				continue
+			}
+			w.Write([]byte{0x02 | 0x08 | 0x10})
+			w.Write(pixel(tile))
+			w.Write([]byte{4})
+			for sr := 0; sr < 4; sr++ {
+				w.Write(pixel(sr))
+				w.Write([]byte{byte(sr<<4 | sr), 0x11})
+			}
+		}
+	}
+	header(0, 0, 3*size, 2*size, encodings.DesktopSizePseudoEncoding)
+}
+
+func newMixedUpdateConn(conn net.Conn, concurrency int) *ClientConn {
+	c := NewClientConn(conn, &ClientConfig{DecodeConcurrency: concurrency})
+	c.pixelFormat = PixelFormat32bit
+	c.encodings = Encodings{&RawEncoding{}, &RREEncoding{}, &HextileEncoding{}, &DesktopSizePseudoEncoding{}}
+	return c
+}
+
+func TestFramebufferUpdate_DecodeConcurrency(t *testing.T) {
+	var want []Rectangle
+	for _, concurrency := range []int{0, 1, 2, 8} {
+		mockConn := &MockConn{}
+		conn := newMixedUpdateConn(mockConn, concurrency)
+		writeMixedUpdate(mockConn)
+
+		msg, err := (&FramebufferUpdate{}).Read(conn)
+		if err != nil {
+			t.Fatalf("concurrency %d: unexpected error: %s", concurrency, err)
+		}
+		if got := mockConn.b.Len() + conn.bufr.Buffered(); got != 0 {
+			t.Errorf("concurrency %d: %d bytes left unread", concurrency, got)
+		}
+		rects := msg.(*FramebufferUpdate).Rects
+		if want == nil {
+			want = rects
+			continue
+		}
+		if got, want := len(rects), len(want); got != want {
+			t.Fatalf("concurrency %d: incorrect number of rectangles; got = %v, want = %v", concurrency, got, want)
+		}
+		for i := range rects {
+			got, want := rects[i], want[i]
+			if got.X != want.X || got.Y != want.Y || got.Width != want.Width || got.Height != want.Height {
+				t.Errorf("concurrency %d: rect %d: incorrect geometry; got = %v, want = %v", concurrency, i, got, want)
+			}
+			if !reflect.DeepEqual(got.Enc, want.Enc) {
+				t.Errorf("concurrency %d: rect %d: decoded %v differs from sequential %v", concurrency, i, got.Enc, want.Enc)
+			}
+		}
+	}
+}
+
+func TestFramebufferUpdate_DecodeConcurrency_RRESubRectCount(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := newMixedUpdateConn(mockConn, 2)
+	mockConn.Write([]byte{0, 0, 1}) // padding, number-of-rectangles
+	binary.Write(mockConn, binary.BigEndian, rectangleMessage{0, 0, 2, 2, encodings.EncRRE})
+	binary.Write(mockConn, binary.BigEndian, uint32(5)) // number-of-subrectangles
+	mockConn.Write([]byte{0, 0, 0, 0})                  // background
+
+	if _, err := (&FramebufferUpdate{}).Read(conn); err == nil || !strings.Contains(err.Error(), "sub-rectangles exceed") {
+		t.Errorf("expected the sub-rectangle count to be rejected; got = %v", err)
+	}
+}
+
+func BenchmarkFramebufferUpdate_Read(b *testing.B) {
+	var update bytes.Buffer
+	writeMixedUpdate(&update)
+
+	for _, concurrency := range []int{1, 4} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			mockConn := &MockConn{}
+			conn := newMixedUpdateConn(mockConn, concurrency)
+			b.SetBytes(int64(update.Len()))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				mockConn.Write(update.Bytes())
+				if _, err := (&FramebufferUpdate{}).Read(conn); err != nil {
+					b.Fatalf("unexpected error: %s", err)
+				}
+			}
+		})
+	}
+}
+
 func TestColor_Marshal(t *testing.T) {
+	// The formats of NewPixelFormat, exercising the full range of each shift.
+	pf16, pf32 := NewPixelFormat(16), NewPixelFormat(32)
 	cm := ColorMap{}
-	for i := 0; i < len(cm); i++ {
-		cm[i] = Color{R: uint16(i), G: uint16(i << 4), B: uint16(i << 8)}
+	for i := 0; i < 256; i++ {
+		cm.Set(uint16(i), uint16(i), uint16(i<<4), uint16(i<<8))
 	}
 
 	tests := []struct {
@@ -140,17 +1027,17 @@ func TestColor_Marshal(t *testing.T) {
 		{&Color{&PixelFormat8bit, &cm, 127, 127, 2032, 32512}, []byte{127}},
 		{&Color{&PixelFormat8bit, &cm, 255, 255, 4080, 65280}, []byte{255}},
 		// 16 BPP
-		{&Color{&PixelFormat16bit, &ColorMap{}, 0, 0, 0, 0}, []byte{0, 0}},
-		{&Color{&PixelFormat16bit, &ColorMap{}, 0, 127, 7, 0}, []byte{0, 127}},
-		{&Color{&PixelFormat16bit, &ColorMap{}, 0, 32767, 2047, 127}, []byte{127, 255}},
-		{&Color{&PixelFormat16bit, &ColorMap{}, 0, 65535, 4095, 255}, []byte{255, 255}},
+		{&Color{&pf16, &ColorMap{}, 0, 0, 0, 0}, []byte{0, 0}},
+		{&Color{&pf16, &ColorMap{}, 0, 127, 7, 0}, []byte{0, 127}},
+		{&Color{&pf16, &ColorMap{}, 0, 32767, 2047, 127}, []byte{127, 255}},
+		{&Color{&pf16, &ColorMap{}, 0, 65535, 4095, 255}, []byte{255, 255}},
 		// 32 BPP
-		{&Color{&PixelFormat32bit, &ColorMap{}, 0, 0, 0, 0}, []byte{0, 0, 0, 0}},
-		{&Color{&PixelFormat32bit, &ColorMap{}, 0, 127, 0, 0}, []byte{0, 0, 0, 127}},
-		{&Color{&PixelFormat32bit, &ColorMap{}, 0, 32767, 127, 0}, []byte{0, 0, 127, 255}},
-		{&Color{&PixelFormat32bit, &ColorMap{}, 0, 65535, 32767, 127}, []byte{0, 127, 255, 255}},
-		{&Color{&PixelFormat32bit, &ColorMap{}, 0, 65535, 65535, 32767}, []byte{127, 255, 255, 255}},
-		{&Color{&PixelFormat32bit, &ColorMap{}, 0, 65535, 65535, 65535}, []byte{255, 255, 255, 255}},
+		{&Color{&pf32, &ColorMap{}, 0, 0, 0, 0}, []byte{0, 0, 0, 0}},
+		{&Color{&pf32, &ColorMap{}, 0, 127, 0, 0}, []byte{0, 0, 0, 127}},
+		{&Color{&pf32, &ColorMap{}, 0, 32767, 127, 0}, []byte{0, 0, 127, 255}},
+		{&Color{&pf32, &ColorMap{}, 0, 65535, 32767, 127}, []byte{0, 127, 255, 255}},
+		{&Color{&pf32, &ColorMap{}, 0, 65535, 65535, 32767}, []byte{127, 255, 255, 255}},
+		{&Color{&pf32, &ColorMap{}, 0, 65535, 65535, 65535}, []byte{255, 255, 255, 255}},
 	}
 
 	for i, tt := range tests {
@@ -162,13 +1049,86 @@ func TestColor_Marshal(t *testing.T) {
 		if got, want := data, tt.data; !operators.EqualSlicesOfByte(got, want) {
 			t.Errorf("%v: incorrect result; got = %v, want = %v", i, got, want)
 		}
+
+		buf := make([]byte, 8)
+		n, err := tt.c.MarshalTo(buf)
+		if err != nil {
+			t.Errorf("%v: unexpected MarshalTo error: %v", i, err)
+			continue
+		}
+		if got, want := buf[:n], tt.data; !operators.EqualSlicesOfByte(got, want) {
+			t.Errorf("%v: incorrect MarshalTo result; got = %v, want = %v", i, got, want)
+		}
+		if _, err := tt.c.MarshalTo(buf[:len(tt.data)-1]); err != io.ErrShortBuffer {
+			t.Errorf("%v: incorrect MarshalTo error for a short buffer; got = %v, want = %v", i, err, io.ErrShortBuffer)
+		}
 	}
 }
 
+func TestColor_Pack(t *testing.T) {
+	pf16 := NewPixelFormat(16)
+	for _, tt := range []struct {
+		desc string
+		c    Color
+		pf   PixelFormat
+		want uint32
+	}{
+		{"true color", Color{R: 0x12, G: 0x34, B: 0x56}, roundTripFormat, 0x123456},
+		{"shifts of the format", Color{R: 0x12, G: 0x34, B: 0x56}, rgbaPixelFormat, 0x563412},
+		{"16 bpp", Color{R: 1, G: 2, B: 3}, pf16, 0x321},
+		{"color-mapped", Color{cmIndex: 42, R: 0x12}, PixelFormat8bit, 42},
+	} {
+		if got := tt.c.Pack(tt.pf); got != tt.want {
+			t.Errorf("%s: incorrect pixel; got = %#x, want = %#x", tt.desc, got, tt.want)
+		}
+	}
+}
+
+// BenchmarkRawEncoding_Marshal marshals a 512x512 rectangle of colors from a
+// 16-color palette, one allocation per color with Marshal, as RawEncoding
+// used to, and into a single buffer with MarshalTo.
+func BenchmarkRawEncoding_Marshal(b *testing.B) {
+	const size = 512
+	pf := PixelFormat32bit
+	var cm ColorMap
+	colors := make([]Color, size*size)
+	for i := range colors {
+		p := i % 16
+		colors[i] = Color{pf: &pf, cm: &cm, R: uint16(p << 4), G: uint16(p << 2), B: uint16(p)}
+	}
+
+	b.Run("Marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(size * size * 4)
+		for n := 0; n < b.N; n++ {
+			buf := NewBuffer(nil)
+			for _, c := range colors {
+				data, err := c.Marshal()
+				if err != nil {
+					b.Fatal(err)
+				}
+				buf.Write(data)
+			}
+		}
+	})
+	b.Run("MarshalTo", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(size * size * 4)
+		enc := &RawEncoding{colors}
+		for n := 0; n < b.N; n++ {
+			if _, err := enc.Marshal(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
 func TestColor_Unmarshal(t *testing.T) {
+	// The formats of NewPixelFormat, exercising the full range of each shift.
+	pf16, pf32 := NewPixelFormat(16), NewPixelFormat(32)
 	var cm ColorMap
-	for i := 0; i < len(cm); i++ {
-		cm[i] = Color{R: uint16(i), G: uint16(i << 4), B: uint16(i << 8)}
+	for i := 0; i < 256; i++ {
+		cm.Set(uint16(i), uint16(i), uint16(i<<4), uint16(i<<8))
 	}
 
 	tests := []struct {
@@ -182,18 +1142,20 @@ func TestColor_Unmarshal(t *testing.T) {
 		{[]byte{0}, &PixelFormat8bit, &cm, 0, 0, 0, 0},
 		{[]byte{127}, &PixelFormat8bit, &cm, 127, 127, 2032, 32512},
 		{[]byte{255}, &PixelFormat8bit, &cm, 255, 255, 4080, 65280},
+		// 16 BPP, with index beyond the ColorMap
+		{[]byte{1, 44}, &PixelFormat{BPP: 16, Depth: 16, BigEndian: RFBTrue}, &cm, 300, 0, 0, 0},
 		// 16 BPP
-		{[]byte{0, 0}, &PixelFormat16bit, &ColorMap{}, 0, 0, 0, 0},
-		{[]byte{0, 127}, &PixelFormat16bit, &ColorMap{}, 0, 127, 7, 0},
-		{[]byte{127, 255}, &PixelFormat16bit, &ColorMap{}, 0, 32767, 2047, 127},
-		{[]byte{255, 255}, &PixelFormat16bit, &ColorMap{}, 0, 65535, 4095, 255},
+		{[]byte{0, 0}, &pf16, &ColorMap{}, 0, 0, 0, 0},
+		{[]byte{0, 127}, &pf16, &ColorMap{}, 0, 127, 7, 0},
+		{[]byte{127, 255}, &pf16, &ColorMap{}, 0, 32767, 2047, 127},
+		{[]byte{255, 255}, &pf16, &ColorMap{}, 0, 65535, 4095, 255},
 		// 32 BPP
-		{[]byte{0, 0, 0, 0}, &PixelFormat32bit, &ColorMap{}, 0, 0, 0, 0},
-		{[]byte{0, 0, 0, 127}, &PixelFormat32bit, &ColorMap{}, 0, 127, 0, 0},
-		{[]byte{0, 0, 127, 255}, &PixelFormat32bit, &ColorMap{}, 0, 32767, 127, 0},
-		{[]byte{0, 127, 255, 255}, &PixelFormat32bit, &ColorMap{}, 0, 65535, 32767, 127},
-		{[]byte{127, 255, 255, 255}, &PixelFormat32bit, &ColorMap{}, 0, 65535, 65535, 32767},
-		{[]byte{255, 255, 255, 255}, &PixelFormat32bit, &ColorMap{}, 0, 65535, 65535, 65535},
+		{[]byte{0, 0, 0, 0}, &pf32, &ColorMap{}, 0, 0, 0, 0},
+		{[]byte{0, 0, 0, 127}, &pf32, &ColorMap{}, 0, 127, 0, 0},
+		{[]byte{0, 0, 127, 255}, &pf32, &ColorMap{}, 0, 32767, 127, 0},
+		{[]byte{0, 127, 255, 255}, &pf32, &ColorMap{}, 0, 65535, 32767, 127},
+		{[]byte{127, 255, 255, 255}, &pf32, &ColorMap{}, 0, 65535, 65535, 32767},
+		{[]byte{255, 255, 255, 255}, &pf32, &ColorMap{}, 0, 65535, 65535, 65535},
 	}
 
 	for i, tt := range tests {
@@ -217,8 +1179,451 @@ func TestColor_Unmarshal(t *testing.T) {
 	}
 }
 
-func TestSetColorMapEntries(t *testing.T) {}
+func TestColor_Equal(t *testing.T) {
+	rgb888 := PixelFormat{BPP: 32, Depth: 24, TrueColor: RFBTrue,
+		RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 16, GreenShift: 8, BlueShift: 0}
+	rgb565 := PixelFormat{BPP: 16, Depth: 16, TrueColor: RFBTrue,
+		RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5, BlueShift: 0}
+	indexed := PixelFormat8bit
+	cm := ColorMap{}
+	cm.Set(1, 0xffff, 0, 0)
+	cm.Set(2, 0, 0xffff, 0)
+
+	red888 := Color{pf: &rgb888, R: 255}
+	red565 := Color{pf: &rgb565, R: 31}
+	redIndexed := Color{pf: &indexed, cm: &cm, cmIndex: 1}
+	green565 := Color{pf: &rgb565, G: 63}
+	greenIndexed := Color{pf: &indexed, cm: &cm, cmIndex: 2}
+	unresolved := Color{pf: &indexed, cmIndex: 1}
+
+	for _, tt := range []struct {
+		desc string
+		a, b Color
+		want bool
+		hex  string // Hex of a.
+	}{
+		{"same format", red888, Color{pf: &rgb888, R: 255}, true, "#ff0000"},
+		{"different formats", red888, red565, true, "#ff0000"},
+		{"true-color and indexed", red565, redIndexed, true, "#ff0000"},
+		{"indexed", greenIndexed, green565, true, "#00ff00"},
+		{"different colors", red888, green565, false, "#ff0000"},
+		{"different indexes", redIndexed, greenIndexed, false, "#ff0000"},
+		{"no pixel format", Color{R: 0xffff}, red888, true, "#ff0000"},
+		{"no color map", unresolved, redIndexed, false, "#000000"},
+	} {
+		if got := tt.a.Equal(tt.b); got != tt.want {
+			t.Errorf("%s: incorrect Equal; got = %v, want = %v", tt.desc, got, tt.want)
+		}
+		if got := tt.b.Equal(tt.a); got != tt.want {
+			t.Errorf("%s: Equal is not symmetric; got = %v, want = %v", tt.desc, got, tt.want)
+		}
+		if got := tt.a.Hex(); got != tt.hex {
+			t.Errorf("%s: incorrect Hex; got = %q, want = %q", tt.desc, got, tt.hex)
+		}
+	}
+}
+
+func TestColorMap(t *testing.T) {
+	var cm ColorMap
+	cm.Set(0, 1, 2, 3)
+	cm.Set(255, 4, 5, 6)
+	cm.Set(300, 7, 8, 9)
+
+	tests := []struct {
+		index   uint16
+		ok      bool
+		r, g, b uint16
+	}{
+		{0, true, 1, 2, 3},
+		{1, true, 0, 0, 0},
+		{255, true, 4, 5, 6},
+		{256, true, 0, 0, 0},
+		{300, true, 7, 8, 9},
+		{301, false, 0, 0, 0},
+		{65535, false, 0, 0, 0},
+	}
+
+	for _, tt := range tests {
+		color, ok := cm.Get(tt.index)
+		if ok != tt.ok {
+			t.Errorf("%v: incorrect ok; got = %v, want = %v", tt.index, ok, tt.ok)
+		}
+		if color.R != tt.r || color.G != tt.g || color.B != tt.b {
+			t.Errorf("%v: incorrect color; got = %v, want = (%v, %v, %v)", tt.index, color, tt.r, tt.g, tt.b)
+		}
+	}
+
+	var nilMap *ColorMap
+	nilMap.Set(0, 1, 2, 3)
+	if _, ok := nilMap.Get(0); ok {
+		t.Error("expected no color from nil ColorMap")
+	}
+}
+
+func TestClientConn_ResolveColor(t *testing.T) {
+	// Partially populated color map; unset entries are black.
+	var cm ColorMap
+	cm.Set(1, 0xffff, 0x8000, 0x0000)
+	cm.Set(200, 0x1234, 0x5678, 0x9abc)
+
+	rgb565 := PixelFormat{BPP: 16, Depth: 16, TrueColor: RFBTrue,
+		RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5, BlueShift: 0}
+	rgb888 := PixelFormat{BPP: 32, Depth: 24, TrueColor: RFBTrue,
+		RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 16, GreenShift: 8, BlueShift: 0}
+
+	tests := []struct {
+		pf      PixelFormat
+		color   Color
+		r, g, b uint8
+	}{
+		// Color-mapped.
+		{PixelFormat8bit, Color{cmIndex: 1}, 0xff, 0x80, 0x00},
+		{PixelFormat8bit, Color{cmIndex: 200}, 0x12, 0x56, 0x9a},
+		{PixelFormat8bit, Color{cmIndex: 2}, 0, 0, 0},
+		{PixelFormat8bit, Color{cmIndex: 300}, 0, 0, 0},
+		// True-color.
+		{rgb565, Color{R: 31, G: 63, B: 31}, 255, 255, 255},
+		{rgb565, Color{R: 0, G: 21, B: 16}, 0, 85, 132},
+		{rgb888, Color{R: 1, G: 128, B: 255}, 1, 128, 255},
+		{PixelFormat{TrueColor: RFBTrue}, Color{R: 1, G: 2, B: 3}, 0, 0, 0},
+	}
+
+	conn := NewClientConn(&MockConn{}, &ClientConfig{})
+	conn.colorMap = cm
+	for i, tt := range tests {
+		conn.pixelFormat = tt.pf
+		r, g, b := conn.ResolveColor(tt.color)
+		if r != tt.r || g != tt.g || b != tt.b {
+			t.Errorf("%v: incorrect result; got = (%v, %v, %v), want = (%v, %v, %v)", i, r, g, b, tt.r, tt.g, tt.b)
+		}
+	}
+}
+
+func TestSetColorMapEntries(t *testing.T) {
+	message := func(firstColor uint16, colors ...[3]uint16) []byte {
+		b := new(bytes.Buffer)
+		b.Write([]byte{0}) // padding
+		binary.Write(b, binary.BigEndian, firstColor)
+		binary.Write(b, binary.BigEndian, uint16(len(colors)))
+		for _, c := range colors {
+			binary.Write(b, binary.BigEndian, c)
+		}
+		return b.Bytes()
+	}
+
+	// Entries written sparsely into an empty map, growing it up to the 16-bit
+	// index maximum, and past it.
+	var data []byte
+	data = append(data, message(200, [3]uint16{1, 2, 3}, [3]uint16{4, 5, 6})...)
+	data = append(data, message(254, [3]uint16{7, 8, 9}, [3]uint16{10, 11, 12}, [3]uint16{13, 14, 15})...)
+	data = append(data, message(math.MaxUint16, [3]uint16{16, 17, 18}, [3]uint16{19, 20, 21})...)
+	mockConn := &MockConn{}
+	mockConn.Write(data)
+	conn := NewClientConn(mockConn, &ClientConfig{})
+
+	for i, want := range [][]Color{
+		{{R: 1, G: 2, B: 3}, {R: 4, G: 5, B: 6}},
+		{{R: 7, G: 8, B: 9}, {R: 10, G: 11, B: 12}, {R: 13, G: 14, B: 15}},
+		{{R: 16, G: 17, B: 18}, {R: 19, G: 20, B: 21}},
+	} {
+		msg, err := (&SetColorMapEntries{}).Read(conn)
+		if err != nil {
+			t.Fatalf("message %d: unexpected error: %s", i, err)
+		}
+		if got := msg.(*SetColorMapEntries).Colors; !reflect.DeepEqual(got, want) {
+			t.Errorf("message %d: incorrect colors; got = %v, want = %v", i, got, want)
+		}
+	}
+
+	for _, tt := range []struct {
+		index uint16
+		color Color
+		ok    bool
+	}{
+		{0, Color{}, true},   // Gap.
+		{199, Color{}, true}, // Gap.
+		{200, Color{R: 1, G: 2, B: 3}, true},
+		{201, Color{R: 4, G: 5, B: 6}, true},
+		{255, Color{R: 10, G: 11, B: 12}, true},
+		{256, Color{R: 13, G: 14, B: 15}, true},
+		{257, Color{}, true},                // Gap.
+		{math.MaxUint16 - 1, Color{}, true}, // Gap.
+		{math.MaxUint16, Color{R: 16, G: 17, B: 18}, true},
+	} {
+		got, ok := conn.colorMap.Get(tt.index)
+		if got != tt.color || ok != tt.ok {
+			t.Errorf("index %d: incorrect entry; got = %v, %v, want = %v, %v", tt.index, got, ok, tt.color, tt.ok)
+		}
+	}
+}
 
 func TestBell(t *testing.T) {}
 
-func TestServerCutText(t *testing.T) {}
+func TestServerCutText(t *testing.T) {
+	for _, tt := range []struct {
+		desc   string
+		max    uint32
+		length uint32
+		text   string
+		ok     bool
+	}{
+		{"text", 0, 5, "hello", true},
+		{"empty", 0, 0, "", true},
+		{"at limit", 5, 5, "hello", true},
+		{"over limit", 4, 5, "hello", false},
+		{"clipboard bomb", 0, 0xffffffff, "hello", false},
+		{"truncated", 0, 6, "hello", false},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{MaxClipboardBytes: tt.max})
+		conn.send([3]byte{}) // padding
+		conn.send(tt.length)
+		conn.send([]byte(tt.text))
+
+		msg, err := (&ServerCutText{}).Read(conn)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.desc, err)
+			continue
+		}
+		if got, want := msg.(*ServerCutText).Text, tt.text; got != want {
+			t.Errorf("%s: incorrect text; got = %q, want = %q", tt.desc, got, want)
+		}
+	}
+}
+
+func TestClientConn_ServerSupports(t *testing.T) {
+	update := func(enc encodings.EncodingType, payload ...byte) []byte {
+		var buf bytes.Buffer
+		buf.Write([]byte{0, 0, 1}) // padding, number-of-rectangles
+		binary.Write(&buf, binary.BigEndian, rectangleMessage{0, 0, 1, 1, enc})
+		buf.Write(payload)
+		return buf.Bytes()
+	}
+	fence := func(flags FenceFlags, payload ...byte) []byte {
+		var buf bytes.Buffer
+		buf.Write([]byte{0, 0, 0}) // padding
+		binary.Write(&buf, binary.BigEndian, flags)
+		buf.WriteByte(uint8(len(payload)))
+		buf.Write(payload)
+		return buf.Bytes()
+	}
+	extendedCutText := []byte{0, 0, 0, 0xff, 0xff, 0xff, 0xfc, 0, 0, 0, 1} // length -4, flags
+
+	for _, tt := range []struct {
+		desc string
+		msg  ServerMessage
+		data []byte
+		enc  encodings.EncodingType
+	}{
+		{"DesktopSize", &FramebufferUpdate{}, update(encodings.EncDesktopSizePseudo), encodings.EncDesktopSizePseudo},
+		{"Cursor", &FramebufferUpdate{}, update(encodings.EncCursorPseudo, 1, 2, 3, 4, 0x80), encodings.EncCursorPseudo},
+		{"LastRect", &FramebufferUpdate{}, update(encodings.EncLastRectPseudo), encodings.EncLastRectPseudo},
+		{"Fence", &ServerFence{}, fence(FenceBlockBefore, 1, 2), encodings.EncFencePseudo},
+		{"ExtendedClipboard", &ServerCutText{}, extendedCutText, encodings.EncExtendedClipboardPseudo},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{})
+		conn.pixelFormat = roundTripFormat
+		conn.fbWidth, conn.fbHeight = 640, 480
+		conn.encodings = Encodings{&RawEncoding{}, &DesktopSizePseudoEncoding{}, &CursorPseudoEncoding{},
+			&FencePseudoEncoding{}, &ExtendedClipboardPseudoEncoding{}}
+		if conn.ServerSupports(tt.enc) {
+			t.Errorf("%s: expected no support before the message", tt.desc)
+		}
+		mockConn.Write(tt.data)
+		if _, err := tt.msg.Read(conn); err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.desc, err)
+			continue
+		}
+		if !conn.ServerSupports(tt.enc) {
+			t.Errorf("%s: expected support after the message", tt.desc)
+		}
+		if mockConn.b.Len() != 0 || conn.bufr.Buffered() != 0 {
+			t.Errorf("%s: expected the message to be read in full", tt.desc)
+		}
+	}
+}
+
+func TestServerFence_Request(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	mockConn.Write([]byte{0, 0, 0})
+	binary.Write(mockConn, binary.BigEndian, FenceRequest|FenceBlockBefore|FenceSyncNext|1<<8)
+	mockConn.Write([]byte{2, 7, 8}) // length, payload
+
+	msg, err := (&ServerFence{}).Read(conn)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	fence := msg.(*ServerFence)
+	if got, want := fence.Flags, FenceRequest|FenceBlockBefore|FenceSyncNext|1<<8; got != want {
+		t.Errorf("incorrect flags; got = %#x, want = %#x", got, want)
+	}
+	if got, want := fence.Payload, []byte{7, 8}; !bytes.Equal(got, want) {
+		t.Errorf("incorrect payload; got = %v, want = %v", got, want)
+	}
+
+	// Answering the request is left to the caller.
+	if got := mockConn.b.Len(); got != 0 {
+		t.Errorf("unexpected %d bytes sent", got)
+	}
+}
+
+func TestEndOfContinuousUpdates(t *testing.T) {
+	endOfContinuousUpdates := []byte{byte(messages.EndOfContinuousUpdates)}
+	emptyUpdate := []byte{0, 0, 0, 0} // message-type, padding, number-of-rectangles
+
+	nc := &chunkConn{chunks: [][]byte{endOfContinuousUpdates}}
+	conn := NewClientConn(nc, NewClientConfig(""))
+	conn.fbWidth, conn.fbHeight = 8, 6
+	conn.encodings = Encodings{&RawEncoding{}, &ContinuousUpdatesPseudoEncoding{}}
+	listen := func() []Event {
+		events := conn.Events()
+		if err := conn.ListenAndHandle(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var got []Event
+		for ev := range events {
+			got = append(got, ev)
+		}
+		return got
+	}
+
+	// The server tells the client that it supports continuous updates.
+	if got, want := listen(), []Event{EndOfContinuousUpdatesEvent{}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect events; got = %v, want = %v", got, want)
+	}
+	if !conn.ServerSupports(encodings.EncContinuousUpdatesPseudo) {
+		t.Error("expected support for continuous updates")
+	}
+	if conn.ContinuousUpdates() {
+		t.Error("expected continuous updates to be disabled")
+	}
+	if got := nc.MockConn.b.Len(); got != 0 {
+		t.Errorf("expected nothing sent; got %d bytes", got)
+	}
+
+	// Enabling continuous updates stops update requests.
+	if err := conn.EnableContinuousUpdates(true, 0, 0, 8, 6); err != nil {
+		t.Fatal(err)
+	}
+	var req EnableContinuousUpdatesMessage
+	if err := binary.Read(&nc.MockConn.b, binary.BigEndian, &req); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := req, (EnableContinuousUpdatesMessage{messages.EnableContinuousUpdates, rfbflags.RFBTrue, 0, 0, 8, 6}); got != want {
+		t.Errorf("incorrect message; got = %v, want = %v", got, want)
+	}
+	if !conn.ContinuousUpdatesActive() {
+		t.Error("expected continuous updates to be active")
+	}
+
+	// An update pushed by the server is not followed by a request, until the
+	// server ends continuous updates.
+	nc.chunks = [][]byte{emptyUpdate, endOfContinuousUpdates}
+	if got, want := listen(), []Event{EndOfContinuousUpdatesEvent{}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect events; got = %v, want = %v", got, want)
+	}
+	if conn.ContinuousUpdates() {
+		t.Error("expected continuous updates to be disabled by the server")
+	}
+	var fur FramebufferUpdateRequestMessage
+	if err := binary.Read(&nc.MockConn.b, binary.BigEndian, &fur); err != nil {
+		t.Fatalf("expected an update request: %s", err)
+	}
+	if got, want := fur, (FramebufferUpdateRequestMessage{messages.FramebufferUpdateRequest, rfbflags.RFBTrue, 0, 0, 8, 6}); got != want {
+		t.Errorf("incorrect request; got = %v, want = %v", got, want)
+	}
+	if got := nc.MockConn.b.Len(); got != 0 {
+		t.Errorf("expected a single request; got %d more bytes", got)
+	}
+}
+
+func TestEnableContinuousUpdates_Fallback(t *testing.T) {
+	const timeout = time.Second
+	newConn := func() (*ClientConn, net.Conn, *fakeClock) {
+		client, server := net.Pipe()
+		t.Cleanup(func() { client.Close(); server.Close() })
+		cfg := NewClientConfig("")
+		cfg.AutoRequestUpdates = true
+		cfg.ContinuousUpdatesTimeout = timeout
+		cfg.ServerMessageCh = make(chan ServerMessage, 1)
+		conn := NewClientConn(client, cfg)
+		conn.fbWidth, conn.fbHeight = 8, 6
+		clk := newFakeClock()
+		conn.setClock(clk)
+		return conn, server, clk
+	}
+	// call calls fn, which sends a message of n bytes, while the server
+	// reads it.
+	call := func(server net.Conn, n int, fn func() error) {
+		t.Helper()
+		done := make(chan error, 1)
+		go func() { done <- fn() }()
+		if _, err := io.ReadFull(server, make([]byte, n)); err != nil {
+			t.Fatalf("expected a message: %s", err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	enable := func(conn *ClientConn) func() error {
+		return func() error { return conn.EnableContinuousUpdates(true, 0, 0, 8, 6) }
+	}
+	enableSize := binary.Size(EnableContinuousUpdatesMessage{})
+	expectFallback := func(desc string, conn *ClientConn, server net.Conn, clk *fakeClock) {
+		t.Helper()
+		clk.BlockUntil(t, 1)
+		clk.Advance(timeout)
+		var req FramebufferUpdateRequestMessage
+		if err := binary.Read(server, binary.BigEndian, &req); err != nil {
+			t.Fatalf("%s: expected an update request: %s", desc, err)
+		}
+		if want := (FramebufferUpdateRequestMessage{messages.FramebufferUpdateRequest, rfbflags.RFBTrue, 0, 0, 8, 6}); req != want {
+			t.Errorf("%s: incorrect request; got = %v, want = %v", desc, req, want)
+		}
+		if conn.ContinuousUpdates() {
+			t.Errorf("%s: expected continuous updates to be disabled", desc)
+		}
+	}
+
+	// The server ignores the enabling, so the client falls back to
+	// requesting updates after the timeout.
+	conn, server, clk := newConn()
+	call(server, enableSize, enable(conn))
+	if !conn.ContinuousUpdates() || conn.ContinuousUpdatesActive() {
+		t.Fatal("expected continuous updates to be enabled, but not active")
+	}
+	expectFallback("ignored", conn, server, clk)
+
+	// An update answering a request outstanding when continuous updates were
+	// enabled doesn't show that the server honors them.
+	conn, server, clk = newConn()
+	call(server, binary.Size(FramebufferUpdateRequestMessage{}), func() error {
+		return conn.FramebufferUpdateRequest(rfbflags.RFBTrue, 0, 0, 8, 6)
+	})
+	call(server, enableSize, enable(conn))
+	go conn.ListenAndHandle()
+	if _, err := server.Write([]byte{byte(messages.FramebufferUpdate), 0, 0, 0}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	<-conn.config.ServerMessageCh
+	if conn.ContinuousUpdatesActive() {
+		t.Error("answered request: expected continuous updates not to be active")
+	}
+	expectFallback("answered request", conn, server, clk)
+
+	// Continuous updates are active at once if the server advertised support.
+	conn, server, _ = newConn()
+	conn.confirmEncoding(encodings.EncContinuousUpdatesPseudo)
+	call(server, enableSize, enable(conn))
+	if !conn.ContinuousUpdatesActive() {
+		t.Error("advertised: expected continuous updates to be active")
+	}
+}
@@ -0,0 +1,125 @@
+// Bandwidth throttling of connections.
+
+package vnc
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bigangryrobot/go-vnc/go/metrics"
+)
+
+// tokenBucket limits a byte stream to a rate. Tokens accumulate at rate per
+// second, up to burst; the bucket starts empty.
+type tokenBucket struct {
+	mu     sync.Mutex
+	clock  clock
+	rate   float64 // tokens per second
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int, clk clock) *tokenBucket {
+	burst := rate / 10 // At most 100ms of traffic at once.
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{clock: clk, rate: float64(rate), burst: burst, last: clk.Now()}
+}
+
+// setClock makes the bucket use clk, restarting it empty.
+func (b *tokenBucket) setClock(clk clock) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clock, b.tokens, b.last = clk, 0, clk.Now()
+}
+
+// take blocks until n tokens, which must not exceed the burst, are available
+// and removes them. It returns whether it had to wait.
+func (b *tokenBucket) take(n int) bool {
+	b.mu.Lock()
+	now := b.clock.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		b.mu.Unlock()
+		return false
+	}
+	// Wait for the deficit to refill. The tokens are taken already, so that
+	// later callers wait out this deficit too, without holding the lock.
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	clk := b.clock
+	b.mu.Unlock()
+	<-clk.After(wait)
+	return true
+}
+
+// throttledConn is a net.Conn whose reads and writes are each limited to a
+// rate in bytes per second.
+type throttledConn struct {
+	net.Conn
+	r, w      *tokenBucket
+	throttled metrics.Metric // Bytes whose transfer was delayed.
+}
+
+// throttle returns nc limited to bytesPerSecond in each direction, as timed
+// by clk, counting delayed bytes in throttled, if not nil. If bytesPerSecond
+// is zero, nc is returned as-is.
+func throttle(nc net.Conn, bytesPerSecond int, throttled metrics.Metric, clk clock) net.Conn {
+	if bytesPerSecond <= 0 {
+		return nc
+	}
+	return &throttledConn{
+		Conn:      nc,
+		r:         newTokenBucket(bytesPerSecond, clk),
+		w:         newTokenBucket(bytesPerSecond, clk),
+		throttled: throttled,
+	}
+}
+
+// Read implements the net.Conn interface.
+func (c *throttledConn) Read(b []byte) (int, error) {
+	if len(b) > c.r.burst {
+		b = b[:c.r.burst]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.r.take(n) {
+		c.countThrottled(n)
+	}
+	return n, err
+}
+
+// Write implements the net.Conn interface.
+func (c *throttledConn) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > c.w.burst {
+			chunk = chunk[:c.w.burst]
+		}
+		if c.w.take(len(chunk)) {
+			c.countThrottled(len(chunk))
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// countThrottled counts n bytes whose transfer was delayed.
+func (c *throttledConn) countThrottled(n int) {
+	if c.throttled != nil {
+		c.throttled.Adjust(int64(n))
+	}
+}
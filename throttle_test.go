@@ -0,0 +1,100 @@
+package vnc
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	const (
+		rate = 20000 // bytes per second
+		size = 6000
+	)
+	data := bytes.Repeat([]byte{0xaa}, size)
+
+	for _, dir := range []string{"write", "read"} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{MaxBytesPerSecond: rate})
+		clk := newFakeClock()
+		conn.setClock(clk)
+		if dir == "read" {
+			mockConn.Write(data)
+		}
+
+		start := clk.Now()
+		done := make(chan error, 1)
+		go func() {
+			switch dir {
+			case "write":
+				done <- conn.send(data)
+			case "read":
+				_, err := io.ReadFull(conn.bufr, make([]byte, size))
+				done <- err
+			}
+		}()
+		// Time only passes while the transfer waits for tokens.
+		var err error
+	transfer:
+		for {
+			select {
+			case err = <-done:
+				break transfer
+			default:
+			}
+			if clk.Pending() > 0 {
+				clk.Advance(time.Millisecond)
+			} else {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", dir, err)
+		}
+		elapsed := clk.Now().Sub(start)
+
+		// The bucket starts empty, so transferring size bytes takes at least
+		// size/rate seconds.
+		if min := time.Duration(size) * time.Second / rate; elapsed < min {
+			t.Errorf("%s: throughput exceeds cap; %d bytes took %v, want >= %v", dir, size, elapsed, min)
+		}
+		if got := conn.metrics["throttled-bytes"].Value(); got == 0 || got > size {
+			t.Errorf("%s: incorrect throttled-bytes; got = %v, want in (0, %d]", dir, got, size)
+		}
+	}
+}
+
+func TestTokenBucket_ConcurrentTake(t *testing.T) {
+	clk := newFakeClock()
+	b := newTokenBucket(1000, clk) // Bursts of 100 tokens.
+
+	// Both callers wait at once, the second also for the deficit of the
+	// first.
+	done := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			b.take(100)
+			done <- struct{}{}
+		}()
+	}
+	clk.BlockUntil(t, 2)
+
+	clk.Advance(100 * time.Millisecond)
+	<-done
+	select {
+	case <-done:
+		t.Fatal("expected the second caller to wait out both deficits")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clk.Advance(100 * time.Millisecond)
+	<-done
+}
+
+func TestThrottle_Disabled(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	if conn.Conn != mockConn {
+		t.Errorf("expected unthrottled connection; got %T", conn.Conn)
+	}
+}
@@ -3,6 +3,8 @@ package vnc
 import (
 	"crypto/tls"
 	"fmt"
+	"io"
+	"net"
 )
 
 type ClientAuthVeNCryptAuth struct{}
@@ -68,14 +70,22 @@ func (auth *ClientAuthVeNCryptAuth) Handshake(c *ClientConn) error {
 		return fmt.Errorf("Server does not accept")
 	}
 
-	// Making TLS Connection and switching original raw tcp to TLS covered
-	tconn := tls.Client(c.Conn, &tls.Config{
+	// The TLS client writes to the Conn directly, after any held back data.
+	if err := c.flush(); err != nil {
+		return err
+	}
+
+	// Making TLS Connection and switching original raw tcp to TLS covered.
+	// The TLS client reads through bufr, which may already hold the start
+	// of the server's handshake, and bufr then reads the decrypted stream.
+	tconn := tls.Client(&bufferedConn{c.Conn, c.bufr}, &tls.Config{
 		InsecureSkipVerify: true,
 	})
 	if err := tconn.Handshake(); err != nil {
 		panic(err)
 	}
 	c.Conn = tconn
+	c.bufr = c.newReader(tconn)
 
 	var cauth ClientAuth
 	for _, a := range c.config.Auth {
@@ -91,3 +101,12 @@ func (auth *ClientAuthVeNCryptAuth) Handshake(c *ClientConn) error {
 
 	return nil
 }
+
+// bufferedConn is a net.Conn reading through r, a buffered reader of the
+// connection.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
@@ -7,14 +7,26 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"image"
+	"image/draw"
 	"io"
 	"log"
 	"net"
 	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/bigangryrobot/go-vnc/buttons"
+	"github.com/bigangryrobot/go-vnc/encodings"
 	"github.com/bigangryrobot/go-vnc/go/metrics"
 	"github.com/bigangryrobot/go-vnc/messages"
+	"github.com/bigangryrobot/go-vnc/rfbflags"
 )
 
 type ReadProxy struct {
@@ -35,41 +47,230 @@ func Connect(ctx context.Context, c net.Conn, cfg *ClientConfig) (*ClientConn, e
 		log.Fatalf("invalid context; %s", err)
 	}
 
-	if err := conn.protocolVersionHandshake(ctx); err != nil {
+	if err := conn.negotiate(ctx); err != nil {
 		conn.Close()
 		return nil, err
 	}
-	if err := conn.securityHandshake(); err != nil {
-		conn.Close()
+
+	return conn, nil
+}
+
+// DefaultPort is the TCP port of display :0 of a VNC server.
+const DefaultPort = "5900"
+
+// Dial connects to the VNC server at address and negotiates a connection
+// using cfg. The address is either "unix:///path/to/socket" for a Unix domain
+// socket, or "host:port" for TCP, optionally prefixed by "tcp://". If the port
+// is omitted, DefaultPort is used.
+func Dial(ctx context.Context, address string, cfg *ClientConfig) (*ClientConn, error) {
+	network, addr, err := parseAddress(address)
+	if err != nil {
 		return nil, err
 	}
-	if err := conn.securityResultHandshake(); err != nil {
-		conn.Close()
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, network, addr)
+	if err != nil {
 		return nil, err
 	}
-	if err := conn.clientInit(); err != nil {
-		conn.Close()
-		return nil, err
+	return Connect(ctx, nc, cfg)
+}
+
+// parseAddress returns the network and address to dial for a Dial address.
+func parseAddress(address string) (network, addr string, err error) {
+	if path, ok := strings.CutPrefix(address, "unix://"); ok {
+		if path == "" {
+			return "", "", Errorf("invalid address %q; missing socket path", address)
+		}
+		return "unix", path, nil
 	}
-	if err := conn.serverInit(); err != nil {
-		conn.Close()
-		return nil, err
+	addr = strings.TrimPrefix(address, "tcp://")
+	if addr == "" {
+		return "", "", Errorf("invalid address %q; missing host", address)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), DefaultPort)
 	}
+	return "tcp", addr, nil
+}
 
-	// Send client-to-server messages.
-	encs := conn.encodings
-	if err := conn.SetEncodings(encs); err != nil {
-		conn.Close()
-		return nil, Errorf("failure calling SetEncodings; %s", err)
+// Reconnect negotiates a new session with a VNC server over nc, reusing the
+// ClientConn and its configuration. The previous connection is closed, and
+// any state left over from its session is discarded.
+func (c *ClientConn) Reconnect(ctx context.Context, nc net.Conn) error {
+	if err := c.processContext(ctx); err != nil {
+		return err
 	}
 
-	pf := conn.pixelFormat
-	if err := conn.SetPixelFormat(pf); err != nil {
-		conn.Close()
-		return nil, Errorf("failure calling SetPixelFormat; %s", err)
+	c.Close()
+	c.reset()
+	c.Conn = throttle(nc, c.config.MaxBytesPerSecond, c.metrics["throttled-bytes"], c.clock)
+	c.bufr = c.newReader(c.Conn)
+	c.connTerminated.Store(false)
+
+	if err := c.negotiate(ctx); err != nil {
+		c.Close()
+		return err
 	}
+	return nil
+}
 
-	return conn, nil
+// reset discards the session state of the connection, so that it can be
+// reused for a new session.
+func (c *ClientConn) reset() {
+	c.colorMap = nil
+	c.closeZlibs()
+	c.zlibsStale.Store(false)
+	c.idleTimedOut.Store(false)
+	c.continuousUpdates.Store(false)
+	c.continuousGen.Add(1)
+	c.continuousEnabled.Store(false)
+	c.continuousDisables.Store(0)
+	c.ledState.Store(0)
+	c.handshakeTrace = HandshakeTrace{}
+	c.rtt = 0
+	c.encodingsMu.Lock()
+	c.retiredEncodings = nil
+	c.updatesRead, c.retiredPending = 0, 0
+	c.encodingsMu.Unlock()
+	c.updateRequests.Store(0)
+	c.setFramebufferSize(0, 0)
+	c.fbMu.Lock()
+	c.fb, c.fbSumValid = nil, false
+	c.fbMu.Unlock()
+	c.firstFrame, c.firstFrameOnce = make(chan struct{}), sync.Once{}
+	c.serverPixelFormat, c.requestedPixelFormat = PixelFormat{}, nil
+	c.pointerMode.Store(int32(PointerAbsolute))
+	c.pointerX, c.pointerY = 0, 0
+	c.pointerButtons = buttons.None
+	c.observedMu.Lock()
+	c.observedEncodings = nil
+	c.confirmedEncodings = nil
+	c.observedMu.Unlock()
+	c.adaptive = adaptiveQuality{}
+	c.lastAutoRequest = time.Time{}
+	c.continuousRegion = image.Rectangle{}
+	c.pauseMu.Lock()
+	c.wakeParkedReads()
+	c.pause = pauseState{}
+	c.pauseMu.Unlock()
+}
+
+// resetStaleZlibs closes the Tight zlib streams if the pixel format has
+// changed since they were last used.
+func (c *ClientConn) resetStaleZlibs() {
+	if c.zlibsStale.CompareAndSwap(true, false) {
+		c.closeZlibs()
+	}
+}
+
+// closeZlibs closes and forgets the Tight zlib streams.
+func (c *ClientConn) closeZlibs() {
+	for i := range c.zlibs {
+		c.closeZlib(i)
+	}
+}
+
+// closeZlib closes and forgets Tight zlib stream i, if open.
+func (c *ClientConn) closeZlib(i int) {
+	c.zlibsMu.Lock()
+	defer c.zlibsMu.Unlock()
+	if c.zlibs[i] != nil {
+		c.zlibs[i].Close()
+		c.zlibs[i] = nil
+	}
+}
+
+// negotiate performs the handshake and initialization of a session, and
+// sends the client's encodings and pixel format.
+func (c *ClientConn) negotiate(ctx context.Context) (err error) {
+	c.coalesceWrites()
+	defer func() {
+		if ferr := c.endCoalescing(); err == nil {
+			err = ferr
+		}
+	}()
+
+	if err := c.protocolVersionHandshake(ctx); err != nil {
+		return err
+	}
+	if err := c.securityHandshake(); err != nil {
+		return err
+	}
+	if err := c.securityResultHandshake(); err != nil {
+		return err
+	}
+	if err := c.clientInit(); err != nil {
+		return err
+	}
+	if err := c.serverInit(); err != nil {
+		return err
+	}
+
+	// Send client-to-server messages, coalesced into a single write by
+	// endCoalescing, which resumes it on temporary errors from where they
+	// interrupted it.
+	if !c.config.SkipInitialSetEncodings {
+		encs := c.GetEncodings()
+		if c.config.AutoEncodingByRTT {
+			encs = c.orderEncodingsByRTT(encs)
+		}
+		if level := c.config.CompressionLevel; level != nil {
+			if *level < MinLevel || *level > MaxLevel {
+				return Errorf("invalid compression level %d", *level)
+			}
+			encs = withLevelFirst(encs, &CompressionLevelPseudoEncoding{*level}, isCompressionLevel)
+		}
+		if err := c.SetEncodings(encs); err != nil {
+			return Errorf("failure calling SetEncodings; %s", err)
+		}
+	}
+
+	// The pixel format from ServerInit is already in use; only tell the
+	// server about it when asked not to rely on the server's own format.
+	if !c.config.UseServerPixelFormat {
+		pf := c.pixelFormat
+		if c.config.AppleCompat {
+			pf = ApplePixelFormat
+		}
+		if err := c.SetPixelFormat(pf); err != nil {
+			return Errorf("failure calling SetPixelFormat; %s", err)
+		}
+	}
+
+	if c.config.RequestInitialUpdate {
+		w, h := c.framebufferSize()
+		if err := c.FramebufferUpdateRequest(rfbflags.RFBFalse, 0, 0, w, h); err != nil {
+			return Errorf("failure calling FramebufferUpdateRequest; %s", err)
+		}
+	}
+
+	if c.config.OnHandshake != nil {
+		c.config.OnHandshake(c.handshakeTrace)
+	}
+	return nil
+}
+
+// Bounds on the retries performed by retryTemporary.
+const (
+	maxTemporaryRetries = 3
+	temporaryRetryDelay = 10 * time.Millisecond
+)
+
+// retryTemporary calls fn, retrying with exponential backoff for as long as
+// it fails with a temporary net.Error, up to maxTemporaryRetries times. Any
+// other error is returned immediately. As fn is called again from the start,
+// it must resume what it wrote before failing, as connWriter does.
+func (c *ClientConn) retryTemporary(fn func() error) error {
+	delay := temporaryRetryDelay
+	for i := 0; ; i++ {
+		err := fn()
+		var nerr net.Error
+		if err == nil || i == maxTemporaryRetries || !errors.As(err, &nerr) || !nerr.Temporary() {
+			return err
+		}
+		<-c.clock.After(delay)
+		delay *= 2
+	}
 }
 
 // A ClientConfig structure is used to configure a ClientConn. After
@@ -84,6 +285,22 @@ type ClientConfig struct {
 	// Password for servers that require authentication.
 	Password string
 
+	// Username for servers whose authentication takes one, such as Apple
+	// Remote Desktop.
+	Username string
+
+	// AppleCompat adjusts the defaults of the connection for macOS Screen
+	// Sharing:
+	//   - ClientAuthARD, with Username and Password, is offered after the
+	//     methods of Auth, unless among them.
+	//   - The encodings first advertised are ZRLE, Hextile, CopyRect and Raw,
+	//     in that order, with the Cursor and DesktopSize pseudo-encodings.
+	//     Tight is left out, as its interoperability with macOS hasn't been
+	//     verified. SetEncodings replaces them as usual.
+	//   - ApplePixelFormat is requested in place of the server's format from
+	//     ServerInit, unless UseServerPixelFormat is set.
+	AppleCompat bool
+
 	// Logger
 	Logger *log.Logger
 
@@ -103,6 +320,309 @@ type ClientConfig struct {
 	// This only needs to contain NEW server messages, and doesn't
 	// need to explicitly contain the RFC-required messages.
 	ServerMessages []ServerMessage
+
+	// MaxDecodeMemory is a soft limit, in bytes, on the decoded pixel data
+	// held for a FramebufferUpdate, as reported by the "framebuffer-bytes"
+	// metric, plus, with DecodeConcurrency, the most encoded pixel data
+	// buffered at once for decoding. When an update exceeds it, the client
+	// requests a pixel format with half the bits per pixel (32 to 16, 16 to
+	// 8) for subsequent updates. The update that exceeded the limit is still
+	// delivered, as are any the server sent before processing the new
+	// format. Zero disables the limit.
+	MaxDecodeMemory uint64
+
+	// DecodeConcurrency is the maximum number of rectangles of a
+	// FramebufferUpdate decoded concurrently. Rectangle payloads are always
+	// read from the connection in order, but Raw, RRE and Hextile payloads
+	// are then decoded on up to this many goroutines. Encodings sharing
+	// connection state, such as Tight and ZRLE, are always decoded in order
+	// on the reading goroutine. Values below 2 disable concurrent decoding.
+	DecodeConcurrency int
+
+	// UseServerPixelFormat skips sending SetPixelFormat during negotiation,
+	// so that the server sends pixel data in its native format, as announced
+	// in ServerInit, without converting it. The client decodes pixel data
+	// using that format.
+	UseServerPixelFormat bool
+
+	// SkipInitialSetEncodings skips sending SetEncodings during negotiation,
+	// e.g. for probes or minimal servers, so that the server assumes Raw
+	// alone until SetEncodings is called. Together with UseServerPixelFormat,
+	// no client-to-server message is sent after ClientInit, other than the
+	// FramebufferUpdateRequest of RequestInitialUpdate.
+	SkipInitialSetEncodings bool
+
+	// StrictEncodings makes SetEncodings fail when a pseudo-encoding would
+	// be ineffective as its prerequisites aren't met, rather than logging a
+	// warning; see SetEncodings.
+	StrictEncodings bool
+
+	// MaxClipboardBytes is the largest ServerCutText text accepted from the
+	// server. Longer text is treated as a protocol error. Zero means
+	// DefaultMaxClipboardBytes.
+	MaxClipboardBytes uint32
+
+	// MaxDesktopNameBytes is the longest desktop name accepted from the
+	// server, in ServerInit or by the DesktopName pseudo-encoding. Longer
+	// names are treated as an error. Zero means DefaultMaxDesktopNameBytes.
+	MaxDesktopNameBytes uint32
+
+	// MaxRectanglesPerUpdate is the largest number of rectangles accepted in
+	// a FramebufferUpdate. Updates announcing more are rejected with a
+	// ProtocolError before any rectangle is read, except for the count of
+	// 65535 used with LastRect, where the update is rejected once it exceeds
+	// the limit without a LastRect. Zero means DefaultMaxRectanglesPerUpdate.
+	MaxRectanglesPerUpdate uint16
+
+	// RequestInitialUpdate sends a non-incremental FramebufferUpdateRequest
+	// for the whole framebuffer once the connection is negotiated, so that
+	// the server sends the first frame without further requests. It is set
+	// by NewClientConfig. Clients using continuous updates, which request
+	// updates themselves, should disable it.
+	RequestInitialUpdate bool
+
+	// AutoRequestUpdates sends an incremental FramebufferUpdateRequest for
+	// the whole framebuffer once each FramebufferUpdate read by
+	// ListenAndHandle has been applied, so that a request is always
+	// outstanding: some servers send nothing, or only LastRect-terminated
+	// updates, without one, and the client appears hung. It is set by
+	// NewClientConfig. Clients using continuous updates, or requesting updates
+	// themselves, should disable it.
+	AutoRequestUpdates bool
+
+	// MinUpdateInterval limits the rate of the requests sent by
+	// AutoRequestUpdates, and so the frame rate, by delaying each request
+	// until at least this long after the previous one. The delay is taken on
+	// the reading goroutine. Zero means no limit.
+	MinUpdateInterval time.Duration
+
+	// ParkReadsWhilePaused makes ListenAndHandle stop reading from the
+	// server while the connection is paused, so that no further data is
+	// decoded; see Pause.
+	ParkReadsWhilePaused bool
+
+	// MaxBytesPerSecond limits the rate at which data is read from and
+	// written to the server, each, to simulate constrained networks or to
+	// avoid saturating links. Bytes delayed by the limit are counted by the
+	// "throttled-bytes" metric. Zero disables the limit.
+	MaxBytesPerSecond int
+
+	// OnFrameComplete, if set, is called on the reading goroutine once each
+	// FramebufferUpdate has been read and all its rectangles decoded,
+	// including updates ended by a LastRect pseudo-rectangle. It is the
+	// point at which a viewer should present the frame. updatedRegions holds
+	// the rectangles of pixel data in the update, excluding those of
+	// pseudo-encodings, and is empty, but not nil, for updates without any.
+	OnFrameComplete func(updatedRegions []Rectangle)
+
+	// OnCursorChange, if set, is called on the reading goroutine for each
+	// Cursor or XCursor pseudo-rectangle of a FramebufferUpdate, once the
+	// update has been read, with the new cursor shape and its hotspot.
+	// Pixels outside the cursor's bitmask are transparent; see CursorImage.
+	// A nil cursor means the server hid the cursor.
+	OnCursorChange func(cursor *image.RGBA, hotspot image.Point)
+
+	// OnLEDStateChange, if set, is called on the reading goroutine for each
+	// QEMU LED State pseudo-rectangle of a FramebufferUpdate, once the update
+	// has been read, with the new state of the keyboard LEDs; see LEDState.
+	OnLEDStateChange func(state LEDFlags)
+
+	// OnDecodedRectangle, if set, is called on the reading goroutine for
+	// each rectangle of pixel data of a FramebufferUpdate, once the update
+	// has been read, with its geometry, encoding and a sampled pixel. It is
+	// a debugging aid for color problems, and doesn't retain the pixels of
+	// the rectangle. See CaptureRawRectangles for the bytes as sent.
+	OnDecodedRectangle func(info RectInfo)
+
+	// OnHandshake, if set, is called once a connection has been negotiated,
+	// with the messages sent by the server during the handshake and
+	// initialization, exactly as received. It doesn't affect negotiation.
+	OnHandshake func(trace HandshakeTrace)
+
+	// DisableMetrics skips creating and updating the connection's metrics,
+	// avoiding their overhead. DebugMetrics then reports them as disabled,
+	// and MaxDecodeMemory, which relies on the "framebuffer-bytes" metric,
+	// has no effect.
+	DisableMetrics bool
+
+	// AdaptiveQuality sheds decoding load when FramebufferUpdates take
+	// longer than AdaptiveQualityThreshold to read and decode, by
+	// renegotiating cheaper encodings: a lower compression level, then no
+	// zlib-based encodings. Once updates are consistently fast again, the
+	// encodings are restored step by step; see adaptive.go for the
+	// heuristics. Encodings set while the client has stepped down become
+	// those as configured, from level 0.
+	AdaptiveQuality bool
+
+	// AdaptiveQualityThreshold is the time to read and decode an update
+	// above which AdaptiveQuality sheds load. Zero means
+	// DefaultAdaptiveQualityThreshold.
+	AdaptiveQualityThreshold time.Duration
+
+	// AutoEncodingByRTT advertises CopyRect, Raw, Hextile, ZRLE and Tight
+	// during negotiation, besides any encodings already set, ordered by the
+	// round-trip time measured during the handshake: compressed encodings,
+	// such as Tight and ZRLE, first on links slower than
+	// AutoEncodingRTTThreshold, and light encodings, such as Raw and
+	// Hextile, first otherwise; see rtt.go. RTT returns the measured time.
+	AutoEncodingByRTT bool
+
+	// AutoEncodingRTTThreshold is the round-trip time from which
+	// AutoEncodingByRTT prefers compressed encodings. Zero means
+	// DefaultAutoEncodingRTTThreshold.
+	AutoEncodingRTTThreshold time.Duration
+
+	// CompressionLevel, if set, is the compression level, from MinLevel to
+	// MaxLevel, advertised with the initial SetEncodings, ahead of the
+	// encodings themselves. It applies to the zlib streams of Zlib, Tight and
+	// ZRLE, which the server sets up for the first update compressed, so a
+	// level set only later by SetCompressionLevel may not take effect on
+	// streams already started. Nil leaves the level to the server.
+	CompressionLevel *int
+
+	// ReadTimeout bounds the time waited for data read in bulk, such as the
+	// pixel data of a Raw rectangle, so that a server sending less data than
+	// it promised causes a timeout rather than a hang. It sets the read
+	// deadline of the connection while the data is read, unless that set
+	// with ClientConn.SetReadDeadline is earlier, and restores the latter
+	// afterwards. Zero means no timeout.
+	ReadTimeout time.Duration
+
+	// IdleTimeout closes the connection once no server message has been
+	// received for this long, making ListenAndHandle return ErrIdleTimeout,
+	// so that sessions gone quiet can be reclaimed. Unlike ReadTimeout, it
+	// bounds the time between messages rather than that of a single read;
+	// servers only send messages when asked, or when something changes, so
+	// it should exceed the interval at which updates are requested. Zero
+	// means no timeout.
+	IdleTimeout time.Duration
+
+	// ContinuousUpdatesTimeout is how long after EnableContinuousUpdates the
+	// client waits for the server to show that it honors it, before falling
+	// back to requesting updates; see EnableContinuousUpdates. Zero means
+	// DefaultContinuousUpdatesTimeout, and a negative value never falls back.
+	ContinuousUpdatesTimeout time.Duration
+
+	// ClampPointer determines how PointerEvent treats positions outside the
+	// framebuffer, which confuse some servers, e.g. after a resize. By
+	// default they are sent as given.
+	ClampPointer PointerClamp
+
+	// ZlibErrorPolicy determines how corrupt zlib data in Tight and ZRLE
+	// rectangles is handled. By default it ends the session; with
+	// ZlibSkipRectangle, the rectangle is skipped, accepting a visual glitch
+	// over a dropped connection from a flaky server.
+	ZlibErrorPolicy ZlibErrorPolicy
+
+	// SkipUnknownPseudoEncodings skips rectangles of pseudo-encodings, which
+	// have negative types, that no Encoding is registered for, rather than
+	// ending the session, so that servers sending pseudo-encodings the client
+	// didn't ask for can be used. Only the header of a skipped rectangle is
+	// read: the client can't know the length of any data following it, so a
+	// pseudo-encoding that carries data leaves the stream out of sync, and is
+	// best left an error, as by default. Pseudo-encodings known to carry data,
+	// such as ExtendedDesktopSize, are never skipped. Each rectangle skipped
+	// is counted by the "pseudo-encodings-skipped" metric and logged.
+	SkipUnknownPseudoEncodings bool
+
+	// MaintainFramebuffer keeps a model of the framebuffer, to which each
+	// FramebufferUpdate is applied once read; see Framebuffer. A DesktopSize
+	// pseudo-rectangle resizes the model, keeping the content of the region
+	// common to both sizes.
+	MaintainFramebuffer bool
+
+	// OnResize, if set, is called on the reading goroutine for each
+	// DesktopSize pseudo-rectangle of a FramebufferUpdate, once the update
+	// has been read and the framebuffer model, if any, resized.
+	OnResize func(width, height uint16)
+
+	// Resync is a last resort against servers, or decoders, that break the
+	// framing of the stream. When a message-type byte is not a known server
+	// message-type, the following data is skipped, up to MaxResyncBytes, until
+	// one is that starts a plausible message, as far as its header tells,
+	// rather than ending the session. Each recovery is counted by the
+	// "resyncs" metric and logged. The scan may skip a whole frame, and noise
+	// that happens to look like a message ends it early, usually failing on
+	// the message that follows.
+	Resync bool
+
+	// MaxResyncBytes is the most bytes skipped by Resync before giving up
+	// with a ResyncError. Zero means DefaultMaxResyncBytes.
+	MaxResyncBytes int
+
+	// CaptureRawRectangles keeps the bytes of each rectangle of the
+	// FramebufferUpdates read, exactly as sent by the server, in
+	// FramebufferUpdate.Wire, e.g. for a proxy to forward or cache them
+	// without encoding them again. Each update then holds about twice the
+	// memory. It is read when the connection is created or reconnected.
+	CaptureRawRectangles bool
+
+	// ForceProtocolVersion, if set, is the ProtocolVersion banner sent to
+	// the server, such as PROTO_VERS_3_3, whatever version the server
+	// offers, for devices that only accept an exact banner. It must be well
+	// formed, as "RFB xxx.yyy\n", and of version 3.3 or later. The
+	// handshake then follows version 3.8 for banners of 3.8 or later, 3.7
+	// for 3.7, and 3.3 otherwise. It overrides the "vnc_max_proto_version"
+	// context value.
+	ForceProtocolVersion string
+
+	// NameCharset is the character set in which the desktop name, sent in
+	// ServerInit and by the DesktopName pseudo-encoding, is decoded. By
+	// default it is UTF-8, with invalid bytes replaced. DesktopNameBytes
+	// returns the name undecoded.
+	NameCharset NameCharset
+}
+
+// DefaultMaxClipboardBytes is the default ClientConfig.MaxClipboardBytes.
+const DefaultMaxClipboardBytes = 1 << 20
+
+func (cfg *ClientConfig) maxClipboardBytes() uint32 {
+	if cfg.MaxClipboardBytes == 0 {
+		return DefaultMaxClipboardBytes
+	}
+	return cfg.MaxClipboardBytes
+}
+
+// DefaultMaxDesktopNameBytes is the default ClientConfig.MaxDesktopNameBytes.
+const DefaultMaxDesktopNameBytes = 4096
+
+func (cfg *ClientConfig) maxDesktopNameBytes() uint32 {
+	if cfg.MaxDesktopNameBytes == 0 {
+		return DefaultMaxDesktopNameBytes
+	}
+	return cfg.MaxDesktopNameBytes
+}
+
+// DefaultContinuousUpdatesTimeout is the default
+// ClientConfig.ContinuousUpdatesTimeout.
+const DefaultContinuousUpdatesTimeout = 3 * time.Second
+
+func (cfg *ClientConfig) continuousUpdatesTimeout() time.Duration {
+	if cfg.ContinuousUpdatesTimeout == 0 {
+		return DefaultContinuousUpdatesTimeout
+	}
+	return cfg.ContinuousUpdatesTimeout
+}
+
+// DefaultMaxRectanglesPerUpdate is the default
+// ClientConfig.MaxRectanglesPerUpdate.
+const DefaultMaxRectanglesPerUpdate = 4096
+
+func (cfg *ClientConfig) maxRectanglesPerUpdate() uint16 {
+	if cfg.MaxRectanglesPerUpdate == 0 {
+		return DefaultMaxRectanglesPerUpdate
+	}
+	return cfg.MaxRectanglesPerUpdate
+}
+
+// DefaultMaxResyncBytes is the default ClientConfig.MaxResyncBytes.
+const DefaultMaxResyncBytes = 64 << 10
+
+func (cfg *ClientConfig) maxResyncBytes() int {
+	if cfg.MaxResyncBytes == 0 {
+		return DefaultMaxResyncBytes
+	}
+	return cfg.MaxResyncBytes
 }
 
 // NewClientConfig returns a populated ClientConfig.
@@ -113,12 +633,16 @@ func NewClientConfig(p string) *ClientConfig {
 			&ClientAuthVNC{p},
 			&ClientAuthVeNCryptAuth{},
 		},
-		Password: p,
+		Password:             p,
+		RequestInitialUpdate: true,
+		AutoRequestUpdates:   true,
 		ServerMessages: []ServerMessage{
 			&FramebufferUpdate{},
 			&SetColorMapEntries{},
 			&Bell{},
 			&ServerCutText{},
+			&ServerFence{},
+			&EndOfContinuousUpdates{},
 		},
 	}
 }
@@ -127,10 +651,15 @@ func NewClientConfig(p string) *ClientConfig {
 type ClientConn struct {
 	Conn            net.Conn
 	bufr            *bufio.Reader
+	bufw            *bufio.Writer // Set while writes are coalesced.
 	config          *ClientConfig
 	protocolVersion string
 
-	connTerminated bool
+	connTerminated atomic.Bool
+
+	// Held while a message is written, so that messages sent from different
+	// goroutines are not interleaved; it also guards bufw.
+	sendMu sync.Mutex
 
 	log *log.Logger
 
@@ -140,16 +669,71 @@ type ClientConn struct {
 	// Definition in §5 - Representation of Pixel Data.
 	colorMap ColorMap
 
-	// Name associated with the desktop, sent from the server.
-	desktopName string
+	// Name associated with the desktop, sent from the server, as decoded
+	// and as sent.
+	desktopName      string
+	desktopNameBytes []byte
 
 	// zlibs is a slice of zlib readers for Tight encoding.
-	// Each stream can be reset independently.
-	zlibs [4]io.ReadCloser
+	// Each stream can be reset independently. zlibsMu guards them, so that
+	// Close can release them while a rectangle is being decoded.
+	zlibsMu sync.Mutex
+	zlibs   [4]io.ReadCloser
+
+	// Buffers for the compressed and decompressed Tight data, reused between
+	// rectangles.
+	tightCompressed []byte
+	zlibBufs        [4][]byte
+
+	// Set when the pixel format changes, so that the reading goroutine
+	// resets zlibs before decoding further Tight data.
+	zlibsStale atomic.Bool
+
+	// Records the bytes read by bufr under ClientConfig.CaptureRawRectangles.
+	capture *captureReader
+
+	// Set when IdleTimeout closed the connection.
+	idleTimedOut atomic.Bool
+
+	// Set while continuous updates are enabled.
+	continuousUpdates atomic.Bool
+
+	// Counts the enablings and disablings of continuous updates, so that the
+	// fallback of an enabling superseded since does nothing.
+	continuousGen atomic.Uint64
+
+	// Set by the last call to EnableContinuousUpdates that enabled them, and
+	// counts the disablings the server has yet to acknowledge with an
+	// EndOfContinuousUpdates message, so that a late acknowledgment doesn't
+	// end continuous updates enabled again since.
+	continuousEnabled  atomic.Bool
+	continuousDisables atomic.Int32
+
+	// The LEDFlags last sent by the server.
+	ledState atomic.Uint32
 
 	// Encodings supported by the client. This should not be modified
 	// directly. Instead, SetEncodings() should be used.
-	encodings Encodings
+	encodingsMu sync.Mutex
+	encodings   Encodings
+
+	// Encodings dropped by SetEncodings that may still be in use by updates
+	// the server sent before it received the change.
+	retiredEncodings Encodings
+
+	// The number of FramebufferUpdates read, and of those yet to be read
+	// that may answer requests sent before the encodings were retired.
+	// Guarded by encodingsMu.
+	updatesRead    uint64
+	retiredPending uint64
+
+	// The number of FramebufferUpdateRequests sent.
+	updateRequests atomic.Uint64
+
+	// Size of the frame buffer in pixels, sent from the server. It is set
+	// holding fbSizeMu, which goroutines other than the read goroutine hold
+	// to read it; see framebufferSize.
+	fbSizeMu sync.Mutex
 
 	// Height of the frame buffer in pixels, sent from the server.
 	fbHeight uint16
@@ -157,16 +741,82 @@ type ClientConn struct {
 	// Width of the frame buffer in pixels, sent from the server.
 	fbWidth uint16
 
+	// The framebuffer model, if maintained; see Framebuffer. The render
+	// target, if any, and the checksum of the model, if valid, are guarded
+	// by the same mutex; see SetRenderTarget and FramebufferChecksum.
+	fbMu         sync.Mutex
+	fb           *image.RGBA
+	renderTarget draw.Image
+	fbSum        uint64
+	fbSumValid   bool
+
+	// The read deadline set with SetReadDeadline, restored by receiveN.
+	deadlineMu   sync.Mutex
+	readDeadline time.Time
+
+	// The image drawn by Screenshot, as each rectangle of the update it
+	// reads is decoded. It is only used on the reading goroutine.
+	screenshot *image.RGBA
+
+	// Closed once the first FramebufferUpdate of the session is applied.
+	firstFrame     chan struct{}
+	firstFrameOnce sync.Once
+
 	// The pixel format associated with the connection. This shouldn't
 	// be modified. If you wish to set a new pixel format, use the
 	// SetPixelFormat method.
 	pixelFormat PixelFormat
 
+	// The server's native pixel format, from ServerInit, and the format last
+	// requested with SetPixelFormat, if any.
+	serverPixelFormat    PixelFormat
+	requestedPixelFormat *PixelFormat
+
 	// Security types, supported by the server
 	securityTypes []uint8
 
+	// The server's messages during negotiation, for OnHandshake.
+	handshakeTrace HandshakeTrace
+
+	// How pointer events convey the pointer position, as requested by the
+	// server, which is set by the read goroutine, as a PointerMode, and the
+	// position and buttons last sent.
+	pointerMode        atomic.Int32
+	pointerX, pointerY uint16
+	pointerButtons     buttons.Button
+
+	// Number of rectangles received in each encoding this session, and the
+	// pseudo-encodings the server has otherwise shown to support.
+	observedMu         sync.Mutex
+	observedEncodings  map[encodings.EncodingType]int
+	confirmedEncodings map[encodings.EncodingType]bool
+
+	// Typed events delivered to the channel returned by Events, if any.
+	events chan Event
+
 	// Track metrics on system performance.
 	metrics map[string]metrics.Metric
+
+	// Source of time for time-dependent features; see setClock.
+	clock clock
+
+	// State of AdaptiveQuality.
+	adaptive adaptiveQuality
+
+	// Round-trip time measured during the handshake, from the time the
+	// client's ProtocolVersion was sent; see rtt.go.
+	rtt      time.Duration
+	rttStart time.Time
+
+	// Time of the last request sent by AutoRequestUpdates.
+	lastAutoRequest time.Time
+
+	// The region of the last EnableContinuousUpdates enabling them.
+	continuousRegion image.Rectangle
+
+	// Whether the session is paused; see pause.go.
+	pauseMu sync.Mutex
+	pause   pauseState
 }
 
 func NewClientConn(c net.Conn, cfg *ClientConfig) *ClientConn {
@@ -175,42 +825,286 @@ func NewClientConn(c net.Conn, cfg *ClientConfig) *ClientConn {
 	if logger == nil {
 		logger = log.New(io.Discard, "", log.LstdFlags)
 	}
-	return &ClientConn{
-		Conn:           c,
-		bufr:           bufio.NewReaderSize(c, 1024),
-		connTerminated: false,
-		config:         cfg,
-		log:            logger,
-		encodings:      Encodings{&RawEncoding{}},
-		pixelFormat:    PixelFormat32bit,
-		metrics: map[string]metrics.Metric{
-			"bytes-received": &metrics.Gauge{},
-			"bytes-sent":     &metrics.Gauge{},
-		},
+	clk := realClock{}
+	var m map[string]metrics.Metric
+	if !cfg.DisableMetrics {
+		m = map[string]metrics.Metric{
+			"bytes-received":           &metrics.Gauge{},
+			"bytes-sent":               &metrics.Gauge{},
+			"decode-duration":          &metrics.Gauge{},
+			"framebuffer-bytes":        &metrics.Gauge{},
+			"pseudo-encodings-skipped": &metrics.Gauge{},
+			"read-bps":                 newRateGauge(clk),
+			"resyncs":                  &metrics.Gauge{},
+			"throttled-bytes":          &metrics.Gauge{},
+			"write-bps":                newRateGauge(clk),
+		}
 	}
+	c = throttle(c, cfg.MaxBytesPerSecond, m["throttled-bytes"], clk) // nil if disabled
+	conn := &ClientConn{
+		Conn:        c,
+		config:      cfg,
+		log:         logger,
+		encodings:   Encodings{&RawEncoding{}},
+		pixelFormat: PixelFormat32bit,
+		metrics:     m,
+		clock:       clk,
+		firstFrame:  make(chan struct{}),
+	}
+	if cfg.AppleCompat {
+		conn.encodings = appleEncodings()
+	}
+	conn.bufr = conn.newReader(c)
+	return conn
 }
 
 // Close a connection to a VNC server.
 func (c *ClientConn) Close() error {
-	if c.connTerminated {
+	if c.connTerminated.Swap(true) {
 		return nil
 	}
 	c.log.Println("VNC Client connection closed.")
-	c.connTerminated = true
-	return c.Conn.Close()
+	c.pauseMu.Lock()
+	c.wakeParkedReads()
+	c.pauseMu.Unlock()
+	err := c.Conn.Close()
+	c.closeZlibs()
+	return err
+}
+
+// SetReadDeadline sets the read deadline of the connection, as
+// net.Conn.SetReadDeadline does, keeping it across the reads bounded by
+// ClientConfig.ReadTimeout, which set their own deadline while they last.
+func (c *ClientConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *ClientConn) GetDesktopName() string      { return c.desktopName }
+func (c *ClientConn) GetPixelFormat() PixelFormat { return c.pixelFormat }
+
+// GetFramebufferHeight returns the height of the framebuffer.
+func (c *ClientConn) GetFramebufferHeight() uint16 {
+	_, h := c.framebufferSize()
+	return h
+}
+
+// SetFramebufferHeight sets the height of the framebuffer.
+func (c *ClientConn) SetFramebufferHeight(height uint16) {
+	c.fbSizeMu.Lock()
+	defer c.fbSizeMu.Unlock()
+	c.fbHeight = height
+}
+
+// GetFramebufferWidth returns the width of the framebuffer.
+func (c *ClientConn) GetFramebufferWidth() uint16 {
+	w, _ := c.framebufferSize()
+	return w
+}
+
+// SetFramebufferWidth sets the width of the framebuffer.
+func (c *ClientConn) SetFramebufferWidth(width uint16) {
+	c.fbSizeMu.Lock()
+	defer c.fbSizeMu.Unlock()
+	c.fbWidth = width
+}
+
+// framebufferSize returns the width and height of the framebuffer, which
+// the read goroutine may change at any time, e.g. on a DesktopSize.
+func (c *ClientConn) framebufferSize() (w, h uint16) {
+	c.fbSizeMu.Lock()
+	defer c.fbSizeMu.Unlock()
+	return c.fbWidth, c.fbHeight
+}
+
+// setFramebufferSize sets the width and height of the framebuffer.
+func (c *ClientConn) setFramebufferSize(w, h uint16) {
+	c.fbSizeMu.Lock()
+	defer c.fbSizeMu.Unlock()
+	c.fbWidth, c.fbHeight = w, h
+}
+
+// SetDesktopName sets the desktop name, and the bytes DesktopNameBytes
+// returns, encoded according to ClientConfig.NameCharset.
+func (c *ClientConn) SetDesktopName(name string) {
+	c.desktopName = name
+	c.desktopNameBytes = c.config.NameCharset.encode(name)
+}
+
+// DesktopNameBytes returns the desktop name as sent by the server, before
+// decoding according to ClientConfig.NameCharset.
+func (c *ClientConn) DesktopNameBytes() []byte { return bytes.Clone(c.desktopNameBytes) }
+
+// ServerPixelFormat returns the server's native pixel format, as announced in
+// ServerInit.
+func (c *ClientConn) ServerPixelFormat() PixelFormat { return c.serverPixelFormat }
+
+// RequestedPixelFormat returns the pixel format last requested with
+// SetPixelFormat, and false if none has been requested, in which case the
+// server's native format is in use.
+func (c *ClientConn) RequestedPixelFormat() (PixelFormat, bool) {
+	if c.requestedPixelFormat == nil {
+		return PixelFormat{}, false
+	}
+	return *c.requestedPixelFormat, true
+}
+
+// GetEncodings returns the encodings supported by the client.
+func (c *ClientConn) GetEncodings() Encodings {
+	c.encodingsMu.Lock()
+	defer c.encodingsMu.Unlock()
+	return c.encodings
+}
+
+// replaceEncodings makes encs the encodings supported by the client, retiring
+// any that are no longer present.
+func (c *ClientConn) replaceEncodings(encs Encodings) {
+	c.encodingsMu.Lock()
+	defer c.encodingsMu.Unlock()
+	var retired Encodings
+	for _, e := range append(c.retiredEncodings[:len(c.retiredEncodings):len(c.retiredEncodings)], c.encodings...) {
+		if !encs.Contains(e.Type()) && !retired.Contains(e.Type()) {
+			retired = append(retired, e)
+		}
+	}
+	c.encodings = encs
+	c.retiredEncodings = retired
+	c.retiredPending = 0
+	if sent := c.updateRequests.Load(); sent > c.updatesRead {
+		c.retiredPending = sent - c.updatesRead
+	}
+}
+
+// settleEncodings forgets the retired encodings once the server sends an
+// update that follows the change and doesn't use them, resetting the decoder
+// state they held. Updates answering requests outstanding at the change may
+// have been encoded before the server saw it, whatever their encodings. It is
+// called by the read goroutine after each FramebufferUpdate.
+func (c *ClientConn) settleEncodings(rects []Rectangle) {
+	c.encodingsMu.Lock()
+	defer c.encodingsMu.Unlock()
+	c.updatesRead++
+	if len(c.retiredEncodings) == 0 {
+		return
+	}
+	if c.retiredPending > 0 {
+		c.retiredPending--
+		return
+	}
+	for _, rect := range rects {
+		if rect.Enc != nil && c.retiredEncodings.Contains(rect.Enc.Type()) {
+			return // The change hasn't taken effect yet.
+		}
+	}
+	if c.retiredEncodings.Contains(encodings.EncTight) {
+		c.closeZlibs()
+	}
+	c.retiredEncodings = nil
 }
 
-func (c *ClientConn) GetDesktopName() string             { return c.desktopName }
-func (c *ClientConn) SetDesktopName(name string)         { c.desktopName = name }
-func (c *ClientConn) GetEncodings() Encodings            { return c.encodings }
-func (c *ClientConn) GetFramebufferHeight() uint16       { return c.fbHeight }
-func (c *ClientConn) SetFramebufferHeight(height uint16) { c.fbHeight = height }
-func (c *ClientConn) GetFramebufferWidth() uint16        { return c.fbWidth }
-func (c *ClientConn) SetFramebufferWidth(width uint16)   { c.fbWidth = width }
-func (c *ClientConn) GetPixelFormat() PixelFormat        { return c.pixelFormat }
+// rateMetrics maps the metrics counting bytes to those of their rates.
+var rateMetrics = map[string]string{
+	"bytes-received": "read-bps",
+	"bytes-sent":     "write-bps",
+}
 
-// ListenAndHandle listens to a VNC server and handles server messages.
+// adjustMetric adjusts the named metric by delta, unless metrics are
+// disabled. Bytes counted by "bytes-received" and "bytes-sent" are also
+// counted by the "read-bps" and "write-bps" rates.
+func (c *ClientConn) adjustMetric(name string, delta int64) {
+	if c.metrics != nil {
+		c.metrics[name].Adjust(delta)
+		if rate, ok := rateMetrics[name]; ok {
+			c.metrics[rate].Adjust(delta)
+		}
+	}
+}
+
+// resetMetric resets the named metric, unless metrics are disabled.
+func (c *ClientConn) resetMetric(name string) {
+	if c.metrics != nil {
+		c.metrics[name].Reset()
+	}
+}
+
+// metricValue returns the value of the named metric, or zero if metrics are
+// disabled.
+func (c *ClientConn) metricValue(name string) uint64 {
+	if c.metrics == nil {
+		return 0
+	}
+	return c.metrics[name].Value()
+}
+
+// ObservedEncodings returns the number of rectangles received from the server
+// in each encoding during this session.
+func (c *ClientConn) ObservedEncodings() map[encodings.EncodingType]int {
+	c.observedMu.Lock()
+	defer c.observedMu.Unlock()
+	observed := make(map[encodings.EncodingType]int, len(c.observedEncodings))
+	for enc, n := range c.observedEncodings {
+		observed[enc] = n
+	}
+	return observed
+}
+
+// observeEncoding counts a rectangle received in encoding enc.
+func (c *ClientConn) observeEncoding(enc encodings.EncodingType) {
+	c.observedMu.Lock()
+	defer c.observedMu.Unlock()
+	if c.observedEncodings == nil {
+		c.observedEncodings = make(map[encodings.EncodingType]int)
+	}
+	c.observedEncodings[enc]++
+}
+
+// ServerSupports returns true once the server has shown to support encoding
+// enc during this session: by sending a rectangle in enc, or for
+// pseudo-encodings signalled otherwise, a LastRect rectangle, a ServerFence
+// message for Fence, an EndOfContinuousUpdates message for
+// ContinuousUpdates, or a ServerCutText message in the Extended Clipboard
+// format. Servers ignore encodings they don't support, so false means only
+// that no evidence has been seen yet.
+func (c *ClientConn) ServerSupports(enc encodings.EncodingType) bool {
+	c.observedMu.Lock()
+	defer c.observedMu.Unlock()
+	return c.observedEncodings[enc] > 0 || c.confirmedEncodings[enc]
+}
+
+// confirmEncoding records that the server supports encoding enc.
+func (c *ClientConn) confirmEncoding(enc encodings.EncodingType) {
+	c.observedMu.Lock()
+	defer c.observedMu.Unlock()
+	if c.confirmedEncodings == nil {
+		c.confirmedEncodings = make(map[encodings.EncodingType]bool)
+	}
+	c.confirmedEncodings[enc] = true
+}
+
+// PointerMode returns how pointer events convey the pointer position. It is
+// PointerAbsolute unless the server requested otherwise.
+func (c *ClientConn) PointerMode() PointerMode { return PointerMode(c.pointerMode.Load()) }
+
+// LEDState returns the state of the remote keyboard LEDs, as last sent by the
+// server with the QEMU LED State pseudo-encoding, which must be among the
+// encodings set for the server to send it. It may be called from any
+// goroutine.
+func (c *ClientConn) LEDState() LEDFlags { return LEDFlags(c.ledState.Load()) }
+
+// ListenAndHandle listens to a VNC server and handles server messages. It
+// returns nil once the connection is closed, either by Close or by the server
+// between messages; otherwise it returns the error that ended the connection,
+// such as io.ErrUnexpectedEOF for a truncated message or a ProtocolError.
 func (c *ClientConn) ListenAndHandle() error {
+	defer func() {
+		if c.events != nil {
+			close(c.events)
+			c.events = nil
+		}
+	}()
+
 	if c.config.ServerMessages == nil {
 		return NewVNCError("Client config error: ServerMessages undefined")
 	}
@@ -219,17 +1113,25 @@ func (c *ClientConn) ListenAndHandle() error {
 		serverMessages[m.Type()] = m
 	}
 
+	received, stopIdle := c.watchIdle()
+	defer stopIdle()
+
 	for {
-		if c.connTerminated {
+		c.waitResumed()
+		if c.connTerminated.Load() {
 			break
 		}
 
-		var messageType messages.ServerMessage
-		if err := c.receive(&messageType); err != nil {
-			if !c.connTerminated {
-				log.Print("error: reading from server")
+		messageType, err := c.receiveMessageType()
+		if err != nil {
+			if c.idleTimedOut.Load() {
+				return ErrIdleTimeout
 			}
-			break
+			if c.connTerminated.Load() || err == io.EOF {
+				break
+			}
+			log.Print("error: reading from server")
+			return err
 		}
 		if c.log != nil {
 			c.log.Printf("message-type: %s", messageType)
@@ -239,13 +1141,41 @@ func (c *ClientConn) ListenAndHandle() error {
 		if !ok {
 			// Unsupported message type! Bad!
 			log.Printf("error unsupported message-type: %v", messageType)
-			break
+			return &ProtocolError{Errorf("unsupported message-type: %v", messageType)}
 		}
 
+		received()
 		parsedMsg, err := msg.Read(c)
 		if err != nil {
+			if c.idleTimedOut.Load() {
+				return ErrIdleTimeout
+			}
+			if c.connTerminated.Load() {
+				break
+			}
 			log.Printf("error parsing message; %v", err)
-			break
+			return err
+		}
+
+		// Keep a request outstanding after each update, and once continuous
+		// updates end.
+		switch msg := parsedMsg.(type) {
+		case *FramebufferUpdate:
+			if err := c.requestNextUpdate(); err != nil {
+				return err
+			}
+		case *EndOfContinuousUpdates:
+			if msg.ended {
+				if err := c.requestNextUpdate(); err != nil {
+					return err
+				}
+			}
+		}
+
+		if c.events != nil {
+			for _, ev := range messageEvents(parsedMsg) {
+				c.events <- ev
+			}
 		}
 
 		if c.config.ServerMessageCh == nil {
@@ -260,72 +1190,257 @@ func (c *ClientConn) ListenAndHandle() error {
 	return nil
 }
 
+// watchIdle closes the connection, setting idleTimedOut, once no server
+// message has been received for ClientConfig.IdleTimeout. It returns a
+// function to call as each message is received, and one ending the watch.
+func (c *ClientConn) watchIdle() (received, stop func()) {
+	timeout := c.config.IdleTimeout
+	if timeout <= 0 {
+		return func() {}, func() {}
+	}
+
+	var mu sync.Mutex
+	last := c.clock.Now()
+	done := make(chan struct{})
+	go func() {
+		wait := timeout
+		for {
+			select {
+			case <-done:
+				return
+			case <-c.clock.After(wait):
+			}
+			mu.Lock()
+			if c.Paused() {
+				last = c.clock.Now()
+			}
+			wait = timeout - c.clock.Now().Sub(last)
+			mu.Unlock()
+			if wait <= 0 {
+				c.idleTimedOut.Store(true)
+				c.Conn.Close()
+				return
+			}
+		}
+	}()
+
+	received = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		last = c.clock.Now()
+	}
+	return received, func() { close(done) }
+}
+
 // receive a packet from the network.
+// Errors other than the connection closing are returned as a ProtocolError.
 func (c *ClientConn) receive(data interface{}) error {
 	if err := binary.Read(c.bufr, binary.BigEndian, data); err != nil {
-		return err
+		return readError(err)
 	}
-	c.metrics["bytes-received"].Adjust(int64(binary.Size(data)))
+	c.adjustMetric("bytes-received", int64(binary.Size(data)))
 	return nil
 }
 
-// receiveN receives N packets from the network.
+// Bounds on the data read by receiveN.
+const (
+	// maxReceiveElements is the most elements read by a single call, which
+	// allows for a Raw rectangle of 8192x8192 pixels of 32 bits.
+	maxReceiveElements = 1 << 28
+
+	// receiveChunkSize is the number of bytes for which memory is allocated
+	// at a time, so that a server promising more data than it sends doesn't
+	// cause a large allocation.
+	receiveChunkSize = 64 << 10
+
+	// maxPreallocatedReceive is the most bytes for which memory is allocated
+	// up front, the pixel data of a Raw rectangle of 2048x2048 pixels of 32
+	// bits.
+	maxPreallocatedReceive = 16 << 20
+)
+
+// readFull reads len(p) bytes of the body of a message into p. A
+// PartialReadError wrapping io.ErrUnexpectedEOF is returned if the connection
+// closes first, even before any byte is read.
+func (c *ClientConn) readFull(p []byte) error {
+	n, err := io.ReadFull(c.bufr, p)
+	if err == nil {
+		return nil
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return &PartialReadError{Want: len(p), Got: n, Err: readError(err)}
+}
+
+// receiveN receives N packets from the network. If ClientConfig.ReadTimeout
+// is set, a server that doesn't send them in time causes a timeout. io.EOF is
+// returned if the connection closes before any data is received, and a
+// PartialReadError if only part of the data is received.
 func (c *ClientConn) receiveN(data interface{}, n int) error {
 	if n == 0 {
 		return nil
 	}
 
-	switch data := data.(type) {
-	case *[]uint8:
-		var v uint8
-		for i := 0; i < n; i++ {
-			if err := binary.Read(c.bufr, binary.BigEndian, &v); err != nil {
-				return err
-			}
-			slice := data
-			*slice = append(*slice, v)
-		}
+	size := 1
+	switch data.(type) {
+	case *[]uint8, *bytes.Buffer:
 	case *[]int32:
-		var v int32
-		for i := 0; i < n; i++ {
-			if err := binary.Read(c.bufr, binary.BigEndian, &v); err != nil {
+		size = 4
+	default:
+		return NewVNCError(fmt.Sprintf("unrecognized data type %v", reflect.TypeOf(data)))
+	}
+	if n < 0 || n > maxReceiveElements {
+		return NewVNCError(fmt.Sprintf("invalid number of elements to receive: %d exceeds %d", n, maxReceiveElements))
+	}
+
+	if timeout := c.config.ReadTimeout; timeout > 0 && c.Conn != nil {
+		c.deadlineMu.Lock()
+		deadline := c.clock.Now().Add(timeout)
+		if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+			deadline = c.readDeadline
+		}
+		c.Conn.SetReadDeadline(deadline)
+		c.deadlineMu.Unlock()
+		defer func() {
+			c.deadlineMu.Lock()
+			defer c.deadlineMu.Unlock()
+			c.Conn.SetReadDeadline(c.readDeadline)
+		}()
+	}
+
+	// Data up to maxPreallocatedReceive is read into a buffer of its size in
+	// one io.ReadFull: c.bufr hands over the bytes it holds, then passes the
+	// rest of the read straight to the connection, rather than refilling its
+	// buffer for each small part. Larger data is read in chunks.
+	want := n * size
+	chunkSize := receiveChunkSize
+	if want <= maxPreallocatedReceive {
+		chunkSize = want
+	}
+	var b []byte
+	for len(b) < want {
+		chunk := min(want-len(b), chunkSize)
+		b = slices.Grow(b, chunk)
+		m, err := io.ReadFull(c.bufr, b[len(b):len(b)+chunk])
+		b = b[:len(b)+m]
+		if err != nil {
+			if err == io.EOF && len(b) == 0 {
 				return err
 			}
-			slice := data
-			*slice = append(*slice, v)
+			c.adjustMetric("bytes-received", int64(len(b)))
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return &PartialReadError{Want: want, Got: len(b), Err: readError(err)}
+		}
+	}
+	c.adjustMetric("bytes-received", int64(len(b)))
+
+	switch data := data.(type) {
+	case *[]uint8:
+		if *data == nil {
+			*data = b
+			break
 		}
+		*data = append(*data, b...)
 	case *bytes.Buffer:
-		var v byte
+		data.Write(b)
+	case *[]int32:
 		for i := 0; i < n; i++ {
-			if err := binary.Read(c.bufr, binary.BigEndian, &v); err != nil {
-				return err
-			}
-			buf := data
-			buf.WriteByte(v)
+			*data = append(*data, int32(binary.BigEndian.Uint32(b[4*i:])))
 		}
-	default:
-		return NewVNCError(fmt.Sprintf("unrecognized data type %v", reflect.TypeOf(data)))
 	}
-	c.metrics["bytes-received"].Adjust(int64(binary.Size(data)))
 	return nil
 }
 
-func (c *ClientConn) send(data interface{}) error {
-	var size int
-	if s, ok := data.([]byte); ok {
-		size = len(s)
-	} else {
-		size = binary.Size(data)
+// send sends parts to the server, one after the other, as a single message:
+// messages sent from other goroutines are not interleaved with them.
+func (c *ClientConn) send(parts ...interface{}) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	var w io.Writer = c.Conn
+	if c.bufw != nil {
+		w = c.bufw
+	}
+	for _, data := range parts {
+		var size int
+		if s, ok := data.([]byte); ok {
+			size = len(s)
+		} else {
+			size = binary.Size(data)
+		}
+		if err := binary.Write(w, binary.BigEndian, data); err != nil {
+			return err
+		}
+		if size > 0 {
+			c.adjustMetric("bytes-sent", int64(size))
+		}
 	}
+	return nil
+}
 
-	if err := binary.Write(c.Conn, binary.BigEndian, data); err != nil {
-		return err
+// coalesceWrites holds back the data sent by c, so that consecutive messages
+// go out in fewer writes, until endCoalescing. Held data is flushed before c
+// waits for data from the server, which may be a response to it.
+func (c *ClientConn) coalesceWrites() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	c.bufw = bufio.NewWriter(connWriter{c})
+}
+
+// endCoalescing flushes the data held back by coalesceWrites, and has c send
+// data as it comes again.
+func (c *ClientConn) endCoalescing() error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	err := c.flushLocked()
+	c.bufw = nil
+	return err
+}
+
+// flush writes the data held back by coalesceWrites, if any.
+func (c *ClientConn) flush() error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return c.flushLocked()
+}
+
+// flushLocked is flush, with sendMu held.
+func (c *ClientConn) flushLocked() error {
+	if c.bufw == nil || c.bufw.Buffered() == 0 {
+		return nil
 	}
+	return c.bufw.Flush()
+}
 
-	if size > 0 {
-		c.metrics["bytes-sent"].Adjust(int64(size))
+// connWriter writes to the current Conn of c, which security types such as
+// VeNCrypt replace during the handshake. Writes failing with a temporary
+// error are resumed, as by retryTemporary.
+type connWriter struct{ c *ClientConn }
+
+func (w connWriter) Write(p []byte) (n int, err error) {
+	err = w.c.retryTemporary(func() error {
+		m, err := w.c.Conn.Write(p[n:])
+		n += m
+		return err
+	})
+	return n, err
+}
+
+// flushingReader flushes the data held back by coalesceWrites before each
+// read, so that the server has every request before c waits for its
+// response.
+type flushingReader struct {
+	r io.Reader
+	c *ClientConn
+}
+
+func (r flushingReader) Read(p []byte) (int, error) {
+	if err := r.c.flush(); err != nil {
+		return 0, err
 	}
-	return nil
+	return r.r.Read(p)
 }
 
 // sendN sends N packets to the network.
@@ -374,8 +1489,25 @@ func (c *ClientConn) processContext(ctx context.Context) error {
 }
 
 func (c *ClientConn) DebugMetrics() {
+	log.Printf("Pixel format: server %v", c.serverPixelFormat)
+	if pf, ok := c.RequestedPixelFormat(); ok {
+		log.Printf("Pixel format: requested %v", pf)
+	}
+	if c.metrics == nil {
+		log.Println("Metrics: disabled.")
+		return
+	}
 	log.Println("Metrics:")
 	for name, metric := range c.metrics {
 		log.Printf("  %v: %v", name, metric.Value())
 	}
+	observed := c.ObservedEncodings()
+	encs := make([]encodings.EncodingType, 0, len(observed))
+	for enc := range observed {
+		encs = append(encs, enc)
+	}
+	sort.Slice(encs, func(i, j int) bool { return encs[i] < encs[j] })
+	for _, enc := range encs {
+		log.Printf("  encoding %v: %v", enc, observed[enc])
+	}
 }
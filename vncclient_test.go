@@ -2,12 +2,23 @@ package vnc
 
 import (
 	"bytes"
+	"compress/zlib"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/bigangryrobot/go-vnc/encodings"
+	"github.com/bigangryrobot/go-vnc/rfbflags"
 )
 
 func newMockServer(t *testing.T, version string) string {
@@ -145,3 +156,896 @@ func TestReceiveN(t *testing.T) {
 		}
 	}
 }
+
+func TestReceiveN_Errors(t *testing.T) {
+	// Under-delivery.
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	mockConn.Write([]byte{1, 2, 3})
+	var data []int32
+	err := conn.receiveN(&data, 2)
+	var perr *PartialReadError
+	if !errors.As(err, &perr) {
+		t.Fatalf("under-delivery: expected a PartialReadError; got = %v", err)
+	}
+	if perr.Want != 8 || perr.Got != 3 {
+		t.Errorf("under-delivery: incorrect counts; got = %d of %d, want = 3 of 8", perr.Got, perr.Want)
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("under-delivery: expected io.ErrUnexpectedEOF; got = %v", err)
+	}
+
+	// Too many elements.
+	if err := conn.receiveN(&data, maxReceiveElements+1); err == nil {
+		t.Error("too many elements: expected an error")
+	}
+
+	// A server that stops sending.
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn = NewClientConn(client, &ClientConfig{ReadTimeout: 10 * time.Millisecond})
+	go server.Write([]byte{1, 2})
+	var buf bytes.Buffer
+	done := make(chan error)
+	go func() { done <- conn.receiveN(&buf, 4) }()
+	select {
+	case err := <-done:
+		var nerr net.Error
+		if !errors.As(err, &perr) || perr.Got != 2 || !errors.As(err, &nerr) || !nerr.Timeout() {
+			t.Errorf("stalled server: expected a partial read timing out; got = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled server: receiveN didn't time out")
+	}
+}
+
+// deadlineConn is a MockConn recording the read deadlines set on it.
+type deadlineConn struct {
+	MockConn
+	deadlines []time.Time
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.deadlines = append(c.deadlines, t)
+	return nil
+}
+
+func TestReceiveN_ReadDeadline(t *testing.T) {
+	caller := time.Now().Add(time.Hour)
+	for _, tt := range []struct {
+		desc     string
+		timeout  time.Duration
+		deadline time.Time // Set with SetReadDeadline.
+		wantRead func(time.Time) bool
+	}{
+		{"no deadline", time.Minute, time.Time{}, func(d time.Time) bool { return d.Before(caller) }},
+		{"later deadline", time.Minute, caller, func(d time.Time) bool { return d.Before(caller) }},
+		{"earlier deadline", 2 * time.Hour, caller, func(d time.Time) bool { return d.Equal(caller) }},
+	} {
+		dc := &deadlineConn{}
+		conn := NewClientConn(dc, &ClientConfig{ReadTimeout: tt.timeout})
+		if err := conn.SetReadDeadline(tt.deadline); err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.desc, err)
+		}
+		dc.Write([]byte{1, 2, 3})
+		var data []uint8
+		if err := conn.receiveN(&data, 3); err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.desc, err)
+		}
+
+		// The deadline set, that of the read, and the restored one.
+		if got, want := len(dc.deadlines), 3; got != want {
+			t.Fatalf("%s: incorrect number of deadlines set; got = %v, want = %v", tt.desc, got, want)
+		}
+		if d := dc.deadlines[1]; !tt.wantRead(d) {
+			t.Errorf("%s: incorrect read deadline %v", tt.desc, d)
+		}
+		if got, want := dc.deadlines[2], tt.deadline; !got.Equal(want) {
+			t.Errorf("%s: deadline not restored; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
+// errConn is a MockConn whose reads fail with err once its data is consumed.
+type errConn struct {
+	MockConn
+	err error
+}
+
+func (c *errConn) Read(b []byte) (int, error) {
+	if c.b.Len() == 0 {
+		return 0, c.err
+	}
+	return c.MockConn.Read(b)
+}
+
+func TestClientConfig_DisableMetrics(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{DisableMetrics: true, MaxDecodeMemory: 1, MaxBytesPerSecond: 1 << 20})
+	if conn.metrics != nil {
+		t.Fatal("expected no metrics")
+	}
+
+	// Sending and receiving, including a FramebufferUpdate checked against
+	// MaxDecodeMemory, must not touch the metrics.
+	if err := conn.FramebufferUpdateRequest(RFBFalse, 0, 0, 1, 1); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	mockConn.Reset()
+	mockConn.Write([]byte{0, 0, 1}) // padding, number-of-rectangles
+	binary.Write(mockConn, binary.BigEndian, rectangleMessage{0, 0, 1, 1, 0})
+	mockConn.Write([]byte{1, 2, 3, 4})
+	if _, err := (&FramebufferUpdate{}).Read(conn); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	conn.DebugMetrics()
+	for _, want := range []string{"Metrics: disabled.", "Pixel format: server"} {
+		if got := buf.String(); !strings.Contains(got, want) {
+			t.Errorf("incorrect DebugMetrics output; got = %q, want = %q", got, want)
+		}
+	}
+}
+
+// BenchmarkClientConn_Metrics compares receiving with metrics enabled and
+// disabled.
+func BenchmarkClientConn_Metrics(b *testing.B) {
+	for _, disable := range []bool{false, true} {
+		b.Run(fmt.Sprintf("DisableMetrics=%v", disable), func(b *testing.B) {
+			mockConn := &MockConn{}
+			conn := NewClientConn(mockConn, &ClientConfig{DisableMetrics: disable})
+			data := make([]byte, 4*1024)
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				mockConn.Write(data)
+				var v uint32
+				for i := 0; i < len(data)/4; i++ {
+					if err := conn.receive(&v); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestClientConn_Receive(t *testing.T) {
+	errBroken := errors.New("broken")
+	for _, tt := range []struct {
+		desc    string
+		data    []byte
+		readErr error
+		want    error // Expected error, compared with errors.Is.
+		proto   bool  // Whether a ProtocolError is expected.
+	}{
+		{"complete", []byte{0, 1}, io.EOF, nil, false},
+		{"closed", nil, io.EOF, io.EOF, false},
+		{"truncated", []byte{0}, io.EOF, io.ErrUnexpectedEOF, false},
+		{"read error", []byte{0}, errBroken, errBroken, true},
+	} {
+		conn := NewClientConn(&errConn{err: tt.readErr}, &ClientConfig{})
+		conn.Conn.(*errConn).Write(tt.data)
+
+		var v uint16
+		err := conn.receive(&v)
+		if !errors.Is(err, tt.want) || (tt.want == nil) != (err == nil) {
+			t.Errorf("%s: incorrect error; got = %v, want = %v", tt.desc, err, tt.want)
+		}
+		var perr *ProtocolError
+		if got, want := errors.As(err, &perr), tt.proto; got != want {
+			t.Errorf("%s: incorrect ProtocolError; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
+func TestClientConn_ListenAndHandleErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc  string
+		data  []byte
+		want  error
+		proto bool
+	}{
+		{"clean close", []byte{2}, nil, false}, // Bell
+		{"truncated message", []byte{3, 0, 0, 0, 0, 0, 5, 'h'}, io.ErrUnexpectedEOF, false},
+		{"unsupported message", []byte{0x7f}, nil, true},
+	} {
+		conn := NewClientConn(&MockConn{}, NewClientConfig(""))
+		conn.Conn.(*MockConn).Write(tt.data)
+
+		err := conn.ListenAndHandle()
+		var perr *ProtocolError
+		if tt.proto {
+			if !errors.As(err, &perr) {
+				t.Errorf("%s: expected ProtocolError; got = %v", tt.desc, err)
+			}
+			continue
+		}
+		if !errors.Is(err, tt.want) || (tt.want == nil) != (err == nil) {
+			t.Errorf("%s: incorrect error; got = %v, want = %v", tt.desc, err, tt.want)
+		}
+	}
+}
+
+// indexedHandler serves an 8-bit color-mapped desktop, responding to each
+// FramebufferUpdateRequest with a color map followed by Raw, RRE and Hextile
+// encoded rectangles.
+type indexedHandler struct {
+	*recordingHandler
+}
+
+func (h *indexedHandler) FramebufferUpdateRequest(c *ServerConn, inc rfbflags.RFBFlag, x, y, w, h2 uint16) error {
+	pf := c.GetPixelFormat()
+	palette := []Color{
+		{R: 0x0000, G: 0x0000, B: 0x0000},
+		{R: 0xffff, G: 0x0000, B: 0x0000},
+		{R: 0x0000, G: 0xffff, B: 0x0000},
+		{R: 0x0000, G: 0x0000, B: 0xffff},
+	}
+	if err := c.SetColorMapEntries(0, palette); err != nil {
+		return err
+	}
+
+	index := func(i uint32) Color { return Color{pf: &pf, cmIndex: i} }
+	rects := []Rectangle{
+		{X: 0, Y: 0, Width: 2, Height: 1, Enc: &RawEncoding{[]Color{index(1), index(2)}}},
+		{X: 0, Y: 1, Width: 4, Height: 4, Enc: &RREEncoding{
+			BackgroundColor: index(3),
+			SubRects:        []RRESubRect{{index(1), Rectangle{X: 1, Y: 1, Width: 2, Height: 2}}},
+		}},
+	}
+	if err := c.FramebufferUpdate(rects); err != nil {
+		return err
+	}
+
+	// Hextile can't be marshaled, so send the update by hand: a single 4x4
+	// tile with a background, a foreground and one 1x1 subrect at (1, 1).
+	return c.send([]byte{
+		0, 0, 0, 1, // message-type, padding, number-of-rectangles
+		0, 0, 0, 0, 0, 4, 0, 4, 0, 0, 0, 5, // x, y, width, height, encoding-type
+		0x02 | 0x04 | 0x08, // subencoding-mask
+		2, 1,               // background, foreground
+		1, 0x11, 0x00, // number-of-subrects, x-and-y, width-and-height
+	})
+}
+
+func TestConnect_8bitIndexed(t *testing.T) {
+	SetSettle(0) // Disable UI settling for tests.
+
+	cfg := NewServerConfig("")
+	cfg.PixelFormat = PixelFormat8bit
+	h := &indexedHandler{newRecordingHandler()}
+	addr := newTestServer(t, cfg, h)
+
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("error connecting to server: %s", err)
+	}
+	ccfg := NewClientConfig("")
+	ccfg.ServerMessageCh = make(chan ServerMessage, 3)
+	vc, err := Connect(context.Background(), nc, ccfg)
+	if err != nil {
+		t.Fatalf("unexpected error connecting: %s", err)
+	}
+	defer vc.Close()
+
+	if err := vc.SetEncodings(Encodings{&RawEncoding{}, &RREEncoding{}, &HextileEncoding{}}); err != nil {
+		t.Fatal(err)
+	}
+	h.expect(t, "SetEncodings [Raw]")
+	h.expect(t, "SetPixelFormat bpp:8")
+	h.expect(t, "SetEncodings [Raw RRE Hextile]")
+	if pf := vc.GetPixelFormat(); rfbflags.IsTrueColor(pf.TrueColor) {
+		t.Fatalf("expected color-mapped pixel format; got %v", pf)
+	}
+
+	go vc.ListenAndHandle()
+	if err := vc.FramebufferUpdateRequest(rfbflags.RFBFalse, 0, 0, 4, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []ServerMessage
+	for len(msgs) < 3 {
+		select {
+		case msg := <-ccfg.ServerMessageCh:
+			msgs = append(msgs, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for server messages; got %d", len(msgs))
+		}
+	}
+
+	type rgb [3]uint8
+	resolve := func(c Color) rgb {
+		r, g, b := vc.ResolveColor(c)
+		return rgb{r, g, b}
+	}
+	red, green, blue := rgb{0xff, 0, 0}, rgb{0, 0xff, 0}, rgb{0, 0, 0xff}
+
+	if got, want := len(msgs[0].(*SetColorMapEntries).Colors), 4; got != want {
+		t.Errorf("incorrect number of colors; got = %d, want = %d", got, want)
+	}
+
+	fu := msgs[1].(*FramebufferUpdate)
+	raw := fu.Rects[0].Enc.(*RawEncoding)
+	if got, want := resolve(raw.Colors[0]), red; got != want {
+		t.Errorf("raw: incorrect color[0]; got = %v, want = %v", got, want)
+	}
+	if got, want := resolve(raw.Colors[1]), green; got != want {
+		t.Errorf("raw: incorrect color[1]; got = %v, want = %v", got, want)
+	}
+	rre := fu.Rects[1].Enc.(*RREEncoding)
+	if got, want := resolve(rre.BackgroundColor), blue; got != want {
+		t.Errorf("rre: incorrect background; got = %v, want = %v", got, want)
+	}
+	if got, want := resolve(rre.SubRects[0].Color), red; got != want {
+		t.Errorf("rre: incorrect sub-rect color; got = %v, want = %v", got, want)
+	}
+	if got, want := rre.SubRects[0].Rect.Width, uint16(2); got != want {
+		t.Errorf("rre: incorrect sub-rect width; got = %v, want = %v", got, want)
+	}
+
+	hextile := msgs[2].(*FramebufferUpdate).Rects[0].Enc.(*HextileEncoding)
+	if got, want := resolve(hextile.Colors[0]), green; got != want {
+		t.Errorf("hextile: incorrect background; got = %v, want = %v", got, want)
+	}
+	if got, want := resolve(hextile.Colors[5]), red; got != want {
+		t.Errorf("hextile: incorrect sub-rect color; got = %v, want = %v", got, want)
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	for _, tt := range []struct {
+		address       string
+		network, addr string
+		ok            bool
+	}{
+		{"unix:///run/vnc.sock", "unix", "/run/vnc.sock", true},
+		{"unix://", "", "", false},
+		{"tcp://example.com:5901", "tcp", "example.com:5901", true},
+		{"example.com:5901", "tcp", "example.com:5901", true},
+		{"example.com", "tcp", "example.com:5900", true},
+		{"[::1]:5901", "tcp", "[::1]:5901", true},
+		{"[::1]", "tcp", "[::1]:5900", true},
+		{"", "", "", false},
+	} {
+		network, addr, err := parseAddress(tt.address)
+		if err != nil {
+			if tt.ok {
+				t.Errorf("%q: unexpected error: %s", tt.address, err)
+			}
+			continue
+		}
+		if !tt.ok {
+			t.Errorf("%q: expected error", tt.address)
+			continue
+		}
+		if network != tt.network || addr != tt.addr {
+			t.Errorf("%q: incorrect result; got = %s %s, want = %s %s", tt.address, network, addr, tt.network, tt.addr)
+		}
+	}
+}
+
+func TestDial_Unix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vnc.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	cfg := NewServerConfig("")
+	cfg.DesktopName = "unix desktop"
+	go cfg.Serve(ln, newRecordingHandler())
+
+	vc, err := Dial(context.Background(), "unix://"+path, NewClientConfig(""))
+	if err != nil {
+		t.Fatalf("unexpected error dialing: %s", err)
+	}
+	defer vc.Close()
+	if got, want := vc.GetDesktopName(), cfg.DesktopName; got != want {
+		t.Errorf("incorrect desktop name; got = %q, want = %q", got, want)
+	}
+}
+
+// nativeHandler serves a desktop in its native pixel format, responding to
+// each FramebufferUpdateRequest with Raw, RRE and Hextile encoded rectangles
+// of red, green and blue pixels.
+type nativeHandler struct {
+	*recordingHandler
+}
+
+func (h *nativeHandler) FramebufferUpdateRequest(c *ServerConn, inc rfbflags.RFBFlag, x, y, w, h2 uint16) error {
+	pf := c.GetPixelFormat()
+	red := Color{pf: &pf, R: pf.RedMax}
+	green := Color{pf: &pf, G: pf.GreenMax}
+	blue := Color{pf: &pf, B: pf.BlueMax}
+	rects := []Rectangle{
+		{X: 0, Y: 0, Width: 3, Height: 1, Enc: &RawEncoding{[]Color{red, green, blue}}},
+		{X: 0, Y: 1, Width: 4, Height: 4, Enc: &RREEncoding{
+			BackgroundColor: blue,
+			SubRects:        []RRESubRect{{green, Rectangle{X: 1, Y: 1, Width: 2, Height: 2}}},
+		}},
+	}
+	if err := c.FramebufferUpdate(rects); err != nil {
+		return err
+	}
+
+	// Hextile can't be marshaled, so send the update by hand: a single 4x4
+	// tile with a green background and a red 1x1 subrect at (1, 1).
+	greenBytes, err := green.Marshal()
+	if err != nil {
+		return err
+	}
+	redBytes, err := red.Marshal()
+	if err != nil {
+		return err
+	}
+	msg := []byte{
+		0, 0, 0, 1, // message-type, padding, number-of-rectangles
+		0, 0, 0, 0, 0, 4, 0, 4, 0, 0, 0, 5, // x, y, width, height, encoding-type
+		0x02 | 0x04 | 0x08, // subencoding-mask
+	}
+	msg = append(msg, greenBytes...)
+	msg = append(msg, redBytes...)
+	msg = append(msg, 1, 0x11, 0x00) // number-of-subrects, x-and-y, width-and-height
+	return c.send(msg)
+}
+
+func TestConnect_UseServerPixelFormat(t *testing.T) {
+	SetSettle(0) // Disable UI settling for tests.
+
+	bgr565 := PixelFormat{BPP: 16, Depth: 16, BigEndian: RFBFalse, TrueColor: RFBTrue,
+		RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 0, GreenShift: 5, BlueShift: 11}
+	cfg := NewServerConfig("")
+	cfg.PixelFormat = bgr565
+	h := &nativeHandler{newRecordingHandler()}
+	addr := newTestServer(t, cfg, h)
+
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("error connecting to server: %s", err)
+	}
+	ccfg := NewClientConfig("")
+	ccfg.UseServerPixelFormat = true
+	ccfg.ServerMessageCh = make(chan ServerMessage, 2)
+	vc, err := Connect(context.Background(), nc, ccfg)
+	if err != nil {
+		t.Fatalf("unexpected error connecting: %s", err)
+	}
+	defer vc.Close()
+
+	if got, want := vc.GetPixelFormat(), bgr565; got != want {
+		t.Errorf("incorrect pixel format; got = %v, want = %v", got, want)
+	}
+	if err := vc.SetEncodings(Encodings{&RawEncoding{}, &RREEncoding{}, &HextileEncoding{}}); err != nil {
+		t.Fatal(err)
+	}
+	// No SetPixelFormat is sent between the two SetEncodings.
+	h.expect(t, "SetEncodings [Raw]")
+	h.expect(t, "SetEncodings [Raw RRE Hextile]")
+
+	go vc.ListenAndHandle()
+	if err := vc.FramebufferUpdateRequest(rfbflags.RFBFalse, 0, 0, 4, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []ServerMessage
+	for len(msgs) < 2 {
+		select {
+		case msg := <-ccfg.ServerMessageCh:
+			msgs = append(msgs, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for server messages; got %d", len(msgs))
+		}
+	}
+
+	type rgb [3]uint8
+	resolve := func(c Color) rgb {
+		r, g, b := vc.ResolveColor(c)
+		return rgb{r, g, b}
+	}
+	red, green, blue := rgb{0xff, 0, 0}, rgb{0, 0xff, 0}, rgb{0, 0, 0xff}
+
+	fu := msgs[0].(*FramebufferUpdate)
+	raw := fu.Rects[0].Enc.(*RawEncoding)
+	for i, want := range []rgb{red, green, blue} {
+		if got := resolve(raw.Colors[i]); got != want {
+			t.Errorf("raw: incorrect color[%d]; got = %v, want = %v", i, got, want)
+		}
+	}
+	rre := fu.Rects[1].Enc.(*RREEncoding)
+	if got, want := resolve(rre.BackgroundColor), blue; got != want {
+		t.Errorf("rre: incorrect background; got = %v, want = %v", got, want)
+	}
+	if got, want := resolve(rre.SubRects[0].Color), green; got != want {
+		t.Errorf("rre: incorrect sub-rect color; got = %v, want = %v", got, want)
+	}
+
+	hextile := msgs[1].(*FramebufferUpdate).Rects[0].Enc.(*HextileEncoding)
+	if got, want := resolve(hextile.Colors[0]), green; got != want {
+		t.Errorf("hextile: incorrect background; got = %v, want = %v", got, want)
+	}
+	if got, want := resolve(hextile.Colors[5]), red; got != want {
+		t.Errorf("hextile: incorrect sub-rect color; got = %v, want = %v", got, want)
+	}
+}
+
+func TestConnect_SkipInitialMessages(t *testing.T) {
+	for _, tt := range []struct {
+		desc                 string
+		skipSetEncodings     bool
+		useServerPixelFormat bool
+		want                 []string
+	}{
+		{"default", false, false, []string{"SetEncodings [Raw]", "SetPixelFormat bpp:32"}},
+		{"skip SetEncodings", true, false, []string{"SetPixelFormat bpp:32"}},
+		{"skip SetPixelFormat", false, true, []string{"SetEncodings [Raw]"}},
+		{"skip both", true, true, nil},
+	} {
+		h := newRecordingHandler()
+		addr := newTestServer(t, NewServerConfig(""), h)
+		nc, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("%s: error connecting to server: %s", tt.desc, err)
+		}
+		cfg := NewClientConfig("")
+		cfg.SkipInitialSetEncodings = tt.skipSetEncodings
+		cfg.UseServerPixelFormat = tt.useServerPixelFormat
+		vc, err := Connect(context.Background(), nc, cfg)
+		if err != nil {
+			t.Fatalf("%s: unexpected error connecting: %s", tt.desc, err)
+		}
+
+		// The initial update request follows the messages sent, if any.
+		w, h2 := vc.GetFramebufferWidth(), vc.GetFramebufferHeight()
+		for _, want := range append(tt.want, fmt.Sprintf("FramebufferUpdateRequest %v 0 0 %d %d", rfbflags.RFBFalse, w, h2)) {
+			h.expect(t, want)
+		}
+		vc.Close()
+	}
+}
+
+func TestConnect_CompressionLevel(t *testing.T) {
+	h := newRecordingHandler()
+	addr := newTestServer(t, NewServerConfig(""), h)
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("error connecting to server: %s", err)
+	}
+	cfg := NewClientConfig("")
+	level := 6
+	cfg.CompressionLevel = &level
+	cfg.AutoEncodingByRTT = true
+	cfg.UseServerPixelFormat = true
+	vc, err := Connect(context.Background(), nc, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error connecting: %s", err)
+	}
+	defer vc.Close()
+
+	// The level is advertised ahead of the encodings compressed with it.
+	want := Encodings{&CompressionLevelPseudoEncoding{level}}
+	want = append(want, vc.orderEncodingsByRTT(Encodings{&RawEncoding{}})...)
+	h.expect(t, fmt.Sprintf("SetEncodings %v", encodingTypes(want)))
+	if got := vc.GetEncodings()[0].Type(); got != encodings.EncCompressionLevel7 {
+		t.Errorf("incorrect first encoding; got = %v, want = %v", got, encodings.EncCompressionLevel7)
+	}
+
+	// An invalid level fails the connection.
+	nc, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("error connecting to server: %s", err)
+	}
+	level = MaxLevel + 1
+	if _, err := Connect(context.Background(), nc, cfg); err == nil {
+		t.Error("expected error for invalid compression level")
+	}
+}
+
+// writeRecordingConn is a net.Conn recording the size of each write.
+type writeRecordingConn struct {
+	net.Conn
+	writes []int
+}
+
+func (c *writeRecordingConn) Write(b []byte) (int, error) {
+	c.writes = append(c.writes, len(b))
+	return c.Conn.Write(b)
+}
+
+func TestConnect_CoalescedWrites(t *testing.T) {
+	SetSettle(0) // Disable UI settling for tests.
+	h := newRecordingHandler()
+	addr := newTestServer(t, NewServerConfig(""), h)
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("error connecting to server: %s", err)
+	}
+	rc := &writeRecordingConn{Conn: nc}
+	cfg := NewClientConfig("")
+	cfg.Auth = []ClientAuth{&ClientAuthNone{}}
+	vc, err := Connect(context.Background(), rc, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error connecting: %s", err)
+	}
+	defer vc.Close()
+
+	// Writes are only split where the client waits for the server: the
+	// security type goes out with ClientInit, there being no SecurityResult
+	// to wait for with None, and the messages following ServerInit go out
+	// together.
+	h.expect(t, fmt.Sprintf("SetEncodings %v", encodingTypes(vc.GetEncodings())))
+	h.expect(t, fmt.Sprintf("SetPixelFormat bpp:%d", vc.pixelFormat.BPP))
+	h.expect(t, fmt.Sprintf("FramebufferUpdateRequest %v 0 0 %d %d", rfbflags.RFBFalse, vc.fbWidth, vc.fbHeight))
+	setEncodings := 4 + 4*len(vc.GetEncodings())
+	initial := setEncodings + binary.Size(SetPixelFormatMessage{}) + binary.Size(FramebufferUpdateRequestMessage{})
+	want := []int{len(PROTO_VERS_3_8), 1 + 1, initial}
+	if !reflect.DeepEqual(rc.writes, want) {
+		t.Errorf("incorrect writes; got = %v, want = %v", rc.writes, want)
+	}
+
+	// Writes aren't held back once connected.
+	if err := vc.KeyEvent(0x41, true); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	h.expect(t, "KeyEvent A true")
+}
+
+// temporaryError implements the net.Error interface.
+type temporaryError struct{ temporary bool }
+
+func (e *temporaryError) Error() string   { return "write failed" }
+func (e *temporaryError) Timeout() bool   { return false }
+func (e *temporaryError) Temporary() bool { return e.temporary }
+
+// flakyConn is a MockConn whose writes fail until failures is exhausted.
+type flakyConn struct {
+	MockConn
+	failures int
+	err      error
+}
+
+func (c *flakyConn) Write(b []byte) (int, error) {
+	if c.failures > 0 {
+		c.failures--
+		return 0, c.err
+	}
+	return c.MockConn.Write(b)
+}
+
+func TestRetryTemporary(t *testing.T) {
+	tests := []struct {
+		desc     string
+		failures int
+		err      error
+		ok       bool
+		attempts int
+	}{
+		{"no failure", 0, nil, true, 1},
+		{"temporary failure once", 1, &temporaryError{true}, true, 2},
+		{"temporary failure exhausts retries", 10, &temporaryError{true}, false, maxTemporaryRetries + 1},
+		{"permanent net.Error", 1, &temporaryError{false}, false, 1},
+		{"permanent error", 1, io.ErrClosedPipe, false, 1},
+	}
+
+	for _, tt := range tests {
+		fc := &flakyConn{failures: tt.failures, err: tt.err}
+		conn := NewClientConn(fc, &ClientConfig{})
+
+		attempts := 0
+		err := conn.retryTemporary(func() error {
+			attempts++
+			return conn.SetPixelFormat(PixelFormat32bit)
+		})
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("%s: unexpected result; got err = %v, want ok = %v", tt.desc, err, tt.ok)
+		}
+		if got, want := attempts, tt.attempts; got != want {
+			t.Errorf("%s: incorrect number of attempts; got = %v, want = %v", tt.desc, got, want)
+		}
+		if !tt.ok {
+			continue
+		}
+
+		// The message must have been written exactly once.
+		var req SetPixelFormatMessage
+		if err := conn.receive(&req); err != nil {
+			t.Errorf("%s: error reading SetPixelFormat: %s", tt.desc, err)
+		}
+		if got, want := conn.bufr.Buffered()+fc.b.Len(), 0; got != want {
+			t.Errorf("%s: unexpected extra bytes written; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
+// partialConn is a MockConn whose first write only writes half of its data,
+// and fails with a temporary error.
+type partialConn struct {
+	MockConn
+	failed bool
+}
+
+func (c *partialConn) Write(b []byte) (int, error) {
+	if !c.failed && len(b) > 1 {
+		c.failed = true
+		n, _ := c.MockConn.Write(b[:len(b)/2])
+		return n, &temporaryError{true}
+	}
+	return c.MockConn.Write(b)
+}
+
+func TestClientConn_CoalescedWrites_PartialWrite(t *testing.T) {
+	pc := &partialConn{}
+	conn := NewClientConn(pc, &ClientConfig{})
+
+	// As sent by negotiate.
+	conn.coalesceWrites()
+	if err := conn.SetPixelFormat(PixelFormat32bit); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := conn.FramebufferUpdateRequest(rfbflags.RFBFalse, 0, 0, 4, 2); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := conn.endCoalescing(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !pc.failed {
+		t.Fatal("expected a partial write")
+	}
+
+	// Each message must have been written exactly once, resuming the write.
+	var pfMsg SetPixelFormatMessage
+	if err := conn.receive(&pfMsg); err != nil {
+		t.Fatalf("error reading SetPixelFormat: %s", err)
+	}
+	var reqMsg FramebufferUpdateRequestMessage
+	if err := conn.receive(&reqMsg); err != nil {
+		t.Fatalf("error reading FramebufferUpdateRequest: %s", err)
+	}
+	if got, want := reqMsg.Width, uint16(4); got != want {
+		t.Errorf("incorrect FramebufferUpdateRequest width; got = %v, want = %v", got, want)
+	}
+	if got, want := conn.bufr.Buffered()+pc.b.Len(), 0; got != want {
+		t.Errorf("unexpected extra bytes written; got = %v, want = %v", got, want)
+	}
+}
+
+func TestClientConn_Close_ReleasesZlibs(t *testing.T) {
+	rect := &Rectangle{Width: 2, Height: 2}
+	pixels := bytes.Repeat([]byte{1}, 2*2*4)
+
+	open := func(conns []*ClientConn) int {
+		n := 0
+		for _, conn := range conns {
+			for _, z := range conn.zlibs {
+				if z != nil {
+					n++
+				}
+			}
+		}
+		return n
+	}
+
+	// Each connection decodes Tight data, opening a zlib stream, and is
+	// closed.
+	var conns []*ClientConn
+	for i := 0; i < 50; i++ {
+		mockConn := &splitConn{}
+		writeTightCopyRect(&mockConn.r, pixels)
+		conn := NewClientConn(mockConn, &ClientConfig{})
+		conn.pixelFormat = PixelFormat32bit
+		if _, err := (&TightEncoding{}).Read(conn, rect); err != nil {
+			t.Fatalf("connection %d: unexpected error: %s", i, err)
+		}
+		if got, want := open([]*ClientConn{conn}), 1; got != want {
+			t.Fatalf("connection %d: incorrect open zlib streams before Close; got = %v, want = %v", i, got, want)
+		}
+		if err := conn.Close(); err != nil {
+			t.Fatalf("connection %d: unexpected error closing: %s", i, err)
+		}
+		conns = append(conns, conn)
+	}
+	if got := open(conns); got != 0 {
+		t.Errorf("incorrect open zlib streams after Close; got = %v, want = 0", got)
+	}
+}
+
+// splitConn is a MockConn that reads from a separate buffer than the one
+// it writes to, so that a server's messages can be queued up front.
+type splitConn struct {
+	MockConn
+	r bytes.Buffer
+}
+
+func (c *splitConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// writeServerHandshake queues the server side of an RFB 3.8 handshake with
+// no authentication.
+func writeServerHandshake(w io.Writer, width, height uint16, pf PixelFormat, name string) error {
+	w.Write([]byte(PROTO_VERS_3_8))
+	w.Write([]byte{1, SecTypeNone})
+	binary.Write(w, binary.BigEndian, uint32(0)) // SecurityResult
+	msg := ServerInit{width, height, pf, uint32(len(name))}
+	bytes, err := msg.Marshal()
+	if err != nil {
+		return err
+	}
+	w.Write(bytes)
+	_, err = w.Write([]byte(name))
+	return err
+}
+
+// writeTightCopyRect writes a Tight encoded rectangle using the copy filter
+// on zlib stream 0.
+func writeTightCopyRect(w io.Writer, pixels []byte) {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(pixels)
+	zw.Close()
+
+	w.Write([]byte{0}) // compression-control
+	w.Write(tightCompactLength(compressed.Len()))
+	w.Write(compressed.Bytes())
+}
+
+func TestClientConn_Reconnect(t *testing.T) {
+	rect := &Rectangle{Width: 2, Height: 2}
+	pixels := func(v byte) []byte { return bytes.Repeat([]byte{v}, 2*2*4) }
+
+	// First session.
+	first := &splitConn{}
+	if err := writeServerHandshake(&first.r, 100, 200, PixelFormat32bit, "first"); err != nil {
+		t.Fatal(err)
+	}
+	vc, err := Connect(context.Background(), first, NewClientConfig(""))
+	if err != nil {
+		t.Fatalf("unexpected error connecting: %s", err)
+	}
+	writeTightCopyRect(&first.r, pixels(1))
+	if _, err := (&TightEncoding{}).Read(vc, rect); err != nil {
+		t.Fatalf("first session: unexpected error reading Tight rect: %s", err)
+	}
+	vc.colorMap.Set(7, 1, 2, 3)
+	if vc.zlibs[0] == nil {
+		t.Fatal("first session: expected zlib stream 0 to be in use")
+	}
+
+	// Second session.
+	second := &splitConn{}
+	if err := writeServerHandshake(&second.r, 300, 400, PixelFormat32bit, "second"); err != nil {
+		t.Fatal(err)
+	}
+	if err := vc.Reconnect(context.Background(), second); err != nil {
+		t.Fatalf("unexpected error reconnecting: %s", err)
+	}
+	if vc.connTerminated.Load() {
+		t.Error("connection terminated after reconnect")
+	}
+	for i, z := range vc.zlibs {
+		if z != nil {
+			t.Errorf("zlib stream %d not reset", i)
+		}
+	}
+	if c, _ := vc.colorMap.Get(7); c.R != 0 || c.G != 0 || c.B != 0 {
+		t.Errorf("color map not reset; got %v", c)
+	}
+	if got, want := vc.GetFramebufferWidth(), uint16(300); got != want {
+		t.Errorf("incorrect framebuffer width; got = %v, want = %v", got, want)
+	}
+	if got, want := vc.GetDesktopName(), "second"; got != want {
+		t.Errorf("incorrect desktop name; got = %v, want = %v", got, want)
+	}
+
+	writeTightCopyRect(&second.r, pixels(2))
+	enc, err := (&TightEncoding{}).Read(vc, rect)
+	if err != nil {
+		t.Fatalf("second session: unexpected error reading Tight rect: %s", err)
+	}
+	if got, want := enc.(*TightEncoding).Data, pixels(2); !bytes.Equal(got, want) {
+		t.Errorf("second session: incorrect pixels; got = %v, want = %v", got, want)
+	}
+}
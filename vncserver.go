@@ -0,0 +1,317 @@
+// VNC server implementation.
+
+package vnc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+
+	"github.com/bigangryrobot/go-vnc/buttons"
+	"github.com/bigangryrobot/go-vnc/encodings"
+	"github.com/bigangryrobot/go-vnc/go/metrics"
+	"github.com/bigangryrobot/go-vnc/keys"
+	"github.com/bigangryrobot/go-vnc/messages"
+	"github.com/bigangryrobot/go-vnc/rfbflags"
+)
+
+// ServerHandler is the interface satisfied by consumers of client messages
+// received by a ServerConn. Each method is called from the goroutine running
+// ListenAndHandle; returning an error terminates the connection.
+type ServerHandler interface {
+	// SetPixelFormat is called when the client changes its pixel format.
+	SetPixelFormat(c *ServerConn, pf PixelFormat) error
+
+	// SetEncodings is called when the client advertises its encodings.
+	SetEncodings(c *ServerConn, encs []encodings.EncodingType) error
+
+	// FramebufferUpdateRequest is called when the client requests an update.
+	FramebufferUpdateRequest(c *ServerConn, inc rfbflags.RFBFlag, x, y, w, h uint16) error
+
+	// KeyEvent is called for each key press or release.
+	KeyEvent(c *ServerConn, key keys.Key, down bool) error
+
+	// PointerEvent is called for each pointer movement or button change.
+	PointerEvent(c *ServerConn, button buttons.Button, x, y uint16) error
+
+	// ClientCutText is called when the client has new text in its cut buffer,
+	// decoded from Latin-1.
+	ClientCutText(c *ServerConn, text string) error
+}
+
+// A ServerConfig structure is used to configure a ServerConn. After
+// one has been passed to initialize a connection, it must not be modified.
+type ServerConfig struct {
+	// A slice of ServerAuth methods offered to the client, in order of
+	// preference.
+	Auth []ServerAuth
+
+	// Logger
+	Logger *log.Logger
+
+	// Name associated with the desktop, sent in ServerInit.
+	DesktopName string
+
+	// Dimensions of the framebuffer in pixels, sent in ServerInit.
+	FBWidth, FBHeight uint16
+
+	// The pixel format advertised in ServerInit.
+	PixelFormat PixelFormat
+
+	// MaxClipboardBytes is the largest ClientCutText text accepted from the
+	// client; longer texts end the connection with an error. Zero means
+	// DefaultMaxClipboardBytes.
+	MaxClipboardBytes uint32
+}
+
+func (cfg *ServerConfig) maxClipboardBytes() uint32 {
+	if cfg.MaxClipboardBytes == 0 {
+		return DefaultMaxClipboardBytes
+	}
+	return cfg.MaxClipboardBytes
+}
+
+// logger returns the configured Logger, or one discarding its output.
+func (cfg *ServerConfig) logger() *log.Logger {
+	if cfg.Logger == nil {
+		return log.New(io.Discard, "", log.LstdFlags)
+	}
+	return cfg.Logger
+}
+
+// NewServerConfig returns a populated ServerConfig. If p is empty, no
+// authentication is required; otherwise VNC authentication is required.
+func NewServerConfig(p string) *ServerConfig {
+	var auth ServerAuth = &ServerAuthNone{}
+	if p != "" {
+		auth = &ServerAuthVNC{p}
+	}
+	return &ServerConfig{
+		Auth:        []ServerAuth{auth},
+		DesktopName: "go-vnc",
+		FBWidth:     1024,
+		FBHeight:    768,
+		PixelFormat: PixelFormat32bit,
+	}
+}
+
+// The ServerConn type holds server connection information.
+type ServerConn struct {
+	Conn            net.Conn
+	bufr            *bufio.Reader
+	config          *ServerConfig
+	protocolVersion string
+
+	connTerminated atomic.Bool
+
+	log *log.Logger
+
+	// Encodings supported by the client, as sent in SetEncodings.
+	encodings []encodings.EncodingType
+
+	// The pixel format requested by the client.
+	pixelFormat PixelFormat
+
+	// Track metrics on system performance.
+	metrics map[string]metrics.Metric
+}
+
+// NewServerConn returns a ServerConn for an accepted connection. The
+// handshake has not been performed; see Accept.
+func NewServerConn(c net.Conn, cfg *ServerConfig) *ServerConn {
+	return &ServerConn{
+		Conn:        c,
+		bufr:        bufio.NewReaderSize(c, 1024),
+		config:      cfg,
+		log:         cfg.logger(),
+		pixelFormat: cfg.PixelFormat,
+		metrics: map[string]metrics.Metric{
+			"bytes-received": &metrics.Gauge{},
+			"bytes-sent":     &metrics.Gauge{},
+		},
+	}
+}
+
+// Accept negotiates the server side of a connection with a VNC client.
+func Accept(c net.Conn, cfg *ServerConfig) (*ServerConn, error) {
+	conn := NewServerConn(c, cfg)
+
+	if err := conn.serverProtocolVersionHandshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.serverSecurityHandshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.readClientInit(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.sendServerInit(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Serve accepts connections on the listener l, negotiates each of them with
+// a default ServerConfig, and dispatches their client messages to handler.
+func Serve(l net.Listener, handler ServerHandler) error {
+	return NewServerConfig("").Serve(l, handler)
+}
+
+// Serve accepts connections on the listener l, negotiates each of them using
+// cfg, and dispatches their client messages to handler. Each connection is
+// served on its own goroutine, and its errors are logged to cfg.Logger. Serve
+// returns when l.Accept fails.
+func (cfg *ServerConfig) Serve(l net.Listener, handler ServerHandler) error {
+	logger := cfg.logger()
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			conn, err := Accept(nc, cfg)
+			if err != nil {
+				logger.Printf("error negotiating connection from %v; %v", nc.RemoteAddr(), err)
+				return
+			}
+			defer conn.Close()
+			if err := conn.ListenAndHandle(handler); err != nil {
+				logger.Printf("error handling connection from %v; %v", nc.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Close a connection to a VNC client.
+func (c *ServerConn) Close() error {
+	if c.connTerminated.Swap(true) {
+		return nil
+	}
+	c.log.Println("VNC Server connection closed.")
+	return c.Conn.Close()
+}
+
+func (c *ServerConn) GetDesktopName() string                 { return c.config.DesktopName }
+func (c *ServerConn) GetEncodings() []encodings.EncodingType { return c.encodings }
+func (c *ServerConn) GetFramebufferHeight() uint16           { return c.config.FBHeight }
+func (c *ServerConn) GetFramebufferWidth() uint16            { return c.config.FBWidth }
+func (c *ServerConn) GetPixelFormat() PixelFormat            { return c.pixelFormat }
+
+// ListenAndHandle listens to a VNC client and dispatches client messages to
+// handler. It returns nil once the connection is closed.
+func (c *ServerConn) ListenAndHandle(handler ServerHandler) error {
+	for !c.connTerminated.Load() {
+		// Peek the message-type so the complete message struct can be read.
+		b, err := c.bufr.Peek(1)
+		if err != nil {
+			if c.connTerminated.Load() || err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		messageType := messages.ClientMessage(b[0])
+		c.log.Printf("message-type: %s", messageType)
+
+		if err := c.handleClientMessage(messageType, handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ServerConn) handleClientMessage(messageType messages.ClientMessage, handler ServerHandler) error {
+	switch messageType {
+	case messages.SetPixelFormat:
+		var msg SetPixelFormatMessage
+		if err := c.receive(&msg); err != nil {
+			return err
+		}
+		c.pixelFormat = msg.PF
+		return handler.SetPixelFormat(c, msg.PF)
+
+	case messages.SetEncodings:
+		var msg SetEncodingsMessage
+		if err := c.receive(&msg); err != nil {
+			return err
+		}
+		encs := make([]encodings.EncodingType, msg.NumEncs)
+		if err := c.receive(&encs); err != nil {
+			return err
+		}
+		c.encodings = encs
+		return handler.SetEncodings(c, encs)
+
+	case messages.FramebufferUpdateRequest:
+		var msg FramebufferUpdateRequestMessage
+		if err := c.receive(&msg); err != nil {
+			return err
+		}
+		return handler.FramebufferUpdateRequest(c, msg.Inc, msg.X, msg.Y, msg.Width, msg.Height)
+
+	case messages.KeyEvent:
+		var msg KeyEventMessage
+		if err := c.receive(&msg); err != nil {
+			return err
+		}
+		return handler.KeyEvent(c, msg.Key, rfbflags.ToBool(msg.DownFlag))
+
+	case messages.PointerEvent:
+		var msg PointerEventMessage
+		if err := c.receive(&msg); err != nil {
+			return err
+		}
+		return handler.PointerEvent(c, buttons.Button(msg.Mask), msg.X, msg.Y)
+
+	case messages.ClientCutText:
+		var msg ClientCutTextMessage
+		if err := c.receive(&msg); err != nil {
+			return err
+		}
+		if max := c.config.maxClipboardBytes(); msg.Length > max {
+			return Errorf("ClientCutText length %d exceeds limit of %d bytes", msg.Length, max)
+		}
+		text := make([]uint8, msg.Length)
+		if err := c.receive(&text); err != nil {
+			return err
+		}
+		return handler.ClientCutText(c, NameCharsetLatin1.decode(text))
+	}
+
+	return NewVNCError(fmt.Sprintf("unsupported client message-type: %v", messageType))
+}
+
+// receive a packet from the network.
+func (c *ServerConn) receive(data interface{}) error {
+	if err := binary.Read(c.bufr, binary.BigEndian, data); err != nil {
+		return err
+	}
+	c.metrics["bytes-received"].Adjust(int64(binary.Size(data)))
+	return nil
+}
+
+func (c *ServerConn) send(data interface{}) error {
+	var size int
+	if s, ok := data.([]byte); ok {
+		size = len(s)
+	} else {
+		size = binary.Size(data)
+	}
+
+	if err := binary.Write(c.Conn, binary.BigEndian, data); err != nil {
+		return err
+	}
+
+	if size > 0 {
+		c.metrics["bytes-sent"].Adjust(int64(size))
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package vnc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bigangryrobot/go-vnc/buttons"
+	"github.com/bigangryrobot/go-vnc/encodings"
+	"github.com/bigangryrobot/go-vnc/keys"
+	"github.com/bigangryrobot/go-vnc/messages"
+	"github.com/bigangryrobot/go-vnc/rfbflags"
+)
+
+// recordingHandler implements the ServerHandler interface, recording a
+// description of each client message received.
+type recordingHandler struct {
+	events chan string
+}
+
+func newRecordingHandler() *recordingHandler {
+	return &recordingHandler{events: make(chan string, 16)}
+}
+
+func (h *recordingHandler) SetPixelFormat(c *ServerConn, pf PixelFormat) error {
+	h.events <- fmt.Sprintf("SetPixelFormat bpp:%d", pf.BPP)
+	return nil
+}
+func (h *recordingHandler) SetEncodings(c *ServerConn, encs []encodings.EncodingType) error {
+	h.events <- fmt.Sprintf("SetEncodings %v", encs)
+	return nil
+}
+func (h *recordingHandler) FramebufferUpdateRequest(c *ServerConn, inc rfbflags.RFBFlag, x, y, w, h2 uint16) error {
+	h.events <- fmt.Sprintf("FramebufferUpdateRequest %v %d %d %d %d", inc, x, y, w, h2)
+	return c.Bell()
+}
+func (h *recordingHandler) KeyEvent(c *ServerConn, key keys.Key, down bool) error {
+	h.events <- fmt.Sprintf("KeyEvent %v %v", key, down)
+	return nil
+}
+func (h *recordingHandler) PointerEvent(c *ServerConn, button buttons.Button, x, y uint16) error {
+	h.events <- fmt.Sprintf("PointerEvent %v %d %d", button, x, y)
+	return nil
+}
+func (h *recordingHandler) ClientCutText(c *ServerConn, text string) error {
+	h.events <- fmt.Sprintf("ClientCutText %q", text)
+	return nil
+}
+
+func (h *recordingHandler) expect(t *testing.T, want string) {
+	t.Helper()
+	select {
+	case got := <-h.events:
+		if got != want {
+			t.Errorf("incorrect event; got = %q, want = %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for event %q", want)
+	}
+}
+
+func newTestServer(t *testing.T, cfg *ServerConfig, h ServerHandler) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go cfg.Serve(ln, h)
+	return ln.Addr().String()
+}
+
+func TestServe(t *testing.T) {
+	SetSettle(0) // Disable UI settling for tests.
+
+	for _, pw := range []string{"", "s3cret"} {
+		cfg := NewServerConfig(pw)
+		cfg.DesktopName = "test desktop"
+		cfg.FBWidth, cfg.FBHeight = 640, 480
+		h := newRecordingHandler()
+		addr := newTestServer(t, cfg, h)
+
+		nc, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("error connecting to server: %s", err)
+		}
+		ccfg := NewClientConfig(pw)
+		ccfg.ServerMessageCh = make(chan ServerMessage, 2)
+		vc, err := Connect(context.Background(), nc, ccfg)
+		if err != nil {
+			t.Fatalf("password %q: unexpected error connecting: %s", pw, err)
+		}
+		go vc.ListenAndHandle()
+
+		if got, want := vc.GetDesktopName(), cfg.DesktopName; got != want {
+			t.Errorf("incorrect desktop name; got = %q, want = %q", got, want)
+		}
+		if got, want := vc.GetFramebufferWidth(), cfg.FBWidth; got != want {
+			t.Errorf("incorrect framebuffer width; got = %v, want = %v", got, want)
+		}
+		if got, want := vc.GetFramebufferHeight(), cfg.FBHeight; got != want {
+			t.Errorf("incorrect framebuffer height; got = %v, want = %v", got, want)
+		}
+
+		h.expect(t, "SetEncodings [Raw]")
+		h.expect(t, "SetPixelFormat bpp:32")
+		h.expect(t, "FramebufferUpdateRequest RFBFalse 0 0 640 480") // RequestInitialUpdate
+
+		vc.KeyEvent(keys.Return, PressKey)
+		h.expect(t, fmt.Sprintf("KeyEvent %v true", keys.Return))
+		vc.PointerEvent(buttons.Left, 10, 20)
+		h.expect(t, fmt.Sprintf("PointerEvent %v 10 20", buttons.Left))
+		vc.ClientCutText("hello")
+		h.expect(t, `ClientCutText "hello"`)
+		vc.FramebufferUpdateRequest(rfbflags.RFBTrue, 1, 2, 3, 4)
+		h.expect(t, "FramebufferUpdateRequest RFBTrue 1 2 3 4")
+
+		// The handler responds to both requests with a Bell.
+		for i := 0; i < 2; i++ {
+			select {
+			case msg := <-ccfg.ServerMessageCh:
+				if got, want := msg.Type(), messages.Bell; got != want {
+					t.Errorf("incorrect server message; got = %v, want = %v", got, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for Bell")
+			}
+		}
+
+		vc.Close()
+	}
+}
+
+// chanWriter sends each write, such as a logged line, on its channel.
+type chanWriter chan string
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestServe_BadPassword(t *testing.T) {
+	logged := make(chanWriter, 16)
+	cfg := NewServerConfig("s3cret")
+	cfg.Logger = log.New(logged, "", 0)
+	addr := newTestServer(t, cfg, newRecordingHandler())
+
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("error connecting to server: %s", err)
+	}
+	if _, err := Connect(context.Background(), nc, NewClientConfig("wrong")); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// The failed negotiation is logged to the configured Logger.
+	for {
+		select {
+		case line := <-logged:
+			if strings.HasPrefix(line, "error negotiating connection") {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the negotiation error to be logged")
+		}
+	}
+}
+
+func TestServerConn_ClientCutText(t *testing.T) {
+	for _, tt := range []struct {
+		desc string
+		max  uint32
+		text []byte
+		ok   bool
+		want string
+	}{
+		{"latin-1", 0, []byte{'c', 'a', 'f', 0xe9}, true, "café"},
+		{"at the limit", 4, []byte("abcd"), true, "abcd"},
+		{"beyond the limit", 3, []byte("abcd"), false, ""},
+	} {
+		mockConn := &MockConn{}
+		cfg := NewServerConfig("")
+		cfg.MaxClipboardBytes = tt.max
+		conn := NewServerConn(mockConn, cfg)
+		binary.Write(mockConn, binary.BigEndian, ClientCutTextMessage{Msg: messages.ClientCutText, Length: uint32(len(tt.text))})
+		mockConn.Write(tt.text)
+
+		h := newRecordingHandler()
+		err := conn.handleClientMessage(messages.ClientCutText, h)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.desc, err)
+		}
+		h.expect(t, fmt.Sprintf("ClientCutText %q", tt.want))
+	}
+}
+
+func TestServerConn_ServerCutText(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewServerConn(mockConn, NewServerConfig(""))
+
+	if err := conn.ServerCutText("café"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := []byte{byte(messages.ServerCutText), 0, 0, 0, 0, 0, 0, 4, 'c', 'a', 'f', 0xe9}
+	if got := mockConn.b.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("incorrect message; got = %v, want = %v", got, want)
+	}
+
+	mockConn.Reset()
+	if err := conn.ServerCutText("€"); err == nil {
+		t.Error("expected error for a character beyond Latin-1")
+	}
+	if got := mockConn.b.Len(); got != 0 {
+		t.Errorf("unexpected %d bytes sent", got)
+	}
+}